@@ -21,6 +21,8 @@ import (
 	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/aws/smithy-go"
 	"go.uber.org/zap"
+
+	"github.com/your-org/file-processor-sample/internal/batch"
 )
 
 type s3API interface {
@@ -47,27 +49,74 @@ var (
 )
 
 // ArchiveEvent is triggered after a file has been parsed and contains
-// the S3 event along with import statistics.
+// the S3 event along with import statistics. Parse holds ParseFile's result
+// per record; RowsProcessed and RowsFailed apply to records without one.
+// Files whose parse failed are not archived.
 type ArchiveEvent struct {
-	events.S3Event
-	RowsProcessed int `json:"rowsProcessed"`
-	RowsFailed    int `json:"rowsFailed"`
+	batch.Event
+	Parse         []ParseResult `json:"parse,omitempty"`
+	RowsProcessed int           `json:"rowsProcessed"`
+	RowsFailed    int           `json:"rowsFailed"`
+}
+
+// ParseResult is the part of a ParseFile record result used for the
+// statistics.
+type ParseResult struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Status string `json:"status"`
+	Error  string `json:"error"`
+	Output struct {
+		RowCount int `json:"rowCount"`
+		BadRows  int `json:"badRows"`
+	} `json:"output"`
+}
+
+// parsed returns ParseFile's result for rec, if the event has one.
+func (e ArchiveEvent) parsed(rec events.S3EventRecord) (ParseResult, bool) {
+	for _, p := range e.Parse {
+		if p.Bucket == rec.S3.Bucket.Name && p.Key == rec.S3.Object.Key {
+			return p, true
+		}
+	}
+	return ParseResult{}, false
+}
+
+// Output is the result of one archived file.
+type Output struct {
+	ArchiveKey      string `json:"archiveKey,omitempty"`
+	AlreadyArchived bool   `json:"alreadyArchived,omitempty"`
+}
+
+// handler archives every file of the event, returning a status per file and
+// the SQS messages to retry when invoked from a queue. The import statistics
+// are recorded for each file.
+func handler(ctx context.Context, evt ArchiveEvent) (batch.Response, error) {
+	return batch.Run(ctx, evt.Event, func(ctx context.Context, rec events.S3EventRecord) (any, error) {
+		p, ok := evt.parsed(rec)
+		if !ok {
+			return archiveRecord(ctx, rec, evt.RowsProcessed, evt.RowsFailed)
+		}
+		if p.Status == batch.StatusFailed {
+			return nil, fmt.Errorf("%s was not parsed: %s", p.Key, p.Error)
+		}
+		return archiveRecord(ctx, rec, p.Output.RowCount, p.Output.BadRows)
+	})
 }
 
-// handler archives the source file, updates DynamoDB and emits metrics.
-func handler(ctx context.Context, evt ArchiveEvent) error {
-	rec := evt.Records[0]
+// archiveRecord archives the source file, updates DynamoDB and emits metrics.
+func archiveRecord(ctx context.Context, rec events.S3EventRecord, rowsProcessed, rowsFailed int) (*Output, error) {
 	bucket := rec.S3.Bucket.Name
 	key := rec.S3.Object.Key
 
 	tagOut, err := s3Client.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{Bucket: &bucket, Key: &key})
 	if err != nil {
-		return fmt.Errorf("get tagging: %w", err)
+		return nil, fmt.Errorf("get tagging: %w", err)
 	}
 	for _, t := range tagOut.TagSet {
 		if strings.EqualFold(aws.ToString(t.Key), "processed") && strings.EqualFold(aws.ToString(t.Value), "true") {
 			log.Infow("already archived", "key", key)
-			return nil
+			return &Output{AlreadyArchived: true}, nil
 		}
 	}
 
@@ -83,10 +132,10 @@ func handler(ctx context.Context, evt ArchiveEvent) error {
 		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "SlowDown" {
 			time.Sleep(200 * time.Millisecond)
 			if _, err = s3Client.CopyObject(ctx, &s3.CopyObjectInput{Bucket: &bucket, CopySource: aws.String(bucket + "/" + key), Key: &archiveKey}); err != nil {
-				return fmt.Errorf("copy object retry: %w", err)
+				return nil, fmt.Errorf("copy object retry: %w", err)
 			}
 		} else {
-			return fmt.Errorf("copy object: %w", err)
+			return nil, fmt.Errorf("copy object: %w", err)
 		}
 	}
 	latency := time.Since(start).Milliseconds()
@@ -97,7 +146,7 @@ func handler(ctx context.Context, evt ArchiveEvent) error {
 		Tagging: &s3types.Tagging{TagSet: []s3types.Tag{{Key: aws.String("processed"), Value: aws.String("true")}}},
 	})
 	if err != nil {
-		return fmt.Errorf("tag source: %w", err)
+		return nil, fmt.Errorf("tag source: %w", err)
 	}
 
 	_, err = dbClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
@@ -108,8 +157,8 @@ func handler(ctx context.Context, evt ArchiveEvent) error {
 		UpdateExpression:         aws.String("SET rowsProcessed=:rp, rowsFailed=:rf, #S=:s"),
 		ExpressionAttributeNames: map[string]string{"#S": "status"},
 		ExpressionAttributeValues: map[string]dbtypes.AttributeValue{
-			":rp": &dbtypes.AttributeValueMemberN{Value: strconv.Itoa(evt.RowsProcessed)},
-			":rf": &dbtypes.AttributeValueMemberN{Value: strconv.Itoa(evt.RowsFailed)},
+			":rp": &dbtypes.AttributeValueMemberN{Value: strconv.Itoa(rowsProcessed)},
+			":rf": &dbtypes.AttributeValueMemberN{Value: strconv.Itoa(rowsFailed)},
 			":s":  &dbtypes.AttributeValueMemberS{Value: "ARCHIVED"},
 		},
 		ConditionExpression: aws.String("attribute_not_exists(#S) OR #S <> :s"),
@@ -117,24 +166,24 @@ func handler(ctx context.Context, evt ArchiveEvent) error {
 	if err != nil {
 		var cfe *dbtypes.ConditionalCheckFailedException
 		if errors.As(err, &cfe) {
-			return fmt.Errorf("manifest already archived")
+			return nil, fmt.Errorf("manifest already archived")
 		}
-		return fmt.Errorf("update manifest: %w", err)
+		return nil, fmt.Errorf("update manifest: %w", err)
 	}
 
 	_, err = cwClient.PutMetricData(ctx, &cloudwatch.PutMetricDataInput{
 		Namespace: aws.String("FileProcessor"),
 		MetricData: []cwtypes.MetricDatum{
-			{MetricName: aws.String("RowsProcessed"), Value: aws.Float64(float64(evt.RowsProcessed))},
-			{MetricName: aws.String("RowsFailed"), Value: aws.Float64(float64(evt.RowsFailed))},
+			{MetricName: aws.String("RowsProcessed"), Value: aws.Float64(float64(rowsProcessed))},
+			{MetricName: aws.String("RowsFailed"), Value: aws.Float64(float64(rowsFailed))},
 			{MetricName: aws.String("ArchiveLatencyMs"), Value: aws.Float64(float64(latency)), Unit: cwtypes.StandardUnitMilliseconds},
 		},
 	})
 	if err != nil {
-		return fmt.Errorf("metrics: %w", err)
+		return nil, fmt.Errorf("metrics: %w", err)
 	}
 	log.Infow("archived", "key", key, "dest", archiveKey)
-	return nil
+	return &Output{ArchiveKey: archiveKey}, nil
 }
 
 // main configures AWS clients and starts the Lambda handler.
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"testing"
 	"time"
 
@@ -12,6 +13,8 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/smithy-go"
 	"go.uber.org/zap"
+
+	"github.com/your-org/file-processor-sample/internal/batch"
 )
 
 type fakeS3 struct {
@@ -36,10 +39,12 @@ func (f *fakeS3) PutObjectTagging(ctx context.Context, in *s3.PutObjectTaggingIn
 }
 
 type fakeDB struct {
-	err error
+	err     error
+	updates []*dynamodb.UpdateItemInput
 }
 
 func (f *fakeDB) UpdateItem(ctx context.Context, in *dynamodb.UpdateItemInput, opt ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	f.updates = append(f.updates, in)
 	if f.err != nil {
 		return nil, f.err
 	}
@@ -53,6 +58,14 @@ func (f *fakeCW) PutMetricData(ctx context.Context, in *cloudwatch.PutMetricData
 	return &cloudwatch.PutMetricDataOutput{}, nil
 }
 
+func newEvent(keys ...string) batch.Event {
+	evt := events.S3Event{}
+	for _, k := range keys {
+		evt.Records = append(evt.Records, events.S3EventRecord{S3: events.S3Entity{Bucket: events.S3Bucket{Name: "b"}, Object: events.S3Object{Key: k}}})
+	}
+	return batch.FromS3(evt)
+}
+
 func TestHandlerSuccess(t *testing.T) {
 	s3Client = &fakeS3{}
 	dbClient = &fakeDB{}
@@ -62,9 +75,9 @@ func TestHandlerSuccess(t *testing.T) {
 	now = func() time.Time { return time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC) }
 
 	evt := ArchiveEvent{RowsProcessed: 5, RowsFailed: 1}
-	evt.Records = []events.S3EventRecord{{S3: events.S3Entity{Bucket: events.S3Bucket{Name: "b"}, Object: events.S3Object{Key: "k"}}}}
+	evt.Event = newEvent("k")
 
-	if err := handler(context.Background(), evt); err != nil {
+	if _, err := handler(context.Background(), evt); err != nil {
 		t.Fatalf("handler error: %v", err)
 	}
 	if !cw.called {
@@ -82,9 +95,9 @@ func TestHandlerSlowdownRetry(t *testing.T) {
 	now = func() time.Time { return time.Time{} }
 
 	evt := ArchiveEvent{}
-	evt.Records = []events.S3EventRecord{{S3: events.S3Entity{Bucket: events.S3Bucket{Name: "b"}, Object: events.S3Object{Key: "k"}}}}
+	evt.Event = newEvent("k")
 
-	if err := handler(context.Background(), evt); err != nil {
+	if _, err := handler(context.Background(), evt); err != nil {
 		t.Fatalf("handler error: %v", err)
 	}
 	if fs3.copyCalls != 2 {
@@ -100,9 +113,70 @@ func TestHandlerConditionalFailure(t *testing.T) {
 	now = func() time.Time { return time.Time{} }
 
 	evt := ArchiveEvent{}
-	evt.Records = []events.S3EventRecord{{S3: events.S3Entity{Bucket: events.S3Bucket{Name: "b"}, Object: events.S3Object{Key: "k"}}}}
+	evt.Event = newEvent("k")
 
-	if err := handler(context.Background(), evt); err == nil {
+	if _, err := handler(context.Background(), evt); err == nil {
 		t.Fatal("expected error")
 	}
 }
+
+func TestHandlerBatch(t *testing.T) {
+	s3Client = &fakeS3{}
+	dbClient = &fakeDB{}
+	cw := &fakeCW{}
+	cwClient = cw
+	log = zap.NewNop().Sugar()
+	now = func() time.Time { return time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC) }
+
+	var evt ArchiveEvent
+	in := `{"Records":[{"s3":{"bucket":{"name":"b"},"object":{"key":"a.csv"}}},{"s3":{"bucket":{"name":"b"},"object":{"key":"c.csv"}}}],"rowsProcessed":3}`
+	if err := json.Unmarshal([]byte(in), &evt); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := handler(context.Background(), evt)
+	if err != nil || len(resp.Records) != 2 || evt.RowsProcessed != 3 {
+		t.Fatalf("resp %+v err %v", resp, err)
+	}
+	if out := resp.Records[1].Output.(*Output); out.ArchiveKey != "archive/2024/05/01/c.csv" {
+		t.Fatalf("archive key %q", out.ArchiveKey)
+	}
+
+	if _, err := handler(context.Background(), ArchiveEvent{}); err == nil {
+		t.Fatal("expected error for an empty event")
+	}
+}
+
+func TestHandlerPerRecordCounts(t *testing.T) {
+	s3Client = &fakeS3{}
+	db := &fakeDB{}
+	dbClient = db
+	cwClient = &fakeCW{}
+	log = zap.NewNop().Sugar()
+	now = func() time.Time { return time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC) }
+
+	var evt ArchiveEvent
+	in := `{"Records":[{"s3":{"bucket":{"name":"b"},"object":{"key":"a.csv"}}},{"s3":{"bucket":{"name":"b"},"object":{"key":"c.csv"}}},{"s3":{"bucket":{"name":"b"},"object":{"key":"x.txt"}}}],
+		"parse":[{"bucket":"b","key":"c.csv","status":"ok","output":{"rowCount":7,"badRows":2}},
+		         {"bucket":"b","key":"a.csv","status":"ok","output":{"rowCount":3,"badRows":0}},
+		         {"bucket":"b","key":"x.txt","status":"failed","error":"no route"}]}`
+	if err := json.Unmarshal([]byte(in), &evt); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := handler(context.Background(), evt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := resp.Records[2]; r.Status != batch.StatusFailed || r.Error != "x.txt was not parsed: no route" {
+		t.Fatalf("unparsed file should not be archived, got %+v", r)
+	}
+	got := map[string]string{}
+	for _, u := range db.updates {
+		key := u.Key["FileKey"].(*dbtypes.AttributeValueMemberS).Value
+		rp := u.ExpressionAttributeValues[":rp"].(*dbtypes.AttributeValueMemberN).Value
+		rf := u.ExpressionAttributeValues[":rf"].(*dbtypes.AttributeValueMemberN).Value
+		got[key] = rp + "/" + rf
+	}
+	if len(got) != 2 || got["a.csv"] != "3/0" || got["c.csv"] != "7/2" {
+		t.Fatalf("manifest counts %v", got)
+	}
+}
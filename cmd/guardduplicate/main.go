@@ -12,7 +12,9 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"go.uber.org/zap"
 
+	"github.com/your-org/file-processor-sample/internal/batch"
 	"github.com/your-org/file-processor-sample/internal/guard"
+	"github.com/your-org/file-processor-sample/internal/sflimits"
 )
 
 var (
@@ -33,36 +35,55 @@ var (
 	dbClient  guard.PutItemAPI
 	tableName = os.Getenv("MANIFEST_TABLE")
 	log       *zap.SugaredLogger
+	limits    *sflimits.Monitor
 )
 
-// handler checks the uploaded file for duplicates and stores a manifest entry.
-func handler(ctx context.Context, evt events.S3Event) error {
-	rec := evt.Records[0]
+// Output is the result of one guarded file.
+type Output struct {
+	SHA256 string `json:"sha256"`
+}
+
+// handler guards every file of the event, returning a status per file and
+// the SQS messages to retry when invoked from a queue.
+func handler(ctx context.Context, evt batch.Event) (batch.Response, error) {
+	return batch.Run(ctx, evt, func(ctx context.Context, rec events.S3EventRecord) (any, error) {
+		return guardRecord(ctx, rec)
+	})
+}
+
+// guardRecord checks the uploaded file for duplicates and stores a manifest
+// entry. New loads are deferred or refused while the org's Salesforce API
+// usage is above the configured percentages.
+func guardRecord(ctx context.Context, rec events.S3EventRecord) (*Output, error) {
+	if err := limits.Check(ctx); err != nil {
+		log.Warnw("load deferred", "key", rec.S3.Object.Key, "error", err)
+		return nil, err
+	}
 	bucket := rec.S3.Bucket.Name
 	key := rec.S3.Object.Key
 	size := rec.S3.Object.Size
 
 	if err := guard.ValidateSize(key, size); err != nil {
-		return err
+		return nil, err
 	}
 
 	obj, err := s3Client.GetObject(ctx, &s3.GetObjectInput{Bucket: &bucket, Key: &key})
 	if err != nil {
-		return fmt.Errorf("get object: %w", err)
+		return nil, fmt.Errorf("get object: %w", err)
 	}
 	defer guard.Close(obj.Body, log)
 
 	sum, err := guard.ComputeSHA256(obj.Body)
 	if err != nil {
-		return fmt.Errorf("read object: %w", err)
+		return nil, fmt.Errorf("read object: %w", err)
 	}
 
 	if err := guard.PutManifest(ctx, dbClient, tableName, key, sum); err != nil {
-		return fmt.Errorf("write manifest: %w", err)
+		return nil, fmt.Errorf("write manifest: %w", err)
 	}
 
 	log.Infow("manifest updated", "key", key, "sha", sum)
-	return nil
+	return &Output{SHA256: sum}, nil
 }
 
 // main initializes AWS clients and starts the Lambda handler.
@@ -74,6 +95,8 @@ func main() {
 	logger, _ := zap.NewProduction()
 	log = logger.Sugar()
 	s3Client = s3.NewFromConfig(cfg)
-	dbClient = dynamodb.NewFromConfig(cfg)
+	db := dynamodb.NewFromConfig(cfg)
+	dbClient = db
+	limits = sflimits.FromEnv(db, nil, log)
 	start(handler)
 }
@@ -3,10 +3,13 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"io"
 	"os"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -14,7 +17,9 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/your-org/file-processor-sample/internal/batch"
 	"github.com/your-org/file-processor-sample/internal/guard"
+	"github.com/your-org/file-processor-sample/internal/sflimits"
 	"go.uber.org/zap"
 )
 
@@ -55,8 +60,12 @@ func (d *stubDDB) PutItem(ctx context.Context, in *dynamodb.PutItemInput, optFns
 	return &dynamodb.PutItemOutput{}, nil
 }
 
-func newEvent(size int64) events.S3Event {
-	return events.S3Event{Records: []events.S3EventRecord{{S3: events.S3Entity{Bucket: events.S3Bucket{Name: "b"}, Object: events.S3Object{Key: "k", Size: size}}}}}
+func newEvent(size int64) batch.Event {
+	return batch.FromS3(events.S3Event{Records: []events.S3EventRecord{newRecord("k", size)}})
+}
+
+func newRecord(key string, size int64) events.S3EventRecord {
+	return events.S3EventRecord{S3: events.S3Entity{Bucket: events.S3Bucket{Name: "b"}, Object: events.S3Object{Key: key, Size: size}}}
 }
 
 func setup(s3c s3API, db ddbAPI) {
@@ -69,7 +78,7 @@ func setup(s3c s3API, db ddbAPI) {
 func TestHandlerTooLarge(t *testing.T) {
 	setup(nil, nil)
 	evt := newEvent(guard.MaxSize + 1)
-	if err := handler(context.Background(), evt); err == nil {
+	if _, err := handler(context.Background(), evt); err == nil {
 		t.Fatalf("expected size error")
 	}
 }
@@ -78,7 +87,7 @@ func TestHandlerGetObjectError(t *testing.T) {
 	s3c := &stubS3{err: errors.New("boom")}
 	setup(s3c, nil)
 	evt := newEvent(1)
-	if err := handler(context.Background(), evt); err == nil || err.Error() != "get object: boom" {
+	if _, err := handler(context.Background(), evt); err == nil || err.Error() != "get object: boom" {
 		t.Fatalf("unexpected err: %v", err)
 	}
 }
@@ -88,7 +97,7 @@ func TestHandlerReadError(t *testing.T) {
 	s3c := &stubS3{out: body}
 	setup(s3c, nil)
 	evt := newEvent(1)
-	if err := handler(context.Background(), evt); err == nil || err.Error() != "read object: read err" {
+	if _, err := handler(context.Background(), evt); err == nil || err.Error() != "read object: read err" {
 		t.Fatalf("unexpected err: %v", err)
 	}
 	if !body.closed {
@@ -106,7 +115,7 @@ func TestHandlerPutError(t *testing.T) {
 	db := &stubDDB{putErr: errors.New("bad")}
 	setup(s3c, db)
 	evt := newEvent(1)
-	if err := handler(context.Background(), evt); err == nil || err.Error() != "write manifest: bad" {
+	if _, err := handler(context.Background(), evt); err == nil || err.Error() != "write manifest: bad" {
 		t.Fatalf("unexpected err: %v", err)
 	}
 	if !body.closed {
@@ -120,7 +129,7 @@ func TestHandlerSuccess(t *testing.T) {
 	db := &stubDDB{}
 	setup(s3c, db)
 	evt := newEvent(1)
-	if err := handler(context.Background(), evt); err != nil {
+	if _, err := handler(context.Background(), evt); err != nil {
 		t.Fatalf("handler error: %v", err)
 	}
 	if !body.closed {
@@ -131,6 +140,34 @@ func TestHandlerSuccess(t *testing.T) {
 	}
 }
 
+func TestHandlerBatch(t *testing.T) {
+	db := &stubDDB{}
+	setup(&stubS3{out: &stubBody{Reader: bytes.NewBufferString("data")}}, db)
+	evt := batch.FromS3(events.S3Event{Records: []events.S3EventRecord{newRecord("a", 1), newRecord("big", guard.MaxSize+1)}})
+	resp, err := handler(context.Background(), evt)
+	if err != nil || len(resp.Records) != 2 {
+		t.Fatalf("expected the oversized file to fail alone, got %+v %v", resp, err)
+	}
+	if r := resp.Records[0]; r.Status != batch.StatusOK || r.Output.(*Output).SHA256 == "" {
+		t.Fatalf("first file should be guarded, got %+v", r)
+	}
+	if r := resp.Records[1]; r.Status != batch.StatusFailed || r.Key != "big" {
+		t.Fatalf("second file should fail, got %+v", r)
+	}
+
+	body, _ := json.Marshal(events.S3Event{Records: []events.S3EventRecord{newRecord("big", guard.MaxSize+1)}})
+	sqs := batch.Event{Records: []batch.Record{{MessageID: "m1", Body: string(body)}}}
+	sqs.Records[0].EventSource = "aws:sqs"
+	resp, err = handler(context.Background(), sqs)
+	if err != nil || len(resp.BatchItemFailures) != 1 || resp.BatchItemFailures[0].ItemIdentifier != "m1" {
+		t.Fatalf("expected a partial batch failure, got %+v %v", resp, err)
+	}
+
+	if _, err := handler(context.Background(), batch.Event{}); err == nil {
+		t.Fatal("expected error for an empty event")
+	}
+}
+
 func TestMainFunc(t *testing.T) {
 	if err := os.Setenv("AWS_REGION", "us-east-1"); err != nil {
 		t.Fatal(err)
@@ -161,3 +198,43 @@ func TestMainFuncError(t *testing.T) {
 	}()
 	main()
 }
+
+// --- api usage stub ---
+type stubUsage struct{ used, max string }
+
+func (u stubUsage) GetItem(ctx context.Context, in *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: map[string]types.AttributeValue{
+		"Used":      &types.AttributeValueMemberN{Value: u.used},
+		"MaxCalls":  &types.AttributeValueMemberN{Value: u.max},
+		"UpdatedAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().UnixMilli(), 10)},
+	}}, nil
+}
+
+func (u stubUsage) UpdateItem(ctx context.Context, in *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func TestHandlerAPILimit(t *testing.T) {
+	s3c := &stubS3{}
+	setup(s3c, &stubDDB{})
+	defer func() { limits = nil }()
+
+	limits = &sflimits.Monitor{DB: stubUsage{used: "850", max: "1000"}, Table: "limits"}
+	_, err := handler(context.Background(), newEvent(1))
+	if _, ok := err.(*sflimits.APILimitThrottledError); !ok {
+		t.Fatalf("expected throttle error, got %T %v", err, err)
+	}
+	two := batch.FromS3(events.S3Event{Records: []events.S3EventRecord{newRecord("a", 1), newRecord("b", 1)}})
+	_, err = handler(context.Background(), two)
+	if _, ok := err.(*sflimits.APILimitThrottledError); !ok {
+		t.Fatalf("throttled records should fail with APILimitThrottledError, got %T %v", err, err)
+	}
+	limits = &sflimits.Monitor{DB: stubUsage{used: "990", max: "1000"}, Table: "limits"}
+	_, err = handler(context.Background(), newEvent(1))
+	if _, ok := err.(*sflimits.APILimitExceededError); !ok {
+		t.Fatalf("expected refusal, got %T %v", err, err)
+	}
+	if s3c.input != nil {
+		t.Fatal("object should not be read while over the limit")
+	}
+}
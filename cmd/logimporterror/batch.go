@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"github.com/your-org/file-processor-sample/internal/importerror"
+)
+
+type s3API interface {
+	GetObject(context.Context, *s3.GetObjectInput, ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	PutObject(context.Context, *s3.PutObjectInput, ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	ListObjectsV2(context.Context, *s3.ListObjectsV2Input, ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	DeleteObject(context.Context, *s3.DeleteObjectInput, ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+	CopyObject(context.Context, *s3.CopyObjectInput, ...func(*s3.Options)) (*s3.CopyObjectOutput, error)
+}
+
+var s3Client s3API
+
+// S3Ref points at a JSONL rejects file with one importerror.Event per line.
+type S3Ref struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+}
+
+// Request is the Lambda input: a single importerror.Event, a JSON array of events,
+// {"events": [...]}, {"rejects": {"bucket": ..., "key": ...}} or
+// {"replay": true} to redeliver the dead-letter spool.
+type Request struct {
+	Single  *importerror.Event
+	Events  []importerror.Event
+	Rejects *S3Ref
+	Replay  bool
+}
+
+// UnmarshalJSON accepts every supported input shape.
+func (r *Request) UnmarshalJSON(b []byte) error {
+	b = bytes.TrimSpace(b)
+	if len(b) > 0 && b[0] == '[' {
+		return json.Unmarshal(b, &r.Events)
+	}
+	var in struct {
+		Events  []importerror.Event `json:"events"`
+		Rejects *S3Ref              `json:"rejects"`
+		Replay  bool                `json:"replay"`
+	}
+	if err := json.Unmarshal(b, &in); err != nil {
+		return err
+	}
+	r.Events, r.Rejects, r.Replay = in.Events, in.Rejects, in.Replay
+	if r.Events != nil || r.Rejects != nil || r.Replay {
+		return nil
+	}
+	r.Single = &importerror.Event{}
+	return json.Unmarshal(b, r.Single)
+}
+
+// invoke is the Lambda entrypoint; single events keep the original handler
+// semantics and return no result.
+func invoke(ctx context.Context, req Request) (*importerror.BatchResult, error) {
+	if req.Single != nil {
+		return nil, handler(ctx, *req.Single)
+	}
+	if req.Replay {
+		return replay(ctx)
+	}
+	evts := req.Events
+	if req.Rejects != nil {
+		more, err := readRejects(ctx, *req.Rejects)
+		if err != nil {
+			return nil, err
+		}
+		evts = append(evts, more...)
+	}
+	return batchHandler(ctx, evts)
+}
+
+// readRejects loads importerror.Events from a JSONL object in S3.
+func readRejects(ctx context.Context, ref S3Ref) ([]importerror.Event, error) {
+	if s3Client == nil {
+		return nil, fmt.Errorf("rejects file: s3 client not configured")
+	}
+	obj, err := s3Client.GetObject(ctx, &s3.GetObjectInput{Bucket: &ref.Bucket, Key: &ref.Key})
+	if err != nil {
+		return nil, fmt.Errorf("get rejects: %w", err)
+	}
+	defer func() { _ = obj.Body.Close() }()
+	return decodeRejects(obj.Body)
+}
+
+// decodeRejects reads one importerror.Event per non-blank JSONL line.
+func decodeRejects(r io.Reader) ([]importerror.Event, error) {
+	var evts []importerror.Event
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for line := 1; sc.Scan(); line++ {
+		l := bytes.TrimSpace(sc.Bytes())
+		if len(l) == 0 {
+			continue
+		}
+		var e importerror.Event
+		if err := json.Unmarshal(l, &e); err != nil {
+			return nil, fmt.Errorf("decode rejects line %d: %w", line, err)
+		}
+		evts = append(evts, e)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read rejects: %w", err)
+	}
+	return evts, nil
+}
+
+// batchHandler delivers events through the batch path, spooling the ones
+// Salesforce cannot take now.
+func batchHandler(ctx context.Context, evts []importerror.Event) (*importerror.BatchResult, error) {
+	return importLogger().Batch(ctx, evts)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"github.com/your-org/file-processor-sample/internal/importerror"
+)
+
+var (
+	deadLetterBucket = os.Getenv("DEAD_LETTER_BUCKET")
+	deadLetterPrefix = envOr("DEAD_LETTER_PREFIX", "import-errors/dead-letter/")
+	quarantinePrefix = envOr("DEAD_LETTER_QUARANTINE_PREFIX", "import-errors/quarantine/")
+)
+
+// envOr returns the environment variable or def when unset.
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// replay redelivers every spooled event once Salesforce has recovered. Events
+// are de-duplicated on ExternalRowID, keeping the most recently spooled copy;
+// anything that still fails is spooled again. A spool object is deleted only
+// when every event read from it was delivered or spooled again; otherwise it
+// is kept for the next replay and the invocation fails. Objects that cannot
+// be decoded are moved to the quarantine prefix.
+func replay(ctx context.Context) (*importerror.BatchResult, error) {
+	if deadLetterBucket == "" || s3Client == nil {
+		return nil, importerror.ErrSpoolDisabled
+	}
+	var keys []string
+	p := s3.NewListObjectsV2Paginator(s3Client, &s3.ListObjectsV2Input{Bucket: &deadLetterBucket, Prefix: &deadLetterPrefix})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("list spool: %w", err)
+		}
+		for _, o := range page.Contents {
+			keys = append(keys, aws.ToString(o.Key))
+		}
+	}
+
+	index := map[string]int{}
+	var evts []importerror.Event
+	var read []string
+	sources := map[string][]string{}
+	for _, k := range keys {
+		more, err := readSpool(ctx, k)
+		if err != nil {
+			continue
+		}
+		read = append(read, k)
+		for _, e := range more {
+			sources[k] = append(sources[k], e.ExternalRowID)
+			if i, ok := index[e.ExternalRowID]; ok {
+				evts[i] = e
+				continue
+			}
+			index[e.ExternalRowID] = len(evts)
+			evts = append(evts, e)
+		}
+	}
+
+	res, err := batchHandler(ctx, evts)
+	if err != nil {
+		return nil, err
+	}
+	var kept []string
+	for _, k := range read {
+		if !settled(res, index, sources[k]) {
+			kept = append(kept, k)
+			continue
+		}
+		key := k
+		if _, err := s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: &deadLetterBucket, Key: &key}); err != nil {
+			log.Warnw("delete spool", "key", key, "error", err)
+		}
+	}
+	log.Infow("replayed dead letters", "objects", len(read), "kept", len(kept), "events", len(evts), "succeeded", res.Succeeded)
+	if len(kept) > 0 {
+		return res, fmt.Errorf("replay kept %d spool objects with undelivered events: %s", len(kept), strings.Join(kept, ", "))
+	}
+	return res, nil
+}
+
+// settled reports whether every event with one of ids was delivered or
+// spooled again.
+func settled(res *importerror.BatchResult, index map[string]int, ids []string) bool {
+	for _, id := range ids {
+		r := res.Results[index[id]]
+		if !r.Success && !r.Spooled {
+			return false
+		}
+	}
+	return true
+}
+
+// readSpool reads one spool object. Objects that cannot be fetched are left
+// for the next replay; objects that cannot be decoded are quarantined so they
+// do not block it.
+func readSpool(ctx context.Context, key string) ([]importerror.Event, error) {
+	obj, err := s3Client.GetObject(ctx, &s3.GetObjectInput{Bucket: &deadLetterBucket, Key: &key})
+	if err != nil {
+		log.Warnw("read spool", "key", key, "error", err)
+		return nil, err
+	}
+	defer func() { _ = obj.Body.Close() }()
+	evts, err := decodeRejects(obj.Body)
+	if err != nil {
+		quarantine(ctx, key, err)
+		return nil, err
+	}
+	return evts, nil
+}
+
+// copySource returns the URL-encoded CopySource of key in bucket.
+func copySource(bucket, key string) string {
+	parts := strings.Split(key, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return bucket + "/" + strings.Join(parts, "/")
+}
+
+// quarantine moves an undecodable spool object out of the spool prefix.
+func quarantine(ctx context.Context, key string, reason error) {
+	dest := quarantinePrefix + strings.TrimPrefix(key, deadLetterPrefix)
+	if strings.HasPrefix(dest, deadLetterPrefix) {
+		log.Errorw("quarantine prefix is inside the spool prefix, skipping spool", "key", key, "reason", reason)
+		return
+	}
+	_, err := s3Client.CopyObject(ctx, &s3.CopyObjectInput{Bucket: &deadLetterBucket, CopySource: aws.String(copySource(deadLetterBucket, key)), Key: &dest})
+	if err == nil {
+		_, err = s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: &deadLetterBucket, Key: &key})
+	}
+	if err != nil {
+		log.Errorw("quarantine spool", "key", key, "reason", reason, "error", err)
+		return
+	}
+	log.Errorw("quarantined spool", "key", key, "dest", dest, "reason", reason)
+}
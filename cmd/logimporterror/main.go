@@ -1,9 +1,9 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -12,148 +12,150 @@ import (
 	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"go.uber.org/zap"
+
+	"github.com/your-org/file-processor-sample/internal/circuit"
+	"github.com/your-org/file-processor-sample/internal/httpclient"
+	"github.com/your-org/file-processor-sample/internal/importerror"
+	"github.com/your-org/file-processor-sample/internal/sfclient"
+	"github.com/your-org/file-processor-sample/internal/sflimits"
 )
 
 var (
 	brokerURL   = os.Getenv("BROKER_URL")
+	brokerID    = os.Getenv("BROKER_CALLER_ID")
+	brokerKey   = os.Getenv("BROKER_HMAC_SECRET")
 	sfAPI       = os.Getenv("SF_API")
 	log         *zap.SugaredLogger
 	sleep       = time.Sleep
+	now         = time.Now
 	lambdaStart = lambda.Start
+	loadConfig  = config.LoadDefaultConfig
 	httpClient  = http.DefaultClient
+	sfBreaker   *circuit.Breaker
+	sfLimits    *sflimits.Monitor
 )
 
-// ErrorEvent is triggered when a row import fails.
-type ErrorEvent struct {
-	ExternalRowID string `json:"externalRowId"`
-	Message       string `json:"message"`
+// sfClient returns the Salesforce client configured by the package
+// variables. Only 5xx and 429 answers are retried; a 4xx rejection is
+// reported as the record's failure.
+func sfClient() *sfclient.Client {
+	return &sfclient.Client{
+		BrokerURL: brokerURL, BrokerID: brokerID, BrokerKey: brokerKey,
+		API: sfAPI, HTTP: httpClient, Breaker: sfBreaker, Limits: sfLimits,
+		Sleep: sleep,
+	}
 }
 
-// tokenResp mirrors the JSON structure returned by the broker.
-type tokenResp struct {
-	AccessToken string `json:"access_token"`
+// importLogger returns the batch delivery path, spooling to the dead-letter
+// prefix.
+func importLogger() *importerror.Logger {
+	return &importerror.Logger{SF: sfClient(), S3: s3Client, Bucket: deadLetterBucket, Prefix: deadLetterPrefix, Now: now, Log: log}
 }
 
-// getToken retrieves an auth token from the token broker, retrying on 401.
-func getToken(ctx context.Context) (string, error) {
-	for i := 0; ; i++ {
-		if i >= 2 {
-			return "", fmt.Errorf("broker status: %s", http.StatusText(http.StatusUnauthorized))
-		}
-		req, err := http.NewRequestWithContext(ctx, http.MethodGet, brokerURL, nil)
-		if err != nil {
-			return "", fmt.Errorf("new token request: %w", err)
-		}
-		resp, err := httpClient.Do(req)
-		if err != nil {
-			return "", fmt.Errorf("do token request: %w", err)
-		}
-		b, _ := io.ReadAll(resp.Body)
-		_ = resp.Body.Close()
-		if resp.StatusCode == http.StatusOK {
-			var tr tokenResp
-			if err := json.Unmarshal(b, &tr); err != nil {
-				return "", fmt.Errorf("decode token: %w", err)
-			}
-			return tr.AccessToken, nil
-		}
-		if resp.StatusCode == http.StatusUnauthorized {
-			continue
-		}
-		return "", fmt.Errorf("broker status: %s", resp.Status)
-	}
+// compositeResponse mirrors the body returned by the Composite resource.
+type compositeResponse struct {
+	CompositeResponse []struct {
+		Body           json.RawMessage `json:"body"`
+		HTTPStatusCode int             `json:"httpStatusCode"`
+		ReferenceID    string          `json:"referenceId"`
+	} `json:"compositeResponse"`
 }
 
-// sfRequest sends an authenticated request to Salesforce.
-func sfRequest(ctx context.Context, method, path, token string, body any) (*http.Response, error) {
-	var r io.Reader
-	if body != nil {
-		b, _ := json.Marshal(body)
-		r = bytes.NewReader(b)
+// handler logs an import error to Salesforce. When Salesforce is unreachable
+// the event is written to the dead-letter spool, if configured, so it is not
+// lost. Without a spool an open circuit is returned as CircuitOpenError for
+// the state machine to wait on.
+func handler(ctx context.Context, evt importerror.Event) error {
+	err := deliver(ctx, evt)
+	if err == nil {
+		log.Infow("error logged", "row", evt.ExternalRowID)
+		return nil
 	}
-	req, err := http.NewRequestWithContext(ctx, method, sfAPI+path, r)
-	if err != nil {
-		return nil, fmt.Errorf("new request: %w", err)
+	if !importerror.Retryable(err) {
+		return err
 	}
-	req.Header.Set("Authorization", "Bearer "+token)
-	if body != nil {
-		req.Header.Set("Content-Type", "application/json")
+	if serr := importLogger().Spool(ctx, []importerror.Event{evt}, err); serr != nil {
+		if errors.Is(serr, importerror.ErrSpoolDisabled) {
+			if oe := sfclient.CircuitOpen(err); oe != nil {
+				return oe
+			}
+			return err
+		}
+		return errors.Join(err, serr)
 	}
-	return httpClient.Do(req)
+	return nil
 }
 
-// handler logs an import error to Salesforce, handling token refresh and retries.
-func handler(ctx context.Context, evt ErrorEvent) error {
-	token, err := getToken(ctx)
+// deliver sends evt to Salesforce in a single Composite request that upserts
+// the Import_Error__c and inserts an attempt child record.
+func deliver(ctx context.Context, evt importerror.Event) error {
+	sf := sfClient()
+	token, err := sf.Token(ctx)
 	if err != nil {
 		return err
 	}
 
-	path := "/sobjects/Import_Error__c/External_Row_Id__c/" + url.PathEscape(evt.ExternalRowID)
+	base := ""
+	if u, err := url.Parse(sfAPI); err == nil {
+		base = u.Path
+	}
 	body := map[string]any{
-		"External_Row_Id__c": evt.ExternalRowID,
-		"Error_Message__c":   evt.Message,
+		"allOrNone": true,
+		"compositeRequest": []map[string]any{
+			{
+				"method":      http.MethodPatch,
+				"url":         base + "/sobjects/Import_Error__c/External_Row_Id__c/" + url.PathEscape(evt.ExternalRowID),
+				"referenceId": "importError",
+				"body":        importerror.Record(evt),
+			},
+			{
+				"method":      http.MethodPost,
+				"url":         base + "/sobjects/Import_Error_Attempt__c",
+				"referenceId": "attempt",
+				"body":        importerror.AttemptRecord(evt, now()),
+			},
+		},
 	}
 
-	var resp *http.Response
-	for attempt := 0; attempt <= 2; attempt++ {
-		resp, err = sfRequest(ctx, http.MethodPatch, path, token, body)
-		if err != nil {
-			return fmt.Errorf("patch: %w", err)
-		}
-		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
-			_ = resp.Body.Close()
-			token, err = getToken(ctx)
-			if err != nil {
-				return err
-			}
-			continue
-		}
-		if resp.StatusCode >= 400 {
-			_ = resp.Body.Close()
-			if attempt == 2 {
-				return fmt.Errorf("salesforce status: %s", resp.Status)
-			}
-			sleep(time.Duration(1<<attempt) * 100 * time.Millisecond)
-			continue
-		}
-		break
+	resp, err := sf.Send(ctx, http.MethodPost, "/composite", &token, body)
+	if err != nil {
+		return err
 	}
-	defer func() { _ = resp.Body.Close() }()
-
-	if resp.StatusCode == http.StatusNoContent {
-		// fetch current retry count
-		gresp, err := sfRequest(ctx, http.MethodGet, path+"?fields=Retry_Count__c", token, nil)
-		if err != nil {
-			return fmt.Errorf("get retry count: %w", err)
-		}
-		b, _ := io.ReadAll(gresp.Body)
-		_ = gresp.Body.Close()
-		if gresp.StatusCode >= 300 {
-			return fmt.Errorf("get retry status: %s", gresp.Status)
-		}
-		var data struct {
-			Retry int `json:"Retry_Count__c"`
-		}
-		if err := json.Unmarshal(b, &data); err != nil {
-			return fmt.Errorf("decode retry: %w", err)
-		}
-		_, err = sfRequest(ctx, http.MethodPatch, path, token, map[string]any{"Retry_Count__c": data.Retry + 1})
-		if err != nil {
-			return fmt.Errorf("update retry: %w", err)
+	b, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	var out compositeResponse
+	if err := json.Unmarshal(b, &out); err != nil {
+		return fmt.Errorf("decode composite: %w", err)
+	}
+	for _, r := range out.CompositeResponse {
+		if r.HTTPStatusCode >= 400 {
+			return fmt.Errorf("%w: composite %s: status %d: %s", importerror.ErrRejected, r.ReferenceID, r.HTTPStatusCode, r.Body)
 		}
 	}
-
-	log.Infow("error logged", "row", evt.ExternalRowID)
 	return nil
 }
 
-// realMain configures logging and starts the provided handler.
+// realMain configures logging and AWS clients and starts the Lambda entrypoint.
 func realMain(start func(interface{})) {
 	logger, _ := zap.NewProduction()
 	log = logger.Sugar()
-	start(handler)
+	cfg, err := loadConfig(context.Background())
+	if err != nil {
+		panic(err)
+	}
+	if httpClient, err = httpclient.New(httpclient.FromEnv(log)); err != nil {
+		panic(err)
+	}
+	s3Client = s3.NewFromConfig(cfg)
+	db := dynamodb.NewFromConfig(cfg)
+	sfBreaker = circuit.FromEnv(db, log)
+	sfLimits = sflimits.FromEnv(db, cloudwatch.NewFromConfig(cfg), log)
+	start(invoke)
 }
 
 // main is the Lambda entrypoint.
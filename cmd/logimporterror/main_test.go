@@ -1,27 +1,41 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"go.uber.org/zap"
+
+	"github.com/your-org/file-processor-sample/internal/brokerauth"
+	"github.com/your-org/file-processor-sample/internal/circuit"
+	"github.com/your-org/file-processor-sample/internal/importerror"
+	"github.com/your-org/file-processor-sample/internal/sflimits"
 )
 
-func loadEvent(t *testing.T) ErrorEvent {
+func loadEvent(t *testing.T) importerror.Event {
 	b, err := os.ReadFile("testdata/event.json")
 	if err != nil {
 		t.Fatal(err)
 	}
-	var e ErrorEvent
+	var e importerror.Event
 	if err := json.Unmarshal(b, &e); err != nil {
 		t.Fatal(err)
 	}
@@ -43,13 +57,13 @@ func TestFirstInsert(t *testing.T) {
 	sfCalls := 0
 	sf := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		sfCalls++
-		if r.Method != http.MethodPatch {
-			t.Fatalf("unexpected method %s", r.Method)
+		if r.Method != http.MethodPost || r.URL.Path != "/composite" {
+			t.Fatalf("unexpected request %s %s", r.Method, r.URL.Path)
 		}
 		if r.Header.Get("Authorization") != "Bearer tok" {
 			t.Fatalf("bad token")
 		}
-		w.WriteHeader(http.StatusCreated)
+		writeComposite(w, http.StatusCreated, http.StatusCreated)
 	}))
 	defer sf.Close()
 
@@ -66,7 +80,7 @@ func TestFirstInsert(t *testing.T) {
 	}
 }
 
-func TestDuplicateIncrement(t *testing.T) {
+func TestAttemptRecorded(t *testing.T) {
 	evt := loadEvent(t)
 	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if _, err := io.WriteString(w, `{"access_token":"tok"}`); err != nil {
@@ -75,43 +89,47 @@ func TestDuplicateIncrement(t *testing.T) {
 	}))
 	defer broker.Close()
 
-	patchCount := 0
-	var secondPatchBody []byte
+	var req struct {
+		AllOrNone        bool `json:"allOrNone"`
+		CompositeRequest []struct {
+			Method string         `json:"method"`
+			URL    string         `json:"url"`
+			Body   map[string]any `json:"body"`
+		} `json:"compositeRequest"`
+	}
+	calls := 0
 	sf := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case http.MethodPatch:
-			patchCount++
-			b, _ := io.ReadAll(r.Body)
-			if patchCount == 2 {
-				secondPatchBody = b
-			}
-			w.WriteHeader(http.StatusNoContent)
-		case http.MethodGet:
-			if _, err := io.WriteString(w, `{"Retry_Count__c":1}`); err != nil {
-				t.Fatal(err)
-			}
-		default:
-			t.Fatalf("unexpected method %s", r.Method)
+		calls++
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatal(err)
 		}
+		writeComposite(w, http.StatusOK, http.StatusCreated)
 	}))
 	defer sf.Close()
 
 	brokerURL = broker.URL
-	sfAPI = sf.URL
+	sfAPI = sf.URL + "/services/data/v59.0"
 	log = zap.NewNop().Sugar()
 	sleep = func(time.Duration) {}
 
 	if err := handler(context.Background(), evt); err != nil {
 		t.Fatalf("handler error: %v", err)
 	}
-	if patchCount != 2 {
-		t.Fatalf("expected 2 patches, got %d", patchCount)
+	if calls != 1 || !req.AllOrNone || len(req.CompositeRequest) != 2 {
+		t.Fatalf("expected one all-or-none composite call, got %d %+v", calls, req)
+	}
+	upsert, attempt := req.CompositeRequest[0], req.CompositeRequest[1]
+	if upsert.Method != http.MethodPatch || upsert.URL != "/services/data/v59.0/sobjects/Import_Error__c/External_Row_Id__c/row1" {
+		t.Fatalf("unexpected upsert: %+v", upsert)
+	}
+	if _, ok := upsert.Body["Retry_Count__c"]; ok {
+		t.Fatalf("retry count must not be written directly: %+v", upsert.Body)
 	}
-	if !bytes.Contains(secondPatchBody, []byte("\"Retry_Count__c\":2")) {
-		t.Fatalf("retry count not incremented: %s", string(secondPatchBody))
+	parent, _ := attempt.Body["Import_Error__r"].(map[string]any)
+	if attempt.Method != http.MethodPost || !strings.HasSuffix(attempt.URL, "/sobjects/Import_Error_Attempt__c") || parent["External_Row_Id__c"] != "row1" {
+		t.Fatalf("unexpected attempt: %+v", attempt)
 	}
 }
-
 func TestValidationError(t *testing.T) {
 	evt := loadEvent(t)
 	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -136,8 +154,8 @@ func TestValidationError(t *testing.T) {
 	if err := handler(context.Background(), evt); err == nil {
 		t.Fatal("expected error")
 	}
-	if patchCount != 3 {
-		t.Fatalf("expected 3 attempts, got %d", patchCount)
+	if patchCount != 1 {
+		t.Fatalf("a 400 rejection should not be retried, got %d attempts", patchCount)
 	}
 }
 
@@ -157,7 +175,7 @@ func TestBroker401Retry(t *testing.T) {
 	defer broker.Close()
 
 	sf := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusCreated)
+		writeComposite(w, http.StatusCreated, http.StatusCreated)
 	}))
 	defer sf.Close()
 
@@ -213,7 +231,7 @@ func TestBrokerDouble401(t *testing.T) {
 
 	brokerURL = broker.URL
 	log = zap.NewNop().Sugar()
-	if _, err := getToken(context.Background()); err == nil {
+	if _, err := sfClient().Token(context.Background()); err == nil {
 		t.Fatal("expected error")
 	}
 	if count != 2 {
@@ -229,7 +247,7 @@ func TestBroker500(t *testing.T) {
 
 	brokerURL = broker.URL
 	log = zap.NewNop().Sugar()
-	if _, err := getToken(context.Background()); err == nil {
+	if _, err := sfClient().Token(context.Background()); err == nil {
 		t.Fatal("expected error")
 	}
 }
@@ -250,7 +268,7 @@ func TestSalesforce401Refresh(t *testing.T) {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
-		w.WriteHeader(http.StatusCreated)
+		writeComposite(w, http.StatusCreated, http.StatusCreated)
 	}))
 	defer sf.Close()
 
@@ -297,7 +315,7 @@ func TestSalesforce401RefreshFail(t *testing.T) {
 	}
 }
 
-func TestRetryGetFailure(t *testing.T) {
+func TestCompositeSubrequestError(t *testing.T) {
 	evt := loadEvent(t)
 	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if _, err := io.WriteString(w, `{"access_token":"tok"}`); err != nil {
@@ -307,11 +325,7 @@ func TestRetryGetFailure(t *testing.T) {
 	defer broker.Close()
 
 	sf := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == http.MethodPatch {
-			w.WriteHeader(http.StatusNoContent)
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-		}
+		writeComposite(w, http.StatusOK, http.StatusBadRequest)
 	}))
 	defer sf.Close()
 
@@ -320,12 +334,13 @@ func TestRetryGetFailure(t *testing.T) {
 	log = zap.NewNop().Sugar()
 	sleep = func(time.Duration) {}
 
-	if err := handler(context.Background(), evt); err == nil {
-		t.Fatal("expected error")
+	err := handler(context.Background(), evt)
+	if err == nil || !strings.Contains(err.Error(), "attempt") {
+		t.Fatalf("expected attempt error, got %v", err)
 	}
 }
 
-func TestRetryDecodeError(t *testing.T) {
+func TestCompositeDecodeError(t *testing.T) {
 	evt := loadEvent(t)
 	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if _, err := io.WriteString(w, `{"access_token":"tok"}`); err != nil {
@@ -335,12 +350,8 @@ func TestRetryDecodeError(t *testing.T) {
 	defer broker.Close()
 
 	sf := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == http.MethodPatch {
-			w.WriteHeader(http.StatusNoContent)
-		} else {
-			if _, err := io.WriteString(w, "bad json"); err != nil {
-				t.Fatal(err)
-			}
+		if _, err := io.WriteString(w, "bad json"); err != nil {
+			t.Fatal(err)
 		}
 	}))
 	defer sf.Close()
@@ -355,83 +366,15 @@ func TestRetryDecodeError(t *testing.T) {
 	}
 }
 
-func TestRetryGetRequestError(t *testing.T) {
-	evt := loadEvent(t)
-	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if _, err := io.WriteString(w, `{"access_token":"tok"}`); err != nil {
-			t.Fatal(err)
-		}
-	}))
-	defer broker.Close()
-
-	prevClient := httpClient
-	httpClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
-		if strings.HasPrefix(req.URL.String(), broker.URL) {
-			return http.DefaultTransport.RoundTrip(req)
-		}
-		if req.Method == http.MethodGet {
-			return nil, errors.New("boom")
-		}
-		rr := httptest.NewRecorder()
-		rr.Code = http.StatusNoContent
-		return rr.Result(), nil
-	})}
-	brokerURL = broker.URL
-	sfAPI = "http://example.com"
-	log = zap.NewNop().Sugar()
-	sleep = func(time.Duration) {}
-
-	if err := handler(context.Background(), evt); err == nil {
-		t.Fatal("expected error")
-	}
-	httpClient = prevClient
-}
-
-func TestRetryUpdateError(t *testing.T) {
-	evt := loadEvent(t)
-	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if _, err := io.WriteString(w, `{"access_token":"tok"}`); err != nil {
-			t.Fatal(err)
-		}
-	}))
-	defer broker.Close()
-
-	step := 0
-	prevClient := httpClient
-	httpClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
-		if req.Method == http.MethodPatch && step == 1 {
-			return nil, errors.New("boom")
-		}
-		rr := httptest.NewRecorder()
-		if req.Method == http.MethodPatch {
-			step++
-			rr.Code = http.StatusNoContent
-		} else {
-			rr.Code = http.StatusOK
-			rr.Body.WriteString(`{"Retry_Count__c":1}`)
-		}
-		return rr.Result(), nil
-	})}
-	brokerURL = broker.URL
-	sfAPI = "http://example.com"
-	log = zap.NewNop().Sugar()
-	sleep = func(time.Duration) {}
-
-	if err := handler(context.Background(), evt); err == nil {
-		t.Fatal("expected error")
-	}
-	httpClient = prevClient
-}
-
 func TestSFRequestErrors(t *testing.T) {
 	prevClient := httpClient
 	sfAPI = ":bad"
-	if _, err := sfRequest(context.Background(), http.MethodGet, "/x", "t", nil); err == nil {
+	if _, err := sfClient().Request(context.Background(), http.MethodGet, "/x", "t", nil); err == nil {
 		t.Fatal("expected error")
 	}
 	httpClient = &http.Client{Transport: roundTripFunc(func(*http.Request) (*http.Response, error) { return nil, errors.New("boom") })}
 	sfAPI = "http://example.com"
-	if _, err := sfRequest(context.Background(), http.MethodGet, "/x", "t", nil); err == nil {
+	if _, err := sfClient().Request(context.Background(), http.MethodGet, "/x", "t", nil); err == nil {
 		t.Fatal("expected error")
 	}
 	httpClient = prevClient
@@ -478,11 +421,16 @@ type roundTripFunc func(*http.Request) (*http.Response, error)
 
 func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
 
+// writeComposite answers a Composite request with the given subrequest statuses.
+func writeComposite(w http.ResponseWriter, upsert, attempt int) {
+	_, _ = fmt.Fprintf(w, `{"compositeResponse":[{"body":null,"httpStatusCode":%d,"referenceId":"importError"},{"body":[{"message":"x"}],"httpStatusCode":%d,"referenceId":"attempt"}]}`, upsert, attempt)
+}
+
 func TestGetTokenErrors(t *testing.T) {
 	// New request error
 	brokerURL = ":bad"
 	log = zap.NewNop().Sugar()
-	if _, err := getToken(context.Background()); err == nil {
+	if _, err := sfClient().Token(context.Background()); err == nil {
 		t.Fatal("expected error")
 	}
 
@@ -492,7 +440,7 @@ func TestGetTokenErrors(t *testing.T) {
 	httpClient = &http.Client{Transport: roundTripFunc(func(*http.Request) (*http.Response, error) {
 		return nil, errors.New("boom")
 	})}
-	if _, err := getToken(context.Background()); err == nil {
+	if _, err := sfClient().Token(context.Background()); err == nil {
 		t.Fatal("expected error")
 	}
 	httpClient = prev
@@ -508,7 +456,7 @@ func TestGetTokenDecodeError(t *testing.T) {
 	defer broker.Close()
 	brokerURL = broker.URL
 	log = zap.NewNop().Sugar()
-	if _, err := getToken(context.Background()); err == nil {
+	if _, err := sfClient().Token(context.Background()); err == nil {
 		t.Fatal("expected error")
 	}
 }
@@ -516,15 +464,561 @@ func TestGetTokenDecodeError(t *testing.T) {
 func TestRealMain(t *testing.T) {
 	called := false
 	start := func(h interface{}) {
-		if _, ok := h.(func(context.Context, ErrorEvent) error); ok {
+		if _, ok := h.(func(context.Context, Request) (*importerror.BatchResult, error)); ok {
 			called = true
 		}
 	}
-	prev := lambdaStart
+	prev, prevCfg := lambdaStart, loadConfig
 	lambdaStart = start
+	loadConfig = func(context.Context, ...func(*config.LoadOptions) error) (aws.Config, error) {
+		return aws.Config{}, nil
+	}
 	main()
-	lambdaStart = prev
+	lambdaStart, loadConfig = prev, prevCfg
 	if !called {
 		t.Fatal("start not called")
 	}
 }
+
+func TestGetTokenSigned(t *testing.T) {
+	var caller, sig string
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		caller = r.Header.Get(brokerauth.HeaderCaller)
+		sig = r.Header.Get(brokerauth.HeaderSignature)
+		_, _ = io.WriteString(w, `{"access_token":"tok"}`)
+	}))
+	defer broker.Close()
+	brokerURL = broker.URL
+	brokerID, brokerKey = "logimporterror", "secret"
+	defer func() { brokerID, brokerKey = "", "" }()
+	log = zap.NewNop().Sugar()
+	if _, err := sfClient().Token(context.Background()); err != nil {
+		t.Fatalf("get token: %v", err)
+	}
+	if caller != "logimporterror" || sig == "" {
+		t.Fatalf("request not signed: %q %q", caller, sig)
+	}
+}
+
+func TestGetTokenBrokerShape(t *testing.T) {
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"token":"brokered"}`)
+	}))
+	defer broker.Close()
+	brokerURL = broker.URL
+	log = zap.NewNop().Sugar()
+	tok, err := sfClient().Token(context.Background())
+	if err != nil || tok != "brokered" {
+		t.Fatalf("unexpected: %q %v", tok, err)
+	}
+}
+
+type fakeS3 struct {
+	objects map[string]string
+	putErr  error
+}
+
+func (f *fakeS3) GetObject(ctx context.Context, in *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	b, ok := f.objects[*in.Key]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(b))}, nil
+}
+
+func (f *fakeS3) PutObject(ctx context.Context, in *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	if f.putErr != nil {
+		return nil, f.putErr
+	}
+	b, err := io.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	if f.objects == nil {
+		f.objects = map[string]string{}
+	}
+	f.objects[*in.Key] = string(b)
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3) ListObjectsV2(ctx context.Context, in *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	var keys []string
+	for k := range f.objects {
+		if strings.HasPrefix(k, aws.ToString(in.Prefix)) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	out := &s3.ListObjectsV2Output{}
+	for _, k := range keys {
+		out.Contents = append(out.Contents, s3types.Object{Key: aws.String(k)})
+	}
+	return out, nil
+}
+
+func (f *fakeS3) DeleteObject(ctx context.Context, in *s3.DeleteObjectInput, _ ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	delete(f.objects, *in.Key)
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (f *fakeS3) CopyObject(ctx context.Context, in *s3.CopyObjectInput, _ ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	src, err := url.PathUnescape(strings.TrimPrefix(aws.ToString(in.CopySource), aws.ToString(in.Bucket)+"/"))
+	if err != nil {
+		return nil, err
+	}
+	b, ok := f.objects[src]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	f.objects[*in.Key] = b
+	return &s3.CopyObjectOutput{}, nil
+}
+
+// spooled returns the events currently in the dead-letter prefix.
+func (f *fakeS3) spooled(t *testing.T) []importerror.Event {
+	var evts []importerror.Event
+	for k, v := range f.objects {
+		if !strings.HasPrefix(k, deadLetterPrefix) {
+			continue
+		}
+		for _, line := range strings.Split(strings.TrimSpace(v), "\n") {
+			var e importerror.Event
+			if err := json.Unmarshal([]byte(line), &e); err != nil {
+				t.Fatalf("decode spool line %q: %v", line, err)
+			}
+			evts = append(evts, e)
+		}
+	}
+	return evts
+}
+
+func TestRequestShapes(t *testing.T) {
+	var r Request
+	if err := json.Unmarshal([]byte(`{"externalRowId":"r1","message":"m"}`), &r); err != nil || r.Single == nil || r.Single.ExternalRowID != "r1" {
+		t.Fatalf("single: %+v %v", r, err)
+	}
+	r = Request{}
+	if err := json.Unmarshal([]byte(`[{"externalRowId":"a"},{"externalRowId":"b"}]`), &r); err != nil || r.Single != nil || len(r.Events) != 2 {
+		t.Fatalf("array: %+v %v", r, err)
+	}
+	r = Request{}
+	if err := json.Unmarshal([]byte(`{"rejects":{"bucket":"b","key":"k"}}`), &r); err != nil || r.Single != nil || r.Rejects.Key != "k" {
+		t.Fatalf("rejects: %+v %v", r, err)
+	}
+}
+
+// collectionSF fakes the sObject Collections endpoints. Rows whose id starts
+// with "bad" fail, rows starting with "old" already exist.
+type collectionSF struct {
+	upserts  int
+	sizes    []int
+	attempts int
+}
+
+func (c *collectionSF) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodPatch && strings.HasSuffix(r.URL.Path, "/External_Row_Id__c"):
+		c.upserts++
+		var body struct {
+			Records []map[string]any `json:"records"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		c.sizes = append(c.sizes, len(body.Records))
+		var out []map[string]any
+		for _, rec := range body.Records {
+			id, _ := rec["External_Row_Id__c"].(string)
+			switch {
+			case strings.HasPrefix(id, "bad"):
+				out = append(out, map[string]any{"success": false, "errors": []map[string]any{{"statusCode": "INVALID_FIELD", "message": "nope"}}})
+			case strings.HasPrefix(id, "old"):
+				out = append(out, map[string]any{"id": "sf-" + id, "success": true, "created": false})
+			default:
+				out = append(out, map[string]any{"id": "sf-" + id, "success": true, "created": true})
+			}
+		}
+		_ = json.NewEncoder(w).Encode(out)
+	case r.Method == http.MethodPost && r.URL.Path == "/composite/sobjects":
+		var body struct {
+			Records []map[string]any `json:"records"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		c.attempts += len(body.Records)
+		var out []map[string]any
+		for range body.Records {
+			out = append(out, map[string]any{"id": "att", "success": true})
+		}
+		_ = json.NewEncoder(w).Encode(out)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestBatchHandler(t *testing.T) {
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"access_token":"tok"}`)
+	}))
+	defer broker.Close()
+	fake := &collectionSF{}
+	sf := httptest.NewServer(fake)
+	defer sf.Close()
+	brokerURL, sfAPI = broker.URL, sf.URL
+	log = zap.NewNop().Sugar()
+	sleep = func(time.Duration) {}
+
+	evts := make([]importerror.Event, 0, 450)
+	for i := 0; i < 448; i++ {
+		evts = append(evts, importerror.Event{ExternalRowID: "row" + strconv.Itoa(i), Message: "m"})
+	}
+	evts = append(evts, importerror.Event{ExternalRowID: "bad1"}, importerror.Event{ExternalRowID: "old1"})
+
+	res, err := invoke(context.Background(), Request{Events: evts})
+	if err != nil {
+		t.Fatalf("invoke: %v", err)
+	}
+	if fake.upserts != 3 || fake.sizes[0] != 200 || fake.sizes[2] != 50 {
+		t.Fatalf("unexpected chunking: %v", fake.sizes)
+	}
+	if res.Total != 450 || res.Succeeded != 449 || res.Failed != 1 {
+		t.Fatalf("unexpected counts: %+v", res)
+	}
+	if r := res.Results[448]; r.Success || !strings.Contains(r.Error, "INVALID_FIELD") {
+		t.Fatalf("expected failure for bad1: %+v", r)
+	}
+	if fake.attempts != 449 {
+		t.Fatalf("expected an attempt per upserted record, got %d", fake.attempts)
+	}
+}
+
+func TestBatchRejectsFile(t *testing.T) {
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"access_token":"tok"}`)
+	}))
+	defer broker.Close()
+	sf := httptest.NewServer(&collectionSF{})
+	defer sf.Close()
+	brokerURL, sfAPI = broker.URL, sf.URL
+	log = zap.NewNop().Sugar()
+	s3Client = &fakeS3{objects: map[string]string{"rejects.jsonl": "{\"externalRowId\":\"a\"}\n\n{\"externalRowId\":\"b\"}\n"}}
+	defer func() { s3Client = nil }()
+
+	res, err := invoke(context.Background(), Request{Rejects: &S3Ref{Bucket: "b", Key: "rejects.jsonl"}})
+	if err != nil || res.Total != 2 || res.Succeeded != 2 {
+		t.Fatalf("unexpected: %+v %v", res, err)
+	}
+	if _, err := invoke(context.Background(), Request{Rejects: &S3Ref{Bucket: "b", Key: "missing"}}); err == nil {
+		t.Fatal("expected error for missing rejects file")
+	}
+}
+
+func TestBatchSalesforceDown(t *testing.T) {
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"access_token":"tok"}`)
+	}))
+	defer broker.Close()
+	sf := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer sf.Close()
+	brokerURL, sfAPI = broker.URL, sf.URL
+	log = zap.NewNop().Sugar()
+	sleep = func(time.Duration) {}
+
+	res, err := batchHandler(context.Background(), []importerror.Event{{ExternalRowID: "a"}, {ExternalRowID: "b"}})
+	if err != nil || res.Failed != 2 || res.Results[0].Error == "" {
+		t.Fatalf("unexpected: %+v %v", res, err)
+	}
+}
+
+func TestErrorEventAliases(t *testing.T) {
+	b, err := os.ReadFile("../../testdata/bad_row.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e importerror.Event
+	if err := json.Unmarshal(b, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.LineNumber != 1 || e.Message != "bad data" {
+		t.Fatalf("aliases not mapped: %+v", e)
+	}
+	var r Request
+	if err := json.Unmarshal([]byte(`{"fileKey":"f","error":"bad"}`), &r); err != nil || r.Single.FileKey != "f" || r.Single.Message != "bad" {
+		t.Fatalf("unexpected: %+v %v", r.Single, err)
+	}
+}
+
+func TestHandlerSpoolsWhenSalesforceDown(t *testing.T) {
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"access_token":"tok"}`)
+	}))
+	defer broker.Close()
+	status := http.StatusServiceUnavailable
+	sf := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		writeComposite(w, http.StatusOK, http.StatusBadRequest)
+	}))
+	defer sf.Close()
+	brokerURL, sfAPI = broker.URL, sf.URL
+	log = zap.NewNop().Sugar()
+	sleep = func(time.Duration) {}
+	fake := &fakeS3{}
+	s3Client, deadLetterBucket = fake, "dlq"
+	defer func() { s3Client, deadLetterBucket = nil, "" }()
+
+	if err := handler(context.Background(), importerror.Event{ExternalRowID: "r1", Message: "m"}); err != nil {
+		t.Fatalf("expected spooled event to succeed, got %v", err)
+	}
+	if got := fake.spooled(t); len(got) != 1 || got[0].ExternalRowID != "r1" {
+		t.Fatalf("unexpected spool: %+v", got)
+	}
+
+	// records Salesforce rejects are not spooled
+	status = http.StatusOK
+	if err := handler(context.Background(), importerror.Event{ExternalRowID: "r2"}); err == nil {
+		t.Fatal("expected rejection error")
+	}
+	status = http.StatusBadRequest
+	if err := handler(context.Background(), importerror.Event{ExternalRowID: "r3"}); err == nil {
+		t.Fatal("expected 400 error")
+	}
+	if got := fake.spooled(t); len(got) != 1 {
+		t.Fatalf("rejected records spooled: %+v", got)
+	}
+}
+
+func TestBatchSpoolAndReplay(t *testing.T) {
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"access_token":"tok"}`)
+	}))
+	defer broker.Close()
+	down := true
+	fakeSF := &collectionSF{}
+	sf := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fakeSF.ServeHTTP(w, r)
+	}))
+	defer sf.Close()
+	brokerURL, sfAPI = broker.URL, sf.URL
+	log = zap.NewNop().Sugar()
+	sleep = func(time.Duration) {}
+	fake := &fakeS3{}
+	s3Client, deadLetterBucket = fake, "dlq"
+	defer func() { s3Client, deadLetterBucket = nil, "" }()
+
+	res, err := batchHandler(context.Background(), []importerror.Event{{ExternalRowID: "a", Message: "first"}, {ExternalRowID: "b"}})
+	if err != nil || res.Spooled != 2 || !res.Results[0].Spooled {
+		t.Fatalf("unexpected: %+v %v", res, err)
+	}
+	if _, err := batchHandler(context.Background(), []importerror.Event{{ExternalRowID: "a", Message: "second"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	down = false
+	var req Request
+	if err := json.Unmarshal([]byte(`{"replay":true}`), &req); err != nil {
+		t.Fatal(err)
+	}
+	res, err = invoke(context.Background(), req)
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if res.Total != 2 || res.Succeeded != 2 || fakeSF.attempts != 2 {
+		t.Fatalf("expected deduplicated replay, got %+v attempts=%d", res, fakeSF.attempts)
+	}
+	if len(fake.objects) != 0 {
+		t.Fatalf("spool not cleared: %v", fake.objects)
+	}
+}
+
+func TestReplayKeepsUndelivered(t *testing.T) {
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"access_token":"tok"}`)
+	}))
+	defer broker.Close()
+	down := true
+	sf := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		(&collectionSF{}).ServeHTTP(w, r)
+	}))
+	defer sf.Close()
+	brokerURL, sfAPI = broker.URL, sf.URL
+	log = zap.NewNop().Sugar()
+	sleep = func(time.Duration) {}
+	spoolA, spoolB := deadLetterPrefix+"a.jsonl", deadLetterPrefix+"b.jsonl"
+	fake := &fakeS3{objects: map[string]string{
+		spoolA: `{"externalRowId":"a"}` + "\n",
+		spoolB: `{"externalRowId":"bad1"}` + "\n" + `{"externalRowId":"b"}` + "\n",
+	}}
+	s3Client, deadLetterBucket = fake, "dlq"
+	defer func() { s3Client, deadLetterBucket = nil, "" }()
+
+	// Salesforce is still down and the events cannot be spooled again.
+	fake.putErr = errors.New("put denied")
+	if _, err := replay(context.Background()); err == nil {
+		t.Fatal("expected replay to fail when re-spooling fails")
+	}
+	if _, ok := fake.objects[spoolA]; !ok {
+		t.Fatalf("spool object deleted: %v", fake.objects)
+	}
+	if len(fake.objects) != 2 {
+		t.Fatalf("unexpected objects %v", fake.objects)
+	}
+
+	// Salesforce is back but rejects bad1: only a.jsonl is consumed.
+	fake.putErr, down = nil, false
+	res, err := replay(context.Background())
+	if err == nil || !strings.Contains(err.Error(), spoolB) || res.Succeeded != 2 {
+		t.Fatalf("expected %s to be kept, got %+v %v", spoolB, res, err)
+	}
+	if _, ok := fake.objects[spoolA]; ok {
+		t.Fatal("delivered spool object not deleted")
+	}
+	if _, ok := fake.objects[spoolB]; !ok {
+		t.Fatal("spool object with a rejected event deleted")
+	}
+}
+
+func TestReplayQuarantine(t *testing.T) {
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"access_token":"tok"}`)
+	}))
+	defer broker.Close()
+	sf := httptest.NewServer(&collectionSF{})
+	defer sf.Close()
+	brokerURL, sfAPI = broker.URL, sf.URL
+	log = zap.NewNop().Sugar()
+	fake := &fakeS3{objects: map[string]string{
+		deadLetterPrefix + "good.jsonl":       `{"externalRowId":"a"}`,
+		deadLetterPrefix + "poison +%é.jsonl": "not json",
+	}}
+	s3Client, deadLetterBucket = fake, "dlq"
+	defer func() { s3Client, deadLetterBucket = nil, "" }()
+
+	res, err := replay(context.Background())
+	if err != nil || res.Succeeded != 1 {
+		t.Fatalf("poison object should not block the replay: %+v %v", res, err)
+	}
+	if len(fake.objects) != 1 || fake.objects[quarantinePrefix+"poison +%é.jsonl"] != "not json" {
+		t.Fatalf("poison object not quarantined: %v", fake.objects)
+	}
+}
+
+func TestReplayDisabled(t *testing.T) {
+	if _, err := replay(context.Background()); !errors.Is(err, importerror.ErrSpoolDisabled) {
+		t.Fatalf("expected disabled error, got %v", err)
+	}
+}
+
+// openCircuit is a breaker table whose item is open for another minute.
+type openCircuit struct{}
+
+func (openCircuit) GetItem(ctx context.Context, in *dynamodb.GetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	until := strconv.FormatInt(time.Now().Add(time.Minute).UnixMilli(), 10)
+	return &dynamodb.GetItemOutput{Item: map[string]dbtypes.AttributeValue{
+		"Failures":  &dbtypes.AttributeValueMemberN{Value: "5"},
+		"OpenUntil": &dbtypes.AttributeValueMemberN{Value: until},
+	}}, nil
+}
+
+func (openCircuit) UpdateItem(ctx context.Context, in *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func TestCircuitOpenFailsFast(t *testing.T) {
+	evt := loadEvent(t)
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"token":"tok"}`)
+	}))
+	defer broker.Close()
+	calls := 0
+	sf := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+	defer sf.Close()
+	brokerURL, sfAPI = broker.URL, sf.URL
+	log = zap.NewNop().Sugar()
+	sfBreaker = &circuit.Breaker{DB: openCircuit{}, Table: "circuit", Name: "salesforce"}
+	defer func() { sfBreaker = nil }()
+
+	err := handler(context.Background(), evt)
+	if _, ok := err.(*circuit.CircuitOpenError); !ok {
+		t.Fatalf("expected unwrapped CircuitOpenError, got %T %v", err, err)
+	}
+	_, err = batchHandler(context.Background(), []importerror.Event{{ExternalRowID: "a"}})
+	if _, ok := err.(*circuit.CircuitOpenError); !ok {
+		t.Fatalf("expected unwrapped CircuitOpenError from batch, got %T %v", err, err)
+	}
+	if calls != 0 {
+		t.Fatalf("expected no Salesforce calls, got %d", calls)
+	}
+
+	fake := &fakeS3{objects: map[string]string{}}
+	s3Client, deadLetterBucket = fake, "dlq"
+	defer func() { s3Client, deadLetterBucket = nil, "" }()
+	if err := handler(context.Background(), evt); err != nil {
+		t.Fatalf("expected spooled event, got %v", err)
+	}
+	if got := fake.spooled(t); len(got) != 1 {
+		t.Fatalf("expected 1 spooled event, got %d", len(got))
+	}
+}
+
+func TestGetTokenCircuitOpen(t *testing.T) {
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "12")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = io.WriteString(w, `{"code":"circuit_open","message":"circuit salesforce open"}`)
+	}))
+	defer broker.Close()
+	brokerURL = broker.URL
+	_, err := sfClient().Token(context.Background())
+	var oe *circuit.CircuitOpenError
+	if !errors.As(err, &oe) || oe.RetryAfter != 12*time.Second {
+		t.Fatalf("expected CircuitOpenError, got %v", err)
+	}
+	if !importerror.Retryable(err) {
+		t.Fatal("open circuit should be retryable")
+	}
+}
+
+// usageTable records the api usage written by sflimits.
+type usageTable struct{ used string }
+
+func (u *usageTable) GetItem(ctx context.Context, in *dynamodb.GetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{}, nil
+}
+
+func (u *usageTable) UpdateItem(ctx context.Context, in *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	u.used = in.ExpressionAttributeValues[":used"].(*dbtypes.AttributeValueMemberN).Value
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func TestLimitInfoRecorded(t *testing.T) {
+	sf := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(sflimits.Header, "api-usage=1234/15000")
+		writeComposite(w, http.StatusCreated, http.StatusCreated)
+	}))
+	defer sf.Close()
+	sfAPI = sf.URL
+	table := &usageTable{}
+	sfLimits = &sflimits.Monitor{DB: table, Table: "limits"}
+	defer func() { sfLimits = nil }()
+
+	resp, err := sfClient().Request(context.Background(), http.MethodPost, "/composite", "tok", map[string]any{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if table.used != "1234" {
+		t.Fatalf("expected usage recorded, got %q", table.used)
+	}
+}
@@ -1,26 +1,35 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"plugin"
+	"strconv"
 	"strings"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	"go.uber.org/zap"
-)
 
-const (
-	chunkSize = 1000
-	maxMemory = 25 * 1024 * 1024
+	"github.com/your-org/file-processor-sample/internal/batch"
+	"github.com/your-org/file-processor-sample/internal/enrich"
+	"github.com/your-org/file-processor-sample/internal/filecheck"
+	"github.com/your-org/file-processor-sample/internal/header"
+	"github.com/your-org/file-processor-sample/internal/preprocess"
+	"github.com/your-org/file-processor-sample/internal/profile"
+	"github.com/your-org/file-processor-sample/internal/route"
+	"github.com/your-org/file-processor-sample/internal/rowcheck"
 )
 
 type parseFunc func(io.Reader) ([]map[string]string, error)
@@ -28,22 +37,22 @@ type parseFunc func(io.Reader) ([]map[string]string, error)
 type s3API interface {
 	GetObject(context.Context, *s3.GetObjectInput, ...func(*s3.Options)) (*s3.GetObjectOutput, error)
 	PutObject(context.Context, *s3.PutObjectInput, ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	DeleteObject(context.Context, *s3.DeleteObjectInput, ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+}
+
+// profileLoader abstracts profile.Loader for tests.
+type profileLoader interface {
+	Load(ctx context.Context, name string) (*profile.Result, error)
 }
 
 var (
-	s3Client s3API
-	log      *zap.SugaredLogger
+	s3Client  s3API
+	ddbClient enrich.DynamoAPI
+	log       *zap.SugaredLogger
+	routes    *route.Table
+	profiles  profileLoader
 )
 
-// getParserID returns the parser plug-in id from PARSER_ID or a default.
-func getParserID() string {
-	id := os.Getenv("PARSER_ID")
-	if id == "" {
-		id = "csv_pipe"
-	}
-	return id
-}
-
 // loadParser loads the parser plug-in with the given id.
 func loadParser(id string) (parseFunc, error) {
 	path := fmt.Sprintf("/opt/plugins/%s.so", id)
@@ -71,74 +80,154 @@ func trimRows(rows []map[string]string) {
 	}
 }
 
-// profileSpec defines required columns loaded from PROFILE_JSON.
-type profileSpec struct {
-	Required []string `json:"required"`
-}
-
-// loadProfile decodes the PROFILE_JSON environment variable.
-func loadProfile() (profileSpec, error) {
-	v := os.Getenv("PROFILE_JSON")
-	if v == "" {
-		return profileSpec{}, nil
+// resolve picks the route for key, sniffing the head of body when a
+// matching route asks for it, and loads the route's profile.
+func resolve(ctx context.Context, key string, body *bufio.Reader) (*route.Route, *profile.Result, error) {
+	var head []byte
+	if routes.NeedsSniff(key) {
+		var err error
+		if head, err = body.Peek(route.SniffBytes); err != nil && err != io.EOF {
+			return nil, nil, fmt.Errorf("read head: %w", err)
+		}
 	}
-	var p profileSpec
-	if err := json.Unmarshal([]byte(v), &p); err != nil {
-		return profileSpec{}, fmt.Errorf("decode profile: %w", err)
+	rt, err := routes.Match(key, head)
+	if err != nil {
+		return nil, nil, err
 	}
-	return p, nil
+	res, err := profiles.Load(ctx, rt.Profile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("route %s: %w", rt.Name, err)
+	}
+	return rt, res, nil
 }
 
-// validateHeader ensures the required columns exist in the header row.
-func validateHeader(rows []map[string]string, req []string) error {
-	if len(rows) == 0 {
-		return fmt.Errorf("no rows")
-	}
-	for _, c := range req {
-		if _, ok := rows[0][c]; !ok {
-			return fmt.Errorf("missing column %s", c)
-		}
-	}
-	return nil
+// codeEnrichment is the error code of rows a required enrichment rejected.
+const codeEnrichment = "ENRICHMENT"
+
+// S3Ref locates an object written by the handler. SHA256 is the hex
+// checksum of its content where the handler reports one.
+type S3Ref struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// ItemReader holds the S3 GetObject parameters of a Distributed Map
+// ItemReader over the chunk items file.
+type ItemReader struct {
+	Bucket string `json:"Bucket"`
+	Key    string `json:"Key"`
 }
 
-// filterRows drops rows missing required columns and returns the valid rows
-// and a count of invalid ones.
-func filterRows(rows []map[string]string, req []string) ([]map[string]string, int) {
+// reject is one line of the rejects file, in the bad-row shape
+// LogImportError reads.
+type reject struct {
+	ExternalRowID string `json:"externalRowId"`
+	Row           int    `json:"row"`
+	Error         string `json:"error"`
+	Field         string `json:"field,omitempty"`
+	ErrorCode     string `json:"errorCode"`
+	FileKey       string `json:"fileKey"`
+	RawRow        string `json:"rawRow,omitempty"`
+}
+
+// checkRows validates and then enriches each row and returns the rows kept
+// and one reject per dropped row. Rows are numbered from 1 in file order.
+func checkRows(ctx context.Context, key string, rows []map[string]string, val *rowcheck.Validator, enr *enrich.Engine) ([]map[string]string, []reject, error) {
 	var out []map[string]string
-	bad := 0
-	for _, r := range rows {
-		valid := true
-		for _, c := range req {
-			if strings.TrimSpace(r[c]) == "" {
-				valid = false
-				break
-			}
+	var rejects []reject
+	for i, r := range rows {
+		raw, _ := json.Marshal(r)
+		rj := reject{ExternalRowID: fmt.Sprintf("%s#%d", key, i+1), Row: i + 1, FileKey: key, RawRow: string(raw)}
+		if rej := val.Check(r); rej != nil {
+			rj.Error, rj.Field, rj.ErrorCode = rej.Message, rej.Field, rej.Code
+			rejects = append(rejects, rj)
+			continue
 		}
-		if valid {
-			out = append(out, r)
-		} else {
-			bad++
+		missed, err := enr.Row(ctx, r)
+		if err != nil {
+			return nil, nil, fmt.Errorf("enrich row %d: %w", i+1, err)
 		}
+		if missed != "" {
+			rj.Error, rj.Field, rj.ErrorCode = "no value for required enrichment "+missed, missed, codeEnrichment
+			rejects = append(rejects, rj)
+			continue
+		}
+		out = append(out, r)
+	}
+	return out, rejects, nil
+}
+
+// writeRejects stores rejects as JSONL next to the source file.
+func writeRejects(ctx context.Context, bucket, key string, rejects []reject) (*S3Ref, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, r := range rejects {
+		if err := enc.Encode(r); err != nil {
+			return nil, fmt.Errorf("encode reject: %w", err)
+		}
+	}
+	ref := &S3Ref{Bucket: bucket, Key: strings.TrimSuffix(key, filepath.Ext(key)) + "_rejects.jsonl"}
+	if _, err := s3Client.PutObject(ctx, &s3.PutObjectInput{Bucket: &ref.Bucket, Key: &ref.Key, Body: bytes.NewReader(buf.Bytes())}); err != nil {
+		return nil, fmt.Errorf("put rejects: %w", err)
 	}
-	return out, bad
+	return ref, nil
 }
 
-// Output is returned by the handler and either contains parsed rows or the
-// S3 keys of chunked JSONL files along with a count of invalid rows.
+// Output is returned by the handler. It stays small enough for a Step
+// Functions payload: the rows are written as chunks, listed by the items
+// file at ItemReader and by Manifest, and only files under the profile's
+// inlineMaxBytes carry their Rows inline. RowCount and BadRows count the
+// accepted and rejected rows. Route and Profile record which route and
+// exact profile revision were applied. Rejected rows are written to
+// Rejects and counted by error code.
 type Output struct {
-	Rows    []map[string]string `json:"rows,omitempty"`
-	Keys    []string            `json:"keys,omitempty"`
-	BadRows int                 `json:"badRows"`
+	Rows        []map[string]string `json:"rows,omitempty"`
+	RowCount    int                 `json:"rowCount"`
+	Chunks      int                 `json:"chunks,omitempty"`
+	Format      string              `json:"format,omitempty"`
+	ItemReader  *ItemReader         `json:"itemReader,omitempty"`
+	Manifest    *S3Ref              `json:"manifest,omitempty"`
+	BadRows     int                 `json:"badRows"`
+	Rejects     *S3Ref              `json:"rejects,omitempty"`
+	RejectCodes map[string]int      `json:"rejectCodes,omitempty"`
+	Warnings    []header.Warning    `json:"warnings,omitempty"`
+	Route       string              `json:"route"`
+	Profile     string              `json:"profile"`
 }
 
-// handler downloads an uploaded file, parses it using a plug-in and writes
-// processed data back to S3 if the file is large.
-func handler(ctx context.Context, evt events.S3Event) (Output, error) {
-	rec := evt.Records[0]
+// rejectFile logs a *filecheck.FileValidationError and returns it
+// unwrapped so the state machine can match its type; other errors pass
+// through.
+func rejectFile(err error) error {
+	var fe *filecheck.FileValidationError
+	if errors.As(err, &fe) {
+		log.Warnw("rejected file", "key", fe.Key, "code", fe.Code, "reason", fe.Reason)
+		return fe
+	}
+	return err
+}
+
+// handler parses every file of the event, returning an Output per file and
+// the SQS messages to retry when invoked from a queue.
+func handler(ctx context.Context, evt batch.Event) (batch.Response, error) {
+	return batch.Run(ctx, evt, func(ctx context.Context, rec events.S3EventRecord) (any, error) {
+		out, err := parseRecord(ctx, rec)
+		if err != nil {
+			return nil, err
+		}
+		return out, nil
+	})
+}
+
+// parseRecord downloads an uploaded file, routes it to a profile, runs the
+// profile's preProcessors, parses it with the profile's plug-in, maps the
+// header onto the profile's columns, validates and enriches the rows and
+// writes them back to S3 as chunks unless they fit inline. Keys no route
+// accepts fail with *route.NoRouteError.
+func parseRecord(ctx context.Context, rec events.S3EventRecord) (Output, error) {
 	bucket := rec.S3.Bucket.Name
 	key := rec.S3.Object.Key
-	size := rec.S3.Object.Size
 
 	obj, err := s3Client.GetObject(ctx, &s3.GetObjectInput{Bucket: &bucket, Key: &key})
 	if err != nil {
@@ -150,51 +239,111 @@ func handler(ctx context.Context, evt events.S3Event) (Output, error) {
 		}
 	}()
 
-	parser, err := loadParser(getParserID())
+	body := bufio.NewReaderSize(obj.Body, route.SniffBytes)
+	rt, res, err := resolve(ctx, key, body)
 	if err != nil {
+		var nr *route.NoRouteError
+		if errors.As(err, &nr) {
+			log.Warnw("rejected unrouted file", "bucket", bucket, "key", key)
+			return Output{}, nr
+		}
 		return Output{}, err
 	}
-	rows, err := parser(obj.Body)
+	out := Output{Route: rt.Name, Profile: res.Ref()}
+	prof := res.Profile
+
+	pre, err := preprocess.Build(prof.PreProcessors)
+	if err != nil {
+		return Output{}, fmt.Errorf("profile %s: %w", out.Profile, err)
+	}
+	val, err := rowcheck.Compile(prof.RowValidation)
+	if err != nil {
+		return Output{}, fmt.Errorf("profile %s: %w", out.Profile, err)
+	}
+	cols, err := header.Compile(prof)
+	if err != nil {
+		return Output{}, fmt.Errorf("profile %s: %w", out.Profile, err)
+	}
+	fc, err := filecheck.Compile(prof.FileValidation, prof.RowValidation.Required)
+	if err != nil {
+		return Output{}, fmt.Errorf("profile %s: %w", out.Profile, err)
+	}
+	enr, err := enrich.Build(ctx, prof.Enrichments, enrich.Deps{S3: s3Client, DynamoDB: ddbClient})
+	if err != nil {
+		return Output{}, fmt.Errorf("profile %s: %w", out.Profile, err)
+	}
+	in, err := pre.Apply(body)
+	if err != nil {
+		return Output{}, err
+	}
+	parser, err := loadParser(prof.ParserID)
+	if err != nil {
+		return Output{}, err
+	}
+	// Only a control record needs the whole file in memory; otherwise the
+	// parser streams the object.
+	var ctl *filecheck.Control
+	if prof.FileValidation.Trailer != nil {
+		data, err := io.ReadAll(in)
+		if err != nil {
+			return Output{}, fmt.Errorf("read: %w", err)
+		}
+		if data, ctl, err = fc.SplitControl(key, data); err != nil {
+			return Output{}, rejectFile(err)
+		}
+		in = bytes.NewReader(data)
+	}
+	rows, err := parser(in)
 	if err != nil {
 		return Output{}, fmt.Errorf("parse: %w", err)
 	}
 	trimRows(rows)
+	if out.Warnings = cols.Map(rows); len(out.Warnings) > 0 {
+		log.Infow("column warnings", "key", key, "warnings", out.Warnings)
+	}
 
-	prof, err := loadProfile()
+	if err := fc.Header(key, rows); err != nil {
+		return Output{}, rejectFile(err)
+	}
+	if err := fc.Verify(key, ctl, rows); err != nil {
+		return Output{}, rejectFile(err)
+	}
+	total := len(rows)
+	rows, rejects, err := checkRows(ctx, key, rows, val, enr)
 	if err != nil {
 		return Output{}, err
 	}
-	if err := validateHeader(rows, prof.Required); err != nil {
-		return Output{}, err
+	bad := len(rejects)
+	out.BadRows = bad
+	if bad > 0 {
+		out.RejectCodes = map[string]int{}
+		for _, r := range rejects {
+			out.RejectCodes[r.ErrorCode]++
+		}
+		if out.Rejects, err = writeRejects(ctx, bucket, key, rejects); err != nil {
+			return Output{}, err
+		}
+		log.Infow("rows rejected", "key", key, "rows", bad, "codes", out.RejectCodes)
+	}
+	if err := fc.BadRows(key, total, bad); err != nil {
+		return Output{}, rejectFile(err)
 	}
-	rows, bad := filterRows(rows, prof.Required)
 
-	if size <= maxMemory {
-		log.Infow("processed", "key", key, "rows", len(rows), "bad", bad)
-		return Output{Rows: rows, BadRows: bad}, nil
+	out.RowCount = len(rows)
+	if inline(rows, prof.Output) {
+		log.Infow("processed", "key", key, "route", out.Route, "profile", out.Profile, "rows", len(rows), "bad", bad)
+		out.Rows = rows
+		return out, nil
 	}
 
-	baseKey := strings.TrimSuffix(key, filepath.Ext(key))
-	var keys []string
-	for i := 0; i < len(rows); i += chunkSize {
-		end := i + chunkSize
-		if end > len(rows) {
-			end = len(rows)
-		}
-		var buf bytes.Buffer
-		for _, r := range rows[i:end] {
-			b, _ := json.Marshal(r)
-			buf.Write(b)
-			buf.WriteByte('\n')
-		}
-		outKey := fmt.Sprintf("%s_%d.jsonl", baseKey, i/chunkSize)
-		if _, err := s3Client.PutObject(ctx, &s3.PutObjectInput{Bucket: &bucket, Key: &outKey, Body: bytes.NewReader(buf.Bytes())}); err != nil {
-			return Output{}, fmt.Errorf("put chunk: %w", err)
-		}
-		keys = append(keys, outKey)
+	m, ref, err := writeChunks(ctx, S3Ref{Bucket: bucket, Key: key}, out, rows, prof.Output)
+	if err != nil {
+		return Output{}, err
 	}
-	log.Infow("processed", "key", key, "chunks", len(keys), "bad", bad)
-	return Output{Keys: keys, BadRows: bad}, nil
+	out.Chunks, out.Format, out.Manifest = len(m.Chunks), m.Format, ref
+	out.ItemReader = &ItemReader{Bucket: m.Items.Bucket, Key: m.Items.Key}
+	log.Infow("processed", "key", key, "route", out.Route, "profile", out.Profile, "rows", len(rows), "chunks", out.Chunks, "format", out.Format, "bad", bad)
+	return out, nil
 }
 
 // lambdaStart is overridden in tests to capture the handler start.
@@ -212,7 +361,20 @@ func run() error {
 	}
 	logger, _ := zap.NewProduction()
 	log = logger.Sugar()
-	s3Client = s3.NewFromConfig(cfg)
+	if routes, err = route.FromEnv(); err != nil {
+		return err
+	}
+	client := s3.NewFromConfig(cfg)
+	s3Client = client
+	ddbClient = dynamodb.NewFromConfig(cfg)
+	src, err := profile.SourceFromEnv(ssm.NewFromConfig(cfg), client)
+	if err != nil {
+		return err
+	}
+	profiles = profile.NewFromSource(src, log, profile.Options{})
+	if n, err := strconv.Atoi(os.Getenv("UPLOAD_WORKERS")); err == nil && n > 0 {
+		uploadWorkers = n
+	}
 	lambdaStart(handler)
 	return nil
 }
@@ -2,27 +2,46 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"go.uber.org/zap"
+
+	"github.com/your-org/file-processor-sample/internal/batch"
+	"github.com/your-org/file-processor-sample/internal/filecheck"
+	"github.com/your-org/file-processor-sample/internal/header"
+	"github.com/your-org/file-processor-sample/internal/profile"
+	"github.com/your-org/file-processor-sample/internal/route"
+	"github.com/your-org/file-processor-sample/internal/rowcheck"
 )
 
 type fakeS3 struct {
+	mu      sync.Mutex
 	objects map[string][]byte
 	puts    map[string][]byte
+	buckets map[string]string
+	deletes []string
 	getErr  error
 	putErr  error
+	// failKey makes puts of this key fail.
+	failKey string
 }
 
 func (f *fakeS3) GetObject(ctx context.Context, in *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
@@ -37,20 +56,34 @@ func (f *fakeS3) GetObject(ctx context.Context, in *s3.GetObjectInput, _ ...func
 }
 
 func (f *fakeS3) PutObject(ctx context.Context, in *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	if f.putErr != nil {
 		return nil, f.putErr
 	}
+	if *in.Key == f.failKey {
+		return nil, fmt.Errorf("put %s failed", f.failKey)
+	}
 	if f.puts == nil {
-		f.puts = map[string][]byte{}
+		f.puts, f.buckets = map[string][]byte{}, map[string]string{}
 	}
 	b, err := io.ReadAll(in.Body)
 	if err != nil {
 		return nil, err
 	}
 	f.puts[*in.Key] = b
+	f.buckets[*in.Key] = *in.Bucket
 	return &s3.PutObjectOutput{}, nil
 }
 
+func (f *fakeS3) DeleteObject(ctx context.Context, in *s3.DeleteObjectInput, _ ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deletes = append(f.deletes, *in.Key)
+	delete(f.puts, *in.Key)
+	return &s3.DeleteObjectOutput{}, nil
+}
+
 const pluginSrc = `package main
 import (
     "fmt"
@@ -109,8 +142,81 @@ func buildPlugin(t *testing.T, id, src string) {
 	}
 }
 
-func newEvent(key string, size int64) events.S3Event {
-	return events.S3Event{Records: []events.S3EventRecord{{S3: events.S3Entity{Bucket: events.S3Bucket{Name: "b"}, Object: events.S3Object{Key: key, Size: size}}}}}
+// testProfile returns a valid Profile v2 using parserID and requiring the
+// given columns.
+func testProfile(parserID string, required ...string) string {
+	if required == nil {
+		required = []string{}
+	}
+	b, _ := json.Marshal(map[string]any{
+		"parserId":           parserID,
+		"maxBytes":           100000000,
+		"maxRows":            10000,
+		"rowStateMachineArn": "arn:aws:states:us-east-1:123456789012:stateMachine:BatchWrapper",
+		"mapMaxConcurrency":  10,
+		"rowValidation":      map[string]any{"required": required},
+		"output":             map[string]any{"inlineMaxBytes": 16384},
+		"targets":            []any{map[string]any{"object": "Account", "externalId": "Id", "fieldMap": map[string]string{"header1": "Name"}}},
+	})
+	return string(b)
+}
+
+// testRoutes sends *.qns keys to the test profiles; files whose header has
+// a third column go to the wide profile, gzipped files to qns_gz, *.enr
+// files to qns_enriched, *.rul files to qns_rules, *.ctl files to
+// qns_strict and *.hdr files to qns_aliases.
+const testRoutes = `{"routes": [
+	{"name": "qns-wide", "glob": "*.qns", "sniff": "^header1\\|header2\\|header3", "profile": "/crm/file-profiles/test/wide"},
+	{"name": "qns", "glob": "*.qns", "profile": "/crm/file-profiles/test/qns"},
+	{"name": "qns-gz", "glob": "*.qns.gz", "profile": "/crm/file-profiles/test/qns_gz"},
+	{"name": "qns-enriched", "glob": "*.enr", "profile": "/crm/file-profiles/test/qns_enriched"},
+	{"name": "qns-rules", "glob": "*.rul", "profile": "/crm/file-profiles/test/qns_rules"},
+	{"name": "qns-strict", "glob": "*.ctl", "profile": "/crm/file-profiles/test/qns_strict"},
+	{"name": "qns-aliases", "glob": "*.hdr", "profile": "/crm/file-profiles/test/qns_aliases"}
+]}`
+
+// useProfile installs testRoutes and serves the qns profile with parserID
+// and the required columns; the wide profile requires header3, and qns_gz,
+// qns_enriched, qns_rules, qns_strict and qns_aliases extend qns with
+// preProcessors, enrichments, row rules, file validation and column
+// aliases.
+func useProfile(t *testing.T, parserID string, required ...string) {
+	t.Helper()
+	tbl, err := route.Parse([]byte(testRoutes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes = tbl
+	profiles = profile.NewFromSource(&profile.FSSource{FS: fstest.MapFS{
+		"crm/file-profiles/test/qns.json":  {Data: []byte(testProfile(parserID, required...))},
+		"crm/file-profiles/test/wide.json": {Data: []byte(testProfile(parserID, "header3"))},
+		"crm/file-profiles/test/qns_gz.json": {Data: []byte(`{"extends": "qns", "preProcessors": [
+			{"type": "gunzip"}, {"type": "normalizeLineEndings"}, {"type": "renameHeaders", "map": {"Col 1": "header1"}}
+		]}`)},
+		"crm/file-profiles/test/qns_enriched.json": {Data: []byte(`{"extends": "qns", "enrichments": [
+			{"type": "constant", "output": "Feed", "value": "qns"},
+			{"type": "s3Lookup", "output": "Code", "bucket": "b", "key": "ref/codes.json", "input": "header1", "required": true}
+		]}`)},
+		"crm/file-profiles/test/qns_rules.json": {Data: []byte(`{"extends": "qns", "rowValidation": {"rules": [
+			{"type": "required", "code": "PREMIUM_IF_BOUND", "field": "Premium", "if": {"field": "Stage", "equals": "Bound"}},
+			{"type": "unique", "code": "DUPLICATE_ID", "field": "header1"},
+			{"type": "enum", "code": "BAD_STAGE", "field": "Stage", "values": ["Quoted", "Bound"]},
+			{"type": "range", "code": "PREMIUM_RANGE", "field": "Premium", "min": 0}
+		]}}`)},
+		"crm/file-profiles/test/qns_strict.json": {Data: []byte(`{"extends": "qns", "fileValidation": {
+			"maxBadRows": 1, "maxBadRowPercent": 40,
+			"header": {"match": "exact", "columns": ["header1", "Amount"]},
+			"trailer": {"pattern": "^TRL\\|(?P<count>\\d+)\\|(?P<total>[0-9.]+)$", "totalField": "Amount"}
+		}}`)},
+		"crm/file-profiles/test/qns_aliases.json": {Data: []byte(`{"extends": "qns", "columns": {
+			"normalize": ["case", "whitespace", "punctuation"],
+			"aliases": {"Amount": ["Amt", "Premium Amount"]}
+		}, "fileValidation": {"header": {"columns": ["header1", "Amount"]}}}`)},
+	}}, zap.NewNop().Sugar(), profile.Options{})
+}
+
+func newRecord(key string, size int64) events.S3EventRecord {
+	return events.S3EventRecord{S3: events.S3Entity{Bucket: events.S3Bucket{Name: "b"}, Object: events.S3Object{Key: key, Size: size}}}
 }
 
 func TestHandler(t *testing.T) {
@@ -118,19 +224,14 @@ func TestHandler(t *testing.T) {
 	buildPlugin(t, "csv_pipe", pluginSrc)
 
 	t.Run("small", func(t *testing.T) {
-		if err := os.Setenv("PARSER_ID", "csv_pipe"); err != nil {
-			t.Fatalf("setenv: %v", err)
-		}
-		if err := os.Setenv("PROFILE_JSON", `{"required":["header1","header2"]}`); err != nil {
-			t.Fatalf("setenv: %v", err)
-		}
+		useProfile(t, "csv_pipe", "header1", "header2")
 		f := &fakeS3{objects: map[string][]byte{"f.qns": []byte("header1|header2\n v1 | v2 ")}}
 		s3Client = f
-		out, err := handler(context.Background(), newEvent("f.qns", 10))
+		out, err := parseRecord(context.Background(), newRecord("f.qns", 10))
 		if err != nil {
 			t.Fatalf("handler error: %v", err)
 		}
-		if len(out.Rows) != 1 || out.BadRows != 0 || len(out.Keys) != 0 {
+		if len(out.Rows) != 1 || out.RowCount != 1 || out.BadRows != 0 || out.ItemReader != nil || len(f.puts) != 0 {
 			t.Fatalf("unexpected output: %+v", out)
 		}
 	})
@@ -143,28 +244,54 @@ func TestHandler(t *testing.T) {
 		}
 		f := &fakeS3{objects: map[string][]byte{"big.qns": []byte(sb.String())}}
 		s3Client = f
-		if err := os.Setenv("PROFILE_JSON", `{"required":["header1","header2"]}`); err != nil {
-			t.Fatalf("setenv: %v", err)
-		}
-		out, err := handler(context.Background(), newEvent("big.qns", 30000000))
+		useProfile(t, "csv_pipe", "header1", "header2")
+		out, err := parseRecord(context.Background(), newRecord("big.qns", 30000000))
 		if err != nil {
 			t.Fatalf("handler error: %v", err)
 		}
-		if len(out.Keys) != 3 || out.BadRows != 0 || len(out.Rows) != 0 {
+		if out.Chunks != 3 || out.RowCount != 2500 || out.BadRows != 0 || len(out.Rows) != 0 {
 			t.Fatalf("unexpected output: %+v", out)
 		}
-		if len(f.puts) != 3 {
-			t.Fatalf("expected 3 chunks, got %d", len(f.puts))
+		if len(f.puts) != 5 {
+			t.Fatalf("expected 3 chunks, items and a manifest, got %d", len(f.puts))
+		}
+		if out.Format != "jsonl" || out.ItemReader == nil || *out.ItemReader != (ItemReader{Bucket: "b", Key: "big_items.json"}) || out.Manifest == nil || out.Manifest.Key != "big_manifest.json" {
+			t.Fatalf("unexpected output: %+v", out)
+		}
+		if sum := sha256.Sum256(f.puts["big_manifest.json"]); out.Manifest.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Fatalf("bad manifest checksum %s", out.Manifest.SHA256)
+		}
+		if b, _ := json.Marshal(out); len(b) > 1024 {
+			t.Fatalf("output is not compact: %s", b)
+		}
+		var m Manifest
+		if err := json.Unmarshal(f.puts["big_manifest.json"], &m); err != nil {
+			t.Fatal(err)
+		}
+		if m.Rows != 2500 || len(m.Chunks) != 3 || m.Chunks[2].Rows != 500 || m.Source.Key != "big.qns" || m.Items.Key != "big_items.json" {
+			t.Fatalf("unexpected manifest %+v", m)
+		}
+		var items []ChunkInfo
+		if err := json.Unmarshal(f.puts["big_items.json"], &items); err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != 3 || items[0] != m.Chunks[0] || items[0].Bucket != "b" || items[0].Key != "big_0.jsonl" || items[0].Format != "jsonl" {
+			t.Fatalf("unexpected items %+v", items)
+		}
+		if sum := sha256.Sum256(f.puts["big_items.json"]); m.Items.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Fatalf("bad items checksum %s", m.Items.SHA256)
+		}
+		sum := sha256.Sum256(f.puts["big_2.jsonl"])
+		if m.Chunks[2].SHA256 != hex.EncodeToString(sum[:]) || m.Chunks[2].Bytes != len(f.puts["big_2.jsonl"]) {
+			t.Fatalf("bad checksum for %+v", m.Chunks[2])
 		}
 	})
 
 	t.Run("missing column", func(t *testing.T) {
 		f := &fakeS3{objects: map[string][]byte{"bad.qns": []byte("header1\nval")}}
 		s3Client = f
-		if err := os.Setenv("PROFILE_JSON", `{"required":["header1","header2"]}`); err != nil {
-			t.Fatalf("setenv: %v", err)
-		}
-		if _, err := handler(context.Background(), newEvent("bad.qns", 10)); err == nil {
+		useProfile(t, "csv_pipe", "header1", "header2")
+		if _, err := parseRecord(context.Background(), newRecord("bad.qns", 10)); err == nil {
 			t.Fatal("expected error")
 		}
 	})
@@ -172,16 +299,16 @@ func TestHandler(t *testing.T) {
 	t.Run("malformed", func(t *testing.T) {
 		f := &fakeS3{objects: map[string][]byte{"m.qns": []byte("header1|header2\nval1")}}
 		s3Client = f
-		if err := os.Setenv("PROFILE_JSON", `{"required":[]}`); err != nil {
-			t.Fatalf("setenv: %v", err)
-		}
-		if _, err := handler(context.Background(), newEvent("m.qns", 10)); err == nil {
+		useProfile(t, "csv_pipe")
+		if _, err := parseRecord(context.Background(), newRecord("m.qns", 10)); err == nil {
 			t.Fatal("expected error")
 		}
 	})
 }
 
 func TestRun(t *testing.T) {
+	t.Setenv("ROUTES_JSON", testRoutes)
+	t.Setenv("PROFILE_SOURCES", "embedded")
 	called := false
 	lambdaStart = func(i interface{}) { called = true }
 	loadConfig = func(ctx context.Context, optFns ...func(*config.LoadOptions) error) (aws.Config, error) {
@@ -205,10 +332,95 @@ func TestRunError(t *testing.T) {
 	}
 }
 
-func TestGetParserID(t *testing.T) {
-	t.Setenv("PARSER_ID", "")
-	if got := getParserID(); got != "csv_pipe" {
-		t.Fatalf("default id wrong: %s", got)
+func TestRunNoRoutes(t *testing.T) {
+	t.Setenv("ROUTES_JSON", "")
+	lambdaStart = func(i interface{}) {}
+	loadConfig = func(ctx context.Context, optFns ...func(*config.LoadOptions) error) (aws.Config, error) {
+		return aws.Config{}, nil
+	}
+	if err := run(); err == nil || !strings.Contains(err.Error(), "ROUTES_JSON") {
+		t.Fatalf("expected missing routes error, got %v", err)
+	}
+}
+
+func TestHandlerRouting(t *testing.T) {
+	log = zap.NewNop().Sugar()
+	buildPlugin(t, "csv_pipe", pluginSrc)
+	useProfile(t, "csv_pipe", "header1")
+
+	t.Run("unrouted", func(t *testing.T) {
+		s3Client = &fakeS3{objects: map[string][]byte{"f.csv": []byte("header1|header2\na|b")}}
+		_, err := parseRecord(context.Background(), newRecord("f.csv", 10))
+		var nr *route.NoRouteError
+		if !errors.As(err, &nr) || nr.Key != "f.csv" {
+			t.Fatalf("expected NoRouteError, got %v", err)
+		}
+	})
+
+	t.Run("sniffed", func(t *testing.T) {
+		s3Client = &fakeS3{objects: map[string][]byte{"w.qns": []byte("header1|header2|header3\na|b|\nc|d|e")}}
+		out, err := parseRecord(context.Background(), newRecord("w.qns", 10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.Route != "qns-wide" || !strings.HasPrefix(out.Profile, "/crm/file-profiles/test/wide:") || len(out.Rows) != 1 || out.BadRows != 1 {
+			t.Fatalf("unexpected output %+v", out)
+		}
+	})
+
+	t.Run("default", func(t *testing.T) {
+		s3Client = &fakeS3{objects: map[string][]byte{"n.qns": []byte("header1|header2\na|b")}}
+		out, err := parseRecord(context.Background(), newRecord("n.qns", 10))
+		if err != nil || out.Route != "qns" || len(out.Rows) != 1 {
+			t.Fatalf("unexpected output %+v %v", out, err)
+		}
+	})
+}
+
+func TestHandlerPreProcessors(t *testing.T) {
+	log = zap.NewNop().Sugar()
+	buildPlugin(t, "csv_pipe", pluginSrc)
+	useProfile(t, "csv_pipe", "header1")
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, _ = io.WriteString(zw, "Col 1|header2\r\nv1|v2\r\n|v3\r\n")
+	_ = zw.Close()
+	s3Client = &fakeS3{objects: map[string][]byte{"f.qns.gz": buf.Bytes()}}
+	out, err := parseRecord(context.Background(), newRecord("f.qns.gz", 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Route != "qns-gz" || len(out.Rows) != 1 || out.Rows[0]["header1"] != "v1" || out.BadRows != 1 {
+		t.Fatalf("unexpected output %+v", out)
+	}
+
+	s3Client = &fakeS3{objects: map[string][]byte{"p.qns.gz": []byte("not gzip")}}
+	if _, err := parseRecord(context.Background(), newRecord("p.qns.gz", 10)); err == nil || !strings.Contains(err.Error(), "gunzip") {
+		t.Fatalf("expected gunzip error, got %v", err)
+	}
+}
+
+func TestHandlerEnrichments(t *testing.T) {
+	log = zap.NewNop().Sugar()
+	buildPlugin(t, "csv_pipe", pluginSrc)
+	useProfile(t, "csv_pipe", "header1")
+
+	s3Client = &fakeS3{objects: map[string][]byte{
+		"f.enr":          []byte("header1|header2\nA|x\nB|y\n|z"),
+		"ref/codes.json": []byte(`{"A": "Alpha"}`),
+	}}
+	out, err := parseRecord(context.Background(), newRecord("f.enr", 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Rows) != 1 || out.BadRows != 2 || out.Rows[0]["Code"] != "Alpha" || out.Rows[0]["Feed"] != "qns" {
+		t.Fatalf("unexpected output %+v", out)
+	}
+
+	s3Client = &fakeS3{objects: map[string][]byte{"f.enr": []byte("header1|header2\nA|x")}}
+	if _, err := parseRecord(context.Background(), newRecord("f.enr", 10)); err == nil || !strings.Contains(err.Error(), "ref/codes.json") {
+		t.Fatalf("expected missing reference data error, got %v", err)
 	}
 }
 
@@ -232,61 +444,329 @@ func TestLoadParserLookup(t *testing.T) {
 	}
 }
 
-func TestLoadProfileError(t *testing.T) {
-	t.Setenv("PROFILE_JSON", "bad")
-	if _, err := loadProfile(); err == nil {
-		t.Fatal("expected error")
+func TestHandlerFileValidation(t *testing.T) {
+	log = zap.NewNop().Sugar()
+	buildPlugin(t, "csv_pipe", pluginSrc)
+	useProfile(t, "csv_pipe", "header1")
+
+	s3Client = &fakeS3{objects: map[string][]byte{"ok.ctl": []byte("header1|Amount\nA|1.10\n|2\nC|3\nTRL|3|6.10\n")}}
+	out, err := parseRecord(context.Background(), newRecord("ok.ctl", 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Route != "qns-strict" || len(out.Rows) != 2 || out.BadRows != 1 {
+		t.Fatalf("unexpected output %+v", out)
+	}
+
+	for name, tc := range map[string]struct{ body, code string }{
+		"header only":   {"header1|Amount\nTRL|0|0", filecheck.CodeNoRows},
+		"no trailer":    {"header1|Amount\nA|1\n", filecheck.CodeNoTrailer},
+		"count":         {"header1|Amount\nA|1\nB|1\nTRL|1|2", filecheck.CodeTrailerCount},
+		"total":         {"header1|Amount\nA|1\nB|1\nTRL|2|3.5", filecheck.CodeTrailerTotal},
+		"extra column":  {"header1|Amount|Extra\nA|1|x\nTRL|1|1", filecheck.CodeHeaderMismatch},
+		"missing":       {"header1\nA\nTRL|1|0", filecheck.CodeMissingColumn},
+		"bad rows":      {"header1|Amount\n|1\n|1\nC|1\nD|1\nE|1\nTRL|5|5", filecheck.CodeBadRows},
+		"bad row share": {"header1|Amount\n|1\nB|1\nTRL|2|2", filecheck.CodeBadRowPercent},
+	} {
+		s3Client = &fakeS3{objects: map[string][]byte{"f.ctl": []byte(tc.body)}}
+		out, err := parseRecord(context.Background(), newRecord("f.ctl", 10))
+		var fe *filecheck.FileValidationError
+		if !errors.As(err, &fe) || fe.Code != tc.code || fe.Key != "f.ctl" {
+			t.Errorf("%s: expected %s, got %v %+v", name, tc.code, err, out)
+		}
+		if len(out.Rows) != 0 {
+			t.Errorf("%s: rejected file returned rows", name)
+		}
 	}
 }
 
-func TestLoadProfileDefault(t *testing.T) {
-	t.Setenv("PROFILE_JSON", "")
-	p, err := loadProfile()
-	if err != nil || len(p.Required) != 0 {
-		t.Fatalf("unexpected: %+v %v", p, err)
+func TestCheckRows(t *testing.T) {
+	val, err := rowcheck.Compile(profile.RowValidation{Required: []string{"a", "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := []map[string]string{{"a": "1", "b": ""}, {"a": "2", "b": "x"}}
+	out, rejects, err := checkRows(context.Background(), "f.qns", rows, val, nil)
+	if err != nil || len(out) != 1 || len(rejects) != 1 {
+		t.Fatalf("unexpected: %v %v %v", out, rejects, err)
+	}
+	if r := rejects[0]; r.Row != 1 || r.ExternalRowID != "f.qns#1" || r.ErrorCode != rowcheck.CodeRequired || r.Field != "b" {
+		t.Fatalf("unexpected reject %+v", r)
 	}
 }
 
-func TestValidateHeaderNoRows(t *testing.T) {
-	if err := validateHeader(nil, []string{"a"}); err == nil {
-		t.Fatal("expected error")
+func TestHandlerRowRules(t *testing.T) {
+	log = zap.NewNop().Sugar()
+	buildPlugin(t, "csv_pipe", pluginSrc)
+	useProfile(t, "csv_pipe", "header1")
+
+	s3Client = &fakeS3{objects: map[string][]byte{"r.rul": []byte("header1|Stage|Premium\nA|Bound|10\nB|Bound|\nA|Quoted|\nC|Lost|\nD|Quoted|-1")}}
+	out, err := parseRecord(context.Background(), newRecord("r.rul", 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{"PREMIUM_IF_BOUND": 1, "DUPLICATE_ID": 1, "BAD_STAGE": 1, "PREMIUM_RANGE": 1}
+	if len(out.Rows) != 1 || out.BadRows != 4 || fmt.Sprint(out.RejectCodes) != fmt.Sprint(want) {
+		t.Fatalf("unexpected output %+v", out)
+	}
+	if out.Rejects == nil || out.Rejects.Bucket != "b" || out.Rejects.Key != "r_rejects.jsonl" {
+		t.Fatalf("unexpected rejects ref %+v", out.Rejects)
+	}
+	lines := strings.Split(strings.TrimSpace(string(s3Client.(*fakeS3).puts["r_rejects.jsonl"])), "\n")
+	var first map[string]any
+	if len(lines) != 4 || json.Unmarshal([]byte(lines[0]), &first) != nil {
+		t.Fatalf("unexpected rejects file %q", lines)
+	}
+	if first["row"] != float64(2) || first["errorCode"] != "PREMIUM_IF_BOUND" || first["field"] != "Premium" || first["externalRowId"] != "r.rul#2" || first["fileKey"] != "r.rul" {
+		t.Fatalf("unexpected reject %v", first)
 	}
 }
 
-func TestFilterRows(t *testing.T) {
-	rows := []map[string]string{{"a": "1", "b": ""}, {"a": "2", "b": "x"}}
-	out, bad := filterRows(rows, []string{"a", "b"})
-	if len(out) != 1 || bad != 1 {
-		t.Fatalf("unexpected: %v %d", out, bad)
+func TestHandlerColumnAliases(t *testing.T) {
+	log = zap.NewNop().Sugar()
+	buildPlugin(t, "csv_pipe", pluginSrc)
+	useProfile(t, "csv_pipe", "header1")
+
+	s3Client = &fakeS3{objects: map[string][]byte{"a.hdr": []byte("HEADER_1|premium amount|Notes|Header 1\nA|10|x|B")}}
+	out, err := parseRecord(context.Background(), newRecord("a.hdr", 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Rows) != 1 || out.Rows[0]["header1"] != "A" || out.Rows[0]["Amount"] != "10" {
+		t.Fatalf("unexpected rows %v", out.Rows)
+	}
+	want := []header.Warning{
+		{Code: header.CodeDuplicateColumn, Column: "Header 1"},
+		{Code: header.CodeUnknownColumn, Column: "Notes"},
+	}
+	if len(out.Warnings) != len(want) {
+		t.Fatalf("unexpected warnings %+v", out.Warnings)
+	}
+	for i, w := range want {
+		if out.Warnings[i].Code != w.Code || out.Warnings[i].Column != w.Column {
+			t.Errorf("warning %d = %+v, want %s on %s", i, out.Warnings[i], w.Code, w.Column)
+		}
+	}
+
+	s3Client = &fakeS3{objects: map[string][]byte{"m.hdr": []byte("header1|Total\nA|10")}}
+	_, err = parseRecord(context.Background(), newRecord("m.hdr", 10))
+	var fe *filecheck.FileValidationError
+	if !errors.As(err, &fe) || fe.Code != filecheck.CodeMissingColumn {
+		t.Fatalf("expected missing Amount, got %v", err)
+	}
+}
+
+func TestHandlerBatch(t *testing.T) {
+	log = zap.NewNop().Sugar()
+	buildPlugin(t, "csv_pipe", pluginSrc)
+	useProfile(t, "csv_pipe", "header1")
+	s3Client = &fakeS3{objects: map[string][]byte{
+		"a.qns": []byte("header1\nA"),
+		"c.qns": []byte("header1\nC\nD"),
+		"x.txt": []byte("header1\nX"),
+		"y.txt": []byte("header1\nY"),
+	}}
+	s3Event := func(keys ...string) events.S3Event {
+		evt := events.S3Event{}
+		for _, k := range keys {
+			evt.Records = append(evt.Records, newRecord(k, 10))
+		}
+		return evt
+	}
+
+	resp, err := handler(context.Background(), batch.FromS3(s3Event("a.qns", "c.qns")))
+	if err != nil || len(resp.Records) != 2 {
+		t.Fatalf("resp %+v err %v", resp, err)
+	}
+	if out := resp.Records[1].Output.(Output); resp.Records[1].Key != "c.qns" || out.RowCount != 2 {
+		t.Fatalf("unexpected output %+v", resp.Records[1])
+	}
+
+	_, err = handler(context.Background(), batch.FromS3(s3Event("x.txt")))
+	if _, ok := err.(*route.NoRouteError); !ok {
+		t.Fatalf("single record error should stay typed, got %T %v", err, err)
+	}
+	resp, err = handler(context.Background(), batch.FromS3(s3Event("a.qns", "x.txt")))
+	if err != nil || resp.Records[0].Status != batch.StatusOK || resp.Records[1].ErrorType != "NoRouteError" {
+		t.Fatalf("expected the unrouted file to fail alone, got %+v %v", resp, err)
+	}
+	_, err = handler(context.Background(), batch.FromS3(s3Event("x.txt", "y.txt")))
+	if nr, ok := err.(*route.NoRouteError); !ok || !strings.Contains(nr.Error(), "x.txt") {
+		t.Fatalf("an event of unrouted files should fail with NoRouteError, got %T %v", err, err)
+	}
+
+	ok, _ := json.Marshal(s3Event("a.qns"))
+	bad, _ := json.Marshal(s3Event("x.txt"))
+	in := fmt.Sprintf(`{"Records":[{"messageId":"m1","eventSource":"aws:sqs","body":%q},{"messageId":"m2","eventSource":"aws:sqs","body":%q}]}`, ok, bad)
+	var evt batch.Event
+	if err := json.Unmarshal([]byte(in), &evt); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = handler(context.Background(), evt)
+	if err != nil || len(resp.BatchItemFailures) != 1 || resp.BatchItemFailures[0].ItemIdentifier != "m2" {
+		t.Fatalf("expected m2 to be retried, got %+v %v", resp, err)
+	}
+
+	if _, err := handler(context.Background(), batch.Event{}); !errors.Is(err, batch.ErrNoRecords) {
+		t.Fatalf("expected ErrNoRecords, got %v", err)
+	}
+}
+
+func TestWriteChunks(t *testing.T) {
+	log = zap.NewNop().Sugar()
+	rows := make([]map[string]string, 25)
+	for i := range rows {
+		rows[i] = map[string]string{"Id": fmt.Sprint(i), "Name": strings.Repeat("n", 90)}
+	}
+	src := S3Ref{Bucket: "in", Key: "flood/dev/q.csv"}
+	for _, tc := range []struct {
+		cfg    profile.Output
+		chunks []int
+		key    string
+	}{
+		{profile.Output{}, []int{25}, "flood/dev/q_0.jsonl"},
+		{profile.Output{ChunkRows: 10}, []int{10, 10, 5}, "flood/dev/q_0.jsonl"},
+		{profile.Output{ChunkBytes: 1024, Format: "jsonl.gz"}, []int{10, 10, 5}, "flood/dev/q_0.jsonl.gz"},
+		{profile.Output{ChunkRows: 20, Format: "csv", Bucket: "out", Prefix: "processed/"}, []int{20, 5}, "processed/flood/dev/q_0.csv"},
+		{profile.Output{Format: "parquet"}, []int{25}, "flood/dev/q_0.parquet"},
+	} {
+		f := &fakeS3{}
+		s3Client = f
+		m, ref, err := writeChunks(context.Background(), src, Output{Route: "r", Profile: "p:1"}, rows, tc.cfg)
+		if err != nil {
+			t.Fatalf("%+v: %v", tc.cfg, err)
+		}
+		var got []int
+		for _, c := range m.Chunks {
+			got = append(got, c.Rows)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.chunks) || m.Chunks[0].Key != tc.key {
+			t.Fatalf("%+v: chunks %+v", tc.cfg, m.Chunks)
+		}
+		want := "in"
+		if tc.cfg.Bucket != "" {
+			want = tc.cfg.Bucket
+		}
+		if ref.Bucket != want || f.buckets[tc.key] != want || f.buckets[ref.Key] != want || ref.Key != strings.TrimSuffix(tc.key, "_0."+m.Format)+"_manifest.json" {
+			t.Fatalf("%+v: manifest at %+v, chunk bucket %q", tc.cfg, ref, f.buckets[tc.key])
+		}
+		if len(f.puts) != len(tc.chunks)+2 {
+			t.Fatalf("%+v: %d puts", tc.cfg, len(f.puts))
+		}
+	}
+
+	s3Client = &fakeS3{putErr: fmt.Errorf("boom")}
+	if _, _, err := writeChunks(context.Background(), src, Output{}, rows, profile.Output{}); err == nil {
+		t.Fatal("expected put error")
+	}
+}
+
+func TestInline(t *testing.T) {
+	rows := []map[string]string{{"Id": "1"}, {"Id": "2"}}
+	b, _ := json.Marshal(rows)
+	for _, tc := range []struct {
+		limit int
+		want  bool
+	}{{0, false}, {len(b) - 1, false}, {len(b), true}} {
+		if got := inline(rows, profile.Output{InlineMaxBytes: tc.limit}); got != tc.want {
+			t.Errorf("inlineMaxBytes %d: got %v", tc.limit, got)
+		}
+	}
+}
+
+func TestWriteChunksParallel(t *testing.T) {
+	log = zap.NewNop().Sugar()
+	defer func(n int) { uploadWorkers = n }(uploadWorkers)
+	uploadWorkers = 4
+	rows := make([]map[string]string, 95)
+	for i := range rows {
+		rows[i] = map[string]string{"Id": fmt.Sprint(i)}
+	}
+	src := S3Ref{Bucket: "in", Key: "q.csv"}
+	cfg := profile.Output{ChunkRows: 10}
+
+	f := &fakeS3{}
+	s3Client = f
+	m, _, err := writeChunks(context.Background(), src, Output{}, rows, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range m.Chunks {
+		if c.Key != fmt.Sprintf("q_%d.jsonl", i) {
+			t.Fatalf("chunk %d is %s", i, c.Key)
+		}
+		first := jsonLines(t, f.puts[c.Key])[0]["Id"]
+		if first != fmt.Sprint(i*10) {
+			t.Fatalf("chunk %d starts with row %s", i, first)
+		}
+	}
+
+	f = &fakeS3{failKey: "q_3.jsonl"}
+	s3Client = f
+	if _, _, err := writeChunks(context.Background(), src, Output{}, rows, cfg); err == nil || !strings.Contains(err.Error(), "q_3.jsonl") {
+		t.Fatalf("expected failure of q_3.jsonl, got %v", err)
+	}
+	if len(f.puts) != 0 {
+		t.Fatalf("partial chunks left behind: %v", f.puts)
+	}
+	if _, ok := f.puts["q_manifest.json"]; ok || len(f.deletes) == 0 || len(f.deletes) > 10 {
+		t.Fatalf("deletes %v", f.deletes)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	f = &fakeS3{}
+	s3Client = f
+	if _, _, err := writeChunks(ctx, src, Output{}, rows, cfg); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancellation, got %v", err)
+	}
+	if _, ok := f.puts["q_manifest.json"]; ok {
+		t.Fatal("manifest written for a cancelled upload")
 	}
 }
 
+// jsonLines decodes a JSONL chunk.
+func jsonLines(t *testing.T, b []byte) []map[string]string {
+	t.Helper()
+	var rows []map[string]string
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var r map[string]string
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, r)
+	}
+	return rows
+}
+
 func TestHandlerErrorPaths(t *testing.T) {
 	log = zap.NewNop().Sugar()
 	buildPlugin(t, "csv_pipe", pluginSrc)
-	t.Setenv("PARSER_ID", "csv_pipe")
+	useProfile(t, "csv_pipe", "header1", "header2")
 
 	t.Run("get object", func(t *testing.T) {
 		s3Client = &fakeS3{getErr: fmt.Errorf("boom")}
-		if _, err := handler(context.Background(), newEvent("x", 1)); err == nil {
+		if _, err := parseRecord(context.Background(), newRecord("x", 1)); err == nil {
 			t.Fatal("expected error")
 		}
 	})
 
 	t.Run("load parser", func(t *testing.T) {
 		s3Client = &fakeS3{objects: map[string][]byte{"f.qns": []byte("x")}}
-		t.Setenv("PARSER_ID", "missing")
-		if _, err := handler(context.Background(), newEvent("f.qns", 1)); err == nil {
+		useProfile(t, "fixed_width")
+		if _, err := parseRecord(context.Background(), newRecord("f.qns", 1)); err == nil {
 			t.Fatal("expected error")
 		}
 	})
 
 	t.Run("profile", func(t *testing.T) {
 		s3Client = &fakeS3{objects: map[string][]byte{"f.qns": []byte("header1|header2")}}
-		t.Setenv("PARSER_ID", "csv_pipe")
-		t.Setenv("PROFILE_JSON", "bad")
-		if _, err := handler(context.Background(), newEvent("f.qns", 1)); err == nil {
-			t.Fatal("expected error")
+		useProfile(t, "csv_pipe")
+		profiles = profile.NewFromSource(&profile.FSSource{FS: fstest.MapFS{
+			"crm/file-profiles/test/qns.json": {Data: []byte(`{"rowValidation":{"required":["a"]}}`)},
+		}}, zap.NewNop().Sugar(), profile.Options{})
+		if _, err := parseRecord(context.Background(), newRecord("f.qns", 1)); err == nil || !strings.Contains(err.Error(), "invalid profile") {
+			t.Fatalf("expected invalid profile, got %v", err)
 		}
 	})
 
@@ -297,8 +777,8 @@ func TestHandlerErrorPaths(t *testing.T) {
 			sb.WriteString("a|b\n")
 		}
 		s3Client = &fakeS3{objects: map[string][]byte{"big.qns": []byte(sb.String())}, putErr: fmt.Errorf("p")}
-		t.Setenv("PROFILE_JSON", `{"required":["header1","header2"]}`)
-		if _, err := handler(context.Background(), newEvent("big.qns", 30000000)); err == nil {
+		useProfile(t, "csv_pipe", "header1", "header2")
+		if _, err := parseRecord(context.Background(), newRecord("big.qns", 30000000)); err == nil {
 			t.Fatal("expected error")
 		}
 	})
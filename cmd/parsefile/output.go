@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"github.com/your-org/file-processor-sample/internal/chunk"
+	"github.com/your-org/file-processor-sample/internal/profile"
+)
+
+// Manifest lists the chunks written for one file and the items file a
+// Distributed Map reads them from. It is written last, so a manifest means
+// the chunk set is complete.
+type Manifest struct {
+	Source  S3Ref       `json:"source"`
+	Route   string      `json:"route"`
+	Profile string      `json:"profile"`
+	Format  string      `json:"format"`
+	Bucket  string      `json:"bucket"`
+	Columns []string    `json:"columns,omitempty"`
+	Rows    int         `json:"rows"`
+	Items   S3Ref       `json:"items"`
+	Chunks  []ChunkInfo `json:"chunks"`
+}
+
+// ChunkInfo describes one chunk object. The items file is a JSON array of
+// them, so each Distributed Map item locates its own chunk.
+type ChunkInfo struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Format string `json:"format"`
+	Rows   int    `json:"rows"`
+	Bytes  int    `json:"bytes"`
+	SHA256 string `json:"sha256"`
+}
+
+// inline reports whether rows are returned in the output instead of as
+// chunks: only when the profile sets inlineMaxBytes and their estimated
+// JSON size is within it. The schema keeps inlineMaxBytes well below the
+// 256 KiB Step Functions payload limit.
+func inline(rows []map[string]string, cfg profile.Output) bool {
+	limit := cfg.InlineMaxBytes
+	if limit <= 0 {
+		return false
+	}
+	// RowSize counts a line break per row, which stands in for the commas
+	// and closing bracket of the array.
+	size := 1
+	for _, r := range rows {
+		size += chunk.RowSize(r)
+	}
+	return size <= limit
+}
+
+// chunkBase returns the key chunks of key are named after: the source key
+// without its extension, under the output prefix when one is set.
+func chunkBase(key string, cfg profile.Output) string {
+	return cfg.Prefix + strings.TrimSuffix(key, filepath.Ext(key))
+}
+
+// uploadWorkers bounds the chunks of one file that are encoded and
+// uploaded at the same time; UPLOAD_WORKERS overrides it.
+var uploadWorkers = 8
+
+// splitChunks cuts rows into chunks of at most cfg.ChunkRows rows, closing
+// a chunk early once its estimated size reaches cfg.ChunkBytes.
+func splitChunks(rows []map[string]string, cfg profile.Output) [][]map[string]string {
+	limit := cfg.ChunkRows
+	if limit <= 0 {
+		limit = chunk.DefaultRows
+	}
+	var parts [][]map[string]string
+	start, size := 0, 0
+	for i, r := range rows {
+		size += chunk.RowSize(r)
+		if i+1-start >= limit || cfg.ChunkBytes > 0 && size >= cfg.ChunkBytes {
+			parts = append(parts, rows[start:i+1])
+			start, size = i+1, 0
+		}
+	}
+	if start < len(rows) {
+		parts = append(parts, rows[start:])
+	}
+	return parts
+}
+
+// writeChunks encodes and uploads the chunks of rows with up to
+// uploadWorkers workers, then writes the items file and the manifest, and
+// returns the manifest and its location. The first failure cancels the
+// remaining uploads and the objects already written are deleted.
+func writeChunks(ctx context.Context, src S3Ref, out Output, rows []map[string]string, cfg profile.Output) (*Manifest, *S3Ref, error) {
+	m := &Manifest{Source: src, Route: out.Route, Profile: out.Profile, Format: chunk.Ext(cfg.Format), Bucket: cfg.Bucket, Rows: len(rows)}
+	if m.Bucket == "" {
+		m.Bucket = src.Bucket
+	}
+	if m.Format == chunk.CSV || m.Format == chunk.Parquet {
+		m.Columns = chunk.Columns(rows)
+	}
+	base := chunkBase(src.Key, cfg)
+	parts := splitChunks(rows, cfg)
+	m.Chunks = make([]ChunkInfo, len(parts))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		mu       sync.Mutex
+		firstErr error
+		started  []string
+	)
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(uploadWorkers, len(parts)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				key := fmt.Sprintf("%s_%d.%s", base, i, m.Format)
+				data, err := encodeChunk(m.Format, m.Columns, parts[i])
+				if err != nil {
+					fail(fmt.Errorf("encode chunk %d: %w", i, err))
+					continue
+				}
+				mu.Lock()
+				if ctx.Err() != nil {
+					mu.Unlock()
+					continue
+				}
+				started = append(started, key)
+				mu.Unlock()
+				if err := putObject(ctx, m.Bucket, key, chunk.ContentType(m.Format), data); err != nil {
+					fail(fmt.Errorf("put chunk %s: %w", key, err))
+					continue
+				}
+				m.Chunks[i] = ChunkInfo{Bucket: m.Bucket, Key: key, Format: m.Format, Rows: len(parts[i]), Bytes: len(data), SHA256: checksum(data)}
+			}
+		}()
+	}
+feed:
+	for i := range parts {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if firstErr == nil && ctx.Err() != nil {
+		firstErr = ctx.Err()
+	}
+	if firstErr != nil {
+		removeChunks(ctx, m.Bucket, started)
+		return nil, nil, firstErr
+	}
+
+	items, err := json.Marshal(m.Chunks)
+	if err != nil {
+		removeChunks(ctx, m.Bucket, started)
+		return nil, nil, fmt.Errorf("encode items: %w", err)
+	}
+	m.Items = S3Ref{Bucket: m.Bucket, Key: base + "_items.json", SHA256: checksum(items)}
+	started = append(started, m.Items.Key)
+	if err := putObject(ctx, m.Bucket, m.Items.Key, "application/json", items); err != nil {
+		removeChunks(ctx, m.Bucket, started)
+		return nil, nil, fmt.Errorf("put items: %w", err)
+	}
+	body, err := json.Marshal(m)
+	if err != nil {
+		removeChunks(ctx, m.Bucket, started)
+		return nil, nil, fmt.Errorf("encode manifest: %w", err)
+	}
+	ref := &S3Ref{Bucket: m.Bucket, Key: base + "_manifest.json", SHA256: checksum(body)}
+	if err := putObject(ctx, ref.Bucket, ref.Key, "application/json", body); err != nil {
+		removeChunks(ctx, m.Bucket, started)
+		return nil, nil, fmt.Errorf("put manifest: %w", err)
+	}
+	return m, ref, nil
+}
+
+// checksum returns the hex SHA-256 of data.
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// encodeChunk encodes rows as one chunk in format.
+func encodeChunk(format string, columns []string, rows []map[string]string) ([]byte, error) {
+	enc, err := chunk.New(format, columns)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		if err := enc.Write(r); err != nil {
+			return nil, err
+		}
+	}
+	return enc.Close()
+}
+
+// removeChunks deletes the objects of a file that failed part way, even
+// when ctx is cancelled. Failures are logged.
+func removeChunks(ctx context.Context, bucket string, keys []string) {
+	ctx = context.WithoutCancel(ctx)
+	for _, key := range keys {
+		if _, err := s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: &bucket, Key: &key}); err != nil {
+			log.Warnw("remove partial chunk", "bucket", bucket, "key", key, "error", err)
+		}
+	}
+	if len(keys) > 0 {
+		log.Infow("removed partial chunks", "bucket", bucket, "chunks", len(keys))
+	}
+}
+
+// putObject uploads data to bucket/key.
+func putObject(ctx context.Context, bucket, key, contentType string, data []byte) error {
+	_, err := s3Client.PutObject(ctx, &s3.PutObjectInput{Bucket: &bucket, Key: &key, ContentType: &contentType, Body: bytes.NewReader(data)})
+	return err
+}
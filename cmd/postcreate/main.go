@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"go.uber.org/zap"
+
+	"github.com/your-org/file-processor-sample/internal/circuit"
+	"github.com/your-org/file-processor-sample/internal/httpclient"
+	"github.com/your-org/file-processor-sample/internal/importerror"
+	"github.com/your-org/file-processor-sample/internal/postcreate"
+	"github.com/your-org/file-processor-sample/internal/profile"
+	"github.com/your-org/file-processor-sample/internal/sfclient"
+	"github.com/your-org/file-processor-sample/internal/sflimits"
+)
+
+// profileLoader returns the effective profile for a name.
+type profileLoader interface {
+	Load(ctx context.Context, name string) (*profile.Result, error)
+}
+
+var (
+	brokerURL        = os.Getenv("BROKER_URL")
+	brokerID         = os.Getenv("BROKER_CALLER_ID")
+	brokerKey        = os.Getenv("BROKER_HMAC_SECRET")
+	sfAPI            = os.Getenv("SF_API")
+	deadLetterBucket = os.Getenv("DEAD_LETTER_BUCKET")
+	deadLetterPrefix = envOr("DEAD_LETTER_PREFIX", "import-errors/dead-letter/")
+	log              *zap.SugaredLogger
+	sleep            = time.Sleep
+	now              = time.Now
+	lambdaStart      = lambda.Start
+	loadConfig       = config.LoadDefaultConfig
+	httpClient       = http.DefaultClient
+	sfBreaker        *circuit.Breaker
+	sfLimits         *sflimits.Monitor
+	s3Client         importerror.PutObjectAPI
+	profiles         profileLoader
+	newClient        = func() postcreate.Client { return &sfclient.Session{Client: sfClient()} }
+)
+
+// envOr returns the environment variable key or def when unset.
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// sfClient returns the Salesforce client configured by the package
+// variables. Only 5xx and 429 answers are retried.
+func sfClient() *sfclient.Client {
+	return &sfclient.Client{
+		BrokerURL: brokerURL, BrokerID: brokerID, BrokerKey: brokerKey,
+		API: sfAPI, HTTP: httpClient, Breaker: sfBreaker, Limits: sfLimits,
+		Sleep: sleep,
+	}
+}
+
+// errorCode is the Error_Code__c of failed rules.
+const errorCode = "POST_CREATE_RULE"
+
+// Event is sent by the row state machine after it created or updated one
+// target record of a row.
+type Event struct {
+	Profile       string            `json:"profile"`
+	Object        string            `json:"object"`
+	ID            string            `json:"id"`
+	Created       bool              `json:"created"`
+	Row           map[string]string `json:"row"`
+	IDs           map[string]string `json:"ids,omitempty"`
+	ExternalRowID string            `json:"externalRowId"`
+	FileKey       string            `json:"fileKey,omitempty"`
+	LineNumber    int               `json:"lineNumber,omitempty"`
+}
+
+// Output reports the rules run for the record and the import error events
+// of the failed ones. Logged events were written as Import_Error__c,
+// spooled ones are left for LogImportError to replay.
+type Output struct {
+	Ran     int                 `json:"ran"`
+	Failed  int                 `json:"failed"`
+	Logged  int                 `json:"logged"`
+	Spooled int                 `json:"spooled"`
+	IDs     map[string]string   `json:"ids"`
+	Events  []importerror.Event `json:"events"`
+}
+
+// handler runs the postCreateRules of the event's target. Rule failures do
+// not fail the invocation; they are logged as import errors tied to the
+// row. Bad input, profile errors and import errors that could be neither
+// logged nor spooled are returned as errors.
+func handler(ctx context.Context, evt Event) (Output, error) {
+	if evt.Profile == "" || evt.Object == "" || evt.ID == "" || evt.ExternalRowID == "" {
+		return Output{}, errors.New("profile, object, id and externalRowId are required")
+	}
+	res, err := profiles.Load(ctx, evt.Profile)
+	if err != nil {
+		return Output{}, fmt.Errorf("load profile: %w", err)
+	}
+	var target *profile.Target
+	for i := range res.Profile.Targets {
+		if res.Profile.Targets[i].Object == evt.Object {
+			target = &res.Profile.Targets[i]
+		}
+	}
+	if target == nil {
+		return Output{}, fmt.Errorf("profile %s has no target %s", res.Ref(), evt.Object)
+	}
+	engine, err := postcreate.Build(*target)
+	if err != nil {
+		return Output{}, fmt.Errorf("profile %s: target %s: %w", res.Ref(), evt.Object, err)
+	}
+
+	rec := &postcreate.Record{Object: evt.Object, ID: evt.ID, Created: evt.Created, Row: evt.Row, IDs: map[string]string{}}
+	for k, v := range evt.IDs {
+		rec.IDs[k] = v
+	}
+	out := Output{Events: []importerror.Event{}}
+	if engine.Len() > 0 {
+		var failed []postcreate.Failure
+		out.Ran, failed = engine.Run(ctx, newClient(), rec)
+		for _, f := range failed {
+			log.Warnw("post create rule failed", "row", evt.ExternalRowID, "object", evt.Object, "rule", f.Index, "error", f.Err)
+			out.Events = append(out.Events, importerror.Event{
+				ExternalRowID: evt.ExternalRowID,
+				Message:       f.Error(),
+				FileKey:       evt.FileKey,
+				LineNumber:    evt.LineNumber,
+				ErrorCode:     errorCode,
+				TargetObject:  evt.Object,
+			})
+		}
+		out.Failed = len(failed)
+	}
+	out.IDs = rec.IDs
+	log.Infow("post create rules", "row", evt.ExternalRowID, "object", evt.Object, "profile", res.Ref(), "ran", out.Ran, "failed", out.Failed)
+	if len(out.Events) > 0 {
+		if err := logErrors(ctx, &out); err != nil {
+			return out, err
+		}
+	}
+	return out, nil
+}
+
+// logErrors delivers the rule failures through the LogImportError batch
+// path. An open circuit without a spool is returned unwrapped as
+// CircuitOpenError.
+func logErrors(ctx context.Context, out *Output) error {
+	l := &importerror.Logger{SF: sfClient(), S3: s3Client, Bucket: deadLetterBucket, Prefix: deadLetterPrefix, Now: now, Log: log}
+	res, err := l.Batch(ctx, out.Events)
+	if err != nil {
+		if oe := sfclient.CircuitOpen(err); oe != nil {
+			return oe
+		}
+		return fmt.Errorf("log rule errors: %w", err)
+	}
+	out.Logged, out.Spooled = res.Succeeded, res.Spooled
+	if lost := res.Failed - res.Spooled; lost > 0 {
+		return fmt.Errorf("log rule errors: %d of %d not delivered", lost, res.Total)
+	}
+	return nil
+}
+
+// realMain configures logging and AWS clients and starts the Lambda entrypoint.
+func realMain(start func(interface{})) {
+	logger, _ := zap.NewProduction()
+	log = logger.Sugar()
+	cfg, err := loadConfig(context.Background())
+	if err != nil {
+		panic(err)
+	}
+	if httpClient, err = httpclient.New(httpclient.FromEnv(log)); err != nil {
+		panic(err)
+	}
+	db := dynamodb.NewFromConfig(cfg)
+	sfBreaker = circuit.FromEnv(db, log)
+	sfLimits = sflimits.FromEnv(db, cloudwatch.NewFromConfig(cfg), log)
+	s3c := s3.NewFromConfig(cfg)
+	s3Client = s3c
+	src, err := profile.SourceFromEnv(ssm.NewFromConfig(cfg), s3c)
+	if err != nil {
+		panic(err)
+	}
+	profiles = profile.NewFromSource(src, log, profile.Options{})
+	start(handler)
+}
+
+// main is the Lambda entrypoint.
+func main() {
+	realMain(lambdaStart)
+}
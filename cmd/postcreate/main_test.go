@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/your-org/file-processor-sample/internal/profile"
+)
+
+const testProfile = `{
+	"parserId": "csv_pipe",
+	"maxBytes": 1000,
+	"maxRows": 10,
+	"rowStateMachineArn": "arn:aws:states:us-east-1:123456789012:stateMachine:Rows",
+	"mapMaxConcurrency": 1,
+	"targets": [
+		{"object": "Account", "externalId": "Member_Number__c", "fieldMap": {"MemberNumber": "Member_Number__c"}},
+		{"object": "Contact", "externalId": "Member_Number__c", "fieldMap": {"MemberNumber": "Member_Number__c"},
+		 "postCreateRules": [
+			{"type": "createTask", "on": "created", "subject": "Welcome @{FirstName}"},
+			{"type": "campaignMemberStatus", "campaignId": "@{Campaign}", "status": "Responded", "when": {"Campaign": "."}},
+			{"type": "upsert", "object": "Quote__c", "externalId": "Quote_Number__c",
+			 "fieldMap": {"QuoteNumber": "Quote_Number__c"}, "link": {"Account__c": "@{Account.id}", "Contact__c": "@{Contact.id}"}}
+		 ]}
+	]
+}`
+
+type sfRequestLog struct {
+	mu   sync.Mutex
+	reqs []string
+}
+
+func (l *sfRequestLog) add(s string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.reqs = append(l.reqs, s)
+}
+
+// setup starts a broker and a Salesforce stub answering with sf and loads
+// profiles from memory.
+func setup(t *testing.T, sf http.HandlerFunc) *sfRequestLog {
+	t.Helper()
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"token":"tok"}`)
+	}))
+	t.Cleanup(broker.Close)
+	reqs := &sfRequestLog{}
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer tok" {
+			t.Errorf("bad token")
+		}
+		b, _ := io.ReadAll(r.Body)
+		reqs.add(r.Method + " " + r.URL.RequestURI() + " " + string(b))
+		if strings.HasPrefix(r.URL.Path, "/composite/") {
+			collection(w, b)
+			return
+		}
+		sf(w, r)
+	}))
+	t.Cleanup(api.Close)
+	brokerURL, sfAPI = broker.URL, api.URL
+	log = zap.NewNop().Sugar()
+	sleep = func(time.Duration) {}
+	mem := fstest.MapFS{"crm/file-profiles/dev/contacts.json": {Data: []byte(testProfile)}}
+	profiles = profile.NewFromSource(&profile.FSSource{FS: mem}, log, profile.Options{})
+	return reqs
+}
+
+// collection answers an sObject Collections request with a success for
+// every record.
+func collection(w http.ResponseWriter, body []byte) {
+	var in struct {
+		Records []map[string]any `json:"records"`
+	}
+	_ = json.Unmarshal(body, &in)
+	out := make([]map[string]any, len(in.Records))
+	for i := range out {
+		out[i] = map[string]any{"id": "a0E" + strconv.Itoa(i), "success": true, "created": true}
+	}
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+func event() Event {
+	return Event{
+		Profile:       "/crm/file-profiles/dev/contacts",
+		Object:        "Contact",
+		ID:            "003A",
+		Created:       true,
+		Row:           map[string]string{"FirstName": "Ann", "Campaign": "701A", "QuoteNumber": "Q1"},
+		IDs:           map[string]string{"Account": "001A"},
+		ExternalRowID: "row-7",
+		FileKey:       "contacts/dev/f.csv",
+		LineNumber:    7,
+	}
+}
+
+func TestHandler(t *testing.T) {
+	reqs := setup(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/sobjects/Task":
+			w.WriteHeader(http.StatusCreated)
+			_, _ = io.WriteString(w, `{"id":"00T1","success":true}`)
+		case r.Method == http.MethodGet && r.URL.Path == "/query":
+			_, _ = io.WriteString(w, `{"done":true,"records":[]}`)
+		case r.Method == http.MethodPost && r.URL.Path == "/sobjects/CampaignMember":
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = io.WriteString(w, `[{"errorCode":"INVALID_CROSS_REFERENCE_KEY","message":"bad campaign"}]`)
+		case r.Method == http.MethodPatch && r.URL.Path == "/sobjects/Quote__c/Quote_Number__c/Q1":
+			w.WriteHeader(http.StatusCreated)
+			_, _ = io.WriteString(w, `{"id":"a01Q","success":true,"created":true}`)
+		default:
+			t.Errorf("unexpected %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	out, err := handler(context.Background(), event())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Ran != 3 || out.Failed != 1 || out.Logged != 1 || len(out.Events) != 1 {
+		t.Fatalf("unexpected output %+v", out)
+	}
+	ev := out.Events[0]
+	if ev.ExternalRowID != "row-7" || ev.ErrorCode != errorCode || ev.TargetObject != "Contact" || ev.LineNumber != 7 || !strings.Contains(ev.Message, "INVALID_CROSS_REFERENCE_KEY: bad campaign") {
+		t.Fatalf("unexpected event %+v", ev)
+	}
+	if out.IDs["Quote__c"] != "a01Q" || out.IDs["Contact"] != "003A" {
+		t.Fatalf("ids = %v", out.IDs)
+	}
+	var quote, logged string
+	for _, r := range reqs.reqs {
+		switch {
+		case strings.HasPrefix(r, "PATCH /sobjects/Quote__c"):
+			quote = r
+		case strings.HasPrefix(r, "PATCH /composite/sobjects/Import_Error__c/External_Row_Id__c"):
+			logged = r
+		}
+	}
+	var upsert struct {
+		Records []map[string]any `json:"records"`
+	}
+	if i := strings.Index(logged, "{"); i < 0 || json.Unmarshal([]byte(logged[i:]), &upsert) != nil || len(upsert.Records) != 1 {
+		t.Fatalf("failed rule should be upserted as Import_Error__c: %q", logged)
+	}
+	if r := upsert.Records[0]; r["External_Row_Id__c"] != "row-7" || r["Error_Code__c"] != errorCode || r["Target_Object__c"] != "Contact" || r["Line_Number__c"] != float64(7) {
+		t.Fatalf("unexpected Import_Error__c %v", r)
+	}
+	var body map[string]string
+	_ = json.Unmarshal([]byte(quote[strings.Index(quote, "{"):]), &body)
+	if body["Account__c"] != "001A" || body["Contact__c"] != "003A" {
+		t.Fatalf("quote should link both records: %s", quote)
+	}
+}
+
+func TestHandlerUpdatedSkipsCreateRules(t *testing.T) {
+	reqs := setup(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/query":
+			_, _ = io.WriteString(w, `{"done":true,"records":[{"Id":"00vM"}]}`)
+		case "/sobjects/CampaignMember/00vM":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			_, _ = io.WriteString(w, `{"id":"a01Q","created":false}`)
+		}
+	})
+	evt := event()
+	evt.Created = false
+	out, err := handler(context.Background(), evt)
+	if err != nil || out.Ran != 2 || out.Failed != 0 {
+		t.Fatalf("out %+v err %v", out, err)
+	}
+	for _, r := range reqs.reqs {
+		if strings.Contains(r, "/sobjects/Task") {
+			t.Fatal("created-only rule ran for an update")
+		}
+	}
+}
+
+func TestHandlerRetriesServerErrors(t *testing.T) {
+	calls := 0
+	setup(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		_, _ = io.WriteString(w, `{"id":"x"}`)
+	})
+	evt := event()
+	evt.Row = map[string]string{"FirstName": "Ann"}
+	out, err := handler(context.Background(), evt)
+	// the upsert fails without a quote number, the task is retried once
+	if err != nil || out.Ran != 2 || out.Failed != 1 || calls != 2 {
+		t.Fatalf("out %+v err %v calls %d", out, err, calls)
+	}
+}
+
+func TestHandlerErrors(t *testing.T) {
+	setup(t, func(w http.ResponseWriter, r *http.Request) {})
+	for name, mod := range map[string]func(*Event){
+		"missing id":      func(e *Event) { e.ID = "" },
+		"unknown target":  func(e *Event) { e.Object = "Lead" },
+		"unknown profile": func(e *Event) { e.Profile = "/crm/file-profiles/dev/nope" },
+	} {
+		evt := event()
+		mod(&evt)
+		if _, err := handler(context.Background(), evt); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestNoRules(t *testing.T) {
+	setup(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected call %s", r.URL)
+	})
+	evt := event()
+	evt.Object = "Account"
+	out, err := handler(context.Background(), evt)
+	if err != nil || out.Ran != 0 || out.Events == nil {
+		t.Fatalf("out %+v err %v", out, err)
+	}
+}
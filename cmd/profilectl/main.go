@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/your-org/file-processor-sample/internal/profile"
+)
+
+// run prints the effective profile for each feed named in args after
+// resolving extends and overlays and validating the result.
+func run(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("profilectl", flag.ContinueOnError)
+	env := fs.String("env", "dev", "environment directory under -root")
+	dir := fs.String("dir", ".", "repository checkout holding the profiles")
+	root := fs.String("root", "/crm/file-profiles", "profile name prefix")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("usage: profilectl [-env dev] [-dir .] <feed>...")
+	}
+	src := &profile.FSSource{FS: os.DirFS(*dir)}
+	for _, feed := range fs.Args() {
+		name := path.Join(*root, *env, feed)
+		doc, err := profile.Resolve(context.Background(), src, name)
+		if err != nil {
+			return err
+		}
+		if _, err := profile.Parse(doc.Data); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if err := writeSorted(stdout, doc.Data); err != nil {
+			return fmt.Errorf("format %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// writeSorted re-encodes data indented with sorted keys so the output of
+// two environments diffs cleanly.
+func writeSorted(w io.Writer, data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunPrintsEffectiveProfile(t *testing.T) {
+	var dev, prod bytes.Buffer
+	if err := run([]string{"-dir", "../..", "-env", "dev", "flood_qns"}, &dev); err != nil {
+		t.Fatal(err)
+	}
+	if err := run([]string{"-dir", "../..", "-env", "prod", "flood_qns"}, &prod); err != nil {
+		t.Fatal(err)
+	}
+	var p map[string]any
+	if err := json.Unmarshal(dev.Bytes(), &p); err != nil {
+		t.Fatalf("output is not json: %v\n%s", err, dev.String())
+	}
+	if _, ok := p["extends"]; ok || p["parserId"] != "csv_pipe" {
+		t.Fatalf("unexpected effective profile %v", p)
+	}
+	if !strings.Contains(dev.String(), `"AccountId": "@{Account.id}"`) {
+		t.Fatalf("expected unescaped, indented output:\n%s", dev.String())
+	}
+	if dev.String() != prod.String() {
+		t.Fatal("dev and prod flood_qns are expected to match")
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "crm", "file-profiles", "dev")
+	if err := os.MkdirAll(p, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(p, "bad.json"), []byte(`{"parserId": "csv_pipe"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{},
+		{"-dir", dir, "missing"},
+		{"-dir", dir, "bad"},
+	} {
+		if err := run(args, &bytes.Buffer{}); err == nil {
+			t.Errorf("%v: expected error", args)
+		}
+	}
+}
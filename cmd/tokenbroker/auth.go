@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"github.com/your-org/file-processor-sample/internal/brokerauth"
+)
+
+// errUnauthorized is returned when the caller cannot be identified or is not allowed.
+var errUnauthorized = errors.New("unauthorized caller")
+
+// callerAuth authenticates broker callers by IAM principal or HMAC signature.
+type callerAuth struct {
+	allow   map[string]bool
+	hmacKey []byte
+	now     func() time.Time
+}
+
+// newCallerAuth builds a callerAuth from a comma separated allowlist and HMAC secret.
+func newCallerAuth(allowlist, secret string) *callerAuth {
+	a := &callerAuth{allow: map[string]bool{}, now: time.Now}
+	for _, c := range strings.Split(allowlist, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			a.allow[c] = true
+		}
+	}
+	if secret != "" {
+		a.hmacKey = []byte(secret)
+	}
+	return a
+}
+
+// authenticate returns the caller identity when it is allowlisted.
+// The IAM principal from the API Gateway authorizer takes precedence over
+// HMAC headers.
+func (a *callerAuth) authenticate(evt events.APIGatewayV2HTTPRequest) (string, error) {
+	if a == nil {
+		return "", errUnauthorized
+	}
+	var caller string
+	if az := evt.RequestContext.Authorizer; az != nil && az.IAM != nil && az.IAM.UserARN != "" {
+		caller = az.IAM.UserARN
+	} else {
+		if len(a.hmacKey) == 0 {
+			return "", errUnauthorized
+		}
+		body := []byte(evt.Body)
+		if evt.IsBase64Encoded {
+			b, err := base64.StdEncoding.DecodeString(evt.Body)
+			if err != nil {
+				return "", fmt.Errorf("%w: decode body", errUnauthorized)
+			}
+			body = b
+		}
+		c, err := brokerauth.Verify(a.hmacKey,
+			header(evt.Headers, brokerauth.HeaderCaller),
+			header(evt.Headers, brokerauth.HeaderTimestamp),
+			header(evt.Headers, brokerauth.HeaderSignature),
+			evt.RequestContext.HTTP.Method, requestPath(evt), body, a.now())
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", errUnauthorized, err)
+		}
+		caller = c
+	}
+	if !a.allow[caller] {
+		return "", fmt.Errorf("%w: %s not allowed", errUnauthorized, caller)
+	}
+	return caller, nil
+}
+
+// header looks up a header case-insensitively; API Gateway lowercases names.
+func header(h map[string]string, name string) string {
+	if v, ok := h[name]; ok {
+		return v
+	}
+	for k, v := range h {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
+}
+
+// requestPath returns the request path from the event.
+func requestPath(evt events.APIGatewayV2HTTPRequest) string {
+	if evt.RawPath != "" {
+		return evt.RawPath
+	}
+	return evt.RequestContext.HTTP.Path
+}
@@ -3,9 +3,11 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -15,6 +17,8 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
 	cwtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
 	"go.uber.org/zap"
+
+	"github.com/your-org/file-processor-sample/internal/circuit"
 )
 
 type tokenStore interface {
@@ -22,6 +26,7 @@ type tokenStore interface {
 	TryLock(ctx context.Context) (bool, error)
 	Save(ctx context.Context, token string, exp time.Time) error
 	Unlock(ctx context.Context) error
+	Revoke(ctx context.Context) error
 }
 
 // Broker implements token retrieval logic.
@@ -36,6 +41,8 @@ type Broker struct {
 	httpClient *http.Client
 	sfURL      string
 	creds      map[string]string
+	auth       *callerAuth
+	breaker    *circuit.Breaker
 	log        *zap.SugaredLogger
 	mu         sync.Mutex
 	token      string
@@ -47,6 +54,13 @@ const (
 	graceTTL = 15 * time.Minute
 )
 
+var (
+	// errLockTimeout is returned when another instance holds the refresh lock too long.
+	errLockTimeout = errors.New("timeout waiting for refresh")
+	// errSalesforce wraps failures talking to the Salesforce token endpoint.
+	errSalesforce = errors.New("salesforce token request failed")
+)
+
 // getToken returns a cached token or refreshes it using fetchToken when needed.
 func (b *Broker) getToken(ctx context.Context) (string, error) {
 	b.mu.Lock()
@@ -94,7 +108,7 @@ func (b *Broker) getToken(ctx context.Context) (string, error) {
 				return tok, nil
 			}
 		}
-		return "", fmt.Errorf("timeout waiting for refresh")
+		return "", errLockTimeout
 	}
 
 	token, err := b.fetchToken(ctx)
@@ -102,7 +116,7 @@ func (b *Broker) getToken(ctx context.Context) (string, error) {
 		if uerr := b.store.Unlock(ctx); uerr != nil {
 			b.log.Warnw("unlock", "error", uerr)
 		}
-		return "", err
+		return "", fmt.Errorf("%w: %w", errSalesforce, err)
 	}
 	expTime := time.Now().Add(cacheTTL)
 	if err := b.store.Save(ctx, token, expTime); err != nil {
@@ -126,8 +140,12 @@ func (b *Broker) getToken(ctx context.Context) (string, error) {
 	return token, nil
 }
 
-// fetchToken calls the Salesforce token endpoint and returns a new token.
+// fetchToken calls the Salesforce token endpoint and returns a new token. The
+// shared circuit breaker fails the call fast while Salesforce is down.
 func (b *Broker) fetchToken(ctx context.Context) (string, error) {
+	if err := b.breaker.Allow(ctx); err != nil {
+		return "", err
+	}
 	form := make(urlValues)
 	for k, v := range b.creds {
 		form[k] = v
@@ -137,6 +155,7 @@ func (b *Broker) fetchToken(ctx context.Context) (string, error) {
 		req, _ := http.NewRequestWithContext(ctx, http.MethodPost, b.sfURL, strings.NewReader(form.Encode()))
 		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 		resp, err := b.httpClient.Do(req)
+		b.breaker.Record(ctx, resp, err)
 		if err != nil {
 			return "", err
 		}
@@ -187,10 +206,108 @@ func (v urlValues) Encode() string {
 	return buf.String()
 }
 
-// handler is the Lambda entrypoint used by API Gateway to obtain a token.
+// revoke drops the in-memory token and invalidates the cached DynamoDB token.
+// Other warm instances keep serving their in-memory copy until it expires,
+// at most cacheTTL later.
+func (b *Broker) revoke(ctx context.Context) error {
+	b.mu.Lock()
+	b.token = ""
+	b.expiry = time.Time{}
+	b.mu.Unlock()
+	return b.store.Revoke(ctx)
+}
+
+// apiError is the JSON error body returned by the broker API.
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// errorResponse maps err to a status code and structured JSON body. An open
+// circuit also sets Retry-After.
+func errorResponse(err error) events.APIGatewayV2HTTPResponse {
+	var oe *circuit.CircuitOpenError
+	if errors.As(err, &oe) {
+		resp := jsonResponse(http.StatusServiceUnavailable, apiError{Code: "circuit_open", Message: oe.Error()})
+		resp.Headers["Retry-After"] = strconv.Itoa(int((oe.RetryAfter + time.Second - 1) / time.Second))
+		return resp
+	}
+	status, code := http.StatusInternalServerError, "internal_error"
+	switch {
+	case errors.Is(err, errUnauthorized):
+		status, code = http.StatusUnauthorized, "unauthorized"
+	case errors.Is(err, errSalesforce):
+		status, code = http.StatusBadGateway, "salesforce_error"
+	case errors.Is(err, errLockTimeout):
+		status, code = http.StatusServiceUnavailable, "refresh_lock_timeout"
+	case errors.Is(err, errDecrypt):
+		code = "token_decrypt_failed"
+	}
+	return jsonResponse(status, apiError{Code: code, Message: err.Error()})
+}
+
+// jsonResponse encodes v as the response body with the given status.
+func jsonResponse(status int, v any) events.APIGatewayV2HTTPResponse {
+	body, _ := json.Marshal(v)
+	return events.APIGatewayV2HTTPResponse{StatusCode: status, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}
+}
+
+// Broker routes. Any other path is answered with 404.
+const (
+	tokenPath   = "/sf/token"
+	refreshPath = tokenPath + "/refresh"
+	revokePath  = tokenPath + "/revoke"
+)
+
+// route dispatches an authenticated request to the token, refresh or revoke action.
+func (b *Broker) route(ctx context.Context, evt events.APIGatewayV2HTTPRequest) events.APIGatewayV2HTTPResponse {
+	caller, err := b.auth.authenticate(evt)
+	if err != nil {
+		b.log.Warnw("auth", "error", err)
+		return errorResponse(err)
+	}
+	method := evt.RequestContext.HTTP.Method
+	path := requestPath(evt)
+	switch path {
+	case revokePath:
+		if method != http.MethodPost {
+			return jsonResponse(http.StatusMethodNotAllowed, apiError{Code: "method_not_allowed", Message: method + " " + path})
+		}
+		if err := b.revoke(ctx); err != nil {
+			b.log.Errorw("revoke", "caller", caller, "error", err)
+			return errorResponse(err)
+		}
+		b.log.Infow("token revoked", "caller", caller)
+		return jsonResponse(http.StatusOK, map[string]bool{"revoked": true})
+	case refreshPath:
+		if method != http.MethodPost {
+			return jsonResponse(http.StatusMethodNotAllowed, apiError{Code: "method_not_allowed", Message: method + " " + path})
+		}
+		if err := b.revoke(ctx); err != nil {
+			b.log.Errorw("refresh revoke", "caller", caller, "error", err)
+			return errorResponse(err)
+		}
+		b.log.Infow("forced refresh", "caller", caller)
+	case tokenPath:
+		if method != "" && method != http.MethodGet {
+			return jsonResponse(http.StatusMethodNotAllowed, apiError{Code: "method_not_allowed", Message: method + " " + path})
+		}
+	default:
+		return jsonResponse(http.StatusNotFound, apiError{Code: "not_found", Message: method + " " + path})
+	}
+	tok, err := b.getToken(ctx)
+	if err != nil {
+		b.log.Errorw("get token", "caller", caller, "error", err)
+		return errorResponse(err)
+	}
+	return jsonResponse(http.StatusOK, map[string]string{"token": tok})
+}
+
+// handler is the Lambda entrypoint used by API Gateway to obtain, refresh or
+// revoke a token.
 func (b *Broker) handler(ctx context.Context, evt events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
 	start := time.Now()
-	tok, err := b.getToken(ctx)
+	resp := b.route(ctx, evt)
 	latency := time.Since(start).Milliseconds()
 	_, _ = b.cw.PutMetricData(ctx, &cloudwatch.PutMetricDataInput{
 		Namespace: aws.String("TokenBroker"),
@@ -201,10 +318,5 @@ func (b *Broker) handler(ctx context.Context, evt events.APIGatewayV2HTTPRequest
 			},
 		},
 	})
-	if err != nil {
-		b.log.Errorw("get token", "error", err)
-		return events.APIGatewayV2HTTPResponse{StatusCode: 500}, nil
-	}
-	body, _ := json.Marshal(map[string]string{"token": tok})
-	return events.APIGatewayV2HTTPResponse{StatusCode: 200, Body: string(body), Headers: map[string]string{"Content-Type": "application/json"}}, nil
+	return resp, nil
 }
@@ -113,3 +113,15 @@ func (d *dynamoStore) Unlock(ctx context.Context) error {
 	})
 	return err
 }
+
+// Revoke removes the cached token so the next request fetches a new one.
+func (d *dynamoStore) Revoke(ctx context.Context) error {
+	_, err := d.db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: &d.table,
+		Key: map[string]dbtypes.AttributeValue{
+			"PK": &dbtypes.AttributeValueMemberS{Value: d.pk},
+		},
+		UpdateExpression: aws.String("REMOVE Token, ExpiresAt"),
+	})
+	return err
+}
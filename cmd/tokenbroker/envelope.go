@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	kmstypes "github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+// envelopePrefix marks a token stored as <wrapped data key>:<nonce+ciphertext>.
+const envelopePrefix = "enc:v1:"
+
+// errDecrypt is returned when a stored token cannot be decrypted.
+var errDecrypt = errors.New("decrypt token")
+
+// keyProvider issues and unwraps AES-256 data keys.
+type keyProvider interface {
+	GenerateDataKey(ctx context.Context) (plaintext, wrapped []byte, err error)
+	DecryptDataKey(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+type kmsAPI interface {
+	GenerateDataKey(ctx context.Context, in *kms.GenerateDataKeyInput, optFns ...func(*kms.Options)) (*kms.GenerateDataKeyOutput, error)
+	Decrypt(ctx context.Context, in *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error)
+}
+
+// kmsKeyProvider generates data keys under a KMS key.
+type kmsKeyProvider struct {
+	client  kmsAPI
+	keyID   string
+	context map[string]string
+}
+
+// GenerateDataKey asks KMS for a new AES-256 data key.
+func (k *kmsKeyProvider) GenerateDataKey(ctx context.Context) ([]byte, []byte, error) {
+	out, err := k.client.GenerateDataKey(ctx, &kms.GenerateDataKeyInput{
+		KeyId:             aws.String(k.keyID),
+		KeySpec:           kmstypes.DataKeySpecAes256,
+		EncryptionContext: k.context,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("kms generate data key: %w", err)
+	}
+	return out.Plaintext, out.CiphertextBlob, nil
+}
+
+// DecryptDataKey unwraps a data key previously issued by KMS.
+func (k *kmsKeyProvider) DecryptDataKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	out, err := k.client.Decrypt(ctx, &kms.DecryptInput{
+		CiphertextBlob:    wrapped,
+		KeyId:             aws.String(k.keyID),
+		EncryptionContext: k.context,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("kms decrypt: %w", err)
+	}
+	return out.Plaintext, nil
+}
+
+// staticKeyProvider wraps data keys with a fixed local key; for tests and local runs.
+type staticKeyProvider struct {
+	key []byte
+}
+
+// GenerateDataKey creates a random data key wrapped with the static key.
+func (s *staticKeyProvider) GenerateDataKey(ctx context.Context) ([]byte, []byte, error) {
+	dk := make([]byte, 32)
+	if _, err := rand.Read(dk); err != nil {
+		return nil, nil, err
+	}
+	wrapped, err := seal(s.key, dk, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dk, wrapped, nil
+}
+
+// DecryptDataKey unwraps a data key with the static key.
+func (s *staticKeyProvider) DecryptDataKey(ctx context.Context, wrapped []byte) ([]byte, error) {
+	return open(s.key, wrapped, nil)
+}
+
+// seal encrypts plaintext with AES-GCM and returns nonce||ciphertext.
+func seal(key, plaintext, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+// open decrypts nonce||ciphertext produced by seal.
+func open(key, data, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], aad)
+}
+
+// encryptedStore envelope-encrypts tokens before they reach the wrapped store.
+type encryptedStore struct {
+	tokenStore
+	keys keyProvider
+	aad  []byte
+
+	mu        sync.Mutex
+	lastKey   []byte
+	lastPlain []byte
+}
+
+// Get reads the stored token and decrypts it. Decryption failures are
+// returned as errors so a tampered or unreadable token is never served.
+func (e *encryptedStore) Get(ctx context.Context) (string, time.Time, bool, error) {
+	tok, exp, refreshing, err := e.tokenStore.Get(ctx)
+	if err != nil || tok == "" {
+		return tok, exp, refreshing, err
+	}
+	if !strings.HasPrefix(tok, envelopePrefix) {
+		// written before encryption was enabled; force a refresh
+		return "", time.Time{}, refreshing, nil
+	}
+	plain, err := e.decrypt(ctx, strings.TrimPrefix(tok, envelopePrefix))
+	if err != nil {
+		return "", time.Time{}, false, fmt.Errorf("%w: %w", errDecrypt, err)
+	}
+	return plain, exp, refreshing, nil
+}
+
+// Save encrypts token under a fresh data key and stores the envelope.
+func (e *encryptedStore) Save(ctx context.Context, token string, exp time.Time) error {
+	dk, wrapped, err := e.keys.GenerateDataKey(ctx)
+	if err != nil {
+		return err
+	}
+	ct, err := seal(dk, []byte(token), e.aad)
+	if err != nil {
+		return fmt.Errorf("encrypt token: %w", err)
+	}
+	e.remember(wrapped, dk)
+	enc := envelopePrefix + base64.StdEncoding.EncodeToString(wrapped) + ":" + base64.StdEncoding.EncodeToString(ct)
+	return e.tokenStore.Save(ctx, enc, exp)
+}
+
+// decrypt unwraps the data key, reusing the last one when unchanged, and
+// opens the token ciphertext.
+func (e *encryptedStore) decrypt(ctx context.Context, env string) (string, error) {
+	wk, ct, ok := strings.Cut(env, ":")
+	if !ok {
+		return "", fmt.Errorf("malformed envelope")
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(wk)
+	if err != nil {
+		return "", fmt.Errorf("decode data key: %w", err)
+	}
+	data, err := base64.StdEncoding.DecodeString(ct)
+	if err != nil {
+		return "", fmt.Errorf("decode ciphertext: %w", err)
+	}
+	e.mu.Lock()
+	dk := e.lastPlain
+	if string(e.lastKey) != string(wrapped) {
+		dk = nil
+	}
+	e.mu.Unlock()
+	if dk == nil {
+		if dk, err = e.keys.DecryptDataKey(ctx, wrapped); err != nil {
+			return "", err
+		}
+		e.remember(wrapped, dk)
+	}
+	plain, err := open(dk, data, e.aad)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// remember caches the most recent wrapped/plaintext data key pair.
+func (e *encryptedStore) remember(wrapped, dk []byte) {
+	e.mu.Lock()
+	e.lastKey = wrapped
+	e.lastPlain = dk
+	e.mu.Unlock()
+}
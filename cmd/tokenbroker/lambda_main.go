@@ -4,14 +4,18 @@ package main
 
 import (
 	"context"
-	"net/http"
+	"encoding/base64"
 	"os"
 
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
 	"go.uber.org/zap"
+
+	"github.com/your-org/file-processor-sample/internal/circuit"
+	"github.com/your-org/file-processor-sample/internal/httpclient"
 )
 
 // main wires together the broker dependencies and starts the Lambda handler.
@@ -22,16 +26,37 @@ func main() {
 	}
 	logger, _ := zap.NewProduction()
 	log := logger.Sugar()
+	client, err := httpclient.New(httpclient.FromEnv(log))
+	if err != nil {
+		panic(err)
+	}
 	table := os.Getenv("AUTH_TABLE")
 	if table == "" {
 		table = "SfAuthToken"
 	}
 	pk := os.Getenv("APP_ID") + "#" + os.Getenv("ENV")
-	store := &dynamoStore{table: table, pk: pk, db: dynamodb.NewFromConfig(cfg)}
+	db := dynamodb.NewFromConfig(cfg)
+	var keys keyProvider
+	if k := os.Getenv("TOKEN_STATIC_KEY"); k != "" {
+		key, err := base64.StdEncoding.DecodeString(k)
+		if err != nil {
+			panic(err)
+		}
+		keys = &staticKeyProvider{key: key}
+	} else if id := os.Getenv("TOKEN_KMS_KEY_ID"); id != "" {
+		keys = &kmsKeyProvider{client: kms.NewFromConfig(cfg), keyID: id, context: map[string]string{"PK": pk}}
+	} else {
+		panic("TOKEN_KMS_KEY_ID or TOKEN_STATIC_KEY is required")
+	}
+	store := &encryptedStore{
+		tokenStore: &dynamoStore{table: table, pk: pk, db: db},
+		keys:       keys,
+		aad:        []byte(pk),
+	}
 	broker := &Broker{
 		store:      store,
 		cw:         cloudwatch.NewFromConfig(cfg),
-		httpClient: http.DefaultClient,
+		httpClient: client,
 		sfURL:      os.Getenv("SF_TOKEN_URL"),
 		creds: map[string]string{
 			"client_id":     os.Getenv("SF_CLIENT_ID"),
@@ -40,7 +65,9 @@ func main() {
 			"password":      os.Getenv("SF_PASSWORD"),
 			"grant_type":    "password",
 		},
-		log: log,
+		auth:    newCallerAuth(os.Getenv("ALLOWED_CALLERS"), os.Getenv("BROKER_HMAC_SECRET")),
+		breaker: circuit.FromEnv(db, log),
+		log:     log,
 	}
 	lambda.Start(broker.handler)
 }
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+)
+
+// fakeTokenPath is where the local server exposes the fake Salesforce token endpoint.
+const fakeTokenPath = "/services/oauth2/token"
+
+// memoryStore is an in-process tokenStore used by the local server.
+type memoryStore struct {
+	mu         sync.Mutex
+	token      string
+	exp        time.Time
+	refreshing bool
+}
+
+// Get returns the cached token and its expiry.
+func (m *memoryStore) Get(ctx context.Context) (string, time.Time, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.token, m.exp, m.refreshing, nil
+}
+
+// TryLock marks the token as refreshing unless another refresh is in progress.
+func (m *memoryStore) TryLock(ctx context.Context) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.refreshing {
+		return false, nil
+	}
+	m.refreshing = true
+	return true, nil
+}
+
+// Save stores the token and clears the refreshing flag.
+func (m *memoryStore) Save(ctx context.Context, token string, exp time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.token, m.exp, m.refreshing = token, exp, false
+	return nil
+}
+
+// Unlock clears the refreshing flag.
+func (m *memoryStore) Unlock(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.refreshing = false
+	return nil
+}
+
+// Revoke drops the cached token.
+func (m *memoryStore) Revoke(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.token, m.exp = "", time.Time{}
+	return nil
+}
+
+// nopMetrics discards CloudWatch metrics when running without AWS.
+type nopMetrics struct{}
+
+// PutMetricData implements metricsClient.
+func (nopMetrics) PutMetricData(ctx context.Context, in *cloudwatch.PutMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.PutMetricDataOutput, error) {
+	return &cloudwatch.PutMetricDataOutput{}, nil
+}
+
+// fakeSalesforce answers OAuth password grants with sequential local tokens.
+func fakeSalesforce() http.HandlerFunc {
+	var n atomic.Int64
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"access_token":"local-%d","token_type":"Bearer"}`, n.Add(1))
+	}
+}
+
+// httpHandler adapts net/http requests to the API Gateway handler.
+func httpHandler(b *Broker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "read body", http.StatusBadRequest)
+			return
+		}
+		evt := events.APIGatewayV2HTTPRequest{
+			RawPath:        r.URL.Path,
+			RawQueryString: r.URL.RawQuery,
+			Headers:        map[string]string{},
+			Body:           string(body),
+		}
+		if !utf8.Valid(body) {
+			evt.Body = base64.StdEncoding.EncodeToString(body)
+			evt.IsBase64Encoded = true
+		}
+		for k, v := range r.Header {
+			evt.Headers[strings.ToLower(k)] = strings.Join(v, ",")
+		}
+		evt.RequestContext.HTTP.Method = r.Method
+		evt.RequestContext.HTTP.Path = r.URL.Path
+		evt.RequestContext.HTTP.SourceIP = r.RemoteAddr
+
+		resp, _ := b.handler(r.Context(), evt)
+		for k, v := range resp.Headers {
+			w.Header().Set(k, v)
+		}
+		w.WriteHeader(resp.StatusCode)
+		_, _ = io.WriteString(w, resp.Body)
+	}
+}
+
+// newLocalMux serves the broker routes and, when fakeSF is set, the fake
+// Salesforce token endpoint on the same listener.
+func newLocalMux(b *Broker, fakeSF bool) *http.ServeMux {
+	mux := http.NewServeMux()
+	if fakeSF {
+		mux.Handle(fakeTokenPath, fakeSalesforce())
+	}
+	mux.Handle("/", httpHandler(b))
+	return mux
+}
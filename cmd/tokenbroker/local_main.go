@@ -0,0 +1,66 @@
+//go:build !lambda
+
+package main
+
+import (
+	"flag"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/your-org/file-processor-sample/internal/httpclient"
+)
+
+// main serves the broker over plain HTTP with an in-memory store for local
+// development and e2e runs.
+func main() {
+	addr := flag.String("addr", envOr("BROKER_ADDR", ":8085"), "listen address")
+	sfURL := flag.String("sf-url", os.Getenv("SF_TOKEN_URL"), "Salesforce OAuth token endpoint")
+	fakeSF := flag.Bool("fake-sf", false, "serve a fake Salesforce token endpoint at "+fakeTokenPath)
+	callers := flag.String("callers", envOr("ALLOWED_CALLERS", "local"), "comma separated allowed caller ids")
+	secret := flag.String("hmac-secret", envOr("BROKER_HMAC_SECRET", "local-secret"), "HMAC secret for signed callers")
+	flag.Parse()
+
+	logger, _ := zap.NewDevelopment()
+	log := logger.Sugar()
+	if *fakeSF && *sfURL == "" {
+		host := *addr
+		if strings.HasPrefix(host, ":") {
+			host = "127.0.0.1" + host
+		}
+		*sfURL = "http://" + host + fakeTokenPath
+	}
+	client, err := httpclient.New(httpclient.FromEnv(log))
+	if err != nil {
+		log.Fatalw("http client", "error", err)
+	}
+	broker := &Broker{
+		store:      &memoryStore{},
+		cw:         nopMetrics{},
+		httpClient: client,
+		sfURL:      *sfURL,
+		creds: map[string]string{
+			"client_id":     os.Getenv("SF_CLIENT_ID"),
+			"client_secret": os.Getenv("SF_CLIENT_SECRET"),
+			"username":      os.Getenv("SF_USERNAME"),
+			"password":      os.Getenv("SF_PASSWORD"),
+			"grant_type":    "password",
+		},
+		auth: newCallerAuth(*callers, *secret),
+		log:  log,
+	}
+	log.Infow("local broker listening", "addr", *addr, "sfURL", *sfURL, "fakeSF", *fakeSF)
+	if err := http.ListenAndServe(*addr, newLocalMux(broker, *fakeSF)); err != nil {
+		log.Fatalw("serve", "error", err)
+	}
+}
+
+// envOr returns the environment variable or def when unset.
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
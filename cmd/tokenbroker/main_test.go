@@ -1,7 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -11,8 +14,14 @@ import (
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
 	"go.uber.org/zap"
 	"strings"
+
+	"github.com/your-org/file-processor-sample/internal/brokerauth"
+	"github.com/your-org/file-processor-sample/internal/circuit"
 )
 
 type fakeStore struct {
@@ -76,6 +85,17 @@ func (f *fakeStore) Unlock(ctx context.Context) error {
 	return nil
 }
 
+func (f *fakeStore) Revoke(ctx context.Context) error {
+	if f.fail {
+		return fmt.Errorf("dynamo down")
+	}
+	f.mu.Lock()
+	f.token = ""
+	f.exp = time.Time{}
+	f.mu.Unlock()
+	return nil
+}
+
 type fakeCW struct {
 	mu  sync.Mutex
 	cnt int
@@ -102,16 +122,17 @@ func TestCachedToken(t *testing.T) {
 		httpClient: srv.Client(),
 		sfURL:      srv.URL,
 		creds:      map[string]string{"grant_type": "password"},
+		auth:       newCallerAuth(testCaller, ""),
 		log:        zap.NewNop().Sugar(),
 	}
-	resp, err := b.handler(context.Background(), events.APIGatewayV2HTTPRequest{})
+	resp, err := b.handler(context.Background(), iamRequest(http.MethodGet, "/sf/token"))
 	if err != nil || resp.StatusCode != 200 {
 		t.Fatalf("unexpected error: %v", err)
 	}
 	if calls != 1 {
 		t.Fatalf("expected 1 call, got %d", calls)
 	}
-	resp, err = b.handler(context.Background(), events.APIGatewayV2HTTPRequest{})
+	resp, err = b.handler(context.Background(), iamRequest(http.MethodGet, "/sf/token"))
 	if err != nil || resp.StatusCode != 200 {
 		t.Fatalf("second call error: %v", err)
 	}
@@ -198,3 +219,270 @@ func TestFetchTokenError(t *testing.T) {
 		t.Fatalf("expected error and two calls")
 	}
 }
+
+const testCaller = "arn:aws:iam::123456789012:role/logimporterror"
+
+func iamRequest(method, path string) events.APIGatewayV2HTTPRequest {
+	evt := events.APIGatewayV2HTTPRequest{RawPath: path}
+	evt.RequestContext.HTTP.Method = method
+	evt.RequestContext.Authorizer = &events.APIGatewayV2HTTPRequestContextAuthorizerDescription{
+		IAM: &events.APIGatewayV2HTTPRequestContextAuthorizerIAMDescription{UserARN: testCaller},
+	}
+	return evt
+}
+
+func decodeError(t *testing.T, resp events.APIGatewayV2HTTPResponse) apiError {
+	var e apiError
+	if err := json.Unmarshal([]byte(resp.Body), &e); err != nil {
+		t.Fatalf("decode error body %q: %v", resp.Body, err)
+	}
+	return e
+}
+
+func TestHandlerUnauthorized(t *testing.T) {
+	b := &Broker{store: &fakeStore{}, cw: &fakeCW{}, auth: newCallerAuth("arn:other", ""), log: zap.NewNop().Sugar()}
+	for _, evt := range []events.APIGatewayV2HTTPRequest{{}, iamRequest(http.MethodGet, "/sf/token")} {
+		resp, _ := b.handler(context.Background(), evt)
+		if resp.StatusCode != http.StatusUnauthorized || decodeError(t, resp).Code != "unauthorized" {
+			t.Fatalf("expected 401, got %d %s", resp.StatusCode, resp.Body)
+		}
+	}
+}
+
+func TestHandlerHMAC(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `{"access_token":"h1"}`)
+	}))
+	defer srv.Close()
+	auth := newCallerAuth("logimporterror", "secret")
+	now := time.Unix(1700000000, 0)
+	auth.now = func() time.Time { return now }
+	b := &Broker{store: &fakeStore{}, cw: &fakeCW{}, httpClient: srv.Client(), sfURL: srv.URL, creds: map[string]string{}, auth: auth, log: zap.NewNop().Sugar()}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://broker/sf/token", nil)
+	brokerauth.SignRequest(req, []byte("secret"), "logimporterror", nil, now)
+	evt := events.APIGatewayV2HTTPRequest{RawPath: "/sf/token", Headers: map[string]string{}}
+	evt.RequestContext.HTTP.Method = http.MethodGet
+	for k := range req.Header {
+		evt.Headers[strings.ToLower(k)] = req.Header.Get(k)
+	}
+	resp, _ := b.handler(context.Background(), evt)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(resp.Body, "h1") {
+		t.Fatalf("unexpected response: %d %s", resp.StatusCode, resp.Body)
+	}
+
+	evt.Headers[strings.ToLower(brokerauth.HeaderSignature)] = "bad"
+	resp, _ = b.handler(context.Background(), evt)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", resp.StatusCode)
+	}
+}
+
+func TestHandlerRevokeAndRefresh(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		_, _ = fmt.Fprintf(w, `{"access_token":"t%d"}`, calls)
+	}))
+	defer srv.Close()
+	store := &fakeStore{}
+	b := &Broker{store: store, cw: &fakeCW{}, httpClient: srv.Client(), sfURL: srv.URL, creds: map[string]string{}, auth: newCallerAuth(testCaller, ""), log: zap.NewNop().Sugar()}
+
+	if _, err := b.getToken(context.Background()); err != nil {
+		t.Fatalf("get token: %v", err)
+	}
+	resp, _ := b.handler(context.Background(), iamRequest(http.MethodPost, "/sf/token/revoke"))
+	if resp.StatusCode != http.StatusOK || store.token != "" || b.token != "" {
+		t.Fatalf("token not revoked: %d %s", resp.StatusCode, resp.Body)
+	}
+
+	resp, _ = b.handler(context.Background(), iamRequest(http.MethodPost, "/sf/token/refresh"))
+	if resp.StatusCode != http.StatusOK || !strings.Contains(resp.Body, "t2") || calls != 2 {
+		t.Fatalf("refresh not forced: %d %s calls=%d", resp.StatusCode, resp.Body, calls)
+	}
+
+	resp, _ = b.handler(context.Background(), iamRequest(http.MethodGet, "/sf/token/refresh"))
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405, got %d", resp.StatusCode)
+	}
+
+	for _, path := range []string{"/anything", "/sf/token/../x", "/refresh", "/sf/token/"} {
+		resp, _ = b.handler(context.Background(), iamRequest(http.MethodGet, path))
+		if resp.StatusCode != http.StatusNotFound || decodeError(t, resp).Code != "not_found" {
+			t.Fatalf("%s: expected 404, got %d %s", path, resp.StatusCode, resp.Body)
+		}
+	}
+}
+
+func TestHandlerErrorStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	b := &Broker{store: &fakeStore{}, cw: &fakeCW{}, httpClient: srv.Client(), sfURL: srv.URL, creds: map[string]string{}, auth: newCallerAuth(testCaller, ""), log: zap.NewNop().Sugar()}
+	resp, _ := b.handler(context.Background(), iamRequest(http.MethodGet, "/sf/token"))
+	if resp.StatusCode != http.StatusBadGateway || decodeError(t, resp).Code != "salesforce_error" {
+		t.Fatalf("expected 502, got %d %s", resp.StatusCode, resp.Body)
+	}
+
+	b = &Broker{store: &fakeStore{lockFail: true}, cw: &fakeCW{}, auth: newCallerAuth(testCaller, ""), log: zap.NewNop().Sugar()}
+	resp, _ = b.handler(context.Background(), iamRequest(http.MethodGet, "/sf/token"))
+	if resp.StatusCode != http.StatusServiceUnavailable || decodeError(t, resp).Code != "refresh_lock_timeout" {
+		t.Fatalf("expected 503, got %d %s", resp.StatusCode, resp.Body)
+	}
+}
+
+// openCircuit is a breaker table whose item is open for another 30 seconds.
+type openCircuit struct{}
+
+func (openCircuit) GetItem(ctx context.Context, in *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	until := fmt.Sprint(time.Now().Add(30 * time.Second).UnixMilli())
+	return &dynamodb.GetItemOutput{Item: map[string]dbtypes.AttributeValue{
+		"OpenUntil": &dbtypes.AttributeValueMemberN{Value: until},
+	}}, nil
+}
+
+func (openCircuit) UpdateItem(ctx context.Context, in *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func TestHandlerCircuitOpen(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+	defer srv.Close()
+	b := &Broker{store: &fakeStore{}, cw: &fakeCW{}, httpClient: srv.Client(), sfURL: srv.URL, creds: map[string]string{}, auth: newCallerAuth(testCaller, ""), log: zap.NewNop().Sugar(),
+		breaker: &circuit.Breaker{DB: openCircuit{}, Table: "circuit", Name: "salesforce"}}
+	resp, _ := b.handler(context.Background(), iamRequest(http.MethodGet, "/sf/token"))
+	if resp.StatusCode != http.StatusServiceUnavailable || decodeError(t, resp).Code != "circuit_open" {
+		t.Fatalf("expected 503 circuit_open, got %d %s", resp.StatusCode, resp.Body)
+	}
+	if ra := resp.Headers["Retry-After"]; ra != "30" && ra != "29" {
+		t.Fatalf("unexpected Retry-After %q", ra)
+	}
+	if calls != 0 {
+		t.Fatalf("expected no Salesforce calls, got %d", calls)
+	}
+}
+
+type fakeKMS struct {
+	key      []byte
+	decrypts int
+}
+
+func (f *fakeKMS) GenerateDataKey(ctx context.Context, in *kms.GenerateDataKeyInput, optFns ...func(*kms.Options)) (*kms.GenerateDataKeyOutput, error) {
+	dk, wrapped, err := (&staticKeyProvider{key: f.key}).GenerateDataKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &kms.GenerateDataKeyOutput{Plaintext: dk, CiphertextBlob: wrapped}, nil
+}
+
+func (f *fakeKMS) Decrypt(ctx context.Context, in *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error) {
+	f.decrypts++
+	dk, err := open(f.key, in.CiphertextBlob, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &kms.DecryptOutput{Plaintext: dk}, nil
+}
+
+func TestEncryptedStoreRoundTrip(t *testing.T) {
+	inner := &fakeStore{}
+	key := bytes.Repeat([]byte{7}, 32)
+	store := &encryptedStore{tokenStore: inner, keys: &staticKeyProvider{key: key}, aad: []byte("app#dev")}
+	exp := time.Now().Add(time.Minute)
+	if err := store.Save(context.Background(), "secret-token", exp); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if strings.Contains(inner.token, "secret-token") || !strings.HasPrefix(inner.token, envelopePrefix) {
+		t.Fatalf("token stored in plaintext: %s", inner.token)
+	}
+	// a fresh store must unwrap the data key rather than rely on the cache
+	store = &encryptedStore{tokenStore: inner, keys: &staticKeyProvider{key: key}, aad: []byte("app#dev")}
+	tok, gotExp, _, err := store.Get(context.Background())
+	if err != nil || tok != "secret-token" || !gotExp.Equal(exp) {
+		t.Fatalf("unexpected: %s %v %v", tok, gotExp, err)
+	}
+}
+
+func TestEncryptedStoreFailClosed(t *testing.T) {
+	inner := &fakeStore{}
+	store := &encryptedStore{tokenStore: inner, keys: &staticKeyProvider{key: bytes.Repeat([]byte{1}, 32)}, aad: []byte("app#dev")}
+	if err := store.Save(context.Background(), "tok", time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	other := &encryptedStore{tokenStore: inner, keys: &staticKeyProvider{key: bytes.Repeat([]byte{2}, 32)}, aad: []byte("app#dev")}
+	if tok, _, _, err := other.Get(context.Background()); !errors.Is(err, errDecrypt) || tok != "" {
+		t.Fatalf("expected decrypt error, got %q %v", tok, err)
+	}
+	inner.token = envelopePrefix + "garbage"
+	if _, _, _, err := store.Get(context.Background()); !errors.Is(err, errDecrypt) {
+		t.Fatalf("expected decrypt error, got %v", err)
+	}
+	inner.token = "legacy-plaintext"
+	if tok, _, _, err := store.Get(context.Background()); err != nil || tok != "" {
+		t.Fatalf("plaintext token should be ignored: %q %v", tok, err)
+	}
+}
+
+func TestEncryptedStoreKMS(t *testing.T) {
+	fk := &fakeKMS{key: bytes.Repeat([]byte{9}, 32)}
+	inner := &fakeStore{}
+	kp := &kmsKeyProvider{client: fk, keyID: "alias/broker", context: map[string]string{"PK": "app#dev"}}
+	store := &encryptedStore{tokenStore: inner, keys: kp}
+	if err := store.Save(context.Background(), "kms-token", time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	store = &encryptedStore{tokenStore: inner, keys: kp}
+	for i := 0; i < 2; i++ {
+		if tok, _, _, err := store.Get(context.Background()); err != nil || tok != "kms-token" {
+			t.Fatalf("unexpected: %q %v", tok, err)
+		}
+	}
+	if fk.decrypts != 1 {
+		t.Fatalf("expected cached data key, got %d decrypts", fk.decrypts)
+	}
+}
+
+func TestLocalServer(t *testing.T) {
+	b := &Broker{store: &memoryStore{}, cw: nopMetrics{}, httpClient: http.DefaultClient, creds: map[string]string{"grant_type": "password"}, auth: newCallerAuth("local", "local-secret"), log: zap.NewNop().Sugar()}
+	srv := httptest.NewServer(newLocalMux(b, true))
+	defer srv.Close()
+	b.sfURL = srv.URL + fakeTokenPath
+
+	call := func(method, path string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, srv.URL+path, nil)
+		brokerauth.SignRequest(req, []byte("local-secret"), "local", nil, time.Now())
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		var out map[string]any
+		_ = json.NewDecoder(resp.Body).Decode(&out)
+		tok, _ := out["token"].(string)
+		return resp, tok
+	}
+
+	resp, tok := call(http.MethodGet, "/sf/token")
+	if resp.StatusCode != http.StatusOK || tok != "local-1" {
+		t.Fatalf("unexpected token response: %d %q", resp.StatusCode, tok)
+	}
+	if _, tok = call(http.MethodGet, "/sf/token"); tok != "local-1" {
+		t.Fatalf("token not cached: %q", tok)
+	}
+	if _, tok = call(http.MethodPost, "/sf/token/refresh"); tok != "local-2" {
+		t.Fatalf("refresh did not fetch a new token: %q", tok)
+	}
+
+	resp, err := http.Get(srv.URL + "/sf/token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for unsigned request, got %d", resp.StatusCode)
+	}
+}
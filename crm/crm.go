@@ -0,0 +1,10 @@
+// Package crm bundles the checked-in feed profiles into the binaries so a
+// Lambda can fall back to them and local runs need no AWS access.
+package crm
+
+import "embed"
+
+// FileProfiles holds file-profiles/<env>/<source>.json.
+//
+//go:embed file-profiles
+var FileProfiles embed.FS
@@ -0,0 +1,176 @@
+// Package batch runs the file handlers over every record of their input:
+// an S3 event notification delivered directly, or an SQS batch whose
+// message bodies are S3 event notifications. Each record gets its own
+// status, and failed SQS messages are reported for partial batch retry.
+package batch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Record statuses.
+const (
+	StatusOK     = "ok"
+	StatusFailed = "failed"
+)
+
+// ErrNoRecords is returned for events without records.
+var ErrNoRecords = errors.New("event has no records")
+
+// Event is the input of a file handler. Records are S3 records, or SQS
+// messages carrying an S3 event notification in Body.
+type Event struct {
+	Records []Record `json:"Records"`
+}
+
+// Record is one entry of Event.Records. MessageID and Body are set for SQS
+// messages only.
+type Record struct {
+	events.S3EventRecord
+	MessageID string `json:"messageId,omitempty"`
+	Body      string `json:"body,omitempty"`
+}
+
+// FromS3 wraps an S3 event.
+func FromS3(evt events.S3Event) Event {
+	out := Event{Records: make([]Record, len(evt.Records))}
+	for i, r := range evt.Records {
+		out.Records[i] = Record{S3EventRecord: r}
+	}
+	return out
+}
+
+// sqs reports whether r is an SQS message.
+func (r Record) sqs() bool {
+	return r.EventSource == "aws:sqs" || r.MessageID != ""
+}
+
+// Result is the outcome of one S3 record.
+type Result struct {
+	MessageID string `json:"messageId,omitempty"`
+	Bucket    string `json:"bucket,omitempty"`
+	Key       string `json:"key,omitempty"`
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+	ErrorType string `json:"errorType,omitempty"`
+	Output    any    `json:"output,omitempty"`
+}
+
+// Response lists the result of every S3 record in order. For SQS batches
+// BatchItemFailures names the messages to retry, in the shape Lambda
+// expects with ReportBatchItemFailures.
+type Response struct {
+	Records           []Result                     `json:"records"`
+	BatchItemFailures []events.SQSBatchItemFailure `json:"batchItemFailures,omitempty"`
+}
+
+// BatchError reports a direct S3 event whose records all failed, with
+// errors of different types. Lambda reports it as "BatchError".
+type BatchError struct {
+	Failed, Total int
+	Errs          []error
+}
+
+func (e *BatchError) Error() string {
+	msgs := make([]string, len(e.Errs))
+	for i, err := range e.Errs {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d of %d records failed: %s", e.Failed, e.Total, strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the record errors.
+func (e *BatchError) Unwrap() []error { return e.Errs }
+
+// Func handles one S3 record and returns its output.
+type Func func(ctx context.Context, rec events.S3EventRecord) (any, error)
+
+// Run calls fn for every S3 record of evt, in order. An SQS message fails
+// when its body is not an S3 event or any of its records fails; the
+// invocation itself then succeeds so Lambda retries only those messages.
+// A direct S3 event fails only when every record failed, so the results of
+// the records that succeeded are kept; callers branch on each Result's
+// Status. When all the errors have the same type the first one is returned
+// as is, so Step Functions can match its type; errors of different types
+// are returned as a *BatchError.
+func Run(ctx context.Context, evt Event, fn Func) (Response, error) {
+	resp := Response{Records: []Result{}}
+	if len(evt.Records) == 0 {
+		return resp, ErrNoRecords
+	}
+	var errs []error
+	total, isSQS := 0, false
+	for _, r := range evt.Records {
+		if !r.sqs() {
+			total++
+			res, err := run(ctx, r.S3EventRecord, fn)
+			resp.Records = append(resp.Records, res)
+			if err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		isSQS = true
+		var inner events.S3Event
+		if err := json.Unmarshal([]byte(r.Body), &inner); err != nil {
+			total++
+			resp.Records = append(resp.Records, failed(Result{MessageID: r.MessageID}, fmt.Errorf("message %s: body is not an S3 event: %w", r.MessageID, err)))
+			resp.BatchItemFailures = append(resp.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: r.MessageID})
+			continue
+		}
+		// S3 test events carry no records and need no retry.
+		ok := true
+		for _, rec := range inner.Records {
+			total++
+			res, err := run(ctx, rec, fn)
+			res.MessageID = r.MessageID
+			resp.Records = append(resp.Records, res)
+			ok = ok && err == nil
+		}
+		if !ok {
+			resp.BatchItemFailures = append(resp.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: r.MessageID})
+		}
+	}
+	if isSQS || len(errs) < total {
+		return resp, nil
+	}
+	for _, err := range errs[1:] {
+		if errorType(err) != errorType(errs[0]) {
+			return resp, &BatchError{Failed: len(errs), Total: total, Errs: errs}
+		}
+	}
+	return resp, errs[0]
+}
+
+// run handles one record and records its result.
+func run(ctx context.Context, rec events.S3EventRecord, fn Func) (Result, error) {
+	res := Result{Bucket: rec.S3.Bucket.Name, Key: rec.S3.Object.Key, Status: StatusOK}
+	out, err := fn(ctx, rec)
+	if err != nil {
+		return failed(res, err), err
+	}
+	res.Output = out
+	return res, nil
+}
+
+// failed marks res as failed with err.
+func failed(res Result, err error) Result {
+	res.Status, res.Error, res.ErrorType = StatusFailed, err.Error(), errorType(err)
+	return res
+}
+
+// errorType names the type of err the way Lambda reports it.
+func errorType(err error) string {
+	t := reflect.TypeOf(err)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Name()
+}
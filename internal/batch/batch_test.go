@@ -0,0 +1,142 @@
+package batch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+type badFile struct{ key string }
+
+func (e *badFile) Error() string { return "bad file " + e.key }
+
+type otherFile struct{ key string }
+
+func (e *otherFile) Error() string { return "other file " + e.key }
+
+// fn fails keys starting with "bad" or "oth".
+func fn(ctx context.Context, rec events.S3EventRecord) (any, error) {
+	key := rec.S3.Object.Key
+	switch {
+	case strings.HasPrefix(key, "bad"):
+		return nil, &badFile{key}
+	case strings.HasPrefix(key, "oth"):
+		return nil, &otherFile{key}
+	}
+	return "done " + key, nil
+}
+
+func s3Event(keys ...string) events.S3Event {
+	evt := events.S3Event{}
+	for _, k := range keys {
+		evt.Records = append(evt.Records, events.S3EventRecord{EventSource: "aws:s3", S3: events.S3Entity{Bucket: events.S3Bucket{Name: "b"}, Object: events.S3Object{Key: k}}})
+	}
+	return evt
+}
+
+func decode(t *testing.T, v any) Event {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var evt Event
+	if err := json.Unmarshal(b, &evt); err != nil {
+		t.Fatal(err)
+	}
+	return evt
+}
+
+func TestRunS3(t *testing.T) {
+	resp, err := Run(context.Background(), decode(t, s3Event("a", "c")), fn)
+	if err != nil || len(resp.Records) != 2 || resp.Records[1].Key != "c" || resp.Records[1].Output != "done c" || resp.Records[1].Status != StatusOK {
+		t.Fatalf("resp %+v err %v", resp, err)
+	}
+
+	_, err = Run(context.Background(), FromS3(s3Event("bad")), fn)
+	var bf *badFile
+	if !errors.As(err, &bf) || err.Error() != "bad file bad" {
+		t.Fatalf("single record error should pass through, got %T %v", err, err)
+	}
+
+	resp, err = Run(context.Background(), FromS3(s3Event("a", "bad1", "oth2")), fn)
+	if err != nil {
+		t.Fatalf("partial failure should keep the results, got %v", err)
+	}
+	if r := resp.Records[1]; r.Status != StatusFailed || r.ErrorType != "badFile" || r.Error != "bad file bad1" {
+		t.Fatalf("unexpected result %+v", r)
+	}
+	if resp.Records[0].Status != StatusOK || resp.Records[2].ErrorType != "otherFile" {
+		t.Fatalf("unexpected results %+v", resp.Records)
+	}
+	if resp.BatchItemFailures != nil {
+		t.Fatal("no SQS failures for S3 events")
+	}
+
+	resp, err = Run(context.Background(), FromS3(s3Event("bad1", "bad2")), fn)
+	if _, ok := err.(*badFile); !ok || err.Error() != "bad file bad1" || len(resp.Records) != 2 {
+		t.Fatalf("errors of one type should return the first, got %T %v", err, err)
+	}
+
+	_, err = Run(context.Background(), FromS3(s3Event("bad1", "oth2")), fn)
+	var be *BatchError
+	var of *otherFile
+	if !errors.As(err, &be) || be.Failed != 2 || be.Total != 2 || !errors.As(err, &bf) || !errors.As(err, &of) {
+		t.Fatalf("expected batch error, got %v", err)
+	}
+	if errorType(err) != "BatchError" {
+		t.Fatalf("type %s", errorType(err))
+	}
+
+	if _, err := Run(context.Background(), Event{}, fn); !errors.Is(err, ErrNoRecords) {
+		t.Fatalf("empty event: %v", err)
+	}
+}
+
+func TestRunSQS(t *testing.T) {
+	body := func(keys ...string) string {
+		b, _ := json.Marshal(s3Event(keys...))
+		return string(b)
+	}
+	sqs := events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "m1", EventSource: "aws:sqs", Body: body("a", "c")},
+		{MessageId: "m2", EventSource: "aws:sqs", Body: body("bad")},
+		{MessageId: "m3", EventSource: "aws:sqs", Body: "not json"},
+		{MessageId: "m4", EventSource: "aws:sqs", Body: `{"Service":"Amazon S3","Event":"s3:TestEvent"}`},
+		{MessageId: "m5", EventSource: "aws:sqs", Body: body("d", "bad2")},
+	}}
+	resp, err := Run(context.Background(), decode(t, sqs), fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var failedIDs []string
+	for _, f := range resp.BatchItemFailures {
+		failedIDs = append(failedIDs, f.ItemIdentifier)
+	}
+	if fmt.Sprint(failedIDs) != "[m2 m3 m5]" {
+		t.Fatalf("failures %v", failedIDs)
+	}
+	var got []string
+	for _, r := range resp.Records {
+		got = append(got, r.MessageID+":"+r.Key+":"+r.Status)
+	}
+	want := "[m1:a:ok m1:c:ok m2:bad:failed m3::failed m5:d:ok m5:bad2:failed]"
+	if fmt.Sprint(got) != want {
+		t.Fatalf("records %v", got)
+	}
+
+	b, _ := json.Marshal(resp)
+	var wire struct {
+		BatchItemFailures []struct {
+			ItemIdentifier string `json:"itemIdentifier"`
+		} `json:"batchItemFailures"`
+	}
+	if err := json.Unmarshal(b, &wire); err != nil || len(wire.BatchItemFailures) != 3 || wire.BatchItemFailures[0].ItemIdentifier != "m2" {
+		t.Fatalf("unexpected response shape %s", b)
+	}
+}
@@ -0,0 +1,43 @@
+package brokerauth
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSignVerify(t *testing.T) {
+	secret := []byte("s3cret")
+	now := time.Unix(1700000000, 0)
+	req, _ := http.NewRequest(http.MethodPost, "http://broker/refresh", nil)
+	SignRequest(req, secret, "logimporterror", nil, now)
+
+	caller, err := Verify(secret, req.Header.Get(HeaderCaller), req.Header.Get(HeaderTimestamp), req.Header.Get(HeaderSignature), http.MethodPost, "/refresh", nil, now)
+	if err != nil || caller != "logimporterror" {
+		t.Fatalf("unexpected: %s %v", caller, err)
+	}
+}
+
+func TestVerifyErrors(t *testing.T) {
+	secret := []byte("s3cret")
+	now := time.Unix(1700000000, 0)
+	ts := "1700000000"
+	sig := Sign(secret, "c", ts, http.MethodGet, "/sf/token", nil)
+
+	if _, err := Verify(secret, "", ts, sig, http.MethodGet, "/sf/token", nil, now); !errors.Is(err, ErrMissing) {
+		t.Fatalf("expected missing, got %v", err)
+	}
+	if _, err := Verify(secret, "c", ts, sig, http.MethodGet, "/sf/token", nil, now.Add(10*time.Minute)); !errors.Is(err, ErrExpired) {
+		t.Fatalf("expected expired, got %v", err)
+	}
+	if _, err := Verify(secret, "c", ts, sig, http.MethodPost, "/sf/token", nil, now); !errors.Is(err, ErrMismatch) {
+		t.Fatalf("expected mismatch, got %v", err)
+	}
+	if _, err := Verify(secret, "c", "nan", sig, http.MethodGet, "/sf/token", nil, now); !errors.Is(err, ErrMismatch) {
+		t.Fatalf("expected mismatch, got %v", err)
+	}
+	if _, err := Verify([]byte("other"), "c", ts, sig, http.MethodGet, "/sf/token", nil, now); !errors.Is(err, ErrMismatch) {
+		t.Fatalf("expected mismatch, got %v", err)
+	}
+}
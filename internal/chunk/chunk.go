@@ -0,0 +1,201 @@
+// Package chunk encodes parsed rows into the chunk files ParseFile writes
+// for large files, in the format a profile's output settings choose.
+package chunk
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// Formats of chunk files.
+const (
+	JSONL     = "jsonl"
+	GzipJSONL = "jsonl.gz"
+	CSV       = "csv"
+	Parquet   = "parquet"
+)
+
+// DefaultRows is the chunk size of profiles without output.chunkRows.
+const DefaultRows = 1000
+
+// Encoder accumulates the rows of one chunk.
+type Encoder interface {
+	// Write adds a row.
+	Write(row map[string]string) error
+	// Close finishes the chunk and returns its content.
+	Close() ([]byte, error)
+}
+
+// Ext returns the file extension of format, which is also its name.
+func Ext(format string) string {
+	if format == "" {
+		return JSONL
+	}
+	return format
+}
+
+// ContentType returns the media type chunks of format are uploaded with.
+func ContentType(format string) string {
+	switch format {
+	case GzipJSONL:
+		return "application/gzip"
+	case CSV:
+		return "text/csv"
+	case Parquet:
+		return "application/vnd.apache.parquet"
+	}
+	return "application/x-ndjson"
+}
+
+// New returns an encoder for format. CSV and Parquet chunks have one
+// column per entry of columns; values of other keys are dropped.
+func New(format string, columns []string) (Encoder, error) {
+	switch format {
+	case "", JSONL:
+		return &jsonlEncoder{}, nil
+	case GzipJSONL:
+		e := &jsonlEncoder{}
+		e.gz = gzip.NewWriter(&e.out)
+		return e, nil
+	case CSV:
+		e := &csvEncoder{cols: columns}
+		e.w = csv.NewWriter(&e.buf)
+		if err := e.w.Write(columns); err != nil {
+			return nil, err
+		}
+		return e, nil
+	case Parquet:
+		return newParquetEncoder(columns), nil
+	}
+	return nil, fmt.Errorf("unknown chunk format %q", format)
+}
+
+// RowSize estimates the uncompressed bytes row takes in a chunk as the
+// length of its JSON line, ignoring escapes. Chunks are split on it before
+// they are encoded.
+func RowSize(row map[string]string) int {
+	n := 2
+	for k, v := range row {
+		n += len(k) + len(v) + 6
+	}
+	return n
+}
+
+// Columns returns the sorted union of the keys of rows.
+func Columns(rows []map[string]string) []string {
+	set := map[string]bool{}
+	for _, r := range rows {
+		for k := range r {
+			set[k] = true
+		}
+	}
+	cols := make([]string, 0, len(set))
+	for k := range set {
+		cols = append(cols, k)
+	}
+	sort.Strings(cols)
+	return cols
+}
+
+// jsonlEncoder writes one JSON object per line, gzipped when gz is set.
+type jsonlEncoder struct {
+	out bytes.Buffer
+	gz  *gzip.Writer
+}
+
+func (e *jsonlEncoder) Write(row map[string]string) error {
+	b, err := json.Marshal(row)
+	if err != nil {
+		return fmt.Errorf("marshal row: %w", err)
+	}
+	b = append(b, '\n')
+	if e.gz != nil {
+		_, err = e.gz.Write(b)
+		return err
+	}
+	e.out.Write(b)
+	return nil
+}
+
+func (e *jsonlEncoder) Close() ([]byte, error) {
+	if e.gz != nil {
+		if err := e.gz.Close(); err != nil {
+			return nil, fmt.Errorf("gzip: %w", err)
+		}
+	}
+	return e.out.Bytes(), nil
+}
+
+// csvEncoder writes a header line and one record per row.
+type csvEncoder struct {
+	cols []string
+	buf  bytes.Buffer
+	w    *csv.Writer
+}
+
+func (e *csvEncoder) Write(row map[string]string) error {
+	rec := make([]string, len(e.cols))
+	for i, c := range e.cols {
+		rec[i] = row[c]
+	}
+	if err := e.w.Write(rec); err != nil {
+		return err
+	}
+	e.w.Flush()
+	return e.w.Error()
+}
+
+func (e *csvEncoder) Close() ([]byte, error) {
+	e.w.Flush()
+	return e.buf.Bytes(), e.w.Error()
+}
+
+// parquetEncoder writes Snappy-compressed Parquet with one optional string
+// column per entry of cols; missing keys are null.
+type parquetEncoder struct {
+	cols []string
+	buf  bytes.Buffer
+	w    *parquet.Writer
+}
+
+func newParquetEncoder(cols []string) *parquetEncoder {
+	// Group orders its fields by name, so column i is the i-th sorted name.
+	sorted := append([]string(nil), cols...)
+	sort.Strings(sorted)
+	g := parquet.Group{}
+	for _, c := range sorted {
+		g[c] = parquet.Optional(parquet.String())
+	}
+	e := &parquetEncoder{cols: sorted}
+	e.w = parquet.NewWriter(&e.buf, parquet.NewSchema("row", g), parquet.Compression(&parquet.Snappy))
+	return e
+}
+
+func (e *parquetEncoder) Write(row map[string]string) error {
+	r := make(parquet.Row, len(e.cols))
+	for i, c := range e.cols {
+		v, ok := row[c]
+		if !ok {
+			r[i] = parquet.Value{}.Level(0, 0, i)
+			continue
+		}
+		r[i] = parquet.ValueOf(v).Level(0, 1, i)
+	}
+	if _, err := e.w.WriteRows([]parquet.Row{r}); err != nil {
+		return fmt.Errorf("parquet: %w", err)
+	}
+	return nil
+}
+
+func (e *parquetEncoder) Close() ([]byte, error) {
+	if err := e.w.Close(); err != nil {
+		return nil, fmt.Errorf("parquet: %w", err)
+	}
+	return e.buf.Bytes(), nil
+}
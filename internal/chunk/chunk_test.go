@@ -0,0 +1,123 @@
+package chunk
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+var rows = []map[string]string{
+	{"Id": "1", "Name": "Ann, \"A\""},
+	{"Id": "2", "Note": "x"},
+}
+
+func encode(t *testing.T, format string) []byte {
+	t.Helper()
+	e, err := New(format, Columns(rows))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range rows {
+		if err := e.Write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := e.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func jsonLines(t *testing.T, r io.Reader) []map[string]string {
+	t.Helper()
+	var got []map[string]string
+	dec := json.NewDecoder(r)
+	for dec.More() {
+		var m map[string]string
+		if err := dec.Decode(&m); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, m)
+	}
+	return got
+}
+
+func TestJSONL(t *testing.T) {
+	b := encode(t, JSONL)
+	if got := jsonLines(t, bytes.NewReader(b)); !reflect.DeepEqual(got, rows) {
+		t.Fatalf("got %v", got)
+	}
+	size := 0
+	for _, r := range rows {
+		size += RowSize(r)
+	}
+	if size != len(b)-2 {
+		t.Fatalf("estimated %d bytes for %d, two of them escapes", size, len(b))
+	}
+}
+
+func TestGzipJSONL(t *testing.T) {
+	b := encode(t, GzipJSONL)
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := jsonLines(t, zr); !reflect.DeepEqual(got, rows) {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestCSV(t *testing.T) {
+	b := encode(t, CSV)
+	recs, err := csv.NewReader(bytes.NewReader(b)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{"Id", "Name", "Note"}, {"1", "Ann, \"A\"", ""}, {"2", "", "x"}}
+	if !reflect.DeepEqual(recs, want) {
+		t.Fatalf("got %q", recs)
+	}
+}
+
+func TestParquet(t *testing.T) {
+	b := encode(t, Parquet)
+	f, err := parquet.OpenFile(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.NumRows() != 2 {
+		t.Fatalf("rows = %d", f.NumRows())
+	}
+	r := parquet.NewReader(f)
+	got := make([]parquet.Row, 2)
+	if n, err := r.ReadRows(got); n != 2 {
+		t.Fatalf("read %d rows: %v", n, err)
+	}
+	cols := f.Schema().Columns()
+	if len(cols) != 3 || cols[1][0] != "Name" {
+		t.Fatalf("columns %v", cols)
+	}
+	if v := got[0][1]; v.IsNull() || v.String() != "Ann, \"A\"" {
+		t.Fatalf("row 0 Name = %v", v)
+	}
+	if !got[1][1].IsNull() || got[1][2].String() != "x" {
+		t.Fatalf("row 1 = %v", got[1])
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New("xml", nil); err == nil || !strings.Contains(err.Error(), "xml") {
+		t.Fatalf("expected unknown format, got %v", err)
+	}
+	if Ext("") != JSONL || Ext(Parquet) != "parquet" || ContentType(GzipJSONL) != "application/gzip" {
+		t.Fatal("unexpected defaults")
+	}
+}
@@ -0,0 +1,293 @@
+// Package circuit implements a circuit breaker around Salesforce calls whose
+// state lives in DynamoDB, so every Lambda instance trips and recovers
+// together.
+package circuit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultThreshold is the number of consecutive failures that opens the circuit.
+	DefaultThreshold = 5
+	// DefaultOpenFor is how long the circuit stays open before a probe is allowed.
+	DefaultOpenFor = 30 * time.Second
+)
+
+// DynamoAPI is the subset of the DynamoDB client used by Breaker.
+type DynamoAPI interface {
+	GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+	UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
+}
+
+// CircuitOpenError is returned instead of calling Salesforce while the circuit
+// is open. Lambda reports the type name as the error type, so state machines
+// can match "CircuitOpenError" in Retry and Catch and wait RetryAfter.
+type CircuitOpenError struct {
+	Name       string
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit %s open, retry after %s", e.Name, e.RetryAfter.Round(time.Second))
+}
+
+// Breaker is a circuit breaker backed by a single DynamoDB item keyed by Name.
+// The item holds the consecutive failure count, the time the circuit stays
+// open until and, while half-open, the lease of the single probing caller.
+// A nil Breaker allows every call. DynamoDB errors fail open so the breaker
+// never causes an outage of its own.
+type Breaker struct {
+	DB        DynamoAPI
+	Table     string
+	Name      string
+	Threshold int
+	OpenFor   time.Duration
+	Log       *zap.SugaredLogger
+	Now       func() time.Time
+
+	// dirty is set when this instance last saw failures or an open circuit,
+	// so successes only write to DynamoDB when there is something to reset.
+	dirty atomic.Bool
+}
+
+// FromEnv builds a Breaker from CIRCUIT_TABLE, CIRCUIT_NAME,
+// CIRCUIT_THRESHOLD and CIRCUIT_OPEN_SECONDS. It returns nil when
+// CIRCUIT_TABLE is unset.
+func FromEnv(db DynamoAPI, log *zap.SugaredLogger) *Breaker {
+	table := os.Getenv("CIRCUIT_TABLE")
+	if table == "" {
+		return nil
+	}
+	b := &Breaker{DB: db, Table: table, Name: os.Getenv("CIRCUIT_NAME"), Log: log}
+	if b.Name == "" {
+		b.Name = "salesforce"
+	}
+	if n, err := strconv.Atoi(os.Getenv("CIRCUIT_THRESHOLD")); err == nil && n > 0 {
+		b.Threshold = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("CIRCUIT_OPEN_SECONDS")); err == nil && n > 0 {
+		b.OpenFor = time.Duration(n) * time.Second
+	}
+	return b
+}
+
+// state is the breaker item as stored in DynamoDB.
+type state struct {
+	failures   int
+	openUntil  time.Time
+	probeUntil time.Time
+}
+
+// Allow returns a *CircuitOpenError when the circuit is open. Once OpenFor
+// has elapsed exactly one caller is let through as a probe; the others keep
+// failing fast until the probe is recorded.
+func (b *Breaker) Allow(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+	st, err := b.load(ctx)
+	if err != nil {
+		b.warn("circuit load", err)
+		return nil
+	}
+	b.dirty.Store(st.failures > 0 || !st.openUntil.IsZero())
+	now := b.now()
+	if st.openUntil.IsZero() {
+		return nil
+	}
+	if now.Before(st.openUntil) {
+		return &CircuitOpenError{Name: b.Name, RetryAfter: st.openUntil.Sub(now)}
+	}
+	lease := now.Add(b.openFor())
+	_, err = b.DB.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           &b.Table,
+		Key:                 b.key(),
+		UpdateExpression:    aws.String("SET ProbeUntil = :lease"),
+		ConditionExpression: aws.String("OpenUntil = :open AND (attribute_not_exists(ProbeUntil) OR ProbeUntil < :now)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":lease": millis(lease),
+			":open":  millis(st.openUntil),
+			":now":   millis(now),
+		},
+	})
+	var ccf *types.ConditionalCheckFailedException
+	switch {
+	case errors.As(err, &ccf):
+		wait := st.probeUntil.Sub(now)
+		if wait <= 0 {
+			wait = b.openFor()
+		}
+		return &CircuitOpenError{Name: b.Name, RetryAfter: wait}
+	case err != nil:
+		b.warn("circuit probe", err)
+	default:
+		b.info("circuit half-open, probing")
+	}
+	return nil
+}
+
+// Record updates the breaker with the outcome of a call. Transport errors,
+// timeouts and 5xx responses count as failures; a cancelled context does not
+// count either way.
+func (b *Breaker) Record(ctx context.Context, resp *http.Response, err error) {
+	if b == nil {
+		return
+	}
+	switch {
+	case errors.Is(err, context.Canceled):
+		return
+	case err != nil || resp.StatusCode >= 500:
+		b.failure(ctx)
+	default:
+		b.success(ctx)
+	}
+}
+
+// success closes the circuit and resets the failure count. The write is
+// skipped when the item was already clean.
+func (b *Breaker) success(ctx context.Context) {
+	if !b.dirty.Swap(false) {
+		return
+	}
+	_, err := b.DB.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           &b.Table,
+		Key:                 b.key(),
+		UpdateExpression:    aws.String("REMOVE Failures, OpenUntil, ProbeUntil"),
+		ConditionExpression: aws.String("attribute_exists(Failures) OR attribute_exists(OpenUntil)"),
+	})
+	var ccf *types.ConditionalCheckFailedException
+	if err != nil && !errors.As(err, &ccf) {
+		b.warn("circuit reset", err)
+		return
+	}
+	if err == nil {
+		b.info("circuit closed")
+	}
+}
+
+// failure increments the failure count and opens the circuit once Threshold
+// is reached or when a half-open probe fails.
+func (b *Breaker) failure(ctx context.Context) {
+	out, err := b.DB.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 &b.Table,
+		Key:                       b.key(),
+		UpdateExpression:          aws.String("ADD Failures :one"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{":one": &types.AttributeValueMemberN{Value: "1"}},
+		ReturnValues:              types.ReturnValueAllNew,
+	})
+	b.dirty.Store(true)
+	if err != nil {
+		b.warn("circuit failure", err)
+		return
+	}
+	st := decode(out.Attributes)
+	now := b.now()
+	halfOpen := !st.openUntil.IsZero() && !now.Before(st.openUntil)
+	if st.failures < b.threshold() && !halfOpen {
+		return
+	}
+	if !st.openUntil.IsZero() && now.Before(st.openUntil) {
+		return
+	}
+	until := now.Add(b.openFor())
+	if _, err := b.DB.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 &b.Table,
+		Key:                       b.key(),
+		UpdateExpression:          aws.String("SET OpenUntil = :until REMOVE ProbeUntil"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{":until": millis(until)},
+	}); err != nil {
+		b.warn("circuit open", err)
+		return
+	}
+	if b.Log != nil {
+		b.Log.Warnw("circuit opened", "name", b.Name, "failures", st.failures, "until", until)
+	}
+}
+
+// load reads the breaker item.
+func (b *Breaker) load(ctx context.Context) (state, error) {
+	out, err := b.DB.GetItem(ctx, &dynamodb.GetItemInput{TableName: &b.Table, Key: b.key(), ConsistentRead: aws.Bool(true)})
+	if err != nil {
+		return state{}, err
+	}
+	return decode(out.Item), nil
+}
+
+// decode converts a DynamoDB item to state; missing attributes are zero.
+func decode(item map[string]types.AttributeValue) state {
+	var st state
+	if v, ok := item["Failures"].(*types.AttributeValueMemberN); ok {
+		st.failures, _ = strconv.Atoi(v.Value)
+	}
+	st.openUntil = timeAttr(item["OpenUntil"])
+	st.probeUntil = timeAttr(item["ProbeUntil"])
+	return st
+}
+
+// timeAttr parses a Unix millisecond number attribute.
+func timeAttr(av types.AttributeValue) time.Time {
+	v, ok := av.(*types.AttributeValueMemberN)
+	if !ok {
+		return time.Time{}
+	}
+	ms, err := strconv.ParseInt(v.Value, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
+
+// millis encodes t as a Unix millisecond number attribute.
+func millis(t time.Time) types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(t.UnixMilli(), 10)}
+}
+
+func (b *Breaker) key() map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{"PK": &types.AttributeValueMemberS{Value: b.Name}}
+}
+
+func (b *Breaker) threshold() int {
+	if b.Threshold > 0 {
+		return b.Threshold
+	}
+	return DefaultThreshold
+}
+
+func (b *Breaker) openFor() time.Duration {
+	if b.OpenFor > 0 {
+		return b.OpenFor
+	}
+	return DefaultOpenFor
+}
+
+func (b *Breaker) now() time.Time {
+	if b.Now != nil {
+		return b.Now()
+	}
+	return time.Now()
+}
+
+func (b *Breaker) warn(msg string, err error) {
+	if b.Log != nil {
+		b.Log.Warnw(msg, "name", b.Name, "error", err)
+	}
+}
+
+func (b *Breaker) info(msg string) {
+	if b.Log != nil {
+		b.Log.Infow(msg, "name", b.Name)
+	}
+}
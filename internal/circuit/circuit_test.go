@@ -0,0 +1,225 @@
+package circuit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// fakeDB keeps the breaker item in memory and understands the update
+// expressions issued by Breaker.
+type fakeDB struct {
+	mu      sync.Mutex
+	item    map[string]types.AttributeValue
+	err     error
+	updates int
+}
+
+func (f *fakeDB) GetItem(ctx context.Context, in *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	out := map[string]types.AttributeValue{}
+	for k, v := range f.item {
+		out[k] = v
+	}
+	return &dynamodb.GetItemOutput{Item: out}, nil
+}
+
+func (f *fakeDB) UpdateItem(ctx context.Context, in *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	f.updates++
+	if f.item == nil {
+		f.item = map[string]types.AttributeValue{}
+	}
+	vals := in.ExpressionAttributeValues
+	switch aws.ToString(in.UpdateExpression) {
+	case "ADD Failures :one":
+		n := num(f.item["Failures"]) + 1
+		f.item["Failures"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(n, 10)}
+	case "SET OpenUntil = :until REMOVE ProbeUntil":
+		f.item["OpenUntil"] = vals[":until"]
+		delete(f.item, "ProbeUntil")
+	case "SET ProbeUntil = :lease":
+		probe, ok := f.item["ProbeUntil"]
+		if num(f.item["OpenUntil"]) != num(vals[":open"]) || (ok && num(probe) >= num(vals[":now"])) {
+			return nil, &types.ConditionalCheckFailedException{}
+		}
+		f.item["ProbeUntil"] = vals[":lease"]
+	case "REMOVE Failures, OpenUntil, ProbeUntil":
+		_, hasF := f.item["Failures"]
+		_, hasO := f.item["OpenUntil"]
+		if !hasF && !hasO {
+			return nil, &types.ConditionalCheckFailedException{}
+		}
+		delete(f.item, "Failures")
+		delete(f.item, "OpenUntil")
+		delete(f.item, "ProbeUntil")
+	}
+	return &dynamodb.UpdateItemOutput{Attributes: f.item}, nil
+}
+
+func num(av types.AttributeValue) int64 {
+	v, _ := av.(*types.AttributeValueMemberN)
+	if v == nil {
+		return 0
+	}
+	n, _ := strconv.ParseInt(v.Value, 10, 64)
+	return n
+}
+
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time { return c.t }
+
+func newBreaker(db *fakeDB, c *clock) *Breaker {
+	return &Breaker{DB: db, Table: "circuit", Name: "salesforce", Threshold: 3, OpenFor: 30 * time.Second, Now: c.now}
+}
+
+var (
+	resp500 = &http.Response{StatusCode: http.StatusInternalServerError}
+	resp200 = &http.Response{StatusCode: http.StatusOK}
+)
+
+func TestOpensAfterThreshold(t *testing.T) {
+	db := &fakeDB{}
+	c := &clock{t: time.Unix(1000, 0)}
+	b := newBreaker(db, c)
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if err := b.Allow(ctx); err != nil {
+			t.Fatalf("attempt %d: %v", i, err)
+		}
+		b.Record(ctx, resp500, nil)
+	}
+	err := b.Allow(ctx)
+	var oe *CircuitOpenError
+	if !errors.As(err, &oe) {
+		t.Fatalf("expected CircuitOpenError, got %v", err)
+	}
+	if oe.RetryAfter != 30*time.Second || oe.Name != "salesforce" {
+		t.Fatalf("unexpected error %+v", oe)
+	}
+}
+
+func TestTimeoutsCountAndSuccessResets(t *testing.T) {
+	db := &fakeDB{}
+	c := &clock{t: time.Unix(1000, 0)}
+	b := newBreaker(db, c)
+	ctx := context.Background()
+	b.Record(ctx, nil, context.DeadlineExceeded)
+	b.Record(ctx, nil, errors.New("dial tcp: timeout"))
+	b.Record(ctx, &http.Response{StatusCode: http.StatusBadRequest}, nil)
+	b.Record(ctx, resp500, nil)
+	b.Record(ctx, resp500, nil)
+	if err := b.Allow(ctx); err != nil {
+		t.Fatalf("4xx should reset the failure count: %v", err)
+	}
+	b.Record(ctx, nil, context.Canceled)
+	if num(db.item["Failures"]) != 2 {
+		t.Fatalf("cancelled calls should not count, failures=%d", num(db.item["Failures"]))
+	}
+}
+
+func TestSuccessSkipsWriteWhenClean(t *testing.T) {
+	db := &fakeDB{}
+	b := newBreaker(db, &clock{t: time.Unix(1000, 0)})
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		_ = b.Allow(ctx)
+		b.Record(ctx, resp200, nil)
+	}
+	if db.updates != 0 {
+		t.Fatalf("expected no writes, got %d", db.updates)
+	}
+}
+
+func TestHalfOpenSingleProbe(t *testing.T) {
+	db := &fakeDB{}
+	c := &clock{t: time.Unix(1000, 0)}
+	b := newBreaker(db, c)
+	other := newBreaker(db, c)
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		b.Record(ctx, resp500, nil)
+	}
+	c.t = c.t.Add(31 * time.Second)
+	if err := b.Allow(ctx); err != nil {
+		t.Fatalf("probe should be allowed: %v", err)
+	}
+	var oe *CircuitOpenError
+	if err := other.Allow(ctx); !errors.As(err, &oe) {
+		t.Fatalf("second caller should fail fast, got %v", err)
+	}
+
+	// probe fails: circuit reopens for another OpenFor
+	b.Record(ctx, resp500, nil)
+	if err := other.Allow(ctx); !errors.As(err, &oe) || oe.RetryAfter != 30*time.Second {
+		t.Fatalf("expected reopened circuit, got %v", err)
+	}
+
+	// next probe succeeds: circuit closes for everyone
+	c.t = c.t.Add(31 * time.Second)
+	if err := b.Allow(ctx); err != nil {
+		t.Fatalf("probe should be allowed: %v", err)
+	}
+	b.Record(ctx, resp200, nil)
+	if err := other.Allow(ctx); err != nil {
+		t.Fatalf("expected closed circuit, got %v", err)
+	}
+	if len(db.item) != 0 {
+		t.Fatalf("expected clean item, got %v", db.item)
+	}
+}
+
+func TestFailOpenOnStoreError(t *testing.T) {
+	db := &fakeDB{err: errors.New("throttled")}
+	b := newBreaker(db, &clock{t: time.Unix(1000, 0)})
+	if err := b.Allow(context.Background()); err != nil {
+		t.Fatalf("expected fail open, got %v", err)
+	}
+	b.Record(context.Background(), resp500, nil)
+}
+
+func TestNilBreaker(t *testing.T) {
+	var b *Breaker
+	if err := b.Allow(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	b.Record(context.Background(), resp500, nil)
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("CIRCUIT_TABLE", "")
+	if FromEnv(&fakeDB{}, nil) != nil {
+		t.Fatal("expected nil breaker without table")
+	}
+	t.Setenv("CIRCUIT_TABLE", "circuit")
+	t.Setenv("CIRCUIT_THRESHOLD", "7")
+	t.Setenv("CIRCUIT_OPEN_SECONDS", "60")
+	b := FromEnv(&fakeDB{}, nil)
+	if b.Name != "salesforce" || b.Threshold != 7 || b.OpenFor != time.Minute {
+		t.Fatalf("unexpected breaker %+v", b)
+	}
+}
+
+func TestErrorName(t *testing.T) {
+	err := &CircuitOpenError{Name: "salesforce", RetryAfter: 1500 * time.Millisecond}
+	if err.Error() != "circuit salesforce open, retry after 2s" {
+		t.Fatalf("unexpected message %q", err.Error())
+	}
+}
@@ -0,0 +1,161 @@
+// Package enrich runs the enrichments declared in a Profile v2 over each
+// validated row. Every enrichment fills one output column; when it finds
+// no value the row keeps going unless the enrichment is required, in which
+// case the row is rejected. Step types are registered by name like
+// preprocess steps.
+package enrich
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/your-org/file-processor-sample/internal/profile"
+)
+
+// Lookup returns the value for row; ok is false on a miss.
+type Lookup func(ctx context.Context, row map[string]string) (value string, ok bool, err error)
+
+// Factory builds a Lookup from the step parameters. It may load reference
+// data up front and must reject bad parameters.
+type Factory func(ctx context.Context, deps Deps, params map[string]any) (Lookup, error)
+
+// Deps are the AWS clients available to enrichments.
+type Deps struct {
+	S3       S3API
+	DynamoDB DynamoAPI
+}
+
+var registry = map[string]Factory{}
+
+// Register makes an enrichment type available to profiles. It panics on a
+// duplicate name.
+func Register(name string, f Factory) {
+	if _, dup := registry[name]; dup {
+		panic("enrich: duplicate type " + name)
+	}
+	registry[name] = f
+}
+
+// Types lists the registered enrichment types.
+func Types() []string {
+	out := make([]string, 0, len(registry))
+	for k := range registry {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func init() {
+	Register("constant", newConstant)
+	Register("expression", newExpression)
+	Register("s3Lookup", newS3Lookup)
+	Register("dynamoLookup", newDynamoLookup)
+}
+
+type step struct {
+	typ      string
+	output   string
+	required bool
+	lookup   Lookup
+}
+
+// Engine applies enrichments in declaration order; later steps see the
+// columns filled by earlier ones.
+type Engine struct {
+	steps []step
+}
+
+// Build validates the enrichments and loads any reference data. Every step
+// takes "output", the column it fills, and "required", whether a miss
+// rejects the row (default false).
+func Build(ctx context.Context, steps []profile.Step, deps Deps) (*Engine, error) {
+	e := &Engine{}
+	for i, s := range steps {
+		f, ok := registry[s.Type]
+		if !ok {
+			return nil, fmt.Errorf("enrichments[%d]: unknown type %q (known: %s)", i, s.Type, strings.Join(Types(), ", "))
+		}
+		output, err := stringParam(s.Params, "output", true)
+		if err != nil {
+			return nil, fmt.Errorf("enrichments[%d] (%s): %w", i, s.Type, err)
+		}
+		required, ok := s.Params["required"].(bool)
+		if _, set := s.Params["required"]; set && !ok {
+			return nil, fmt.Errorf("enrichments[%d] (%s): required must be a boolean", i, s.Type)
+		}
+		lookup, err := f(ctx, deps, s.Params)
+		if err != nil {
+			return nil, fmt.Errorf("enrichments[%d] (%s): %w", i, s.Type, err)
+		}
+		e.steps = append(e.steps, step{typ: s.Type, output: output, required: required, lookup: lookup})
+	}
+	return e, nil
+}
+
+// Row enriches one row in place. When a required enrichment misses it
+// stops and returns that enrichment's output column.
+func (e *Engine) Row(ctx context.Context, r map[string]string) (missed string, err error) {
+	if e == nil {
+		return "", nil
+	}
+	for _, s := range e.steps {
+		v, ok, err := s.lookup(ctx, r)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", s.output, err)
+		}
+		if !ok {
+			if s.required {
+				return s.output, nil
+			}
+			continue
+		}
+		r[s.output] = v
+	}
+	return "", nil
+}
+
+// stringParam returns params[key] as a string.
+func stringParam(params map[string]any, key string, required bool) (string, error) {
+	v, ok := params[key]
+	if !ok {
+		if required {
+			return "", fmt.Errorf("%s is required", key)
+		}
+		return "", nil
+	}
+	s, ok := v.(string)
+	if !ok || (required && s == "") {
+		return "", fmt.Errorf("%s must be a non-empty string", key)
+	}
+	return s, nil
+}
+
+// newConstant fills the output with "value".
+func newConstant(ctx context.Context, deps Deps, params map[string]any) (Lookup, error) {
+	v, ok := params["value"].(string)
+	if !ok {
+		return nil, fmt.Errorf("value must be a string")
+	}
+	return func(context.Context, map[string]string) (string, bool, error) {
+		return v, true, nil
+	}, nil
+}
+
+// newExpression fills the output from "expr"; an empty result is a miss.
+func newExpression(ctx context.Context, deps Deps, params map[string]any) (Lookup, error) {
+	src, err := stringParam(params, "expr", true)
+	if err != nil {
+		return nil, err
+	}
+	e, err := compileExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	return func(_ context.Context, row map[string]string) (string, bool, error) {
+		v := e.eval(row)
+		return v, v != "", nil
+	}, nil
+}
@@ -0,0 +1,188 @@
+package enrich
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"github.com/your-org/file-processor-sample/internal/profile"
+)
+
+type fakeS3 struct {
+	objects map[string]string
+}
+
+func (f *fakeS3) GetObject(ctx context.Context, in *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	body, ok := f.objects[*in.Bucket+"/"+*in.Key]
+	if !ok {
+		return nil, fmt.Errorf("no such key %s", *in.Key)
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(body))}, nil
+}
+
+type fakeDB struct {
+	items map[string]map[string]types.AttributeValue
+	calls int
+	err   error
+}
+
+func (f *fakeDB) GetItem(ctx context.Context, in *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	k := in.Key["MemberNumber"].(*types.AttributeValueMemberS).Value
+	return &dynamodb.GetItemOutput{Item: f.items[k]}, nil
+}
+
+func steps(t *testing.T, doc string) []profile.Step {
+	t.Helper()
+	var s []profile.Step
+	if err := json.Unmarshal([]byte(doc), &s); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestEngine(t *testing.T) {
+	deps := Deps{
+		S3: &fakeS3{objects: map[string]string{
+			"ref/states.csv":  "Code;Name\nFL;Florida\nTX;Texas\n",
+			"ref/agents.json": `[{"id": 7, "email": "a@x.com"}, {"id": 8, "email": "b@x.com"}]`,
+			"ref/tiers.json":  `{"gold": 1, "silver": 2}`,
+		}},
+		DynamoDB: &fakeDB{items: map[string]map[string]types.AttributeValue{
+			"M1": {"Segment": &types.AttributeValueMemberS{Value: "retail"}},
+		}},
+	}
+	doc := `[
+		{"type": "constant", "output": "Source", "value": "flood_qns"},
+		{"type": "s3Lookup", "output": "StateName", "bucket": "ref", "key": "states.csv", "delimiter": ";", "input": "State", "match": "Code", "value": "Name", "required": true},
+		{"type": "s3Lookup", "output": "AgentEmail", "bucket": "ref", "key": "agents.json", "input": "AgentId", "match": "id", "value": "email"},
+		{"type": "s3Lookup", "output": "Tier", "bucket": "ref", "key": "tiers.json", "input": "Level"},
+		{"type": "dynamoLookup", "output": "Segment", "table": "members", "key": "MemberNumber", "input": "MemberNumber", "attribute": "Segment"},
+		{"type": "expression", "output": "FullName", "expr": "upper(trim(LastName)) + \", \" + coalesce(col(\"First Name\"), \"?\")"}
+	]`
+	e, err := Build(context.Background(), steps(t, doc), deps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := []map[string]string{
+		{"State": "FL", "AgentId": "7", "Level": "gold", "MemberNumber": "M1", "LastName": " doe ", "First Name": "Jane"},
+		{"State": "ZZ", "MemberNumber": "M1"},
+		{"State": "TX", "MemberNumber": "M2", "LastName": "roe"},
+		{"State": "FL", "MemberNumber": "M1"},
+	}
+	var kept []map[string]string
+	for i, r := range rows {
+		missed, err := e.Row(context.Background(), r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (missed != "") != (i == 1) {
+			t.Fatalf("row %d: missed %q, expected only the unknown state rejected", i, missed)
+		}
+		if missed == "" {
+			kept = append(kept, r)
+		}
+	}
+	if missed, _ := e.Row(context.Background(), map[string]string{"State": "ZZ"}); missed != "StateName" {
+		t.Fatalf("missed = %q, want StateName", missed)
+	}
+	first := kept[0]
+	want := map[string]string{"Source": "flood_qns", "StateName": "Florida", "AgentEmail": "a@x.com", "Tier": "1", "Segment": "retail", "FullName": "DOE, Jane"}
+	for k, v := range want {
+		if first[k] != v {
+			t.Errorf("%s = %q, want %q", k, first[k], v)
+		}
+	}
+	if _, ok := kept[1]["Segment"]; ok {
+		t.Error("optional miss should leave the column unset")
+	}
+	if kept[1]["FullName"] != "ROE, ?" {
+		t.Errorf("FullName = %q", kept[1]["FullName"])
+	}
+	if db := deps.DynamoDB.(*fakeDB); db.calls != 2 {
+		t.Errorf("expected repeated keys to be cached, got %d calls", db.calls)
+	}
+}
+
+func TestDynamoError(t *testing.T) {
+	deps := Deps{DynamoDB: &fakeDB{err: errors.New("throttled")}}
+	e, err := Build(context.Background(), steps(t, `[{"type":"dynamoLookup","output":"S","table":"t","key":"MemberNumber","input":"M","attribute":"S"}]`), deps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Row(context.Background(), map[string]string{"M": "1"}); err == nil || !strings.Contains(err.Error(), "throttled") {
+		t.Fatalf("expected lookup failure, got %v", err)
+	}
+}
+
+func TestBuildErrors(t *testing.T) {
+	deps := Deps{S3: &fakeS3{objects: map[string]string{"ref/bad.csv": "A,B\n", "ref/t.xml": ""}}, DynamoDB: &fakeDB{}}
+	for _, doc := range []string{
+		`[{"type":"geocode","output":"x"}]`,
+		`[{"type":"constant","value":"x"}]`,
+		`[{"type":"constant","output":"o","value":"x","required":"yes"}]`,
+		`[{"type":"constant","output":"o"}]`,
+		`[{"type":"expression","output":"o","expr":"upper(a"}]`,
+		`[{"type":"expression","output":"o","expr":"nope(a)"}]`,
+		`[{"type":"expression","output":"o","expr":"substr(a)"}]`,
+		`[{"type":"expression","output":"o","expr":"col(a)"}]`,
+		`[{"type":"expression","output":"o","expr":"a b"}]`,
+		`[{"type":"s3Lookup","output":"o","bucket":"ref","key":"missing.csv","input":"a","match":"A","value":"B"}]`,
+		`[{"type":"s3Lookup","output":"o","bucket":"ref","key":"bad.csv","input":"a","match":"A","value":"C"}]`,
+		`[{"type":"s3Lookup","output":"o","bucket":"ref","key":"t.xml","input":"a"}]`,
+		`[{"type":"dynamoLookup","output":"o","table":"t","input":"a"}]`,
+	} {
+		if _, err := Build(context.Background(), steps(t, doc), deps); err == nil {
+			t.Errorf("%s: expected error", doc)
+		}
+	}
+}
+
+func TestExpressions(t *testing.T) {
+	row := map[string]string{"a": "Hello", "b": "", "n": "12345", "neg": "-1", "two": "2"}
+	cases := map[string]string{
+		`a`:                                   "Hello",
+		`"x" + a + "y"`:                       "xHelloy",
+		`lower(a)`:                            "hello",
+		`substr(n, 1, 3)`:                     "234",
+		`substr(n, 3)`:                        "45",
+		`substr(n, 9)`:                        "",
+		`substr(n, 1, two)`:                   "23",
+		`substr(n, 2, neg)`:                   "",
+		`substr(n, 2, a)`:                     "",
+		`substr(n, a)`:                        "",
+		`substr(n, 1, 99)`:                    "2345",
+		`substr(n, 1, "9223372036854775807")`: "2345",
+		`replace(a, "l", "L")`:                "HeLLo",
+		`concat(b, a, "!")`:                   "Hello!",
+		`coalesce(b, missing, "def")`:         "def",
+		`("[" + (a + "]"))`:                   "[Hello]",
+		`"tab\tquote\""`:                      "tab\tquote\"",
+	}
+	for src, want := range cases {
+		e, err := compileExpr(src)
+		if err != nil {
+			t.Errorf("%s: %v", src, err)
+			continue
+		}
+		if got := e.eval(row); got != want {
+			t.Errorf("%s = %q, want %q", src, got, want)
+		}
+	}
+	for _, src := range []string{``, `"open`, `a +`, `(a`, `upper(a,)`, `#`} {
+		if _, err := compileExpr(src); err == nil {
+			t.Errorf("%q: expected error", src)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package enrich
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// expr is a compiled derived-field expression. The language has string
+// literals ("..."), integer literals, column references (MemberNumber, or col("Member No")
+// for names that are not identifiers), function calls and "+" for
+// concatenation:
+//
+//	upper(trim(LastName)) + ", " + FirstName
+//	coalesce(MobilePhone, HomePhone)
+type expr interface {
+	eval(row map[string]string) string
+}
+
+type literal string
+
+func (l literal) eval(map[string]string) string { return string(l) }
+
+type column string
+
+func (c column) eval(row map[string]string) string { return row[string(c)] }
+
+type concat []expr
+
+func (c concat) eval(row map[string]string) string {
+	var b strings.Builder
+	for _, e := range c {
+		b.WriteString(e.eval(row))
+	}
+	return b.String()
+}
+
+type call struct {
+	fn   func(args []string) string
+	args []expr
+}
+
+func (c call) eval(row map[string]string) string {
+	vals := make([]string, len(c.args))
+	for i, a := range c.args {
+		vals[i] = a.eval(row)
+	}
+	return c.fn(vals)
+}
+
+// function describes a built-in: its arity range and implementation.
+type function struct {
+	min, max int // max < 0 means variadic
+	fn       func(args []string) string
+}
+
+var functions = map[string]function{
+	"upper":   {1, 1, func(a []string) string { return strings.ToUpper(a[0]) }},
+	"lower":   {1, 1, func(a []string) string { return strings.ToLower(a[0]) }},
+	"trim":    {1, 1, func(a []string) string { return strings.TrimSpace(a[0]) }},
+	"concat":  {0, -1, func(a []string) string { return strings.Join(a, "") }},
+	"replace": {3, 3, func(a []string) string { return strings.ReplaceAll(a[0], a[1], a[2]) }},
+	"coalesce": {1, -1, func(a []string) string {
+		for _, s := range a {
+			if s != "" {
+				return s
+			}
+		}
+		return ""
+	}},
+	"substr": {2, 3, func(a []string) string {
+		// start and length may come from row data: anything that is not a
+		// usable number yields "".
+		r := []rune(a[0])
+		start, err := strconv.Atoi(a[1])
+		if err != nil || start < 0 || start > len(r) {
+			return ""
+		}
+		end := len(r)
+		if len(a) == 3 {
+			n, err := strconv.Atoi(a[2])
+			if err != nil || n < 0 {
+				return ""
+			}
+			if n < end-start {
+				end = start + n
+			}
+		}
+		return string(r[start:end])
+	}},
+}
+
+// compileExpr parses src.
+func compileExpr(src string) (expr, error) {
+	p := &parser{src: src}
+	e, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	p.space()
+	if p.pos < len(p.src) {
+		return nil, p.errorf("unexpected %q", p.src[p.pos:])
+	}
+	return e, nil
+}
+
+type parser struct {
+	src string
+	pos int
+}
+
+func (p *parser) errorf(format string, args ...any) error {
+	return fmt.Errorf("expression at %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) space() {
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *parser) peek() byte {
+	p.space()
+	if p.pos < len(p.src) {
+		return p.src[p.pos]
+	}
+	return 0
+}
+
+// expr := term ('+' term)*
+func (p *parser) expr() (expr, error) {
+	first, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	parts := concat{first}
+	for p.peek() == '+' {
+		p.pos++
+		t, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, t)
+	}
+	if len(parts) == 1 {
+		return first, nil
+	}
+	return parts, nil
+}
+
+// term := string | '(' expr ')' | ident | ident '(' args ')'
+func (p *parser) term() (expr, error) {
+	switch c := p.peek(); {
+	case c == '"':
+		s, err := p.str()
+		return literal(s), err
+	case c == '(':
+		p.pos++
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, p.errorf("missing )")
+		}
+		p.pos++
+		return e, nil
+	case c >= '0' && c <= '9':
+		start := p.pos
+		for p.pos < len(p.src) && p.src[p.pos] >= '0' && p.src[p.pos] <= '9' {
+			p.pos++
+		}
+		return literal(p.src[start:p.pos]), nil
+	case isIdent(c):
+		start := p.pos
+		for p.pos < len(p.src) && isIdent(p.src[p.pos]) {
+			p.pos++
+		}
+		name := p.src[start:p.pos]
+		if p.peek() != '(' {
+			return column(name), nil
+		}
+		p.pos++
+		args, err := p.args()
+		if err != nil {
+			return nil, err
+		}
+		if name == "col" {
+			if len(args) == 1 {
+				if lit, ok := args[0].(literal); ok {
+					return column(lit), nil
+				}
+			}
+			return nil, p.errorf("col takes one string literal")
+		}
+		f, ok := functions[name]
+		if !ok {
+			return nil, p.errorf("unknown function %s", name)
+		}
+		if len(args) < f.min || (f.max >= 0 && len(args) > f.max) {
+			return nil, p.errorf("%s: wrong number of arguments", name)
+		}
+		return call{fn: f.fn, args: args}, nil
+	case c == 0:
+		return nil, p.errorf("unexpected end")
+	default:
+		return nil, p.errorf("unexpected %q", c)
+	}
+}
+
+// args parses a comma separated list up to and including ')'.
+func (p *parser) args() ([]expr, error) {
+	var out []expr
+	if p.peek() == ')' {
+		p.pos++
+		return out, nil
+	}
+	for {
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case ')':
+			p.pos++
+			return out, nil
+		default:
+			return nil, p.errorf("expected , or )")
+		}
+	}
+}
+
+// str parses a double quoted literal with Go escapes.
+func (p *parser) str() (string, error) {
+	start := p.pos
+	p.pos++
+	for p.pos < len(p.src) {
+		switch p.src[p.pos] {
+		case '\\':
+			p.pos += 2
+			continue
+		case '"':
+			p.pos++
+			s, err := strconv.Unquote(p.src[start:p.pos])
+			if err != nil {
+				return "", p.errorf("bad string: %v", err)
+			}
+			return s, nil
+		}
+		p.pos++
+	}
+	return "", p.errorf("unterminated string")
+}
+
+func isIdent(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
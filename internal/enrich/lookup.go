@@ -0,0 +1,248 @@
+package enrich
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// S3API abstracts the S3 GetObject operation for testability.
+type S3API interface {
+	GetObject(ctx context.Context, in *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+// DynamoAPI abstracts the DynamoDB GetItem operation for testability.
+type DynamoAPI interface {
+	GetItem(ctx context.Context, in *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+}
+
+// newS3Lookup loads a reference table from s3://bucket/key once and maps
+// the row's "input" column through it. CSV tables (header row, "delimiter"
+// default ",") and JSON arrays of objects need "match", the table column
+// holding the key, and "value", the column returned. A JSON object is used
+// directly as key to value. "format" defaults from the key extension.
+func newS3Lookup(ctx context.Context, deps Deps, params map[string]any) (Lookup, error) {
+	var bucket, key, input, format, match, value, delim string
+	var err error
+	get := func(dst *string, name string, required bool) {
+		if err == nil {
+			*dst, err = stringParam(params, name, required)
+		}
+	}
+	get(&bucket, "bucket", true)
+	get(&key, "key", true)
+	get(&input, "input", true)
+	get(&format, "format", false)
+	get(&match, "match", false)
+	get(&value, "value", false)
+	get(&delim, "delimiter", false)
+	if err != nil {
+		return nil, err
+	}
+	if format == "" {
+		format = strings.TrimPrefix(path.Ext(key), ".")
+	}
+	if format != "csv" && format != "json" {
+		return nil, fmt.Errorf("format must be csv or json, got %q", format)
+	}
+	if deps.S3 == nil {
+		return nil, fmt.Errorf("no S3 client")
+	}
+	out, err := deps.S3.GetObject(ctx, &s3.GetObjectInput{Bucket: &bucket, Key: &key})
+	if err != nil {
+		return nil, fmt.Errorf("get s3://%s/%s: %w", bucket, key, err)
+	}
+	defer out.Body.Close()
+
+	var table map[string]string
+	if format == "csv" {
+		table, err = csvTable(out.Body, delim, match, value)
+	} else {
+		table, err = jsonTable(out.Body, match, value)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("s3://%s/%s: %w", bucket, key, err)
+	}
+	return func(_ context.Context, row map[string]string) (string, bool, error) {
+		v, ok := table[row[input]]
+		return v, ok, nil
+	}, nil
+}
+
+// csvTable reads a delimited table with a header row.
+func csvTable(r io.Reader, delim, match, value string) (map[string]string, error) {
+	if match == "" || value == "" {
+		return nil, fmt.Errorf("match and value are required for csv")
+	}
+	cr := csv.NewReader(r)
+	if delim != "" {
+		if len([]rune(delim)) != 1 {
+			return nil, fmt.Errorf("delimiter must be one character")
+		}
+		cr.Comma = []rune(delim)[0]
+	}
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+	mi, vi := -1, -1
+	for i, h := range header {
+		switch strings.TrimSpace(h) {
+		case match:
+			mi = i
+		case value:
+			vi = i
+		}
+	}
+	if mi < 0 || vi < 0 {
+		return nil, fmt.Errorf("header lacks %s or %s", match, value)
+	}
+	table := map[string]string{}
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return table, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if mi < len(rec) && vi < len(rec) {
+			table[rec[mi]] = rec[vi]
+		}
+	}
+}
+
+// jsonTable reads either {"key": value} or [{match: key, value: value}].
+func jsonTable(r io.Reader, match, value string) (map[string]string, error) {
+	var doc any
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+	table := map[string]string{}
+	switch d := doc.(type) {
+	case map[string]any:
+		for k, v := range d {
+			table[k] = scalar(v)
+		}
+	case []any:
+		if match == "" || value == "" {
+			return nil, fmt.Errorf("match and value are required for a json array")
+		}
+		for _, e := range d {
+			obj, ok := e.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("array entries must be objects")
+			}
+			if k, ok := obj[match]; ok {
+				table[scalar(k)] = scalar(obj[value])
+			}
+		}
+	default:
+		return nil, fmt.Errorf("json table must be an object or array")
+	}
+	return table, nil
+}
+
+// scalar renders a decoded JSON value as a column value.
+func scalar(v any) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case json.Number:
+		return t.String()
+	case bool:
+		return strconv.FormatBool(t)
+	default:
+		b, _ := json.Marshal(t)
+		return string(b)
+	}
+}
+
+// memoLimit bounds the per-file cache of DynamoDB lookups.
+const memoLimit = 10000
+
+// newDynamoLookup reads "attribute" from the item in "table" whose
+// partition key "key" (default "PK") equals the row's "input" column.
+// Results, including misses, are cached for the rest of the file.
+func newDynamoLookup(ctx context.Context, deps Deps, params map[string]any) (Lookup, error) {
+	table, err := stringParam(params, "table", true)
+	if err != nil {
+		return nil, err
+	}
+	input, err := stringParam(params, "input", true)
+	if err != nil {
+		return nil, err
+	}
+	attr, err := stringParam(params, "attribute", true)
+	if err != nil {
+		return nil, err
+	}
+	key, err := stringParam(params, "key", false)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" {
+		key = "PK"
+	}
+	if deps.DynamoDB == nil {
+		return nil, fmt.Errorf("no DynamoDB client")
+	}
+	type hit struct {
+		v  string
+		ok bool
+	}
+	var mu sync.Mutex
+	memo := map[string]hit{}
+	return func(ctx context.Context, row map[string]string) (string, bool, error) {
+		k := row[input]
+		if k == "" {
+			return "", false, nil
+		}
+		mu.Lock()
+		h, cached := memo[k]
+		mu.Unlock()
+		if cached {
+			return h.v, h.ok, nil
+		}
+		out, err := deps.DynamoDB.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName:                &table,
+			Key:                      map[string]types.AttributeValue{key: &types.AttributeValueMemberS{Value: k}},
+			ProjectionExpression:     aws.String("#a"),
+			ExpressionAttributeNames: map[string]string{"#a": attr},
+		})
+		if err != nil {
+			return "", false, fmt.Errorf("get %s %s: %w", table, k, err)
+		}
+		switch v := out.Item[attr].(type) {
+		case *types.AttributeValueMemberS:
+			h = hit{v.Value, true}
+		case *types.AttributeValueMemberN:
+			h = hit{v.Value, true}
+		case *types.AttributeValueMemberBOOL:
+			h = hit{strconv.FormatBool(v.Value), true}
+		}
+		mu.Lock()
+		if len(memo) >= memoLimit {
+			memo = map[string]hit{}
+		}
+		memo[k] = h
+		mu.Unlock()
+		return h.v, h.ok, nil
+	}, nil
+}
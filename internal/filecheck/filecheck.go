@@ -0,0 +1,215 @@
+// Package filecheck applies a profile's fileValidation: checks that reject
+// a file as a whole rather than row by row, so a corrupt vendor file is
+// never half loaded.
+package filecheck
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/your-org/file-processor-sample/internal/profile"
+)
+
+// Codes reported by FileValidationError.
+const (
+	CodeNoRows         = "NO_ROWS"
+	CodeMissingColumn  = "MISSING_COLUMN"
+	CodeHeaderMismatch = "HEADER_MISMATCH"
+	CodeBadRows        = "BAD_ROW_LIMIT"
+	CodeBadRowPercent  = "BAD_ROW_PERCENT"
+	CodeNoTrailer      = "TRAILER_MISSING"
+	CodeTrailerCount   = "TRAILER_COUNT"
+	CodeTrailerTotal   = "TRAILER_TOTAL"
+)
+
+// totalTolerance absorbs rounding in hash totals of decimal amounts.
+const totalTolerance = 0.005
+
+// FileValidationError rejects a whole file. The handler returns it
+// unwrapped so Step Functions can match the error type.
+type FileValidationError struct {
+	Key    string
+	Code   string
+	Reason string
+}
+
+// Error describes the rejection.
+func (e *FileValidationError) Error() string {
+	return fmt.Sprintf("file %s rejected: %s: %s", e.Key, e.Code, e.Reason)
+}
+
+// Checker holds the compiled checks for one profile.
+type Checker struct {
+	cfg      profile.FileValidation
+	required []string
+	trailer  *regexp.Regexp
+}
+
+// Compile prepares the checks of fv; required are the columns of
+// rowValidation.required.
+func Compile(fv profile.FileValidation, required []string) (*Checker, error) {
+	c := &Checker{cfg: fv, required: required}
+	if fv.Trailer != nil {
+		re, err := regexp.Compile(fv.Trailer.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("fileValidation.trailer.pattern: %w", err)
+		}
+		c.trailer = re
+	}
+	return c, nil
+}
+
+// Control is the content of a control record.
+type Control struct {
+	Line  string
+	Count *int
+	Total *float64
+}
+
+// SplitControl removes the control record from data and returns it. It is
+// a no-op for profiles without a trailer.
+func (c *Checker) SplitControl(key string, data []byte) ([]byte, *Control, error) {
+	if c.trailer == nil {
+		return data, nil, nil
+	}
+	body := bytes.TrimRight(data, "\r\n")
+	var line []byte
+	if c.cfg.Trailer.Position == "first" {
+		line, body, _ = bytes.Cut(body, []byte("\n"))
+	} else if i := bytes.LastIndexByte(body, '\n'); i >= 0 {
+		line, body = body[i+1:], body[:i+1]
+	} else {
+		line, body = body, nil
+	}
+	line = bytes.TrimRight(line, "\r")
+	m := c.trailer.FindSubmatch(line)
+	if m == nil {
+		return nil, nil, &FileValidationError{Key: key, Code: CodeNoTrailer, Reason: fmt.Sprintf("%s line %q does not match the control record pattern", c.position(), line)}
+	}
+	ctl := &Control{Line: string(line)}
+	for i, name := range c.trailer.SubexpNames() {
+		if i == 0 || m[i] == nil {
+			continue
+		}
+		v := strings.TrimSpace(string(m[i]))
+		switch name {
+		case "count":
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, nil, &FileValidationError{Key: key, Code: CodeTrailerCount, Reason: fmt.Sprintf("control count %q is not a number", v)}
+			}
+			ctl.Count = &n
+		case "total":
+			x, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, nil, &FileValidationError{Key: key, Code: CodeTrailerTotal, Reason: fmt.Sprintf("control total %q is not a number", v)}
+			}
+			ctl.Total = &x
+		}
+	}
+	return body, ctl, nil
+}
+
+// position names the line the control record is expected on.
+func (c *Checker) position() string {
+	if c.cfg.Trailer.Position == "first" {
+		return "first"
+	}
+	return "last"
+}
+
+// Header checks the columns of the first row against the header settings:
+// by default the required columns must be present, with match "exact" the
+// header must hold exactly the configured columns.
+func (c *Checker) Header(key string, rows []map[string]string) error {
+	if len(rows) == 0 {
+		return &FileValidationError{Key: key, Code: CodeNoRows, Reason: "no rows"}
+	}
+	want := c.required
+	exact := false
+	if h := c.cfg.Header; h != nil {
+		if len(h.Columns) > 0 {
+			want = h.Columns
+		}
+		exact = h.Match == "exact"
+	}
+	var missing []string
+	for _, col := range want {
+		if _, ok := rows[0][col]; !ok {
+			missing = append(missing, col)
+		}
+	}
+	if len(missing) > 0 {
+		return &FileValidationError{Key: key, Code: CodeMissingColumn, Reason: "missing column " + strings.Join(missing, ", ")}
+	}
+	if exact {
+		expected := make(map[string]bool, len(want))
+		for _, col := range want {
+			expected[col] = true
+		}
+		var extra []string
+		for col := range rows[0] {
+			if !expected[col] {
+				extra = append(extra, col)
+			}
+		}
+		if len(extra) > 0 {
+			sort.Strings(extra)
+			return &FileValidationError{Key: key, Code: CodeHeaderMismatch, Reason: "unexpected column " + strings.Join(extra, ", ")}
+		}
+	}
+	return nil
+}
+
+// Verify compares the control record with the parsed data rows.
+func (c *Checker) Verify(key string, ctl *Control, rows []map[string]string) error {
+	if ctl == nil {
+		return nil
+	}
+	if ctl.Count != nil && *ctl.Count != len(rows) {
+		return &FileValidationError{Key: key, Code: CodeTrailerCount, Reason: fmt.Sprintf("control record counts %d rows, file has %d", *ctl.Count, len(rows))}
+	}
+	if ctl.Total != nil {
+		field := c.cfg.Trailer.TotalField
+		sum := 0.0
+		for i, r := range rows {
+			v := strings.TrimSpace(r[field])
+			if v == "" {
+				continue
+			}
+			x, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return &FileValidationError{Key: key, Code: CodeTrailerTotal, Reason: fmt.Sprintf("row %d %s %q is not a number", i+1, field, v)}
+			}
+			sum += x
+		}
+		if math.Abs(sum-*ctl.Total) > totalTolerance {
+			return &FileValidationError{Key: key, Code: CodeTrailerTotal, Reason: fmt.Sprintf("control total of %s is %s, rows sum to %s", field, fmtNum(*ctl.Total), fmtNum(sum))}
+		}
+	}
+	return nil
+}
+
+// BadRows fails the file when bad of total rows breaches maxBadRows or
+// maxBadRowPercent.
+func (c *Checker) BadRows(key string, total, bad int) error {
+	if limit := c.cfg.MaxBadRows; limit != nil && bad > *limit {
+		return &FileValidationError{Key: key, Code: CodeBadRows, Reason: fmt.Sprintf("%d bad rows, at most %d allowed", bad, *limit)}
+	}
+	if limit := c.cfg.MaxBadRowPercent; limit != nil && total > 0 {
+		if pct := float64(bad) * 100 / float64(total); pct > *limit {
+			return &FileValidationError{Key: key, Code: CodeBadRowPercent, Reason: fmt.Sprintf("%.1f%% of %d rows are bad, at most %s%% allowed", pct, total, fmtNum(*limit))}
+		}
+	}
+	return nil
+}
+
+// fmtNum formats x without trailing zeros.
+func fmtNum(x float64) string {
+	return strconv.FormatFloat(x, 'f', -1, 64)
+}
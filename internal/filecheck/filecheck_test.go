@@ -0,0 +1,113 @@
+package filecheck
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/your-org/file-processor-sample/internal/profile"
+)
+
+func code(err error) string {
+	var fe *FileValidationError
+	if errors.As(err, &fe) {
+		return fe.Code
+	}
+	return ""
+}
+
+func intp(n int) *int           { return &n }
+func floatp(x float64) *float64 { return &x }
+func rows(n int) []map[string]string {
+	r := make([]map[string]string, n)
+	for i := range r {
+		r[i] = map[string]string{"A": "1.25"}
+	}
+	return r
+}
+
+func TestSplitControl(t *testing.T) {
+	c, err := Compile(profile.FileValidation{Trailer: &profile.Trailer{Pattern: `^TRL\|(?P<count>\d+)\|(?P<total>[0-9.]+)$`, TotalField: "A"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, ctl, err := c.SplitControl("k", []byte("A\n1.25\n1.25\r\nTRL|2|2.50\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "A\n1.25\n1.25\r\n" || *ctl.Count != 2 || *ctl.Total != 2.5 {
+		t.Fatalf("body %q control %+v", body, ctl)
+	}
+	if err := c.Verify("k", ctl, rows(2)); err != nil {
+		t.Fatal(err)
+	}
+	if got := code(c.Verify("k", ctl, rows(3))); got != CodeTrailerCount {
+		t.Fatalf("count mismatch: got %q", got)
+	}
+	ctl.Count = nil
+	if got := code(c.Verify("k", ctl, rows(3))); got != CodeTrailerTotal {
+		t.Fatalf("total mismatch: got %q", got)
+	}
+	if got := code(c.Verify("k", ctl, []map[string]string{{"A": "x"}})); got != CodeTrailerTotal {
+		t.Fatalf("bad amount: got %q", got)
+	}
+	if _, _, err := c.SplitControl("k", []byte("A\n1.25\n")); code(err) != CodeNoTrailer {
+		t.Fatalf("missing trailer: got %v", err)
+	}
+
+	first, _ := Compile(profile.FileValidation{Trailer: &profile.Trailer{Position: "first", Pattern: `^HDR (?P<count>\d+)$`}}, nil)
+	body, ctl, err = first.SplitControl("k", []byte("HDR 1\nA\n1\n"))
+	if err != nil || string(body) != "A\n1" || *ctl.Count != 1 || ctl.Total != nil {
+		t.Fatalf("header control: body %q control %+v err %v", body, ctl, err)
+	}
+
+	none, _ := Compile(profile.FileValidation{}, nil)
+	body, ctl, err = none.SplitControl("k", []byte("A\n1\n"))
+	if err != nil || ctl != nil || string(body) != "A\n1\n" {
+		t.Fatal("no trailer configured should leave data alone")
+	}
+}
+
+func TestHeader(t *testing.T) {
+	row := []map[string]string{{"A": "1", "B": "2"}}
+	for i, c := range []struct {
+		fv       profile.FileValidation
+		required []string
+		rows     []map[string]string
+		want     string
+	}{
+		{profile.FileValidation{}, []string{"A"}, nil, CodeNoRows},
+		{profile.FileValidation{}, []string{"A"}, row, ""},
+		{profile.FileValidation{}, []string{"C"}, row, CodeMissingColumn},
+		{profile.FileValidation{Header: &profile.HeaderCheck{Columns: []string{"B"}}}, []string{"C"}, row, ""},
+		{profile.FileValidation{Header: &profile.HeaderCheck{Match: "exact", Columns: []string{"A", "B"}}}, nil, row, ""},
+		{profile.FileValidation{Header: &profile.HeaderCheck{Match: "exact", Columns: []string{"A"}}}, nil, row, CodeHeaderMismatch},
+		{profile.FileValidation{Header: &profile.HeaderCheck{Match: "exact"}}, []string{"A"}, row, CodeHeaderMismatch},
+	} {
+		chk, _ := Compile(c.fv, c.required)
+		if got := code(chk.Header("k", c.rows)); got != c.want {
+			t.Errorf("case %d: got %q, want %q", i, got, c.want)
+		}
+	}
+}
+
+func TestBadRows(t *testing.T) {
+	c, _ := Compile(profile.FileValidation{MaxBadRows: intp(2), MaxBadRowPercent: floatp(10)}, nil)
+	for _, tc := range []struct {
+		total, bad int
+		want       string
+	}{
+		{100, 2, ""},
+		{100, 3, CodeBadRows},
+		{20, 2, ""},
+		{10, 2, CodeBadRowPercent},
+		{0, 0, ""},
+	} {
+		if got := code(c.BadRows("k", tc.total, tc.bad)); got != tc.want {
+			t.Errorf("%d of %d: got %q, want %q", tc.bad, tc.total, got, tc.want)
+		}
+	}
+	unlimited, _ := Compile(profile.FileValidation{}, nil)
+	if err := unlimited.BadRows("k", 1, 1); err != nil {
+		t.Fatal(err)
+	}
+}
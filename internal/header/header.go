@@ -0,0 +1,202 @@
+// Package header maps the columns of an incoming file onto the column
+// names a profile uses, following the profile's columns settings, so
+// vendors can send "Member Number", "member_number" or "MEMBERNUMBER" for
+// the same MemberNumber column.
+package header
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/your-org/file-processor-sample/internal/profile"
+)
+
+// Codes reported by Warning.
+const (
+	CodeUnknownColumn   = "UNKNOWN_COLUMN"
+	CodeDuplicateColumn = "DUPLICATE_COLUMN"
+)
+
+// Warning reports an incoming column that was not mapped.
+type Warning struct {
+	Code    string `json:"code"`
+	Column  string `json:"column"`
+	Message string `json:"message"`
+}
+
+// Mapper renames incoming columns to profile columns.
+type Mapper struct {
+	norm  func(string) string
+	names map[string]string
+	known map[string]bool
+	off   bool
+}
+
+// Compile builds the Mapper for p. Profiles without columns settings get a
+// Mapper that leaves rows alone. Two profile columns or aliases that are
+// the same after normalization are an error.
+func Compile(p *profile.Profile) (*Mapper, error) {
+	cfg := p.Columns
+	m := &Mapper{
+		norm:  normalizer(cfg.Normalize),
+		names: map[string]string{},
+		known: map[string]bool{},
+		off:   len(cfg.Normalize) == 0 && len(cfg.Aliases) == 0,
+	}
+	for _, col := range Known(p) {
+		m.known[col] = true
+		if err := m.add(col, col); err != nil {
+			return nil, err
+		}
+	}
+	for _, col := range sortedKeys(cfg.Aliases) {
+		for _, alias := range cfg.Aliases[col] {
+			if err := m.add(alias, col); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return m, nil
+}
+
+// add registers name as a spelling of col.
+func (m *Mapper) add(name, col string) error {
+	k := m.norm(name)
+	if prev, ok := m.names[k]; ok && prev != col {
+		return fmt.Errorf("columns: %q names both %s and %s", name, prev, col)
+	}
+	m.names[k] = col
+	return nil
+}
+
+// Map renames the columns of rows in place and returns warnings for the
+// columns it could not map. All rows are expected to share the header of
+// the first. An incoming column spelled exactly like a profile column wins
+// over other spellings of it.
+func (m *Mapper) Map(rows []map[string]string) []Warning {
+	if m.off || len(rows) == 0 {
+		return nil
+	}
+	cols := make([]string, 0, len(rows[0]))
+	for c := range rows[0] {
+		cols = append(cols, c)
+	}
+	sort.Strings(cols)
+	sort.SliceStable(cols, func(i, j int) bool { return m.known[cols[i]] && !m.known[cols[j]] })
+
+	var warns []Warning
+	rename := map[string]string{}
+	claimed := map[string]string{}
+	for _, c := range cols {
+		name, ok := m.names[m.norm(c)]
+		if !ok {
+			warns = append(warns, Warning{Code: CodeUnknownColumn, Column: c, Message: fmt.Sprintf("column %q is not used by the profile", c)})
+			continue
+		}
+		if prev, dup := claimed[name]; dup {
+			warns = append(warns, Warning{Code: CodeDuplicateColumn, Column: c, Message: fmt.Sprintf("column %q is another %s; %q is used", c, name, prev)})
+			continue
+		}
+		claimed[name] = c
+		if name != c {
+			rename[c] = name
+		}
+	}
+	if len(rename) > 0 {
+		for _, r := range rows {
+			for from, to := range rename {
+				if v, ok := r[from]; ok {
+					delete(r, from)
+					r[to] = v
+				}
+			}
+		}
+	}
+	return warns
+}
+
+// Known lists the columns p refers to: aliased columns, columns used by
+// row and file validation and the fieldMap keys of its targets.
+func Known(p *profile.Profile) []string {
+	set := map[string]bool{}
+	add := func(cols ...string) {
+		for _, c := range cols {
+			if c != "" {
+				set[c] = true
+			}
+		}
+	}
+	for c := range p.Columns.Aliases {
+		add(c)
+	}
+	add(p.RowValidation.Required...)
+	for c := range p.RowValidation.Regex {
+		add(c)
+	}
+	for _, r := range p.RowValidation.Rules {
+		add(r.Field, r.Other)
+		add(r.Fields...)
+		if r.If != nil {
+			add(r.If.Field)
+		}
+	}
+	if h := p.FileValidation.Header; h != nil {
+		add(h.Columns...)
+	}
+	if t := p.FileValidation.Trailer; t != nil {
+		add(t.TotalField)
+	}
+	for _, t := range p.Targets {
+		for c := range t.FieldMap {
+			add(c)
+		}
+	}
+	cols := make([]string, 0, len(set))
+	for c := range set {
+		cols = append(cols, c)
+	}
+	sort.Strings(cols)
+	return cols
+}
+
+// normalizer returns the comparison key for column names under opts.
+// Surrounding whitespace is always ignored.
+func normalizer(opts []string) func(string) string {
+	var fold, space, punct bool
+	for _, o := range opts {
+		switch o {
+		case "case":
+			fold = true
+		case "whitespace":
+			space = true
+		case "punctuation":
+			punct = true
+		}
+	}
+	return func(s string) string {
+		s = strings.TrimSpace(s)
+		if fold {
+			s = strings.ToLower(s)
+		}
+		if space || punct {
+			s = strings.Map(func(r rune) rune {
+				if space && unicode.IsSpace(r) || punct && (unicode.IsPunct(r) || unicode.IsSymbol(r)) {
+					return -1
+				}
+				return r
+			}, s)
+		}
+		return s
+	}
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
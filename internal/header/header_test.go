@@ -0,0 +1,99 @@
+package header
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/your-org/file-processor-sample/internal/profile"
+)
+
+func compile(t *testing.T, doc string) (*Mapper, error) {
+	t.Helper()
+	var p profile.Profile
+	if err := json.Unmarshal([]byte(doc), &p); err != nil {
+		t.Fatal(err)
+	}
+	return Compile(&p)
+}
+
+func TestMap(t *testing.T) {
+	m, err := compile(t, `{
+		"columns": {"normalize": ["case", "whitespace", "punctuation"], "aliases": {"PostCode": ["Zip", "ZIP Code"]}},
+		"rowValidation": {"required": ["MemberNumber"]},
+		"targets": [{"object": "Contact", "externalId": "E", "fieldMap": {"FirstName": "FirstName", "MemberNumber": "E"}}]
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := []map[string]string{
+		{"member_number": "1", "First Name": "Ann", "zip-code": "12345", "Member Number": "x", "Notes": "n"},
+		{"member_number": "2", "First Name": "Bob", "zip-code": "", "Member Number": "y", "Notes": ""},
+	}
+	warns := m.Map(rows)
+	for i, want := range []map[string]string{
+		{"MemberNumber": "x", "FirstName": "Ann", "PostCode": "12345", "member_number": "1", "Notes": "n"},
+		{"MemberNumber": "y", "FirstName": "Bob", "PostCode": "", "member_number": "2", "Notes": ""},
+	} {
+		if len(rows[i]) != len(want) {
+			t.Fatalf("row %d = %v", i, rows[i])
+		}
+		for k, v := range want {
+			if got, ok := rows[i][k]; !ok || got != v {
+				t.Fatalf("row %d = %v, want %v", i, rows[i], want)
+			}
+		}
+	}
+	if len(warns) != 2 || warns[0].Code != CodeUnknownColumn || warns[0].Column != "Notes" ||
+		warns[1].Code != CodeDuplicateColumn || warns[1].Column != "member_number" || warns[1].Message == "" {
+		t.Fatalf("unexpected warnings %+v", warns)
+	}
+}
+
+func TestMapExactWins(t *testing.T) {
+	m, _ := compile(t, `{"columns": {"normalize": ["case"]}, "rowValidation": {"required": ["Id"]}}`)
+	rows := []map[string]string{{"ID": "1", "Id": "2"}}
+	warns := m.Map(rows)
+	if rows[0]["Id"] != "2" || rows[0]["ID"] != "1" || len(warns) != 1 || warns[0].Column != "ID" {
+		t.Fatalf("rows %v warnings %+v", rows, warns)
+	}
+}
+
+func TestMapWithoutSettings(t *testing.T) {
+	m, _ := compile(t, `{"rowValidation": {"required": ["Id"]}}`)
+	rows := []map[string]string{{" id ": "1", "Other": "x"}}
+	if warns := m.Map(rows); warns != nil || rows[0][" id "] != "1" {
+		t.Fatalf("rows %v warnings %+v", rows, warns)
+	}
+	if m.Map(nil) != nil {
+		t.Fatal("no rows, no warnings")
+	}
+}
+
+func TestNormalizer(t *testing.T) {
+	for _, c := range []struct {
+		opts    []string
+		in, out string
+	}{
+		{nil, " Member Number ", "Member Number"},
+		{[]string{"case"}, "Member Number", "member number"},
+		{[]string{"whitespace"}, "Member \tNumber", "MemberNumber"},
+		{[]string{"punctuation"}, "Member_No.#", "MemberNo"},
+		{[]string{"case", "whitespace", "punctuation"}, "MEMBER - NUMBER", "membernumber"},
+	} {
+		if got := normalizer(c.opts)(c.in); got != c.out {
+			t.Errorf("%v %q: got %q, want %q", c.opts, c.in, got, c.out)
+		}
+	}
+}
+
+func TestCompileConflicts(t *testing.T) {
+	for _, doc := range []string{
+		`{"columns": {"normalize": ["case"]}, "rowValidation": {"required": ["Id", "ID"]}}`,
+		`{"columns": {"aliases": {"A": ["X"], "B": ["X"]}}}`,
+		`{"columns": {"normalize": ["punctuation"], "aliases": {"Zip": ["Post_Code"]}}, "rowValidation": {"required": ["PostCode"]}}`,
+	} {
+		if _, err := compile(t, doc); err == nil {
+			t.Errorf("%s: expected error", doc)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+// Package httpclient builds the HTTP client shared by the Salesforce callers:
+// bounded timeouts so a hung connection cannot eat the Lambda timeout,
+// pooling tuned for warm Lambda reuse, optional proxy and CA bundle, and
+// request logging with credentials redacted.
+package httpclient
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Config controls the client returned by New. Zero durations use the defaults.
+type Config struct {
+	// DialTimeout bounds establishing the TCP connection (default 5s).
+	DialTimeout time.Duration
+	// TLSHandshakeTimeout bounds the TLS handshake (default 5s).
+	TLSHandshakeTimeout time.Duration
+	// ResponseHeaderTimeout bounds waiting for response headers (default 15s).
+	ResponseHeaderTimeout time.Duration
+	// Timeout bounds the whole request including the body (default 25s).
+	Timeout time.Duration
+	// IdleConnTimeout is how long pooled connections are kept (default 90s).
+	IdleConnTimeout time.Duration
+	// MaxIdleConnsPerHost sizes the pool per host (default 10).
+	MaxIdleConnsPerHost int
+	// ProxyURL overrides the HTTPS_PROXY/NO_PROXY environment when set.
+	ProxyURL string
+	// CABundle is a PEM file added to the system roots.
+	CABundle string
+	// Log receives one entry per request when set.
+	Log *zap.SugaredLogger
+	// LogBodies also logs request and response bodies, redacted and truncated.
+	LogBodies bool
+}
+
+// FromEnv reads HTTP_DIAL_TIMEOUT, HTTP_TLS_TIMEOUT,
+// HTTP_RESPONSE_HEADER_TIMEOUT and HTTP_TIMEOUT (Go durations),
+// HTTP_PROXY_URL, HTTP_CA_BUNDLE and HTTP_LOG ("headers" or "bodies").
+func FromEnv(log *zap.SugaredLogger) Config {
+	cfg := Config{
+		DialTimeout:           envDuration("HTTP_DIAL_TIMEOUT"),
+		TLSHandshakeTimeout:   envDuration("HTTP_TLS_TIMEOUT"),
+		ResponseHeaderTimeout: envDuration("HTTP_RESPONSE_HEADER_TIMEOUT"),
+		Timeout:               envDuration("HTTP_TIMEOUT"),
+		ProxyURL:              os.Getenv("HTTP_PROXY_URL"),
+		CABundle:              os.Getenv("HTTP_CA_BUNDLE"),
+	}
+	if n, err := strconv.Atoi(os.Getenv("HTTP_MAX_IDLE_PER_HOST")); err == nil && n > 0 {
+		cfg.MaxIdleConnsPerHost = n
+	}
+	switch os.Getenv("HTTP_LOG") {
+	case "headers":
+		cfg.Log = log
+	case "bodies":
+		cfg.Log, cfg.LogBodies = log, true
+	}
+	return cfg
+}
+
+func envDuration(key string) time.Duration {
+	d, _ := time.ParseDuration(os.Getenv(key))
+	return d
+}
+
+// New returns a client configured from cfg.
+func New(cfg Config) (*http.Client, error) {
+	tr := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   or(cfg.DialTimeout, 5*time.Second),
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   or(cfg.TLSHandshakeTimeout, 5*time.Second),
+		ResponseHeaderTimeout: or(cfg.ResponseHeaderTimeout, 15*time.Second),
+		IdleConnTimeout:       or(cfg.IdleConnTimeout, 90*time.Second),
+		ExpectContinueTimeout: time.Second,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   10,
+	}
+	if cfg.MaxIdleConnsPerHost > 0 {
+		tr.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	}
+	if cfg.ProxyURL != "" {
+		u, err := url.Parse(cfg.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("parse proxy url: %w", err)
+		}
+		tr.Proxy = http.ProxyURL(u)
+	}
+	if cfg.CABundle != "" {
+		pool, err := certPool(cfg.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		tr.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+	var rt http.RoundTripper = tr
+	if cfg.Log != nil {
+		rt = &logTransport{next: tr, log: cfg.Log, bodies: cfg.LogBodies}
+	}
+	return &http.Client{Transport: rt, Timeout: or(cfg.Timeout, 25*time.Second)}, nil
+}
+
+// certPool returns the system roots plus the certificates in the PEM file.
+func certPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read ca bundle: %w", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("ca bundle %s: no certificates found", path)
+	}
+	return pool, nil
+}
+
+func or(d, def time.Duration) time.Duration {
+	if d > 0 {
+		return d
+	}
+	return def
+}
+
+// bodyLimit caps the bytes of each body written to the log.
+const bodyLimit = 2048
+
+// logTransport logs every request with credentials redacted.
+type logTransport struct {
+	next   http.RoundTripper
+	log    *zap.SugaredLogger
+	bodies bool
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *logTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	fields := []any{"method", req.Method, "url", RedactURL(req.URL), "reqHeaders", RedactHeaders(req.Header)}
+	if t.bodies && req.Body != nil && req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			b, _ := io.ReadAll(io.LimitReader(body, bodyLimit))
+			_ = body.Close()
+			fields = append(fields, "reqBody", Redact(string(b)))
+		}
+	}
+	resp, err := t.next.RoundTrip(req)
+	fields = append(fields, "ms", time.Since(start).Milliseconds())
+	if err != nil {
+		t.log.Warnw("http request failed", append(fields, "error", err)...)
+		return nil, err
+	}
+	fields = append(fields, "status", resp.StatusCode, "respHeaders", RedactHeaders(resp.Header))
+	if t.bodies && resp.Body != nil {
+		b, rerr := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(b))
+		if rerr != nil {
+			t.log.Warnw("http request failed", append(fields, "error", rerr)...)
+			return nil, rerr
+		}
+		if len(b) > bodyLimit {
+			b = b[:bodyLimit]
+		}
+		fields = append(fields, "respBody", Redact(string(b)))
+	}
+	t.log.Infow("http request", fields...)
+	return resp, nil
+}
+
+// redacted replaces secret values in logs.
+const redacted = "REDACTED"
+
+// secretHeaders are never logged in clear.
+var secretHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+	"X-Broker-Signature":  true,
+}
+
+// secretKeys are JSON keys and form or query parameters holding credentials.
+var secretKeys = []string{"access_token", "refresh_token", "id_token", "client_secret", "client_assertion", "password", "token", "signature"}
+
+var (
+	jsonSecret = regexp.MustCompile(`("(?i:` + strings.Join(secretKeys, "|") + `)"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+	formSecret = regexp.MustCompile(`((?:^|&)(?i:` + strings.Join(secretKeys, "|") + `)=)[^&]*`)
+)
+
+// RedactHeaders returns h with credential headers replaced.
+func RedactHeaders(h http.Header) map[string]string {
+	out := make(map[string]string, len(h))
+	for k, v := range h {
+		if secretHeaders[http.CanonicalHeaderKey(k)] {
+			out[k] = redacted
+			continue
+		}
+		out[k] = strings.Join(v, ",")
+	}
+	return out
+}
+
+// RedactURL returns u as a string with userinfo and secret query values removed.
+func RedactURL(u *url.URL) string {
+	c := *u
+	if c.User != nil {
+		c.User = url.User(redacted)
+	}
+	c.RawQuery = formSecret.ReplaceAllString(c.RawQuery, "${1}"+redacted)
+	return c.String()
+}
+
+// Redact masks credential values in JSON or form encoded bodies.
+func Redact(body string) string {
+	body = jsonSecret.ReplaceAllString(body, `${1}"`+redacted+`"`)
+	return formSecret.ReplaceAllString(body, "${1}"+redacted)
+}
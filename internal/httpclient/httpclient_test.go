@@ -0,0 +1,157 @@
+package httpclient
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestDefaults(t *testing.T) {
+	c, err := New(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := c.Transport.(*http.Transport)
+	if c.Timeout != 25*time.Second || tr.ResponseHeaderTimeout != 15*time.Second || tr.TLSHandshakeTimeout != 5*time.Second || tr.MaxIdleConnsPerHost != 10 {
+		t.Fatalf("unexpected defaults: timeout=%s header=%s tls=%s idle=%d", c.Timeout, tr.ResponseHeaderTimeout, tr.TLSHandshakeTimeout, tr.MaxIdleConnsPerHost)
+	}
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer srv.Close()
+	c, err := New(Config{ResponseHeaderTimeout: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(srv.URL); err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("HTTP_TIMEOUT", "3s")
+	t.Setenv("HTTP_RESPONSE_HEADER_TIMEOUT", "2s")
+	t.Setenv("HTTP_PROXY_URL", "http://proxy.internal:3128")
+	t.Setenv("HTTP_LOG", "bodies")
+	log := zap.NewNop().Sugar()
+	cfg := FromEnv(log)
+	if cfg.Timeout != 3*time.Second || cfg.ResponseHeaderTimeout != 2*time.Second || cfg.Log != log || !cfg.LogBodies {
+		t.Fatalf("unexpected config %+v", cfg)
+	}
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := c.Transport.(*logTransport).next.(*http.Transport)
+	u, _ := tr.Proxy(&http.Request{URL: &url.URL{Scheme: "https", Host: "example.my.salesforce.com"}})
+	if u == nil || u.Host != "proxy.internal:3128" {
+		t.Fatalf("unexpected proxy %v", u)
+	}
+}
+
+func TestCABundle(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+	plain, _ := New(Config{})
+	if _, err := plain.Get(srv.URL); err == nil {
+		t.Fatal("expected unknown authority without bundle")
+	}
+
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	block := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(path, block, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := New(Config{CABundle: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("expected trusted server: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	bad := filepath.Join(t.TempDir(), "bad.pem")
+	_ = os.WriteFile(bad, []byte("not a cert"), 0o600)
+	if _, err := New(Config{CABundle: bad}); err == nil {
+		t.Fatal("expected error for empty bundle")
+	}
+	if _, err := New(Config{CABundle: filepath.Join(t.TempDir(), "missing.pem")}); err == nil {
+		t.Fatal("expected error for missing bundle")
+	}
+}
+
+func TestLoggingRedactsSecrets(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "sid=abc")
+		_, _ = io.WriteString(w, `{"access_token":"00Dxx!secret","instance_url":"https://x"}`)
+	}))
+	defer srv.Close()
+	core, logs := observer.New(zap.InfoLevel)
+	c, err := New(Config{Log: zap.New(core).Sugar(), LogBodies: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/token?client_secret=s3cr3t&grant_type=password", strings.NewReader("username=u&password=hunter2&client_id=id"))
+	req.Header.Set("Authorization", "Bearer tok")
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if !strings.Contains(string(body), "00Dxx!secret") {
+		t.Fatal("response body must still reach the caller")
+	}
+
+	entries := logs.All()
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 log entry, got %d", len(entries))
+	}
+	out := fmt.Sprint(entries[0].ContextMap())
+	for _, secret := range []string{"s3cr3t", "hunter2", "00Dxx!secret", "Bearer tok", "sid=abc"} {
+		if strings.Contains(out, secret) {
+			t.Fatalf("log leaks %q: %s", secret, out)
+		}
+	}
+	for _, keep := range []string{"grant_type=password", "username=u", "instance_url", "status:200"} {
+		if !strings.Contains(out, keep) {
+			t.Fatalf("log missing %q: %s", keep, out)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	cases := map[string]string{
+		`{"token":"abc","ok":1}`:                 `{"token":"REDACTED","ok":1}`,
+		`{"Password" : "p\"w"}`:                  `{"Password" : "REDACTED"}`,
+		`client_id=x&client_secret=y&password=z`: `client_id=x&client_secret=REDACTED&password=REDACTED`,
+		`grant_type=password`:                    `grant_type=password`,
+	}
+	for in, want := range cases {
+		if got := Redact(in); got != want {
+			t.Errorf("Redact(%q) = %q, want %q", in, got, want)
+		}
+	}
+	u, _ := url.Parse("https://user:pw@example.com/x?access_token=t&a=b")
+	if got := RedactURL(u); strings.Contains(got, "pw") || strings.Contains(got, "access_token=t") || !strings.Contains(got, "a=b") {
+		t.Errorf("RedactURL = %q", got)
+	}
+}
@@ -0,0 +1,366 @@
+// Package importerror records import errors in Salesforce as
+// Import_Error__c records with an Import_Error_Attempt__c child per
+// delivery. Events that cannot be delivered while Salesforce is unreachable
+// are spooled to S3 for LogImportError to replay.
+package importerror
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"go.uber.org/zap"
+
+	"github.com/your-org/file-processor-sample/internal/sfclient"
+)
+
+// BatchSize is the sObject Collections record limit per request.
+const BatchSize = 200
+
+// rawRowLimit caps the characters of the source row copied to Raw_Row__c.
+const rawRowLimit = 4000
+
+// Event is one failed row import. The optional fields trace the error back
+// to the exact input line.
+type Event struct {
+	ExternalRowID string `json:"externalRowId"`
+	Message       string `json:"message"`
+	FileKey       string `json:"fileKey,omitempty"`
+	LineNumber    int    `json:"lineNumber,omitempty"`
+	Field         string `json:"field,omitempty"`
+	ErrorCode     string `json:"errorCode,omitempty"`
+	TargetObject  string `json:"targetObject,omitempty"`
+	RawRow        string `json:"rawRow,omitempty"`
+}
+
+// UnmarshalJSON also accepts the "error" and "row" names used by the
+// parser's bad-row output for Message and LineNumber.
+func (e *Event) UnmarshalJSON(b []byte) error {
+	type plain Event
+	var in struct {
+		plain
+		Error string `json:"error"`
+		Row   int    `json:"row"`
+	}
+	if err := json.Unmarshal(b, &in); err != nil {
+		return err
+	}
+	*e = Event(in.plain)
+	if e.Message == "" {
+		e.Message = in.Error
+	}
+	if e.LineNumber == 0 {
+		e.LineNumber = in.Row
+	}
+	return nil
+}
+
+// Truncate shortens s to at most n characters.
+func Truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	r := []rune(s)
+	return string(r[:n])
+}
+
+// Record returns the Import_Error__c fields for evt. Optional trace fields
+// are only sent when present.
+func Record(evt Event) map[string]any {
+	rec := map[string]any{
+		"External_Row_Id__c": evt.ExternalRowID,
+		"Error_Message__c":   evt.Message,
+	}
+	opt := map[string]string{
+		"File_Key__c":      evt.FileKey,
+		"Field_Name__c":    evt.Field,
+		"Error_Code__c":    evt.ErrorCode,
+		"Target_Object__c": evt.TargetObject,
+		"Raw_Row__c":       Truncate(evt.RawRow, rawRowLimit),
+	}
+	for k, v := range opt {
+		if v != "" {
+			rec[k] = v
+		}
+	}
+	if evt.LineNumber > 0 {
+		rec["Line_Number__c"] = evt.LineNumber
+	}
+	return rec
+}
+
+// AttemptRecord returns an Import_Error_Attempt__c child for evt linked to
+// its parent by external id. Salesforce rolls the children up into
+// Retry_Count__c, so concurrent failures never lose an increment.
+func AttemptRecord(evt Event, at time.Time) map[string]any {
+	return map[string]any{
+		"Import_Error__r":  map[string]string{"External_Row_Id__c": evt.ExternalRowID},
+		"Error_Message__c": evt.Message,
+		"Attempted_At__c":  at.UTC().Format(time.RFC3339),
+	}
+}
+
+// ErrRejected marks errors where Salesforce refused the record itself.
+var ErrRejected = errors.New("rejected by salesforce")
+
+// Retryable reports whether err means Salesforce or the broker was
+// unreachable, as opposed to the record being rejected.
+func Retryable(err error) bool {
+	if errors.Is(err, ErrRejected) {
+		return false
+	}
+	return sfclient.Transient(err)
+}
+
+// ErrSpoolDisabled is returned when no dead-letter bucket is configured.
+var ErrSpoolDisabled = errors.New("dead-letter spool not configured")
+
+// PutObjectAPI is the subset of the S3 client used to spool events.
+type PutObjectAPI interface {
+	PutObject(context.Context, *s3.PutObjectInput, ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+}
+
+// Logger delivers events to Salesforce and spools the ones it cannot
+// deliver under Prefix in Bucket. Spooling is off without S3 or Bucket.
+type Logger struct {
+	SF     *sfclient.Client
+	S3     PutObjectAPI
+	Bucket string
+	Prefix string
+	Now    func() time.Time
+	Log    *zap.SugaredLogger
+}
+
+// RecordResult reports the outcome for one event in a batch.
+type RecordResult struct {
+	ExternalRowID string `json:"externalRowId"`
+	ID            string `json:"id,omitempty"`
+	Success       bool   `json:"success"`
+	Created       bool   `json:"created"`
+	Error         string `json:"error,omitempty"`
+	Spooled       bool   `json:"spooled,omitempty"`
+
+	// cause is the delivery error for failures caused by Salesforce being
+	// unreachable rather than by the record itself.
+	cause error
+}
+
+// BatchResult summarises a batch delivery.
+type BatchResult struct {
+	Total     int            `json:"total"`
+	Succeeded int            `json:"succeeded"`
+	Failed    int            `json:"failed"`
+	Spooled   int            `json:"spooled"`
+	Results   []RecordResult `json:"results"`
+}
+
+// Spool writes undelivered events to the dead-letter prefix as one JSONL
+// object, in the same format LogImportError accepts as a rejects file.
+func (l *Logger) Spool(ctx context.Context, evts []Event, reason error) error {
+	if l.Bucket == "" || l.S3 == nil {
+		return ErrSpoolDisabled
+	}
+	var buf bytes.Buffer
+	for _, e := range evts {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return fmt.Errorf("encode spool: %w", err)
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	key := fmt.Sprintf("%s%s-%s.jsonl", l.Prefix, l.now().UTC().Format("20060102T150405.000000000Z"), hex.EncodeToString(suffix))
+	_, err := l.S3.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:   &l.Bucket,
+		Key:      &key,
+		Body:     bytes.NewReader(buf.Bytes()),
+		Metadata: map[string]string{"reason": Truncate(reason.Error(), 512)},
+	})
+	if err != nil {
+		return fmt.Errorf("put spool: %w", err)
+	}
+	l.Log.Warnw("spooled undelivered errors", "key", key, "count", len(evts), "reason", reason)
+	return nil
+}
+
+// Batch upserts evts through sObject Collections in chunks of BatchSize and
+// reports the outcome of every record. Undeliverable records are spooled;
+// without a spool an open circuit is returned as CircuitOpenError for the
+// state machine to wait on.
+func (l *Logger) Batch(ctx context.Context, evts []Event) (*BatchResult, error) {
+	res := &BatchResult{Total: len(evts), Results: make([]RecordResult, 0, len(evts))}
+	if len(evts) == 0 {
+		return res, nil
+	}
+	token, err := l.SF.Token(ctx)
+	if err != nil {
+		if serr := l.Spool(ctx, evts, err); serr != nil {
+			if oe := sfclient.CircuitOpen(err); oe != nil && errors.Is(serr, ErrSpoolDisabled) {
+				return nil, oe
+			}
+			return nil, errors.Join(err, serr)
+		}
+		for _, e := range evts {
+			res.Results = append(res.Results, RecordResult{ExternalRowID: e.ExternalRowID, Error: err.Error(), Spooled: true})
+		}
+		res.Failed, res.Spooled = len(evts), len(evts)
+		return res, nil
+	}
+	for i := 0; i < len(evts); i += BatchSize {
+		end := min(i+BatchSize, len(evts))
+		res.Results = append(res.Results, l.upsertChunk(ctx, &token, evts[i:end])...)
+	}
+	var retry []int
+	for i, r := range res.Results {
+		if r.Success {
+			res.Succeeded++
+			continue
+		}
+		res.Failed++
+		if r.cause != nil {
+			retry = append(retry, i)
+		}
+	}
+	if len(retry) > 0 {
+		undelivered := make([]Event, len(retry))
+		for n, i := range retry {
+			undelivered[n] = evts[i]
+		}
+		cause := res.Results[retry[0]].cause
+		if err := l.Spool(ctx, undelivered, cause); err != nil {
+			if oe := sfclient.CircuitOpen(cause); oe != nil && errors.Is(err, ErrSpoolDisabled) {
+				return nil, oe
+			}
+			l.Log.Errorw("spool failed", "count", len(retry), "error", err)
+		} else {
+			for _, i := range retry {
+				res.Results[i].Spooled = true
+			}
+			res.Spooled = len(retry)
+		}
+	}
+	l.Log.Infow("batch logged", "total", res.Total, "succeeded", res.Succeeded, "failed", res.Failed, "spooled", res.Spooled)
+	return res, nil
+}
+
+// collectionResult is one element of an sObject Collections response.
+type collectionResult struct {
+	ID      string `json:"id"`
+	Success bool   `json:"success"`
+	Created bool   `json:"created"`
+	Errors  []struct {
+		StatusCode string   `json:"statusCode"`
+		Message    string   `json:"message"`
+		Fields     []string `json:"fields"`
+	} `json:"errors"`
+}
+
+// message joins the Salesforce errors into one string.
+func (c collectionResult) message() string {
+	var parts []string
+	for _, e := range c.Errors {
+		parts = append(parts, e.StatusCode+": "+e.Message)
+	}
+	return strings.Join(parts, "; ")
+}
+
+// upsertChunk upserts up to BatchSize events and records an attempt for
+// each successful upsert.
+func (l *Logger) upsertChunk(ctx context.Context, token *string, evts []Event) []RecordResult {
+	out := make([]RecordResult, len(evts))
+	records := make([]map[string]any, len(evts))
+	for i, e := range evts {
+		out[i].ExternalRowID = e.ExternalRowID
+		records[i] = Record(e)
+		records[i]["attributes"] = map[string]string{"type": "Import_Error__c"}
+	}
+	results, err := l.collectionCall(ctx, http.MethodPatch, "/composite/sobjects/Import_Error__c/External_Row_Id__c", token, map[string]any{"allOrNone": false, "records": records})
+	if err == nil && len(results) != len(evts) {
+		err = fmt.Errorf("collection returned %d results for %d records", len(results), len(evts))
+	}
+	if err != nil {
+		for i := range out {
+			out[i].Error = err.Error()
+			if Retryable(err) {
+				out[i].cause = err
+			}
+		}
+		return out
+	}
+
+	var ok []int
+	for i, r := range results {
+		out[i].ID, out[i].Success, out[i].Created = r.ID, r.Success, r.Created
+		if r.Success {
+			ok = append(ok, i)
+		} else {
+			out[i].Error = r.message()
+		}
+	}
+	if len(ok) > 0 {
+		l.recordAttempts(ctx, token, evts, out, ok)
+	}
+	return out
+}
+
+// recordAttempts inserts an Import_Error_Attempt__c for every upserted
+// record. A record whose attempt cannot be written is reported as failed so
+// the caller can redeliver it.
+func (l *Logger) recordAttempts(ctx context.Context, token *string, evts []Event, out []RecordResult, idx []int) {
+	at := l.now()
+	records := make([]map[string]any, len(idx))
+	for n, i := range idx {
+		records[n] = AttemptRecord(evts[i], at)
+		records[n]["attributes"] = map[string]string{"type": "Import_Error_Attempt__c"}
+	}
+	results, err := l.collectionCall(ctx, http.MethodPost, "/composite/sobjects", token, map[string]any{"allOrNone": false, "records": records})
+	if err == nil && len(results) != len(idx) {
+		err = fmt.Errorf("collection returned %d results for %d records", len(results), len(idx))
+	}
+	for n, i := range idx {
+		switch {
+		case err != nil:
+			out[i].Success, out[i].Error = false, "record attempt: "+err.Error()
+			if Retryable(err) {
+				out[i].cause = err
+			}
+		case !results[n].Success:
+			out[i].Success, out[i].Error = false, "record attempt: "+results[n].message()
+		}
+	}
+}
+
+// collectionCall sends an sObject Collections request and decodes the
+// per-record results.
+func (l *Logger) collectionCall(ctx context.Context, method, path string, token *string, body any) ([]collectionResult, error) {
+	resp, err := l.SF.Send(ctx, method, path, token, body)
+	if err != nil {
+		return nil, err
+	}
+	b, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	var results []collectionResult
+	if err := json.Unmarshal(b, &results); err != nil {
+		return nil, fmt.Errorf("decode collection response: %w", err)
+	}
+	return results, nil
+}
+
+func (l *Logger) now() time.Time {
+	if l.Now == nil {
+		return time.Now()
+	}
+	return l.Now()
+}
@@ -0,0 +1,164 @@
+package importerror
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"go.uber.org/zap"
+
+	"github.com/your-org/file-processor-sample/internal/circuit"
+	"github.com/your-org/file-processor-sample/internal/sfclient"
+)
+
+func TestErrorRecordFields(t *testing.T) {
+	rec := Record(Event{
+		ExternalRowID: "r1",
+		Message:       "bad email",
+		FileKey:       "flood_qns/dev/file.csv",
+		LineNumber:    42,
+		Field:         "Email",
+		ErrorCode:     "REGEX",
+		TargetObject:  "Account",
+		RawRow:        strings.Repeat("é", rawRowLimit+10),
+	})
+	want := map[string]any{
+		"File_Key__c":      "flood_qns/dev/file.csv",
+		"Line_Number__c":   42,
+		"Field_Name__c":    "Email",
+		"Error_Code__c":    "REGEX",
+		"Target_Object__c": "Account",
+	}
+	for k, v := range want {
+		if rec[k] != v {
+			t.Fatalf("%s = %v, want %v", k, rec[k], v)
+		}
+	}
+	if raw, _ := rec["Raw_Row__c"].(string); len([]rune(raw)) != rawRowLimit {
+		t.Fatalf("raw row not truncated: %d", len([]rune(raw)))
+	}
+	if rec := Record(Event{ExternalRowID: "r2"}); len(rec) != 2 {
+		t.Fatalf("optional fields should be omitted: %v", rec)
+	}
+}
+
+type putS3 struct {
+	objects map[string][]byte
+	err     error
+}
+
+func (p *putS3) PutObject(ctx context.Context, in *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	b, _ := io.ReadAll(in.Body)
+	p.objects[*in.Key] = b
+	return &s3.PutObjectOutput{}, nil
+}
+
+// logger returns a Logger against a broker and a Salesforce stub answering
+// with sf.
+func logger(t *testing.T, sf http.HandlerFunc) *Logger {
+	t.Helper()
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"token":"tok"}`)
+	}))
+	t.Cleanup(broker.Close)
+	api := httptest.NewServer(sf)
+	t.Cleanup(api.Close)
+	return &Logger{
+		SF:  &sfclient.Client{BrokerURL: broker.URL, API: api.URL, Sleep: func(time.Duration) {}},
+		Now: func() time.Time { return time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC) },
+		Log: zap.NewNop().Sugar(),
+	}
+}
+
+func TestBatch(t *testing.T) {
+	var attempts int
+	l := logger(t, func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Records []map[string]any `json:"records"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		var out []map[string]any
+		for _, rec := range body.Records {
+			switch {
+			case r.Method == http.MethodPost:
+				attempts++
+				out = append(out, map[string]any{"success": true})
+			case rec["External_Row_Id__c"] == "bad":
+				out = append(out, map[string]any{"success": false, "errors": []map[string]any{{"statusCode": "INVALID_FIELD", "message": "nope"}}})
+			default:
+				out = append(out, map[string]any{"id": "a0E", "success": true, "created": true})
+			}
+		}
+		_ = json.NewEncoder(w).Encode(out)
+	})
+	res, err := l.Batch(context.Background(), []Event{{ExternalRowID: "r1", Message: "m"}, {ExternalRowID: "bad"}})
+	if err != nil || res.Succeeded != 1 || res.Failed != 1 || res.Spooled != 0 || attempts != 1 {
+		t.Fatalf("unexpected %+v %v attempts=%d", res, err, attempts)
+	}
+	if r := res.Results[1]; r.Success || r.Spooled || r.Error != "INVALID_FIELD: nope" {
+		t.Fatalf("rejected record %+v", r)
+	}
+}
+
+func TestBatchSpool(t *testing.T) {
+	l := logger(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	store := &putS3{objects: map[string][]byte{}}
+	l.S3, l.Bucket, l.Prefix = store, "dlq", "dead/"
+	res, err := l.Batch(context.Background(), []Event{{ExternalRowID: "r1", Message: "x"}})
+	if err != nil || res.Spooled != 1 || !res.Results[0].Spooled {
+		t.Fatalf("unexpected %+v %v", res, err)
+	}
+	for k, v := range store.objects {
+		var e Event
+		if !strings.HasPrefix(k, "dead/20240501T000000") || json.Unmarshal(bytes.TrimSpace(v), &e) != nil || e.ExternalRowID != "r1" {
+			t.Fatalf("unexpected spool %s %s", k, v)
+		}
+	}
+
+	store.err = errors.New("denied")
+	if res, err := l.Batch(context.Background(), []Event{{ExternalRowID: "r2"}}); err != nil || res.Spooled != 0 || res.Results[0].Spooled {
+		t.Fatalf("failed spool should leave the record unspooled: %+v %v", res, err)
+	}
+}
+
+// openCircuit is a breaker table whose item is open for another minute.
+type openCircuit struct{}
+
+func (openCircuit) GetItem(ctx context.Context, in *dynamodb.GetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	until := strconv.FormatInt(time.Now().Add(time.Minute).UnixMilli(), 10)
+	return &dynamodb.GetItemOutput{Item: map[string]dbtypes.AttributeValue{
+		"Failures":  &dbtypes.AttributeValueMemberN{Value: "5"},
+		"OpenUntil": &dbtypes.AttributeValueMemberN{Value: until},
+	}}, nil
+}
+
+func (openCircuit) UpdateItem(ctx context.Context, in *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func TestBatchCircuitOpen(t *testing.T) {
+	l := logger(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected call %s", r.URL)
+	})
+	l.SF.Breaker = &circuit.Breaker{DB: openCircuit{}, Table: "circuit", Name: "salesforce"}
+	_, err := l.Batch(context.Background(), []Event{{ExternalRowID: "r1"}})
+	if _, ok := err.(*circuit.CircuitOpenError); !ok {
+		t.Fatalf("expected CircuitOpenError without a spool, got %T %v", err, err)
+	}
+}
@@ -0,0 +1,294 @@
+// Package postcreate runs the postCreateRules declared on a Profile v2
+// target after the row processor has created or updated the target record.
+// Rules can create related Tasks, set campaign member status or upsert a
+// follow-up record. Step types are registered by name like enrichments.
+package postcreate
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/your-org/file-processor-sample/internal/profile"
+)
+
+// Client is the Salesforce access available to rules.
+type Client interface {
+	// Create inserts a record and returns its id.
+	Create(ctx context.Context, object string, fields map[string]any) (string, error)
+	// Update changes fields on an existing record.
+	Update(ctx context.Context, object, id string, fields map[string]any) error
+	// Upsert creates or updates the record whose extField equals extID.
+	Upsert(ctx context.Context, object, extField, extID string, fields map[string]any) (id string, created bool, err error)
+	// Query runs a SOQL query and returns the matching records.
+	Query(ctx context.Context, soql string) ([]map[string]any, error)
+}
+
+// Record is the target record the rules run for.
+type Record struct {
+	Object  string
+	ID      string
+	Created bool
+	Row     map[string]string
+	// IDs holds the ids of records already written for the row, by object
+	// name, for @{Object.id} references. Follow-up upserts add to it.
+	IDs map[string]string
+}
+
+// Action performs a rule against rec.
+type Action func(ctx context.Context, c Client, rec *Record) error
+
+// Factory builds an Action for rules on target object from the step
+// parameters. It must reject bad parameters.
+type Factory func(object string, params map[string]any) (Action, error)
+
+var registry = map[string]Factory{}
+
+// Register makes a rule type available to profiles. It panics on a
+// duplicate name.
+func Register(name string, f Factory) {
+	if _, dup := registry[name]; dup {
+		panic("postcreate: duplicate type " + name)
+	}
+	registry[name] = f
+}
+
+// Types lists the registered rule types.
+func Types() []string {
+	out := make([]string, 0, len(registry))
+	for k := range registry {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func init() {
+	Register("createTask", newCreateTask)
+	Register("campaignMemberStatus", newCampaignMemberStatus)
+	Register("upsert", newUpsert)
+}
+
+// Trigger values for the "on" parameter.
+const (
+	OnAny     = "any"
+	OnCreated = "created"
+	OnUpdated = "updated"
+)
+
+type rule struct {
+	typ    string
+	on     string
+	when   map[string]*regexp.Regexp
+	action Action
+}
+
+// matches reports whether the rule applies to rec.
+func (r rule) matches(rec *Record) bool {
+	if r.on == OnCreated && !rec.Created || r.on == OnUpdated && rec.Created {
+		return false
+	}
+	for col, re := range r.when {
+		if !re.MatchString(rec.Row[col]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Engine runs the rules of one target in declaration order.
+type Engine struct {
+	rules []rule
+}
+
+// Failure is a rule that could not be applied.
+type Failure struct {
+	Index int
+	Type  string
+	Err   error
+}
+
+// Error describes the failed rule.
+func (f Failure) Error() string {
+	return fmt.Sprintf("postCreateRules[%d] %s: %v", f.Index, f.Type, f.Err)
+}
+
+// Unwrap returns the rule's error.
+func (f Failure) Unwrap() error { return f.Err }
+
+// Build validates the rules of target. Every rule takes "on", one of
+// "created", "updated" or "any" (default), and "when", a map of row columns
+// to regexes that must all match for the rule to run.
+func Build(target profile.Target) (*Engine, error) {
+	e := &Engine{}
+	for i, s := range target.PostCreateRules {
+		f, ok := registry[s.Type]
+		if !ok {
+			return nil, fmt.Errorf("postCreateRules[%d]: unknown type %q (known: %s)", i, s.Type, strings.Join(Types(), ", "))
+		}
+		params := make(map[string]any, len(s.Params))
+		for k, v := range s.Params {
+			params[k] = v
+		}
+		r := rule{typ: s.Type, on: OnAny}
+		if v, ok := params["on"]; ok {
+			on, _ := v.(string)
+			if on != OnAny && on != OnCreated && on != OnUpdated {
+				return nil, fmt.Errorf("postCreateRules[%d] %s: on must be %q, %q or %q", i, s.Type, OnCreated, OnUpdated, OnAny)
+			}
+			r.on = on
+			delete(params, "on")
+		}
+		if v, ok := params["when"]; ok {
+			when, err := stringMap(v)
+			if err != nil {
+				return nil, fmt.Errorf("postCreateRules[%d] %s: when %v", i, s.Type, err)
+			}
+			r.when = make(map[string]*regexp.Regexp, len(when))
+			for col, pat := range when {
+				re, err := regexp.Compile(pat)
+				if err != nil {
+					return nil, fmt.Errorf("postCreateRules[%d] %s: when %s: %w", i, s.Type, col, err)
+				}
+				r.when[col] = re
+			}
+			delete(params, "when")
+		}
+		action, err := f(target.Object, params)
+		if err != nil {
+			return nil, fmt.Errorf("postCreateRules[%d] %s: %w", i, s.Type, err)
+		}
+		r.action = action
+		e.rules = append(e.rules, r)
+	}
+	return e, nil
+}
+
+// Len returns the number of rules.
+func (e *Engine) Len() int {
+	if e == nil {
+		return 0
+	}
+	return len(e.rules)
+}
+
+// Run applies the matching rules to rec and returns how many ran and the
+// ones that failed. A failed rule does not stop the rules after it.
+func (e *Engine) Run(ctx context.Context, c Client, rec *Record) (ran int, failed []Failure) {
+	if e == nil {
+		return 0, nil
+	}
+	if rec.IDs == nil {
+		rec.IDs = map[string]string{}
+	}
+	if rec.ID != "" {
+		rec.IDs[rec.Object] = rec.ID
+	}
+	for i, r := range e.rules {
+		if !r.matches(rec) {
+			continue
+		}
+		ran++
+		if err := r.action(ctx, c, rec); err != nil {
+			failed = append(failed, Failure{Index: i, Type: r.typ, Err: err})
+		}
+	}
+	return ran, failed
+}
+
+// refPattern matches @{Column} and @{Object.id} references in templates.
+var refPattern = regexp.MustCompile(`@\{([^}]+)\}`)
+
+// template is a parameter value that may reference row columns and ids.
+type template string
+
+// expand substitutes the references in t. @{Object.id} resolves to the id
+// written for Object, anything else to the row column of that name.
+func (t template) expand(rec *Record) (string, error) {
+	var missing []string
+	out := refPattern.ReplaceAllStringFunc(string(t), func(m string) string {
+		ref := m[2 : len(m)-1]
+		if obj, ok := strings.CutSuffix(ref, ".id"); ok {
+			if id, ok := rec.IDs[obj]; ok {
+				return id
+			}
+			missing = append(missing, m)
+			return ""
+		}
+		v, ok := rec.Row[ref]
+		if !ok {
+			missing = append(missing, m)
+		}
+		return v
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("unresolved %s", strings.Join(missing, ", "))
+	}
+	return out, nil
+}
+
+// expandFields expands every template in fields.
+func expandFields(fields map[string]template, rec *Record) (map[string]any, error) {
+	out := make(map[string]any, len(fields))
+	for k, t := range fields {
+		v, err := t.expand(rec)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", k, err)
+		}
+		out[k] = v
+	}
+	return out, nil
+}
+
+// stringParam returns the string parameter name; required parameters must
+// be non-empty.
+func stringParam(params map[string]any, name string, required bool) (string, error) {
+	v, ok := params[name]
+	if !ok {
+		if required {
+			return "", fmt.Errorf("%s is required", name)
+		}
+		return "", nil
+	}
+	s, ok := v.(string)
+	if !ok || required && s == "" {
+		return "", fmt.Errorf("%s must be a non-empty string", name)
+	}
+	return s, nil
+}
+
+// stringMap converts a JSON object of strings.
+func stringMap(v any) (map[string]string, error) {
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("must be an object of strings")
+	}
+	out := make(map[string]string, len(m))
+	for k, x := range m {
+		s, ok := x.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s must be a string", k)
+		}
+		out[k] = s
+	}
+	return out, nil
+}
+
+// templateMap reads an optional object parameter of templates.
+func templateMap(params map[string]any, name string) (map[string]template, error) {
+	v, ok := params[name]
+	if !ok {
+		return map[string]template{}, nil
+	}
+	m, err := stringMap(v)
+	if err != nil {
+		return nil, fmt.Errorf("%s %v", name, err)
+	}
+	out := make(map[string]template, len(m))
+	for k, s := range m {
+		out[k] = template(s)
+	}
+	return out, nil
+}
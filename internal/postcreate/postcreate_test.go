@@ -0,0 +1,170 @@
+package postcreate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/your-org/file-processor-sample/internal/profile"
+)
+
+type call struct {
+	op     string
+	object string
+	id     string
+	fields map[string]any
+}
+
+type fakeClient struct {
+	calls   []call
+	members []map[string]any
+	queries []string
+	fail    map[string]error
+}
+
+func (f *fakeClient) Create(ctx context.Context, object string, fields map[string]any) (string, error) {
+	f.calls = append(f.calls, call{"create", object, "", fields})
+	if err := f.fail[object]; err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("new%d", len(f.calls)), nil
+}
+
+func (f *fakeClient) Update(ctx context.Context, object, id string, fields map[string]any) error {
+	f.calls = append(f.calls, call{"update", object, id, fields})
+	return f.fail[object]
+}
+
+func (f *fakeClient) Upsert(ctx context.Context, object, extField, extID string, fields map[string]any) (string, bool, error) {
+	f.calls = append(f.calls, call{"upsert", object, extField + "/" + extID, fields})
+	if err := f.fail[object]; err != nil {
+		return "", false, err
+	}
+	return "up-" + extID, true, nil
+}
+
+func (f *fakeClient) Query(ctx context.Context, soql string) ([]map[string]any, error) {
+	f.queries = append(f.queries, soql)
+	return f.members, nil
+}
+
+func target(t *testing.T, object, rules string) profile.Target {
+	t.Helper()
+	tg := profile.Target{Object: object}
+	if err := json.Unmarshal([]byte(rules), &tg.PostCreateRules); err != nil {
+		t.Fatal(err)
+	}
+	return tg
+}
+
+func TestRun(t *testing.T) {
+	e, err := Build(target(t, "Contact", `[
+		{"type": "createTask", "on": "created", "subject": "Welcome @{FirstName}", "fields": {"Status": "Not Started"}},
+		{"type": "campaignMemberStatus", "campaignId": "@{Campaign}", "status": "Responded", "when": {"Response": "^(Y|yes)$"}},
+		{"type": "upsert", "on": "updated", "object": "Quote__c", "externalId": "Quote_Number__c",
+		 "fieldMap": {"QuoteNumber": "Quote_Number__c", "Premium": "Premium__c"}, "link": {"Contact__c": "@{Contact.id}"}},
+		{"type": "createTask", "subject": "Review quote", "fields": {"WhatId": "@{Quote__c.id}"}, "when": {"QuoteNumber": "."}}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	row := map[string]string{"FirstName": "Ann", "Campaign": "701A", "Response": "Y", "QuoteNumber": "Q1", "Premium": "10"}
+
+	c := &fakeClient{}
+	ran, failed := e.Run(context.Background(), c, &Record{Object: "Contact", ID: "003A", Created: true, Row: row})
+	// the quote upsert only runs on updates, so the last task cannot link to it
+	if ran != 3 || len(failed) != 1 || failed[0].Index != 3 || !strings.Contains(failed[0].Error(), "@{Quote__c.id}") {
+		t.Fatalf("ran %d failed %v", ran, failed)
+	}
+	task := c.calls[0]
+	if task.object != "Task" || task.fields["Subject"] != "Welcome Ann" || task.fields["WhoId"] != "003A" || task.fields["Status"] != "Not Started" {
+		t.Fatalf("unexpected task %+v", task)
+	}
+
+	c = &fakeClient{members: []map[string]any{{"Id": "00vA"}}}
+	rec := &Record{Object: "Contact", ID: "003A", Row: row}
+	ran, failed = e.Run(context.Background(), c, rec)
+	if ran != 3 || len(failed) != 0 {
+		t.Fatalf("ran %d failed %v", ran, failed)
+	}
+	if len(c.queries) != 1 || !strings.Contains(c.queries[0], "CampaignId = '701A' AND ContactId = '003A'") {
+		t.Fatalf("unexpected query %v", c.queries)
+	}
+	if u := c.calls[0]; u.op != "update" || u.id != "00vA" || u.fields["Status"] != "Responded" {
+		t.Fatalf("unexpected member update %+v", u)
+	}
+	up := c.calls[1]
+	if up.op != "upsert" || up.id != "Quote_Number__c/Q1" || up.fields["Contact__c"] != "003A" || up.fields["Premium__c"] != "10" {
+		t.Fatalf("unexpected upsert %+v", up)
+	}
+	if _, ok := up.fields["Quote_Number__c"]; ok {
+		t.Fatal("external id should not be in the body")
+	}
+	if task := c.calls[2]; task.fields["WhatId"] != "up-Q1" {
+		t.Fatalf("task should link to the upserted quote, got %+v", task)
+	}
+	if rec.IDs["Quote__c"] != "up-Q1" {
+		t.Fatalf("ids = %v", rec.IDs)
+	}
+}
+
+func TestCampaignMemberCreate(t *testing.T) {
+	e, err := Build(target(t, "Lead", `[{"type": "campaignMemberStatus", "campaignId": "701B", "status": "Sent"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &fakeClient{}
+	if _, failed := e.Run(context.Background(), c, &Record{Object: "Lead", ID: "00Q'1", Row: map[string]string{}}); len(failed) != 0 {
+		t.Fatal(failed)
+	}
+	if !strings.Contains(c.queries[0], `LeadId = '00Q\'1'`) {
+		t.Fatalf("id should be quoted: %s", c.queries[0])
+	}
+	if m := c.calls[0]; m.op != "create" || m.object != "CampaignMember" || m.fields["LeadId"] != "00Q'1" || m.fields["Status"] != "Sent" {
+		t.Fatalf("unexpected create %+v", m)
+	}
+}
+
+func TestRunFailureContinues(t *testing.T) {
+	e, _ := Build(target(t, "Account", `[{"type":"createTask","subject":"a"},{"type":"createTask","subject":"b"}]`))
+	boom := errors.New("REQUIRED_FIELD_MISSING")
+	c := &fakeClient{fail: map[string]error{"Task": boom}}
+	ran, failed := e.Run(context.Background(), c, &Record{Object: "Account", ID: "001"})
+	if ran != 2 || len(failed) != 2 || !errors.Is(failed[1], boom) || failed[1].Index != 1 {
+		t.Fatalf("ran %d failed %v", ran, failed)
+	}
+	if c.calls[0].fields["WhatId"] != "001" {
+		t.Fatalf("accounts relate through WhatId: %+v", c.calls[0])
+	}
+}
+
+func TestBuildErrors(t *testing.T) {
+	for _, tc := range []struct{ object, rules string }{
+		{"Account", `[{"type":"sendEmail"}]`},
+		{"Account", `[{"type":"createTask"}]`},
+		{"Account", `[{"type":"createTask","subject":"x","on":"deleted"}]`},
+		{"Account", `[{"type":"createTask","subject":"x","when":{"A":"("}}]`},
+		{"Account", `[{"type":"createTask","subject":"x","when":["A"]}]`},
+		{"Account", `[{"type":"createTask","subject":"x","fields":{"Priority":1}}]`},
+		{"Account", `[{"type":"campaignMemberStatus","campaignId":"c","status":"s"}]`},
+		{"Contact", `[{"type":"campaignMemberStatus","campaignId":"c"}]`},
+		{"Account", `[{"type":"upsert","object":"Quote__c","externalId":"Ext__c"}]`},
+		{"Account", `[{"type":"upsert","object":"Quote__c","externalId":"Ext__c","fieldMap":{"A":"B__c"}}]`},
+	} {
+		if _, err := Build(target(t, tc.object, tc.rules)); err == nil {
+			t.Errorf("%s %s: expected error", tc.object, tc.rules)
+		}
+	}
+}
+
+func TestRegisterDuplicatePanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic")
+		}
+	}()
+	Register("upsert", newUpsert)
+}
@@ -0,0 +1,141 @@
+package postcreate
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// newCreateTask builds a rule that inserts a Task related to the record:
+// WhoId for Contacts and Leads, WhatId otherwise. "subject" and the
+// optional "fields" (Task field to value) are templates.
+func newCreateTask(object string, params map[string]any) (Action, error) {
+	subject, err := stringParam(params, "subject", true)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := templateMap(params, "fields")
+	if err != nil {
+		return nil, err
+	}
+	fields["Subject"] = template(subject)
+	relation := "WhatId"
+	if object == "Contact" || object == "Lead" {
+		relation = "WhoId"
+	}
+	if _, ok := fields[relation]; !ok {
+		fields[relation] = template("@{" + object + ".id}")
+	}
+	return func(ctx context.Context, c Client, rec *Record) error {
+		body, err := expandFields(fields, rec)
+		if err != nil {
+			return err
+		}
+		_, err = c.Create(ctx, "Task", body)
+		return err
+	}, nil
+}
+
+// newCampaignMemberStatus builds a rule that adds the Contact or Lead to
+// "campaignId" with "status", or updates the status of the existing
+// CampaignMember. Both parameters are templates.
+func newCampaignMemberStatus(object string, params map[string]any) (Action, error) {
+	if object != "Contact" && object != "Lead" {
+		return nil, fmt.Errorf("target must be Contact or Lead, not %s", object)
+	}
+	campaign, err := stringParam(params, "campaignId", true)
+	if err != nil {
+		return nil, err
+	}
+	status, err := stringParam(params, "status", true)
+	if err != nil {
+		return nil, err
+	}
+	member := object + "Id"
+	return func(ctx context.Context, c Client, rec *Record) error {
+		campaignID, err := template(campaign).expand(rec)
+		if err != nil {
+			return fmt.Errorf("campaignId: %w", err)
+		}
+		st, err := template(status).expand(rec)
+		if err != nil {
+			return fmt.Errorf("status: %w", err)
+		}
+		if campaignID == "" {
+			return fmt.Errorf("campaignId is empty")
+		}
+		soql := fmt.Sprintf("SELECT Id FROM CampaignMember WHERE CampaignId = %s AND %s = %s LIMIT 1", soqlQuote(campaignID), member, soqlQuote(rec.ID))
+		existing, err := c.Query(ctx, soql)
+		if err != nil {
+			return fmt.Errorf("find campaign member: %w", err)
+		}
+		if len(existing) > 0 {
+			id, _ := existing[0]["Id"].(string)
+			return c.Update(ctx, "CampaignMember", id, map[string]any{"Status": st})
+		}
+		_, err = c.Create(ctx, "CampaignMember", map[string]any{"CampaignId": campaignID, member: rec.ID, "Status": st})
+		return err
+	}, nil
+}
+
+// newUpsert builds a follow-up upsert of "object" on "externalId". Like a
+// profile target, "fieldMap" maps row columns to fields and must include
+// the external id; the optional "link" maps fields to templates such as
+// "@{Account.id}". The new id is available to later rules.
+func newUpsert(_ string, params map[string]any) (Action, error) {
+	object, err := stringParam(params, "object", true)
+	if err != nil {
+		return nil, err
+	}
+	extField, err := stringParam(params, "externalId", true)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := params["fieldMap"]
+	if !ok {
+		return nil, fmt.Errorf("fieldMap is required")
+	}
+	fieldMap, err := stringMap(v)
+	if err != nil {
+		return nil, fmt.Errorf("fieldMap %v", err)
+	}
+	extColumn := ""
+	for col, field := range fieldMap {
+		if field == extField {
+			extColumn = col
+		}
+	}
+	if extColumn == "" {
+		return nil, fmt.Errorf("fieldMap must map a column to %s", extField)
+	}
+	link, err := templateMap(params, "link")
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, c Client, rec *Record) error {
+		extID := rec.Row[extColumn]
+		if extID == "" {
+			return fmt.Errorf("%s: column %s is empty", extField, extColumn)
+		}
+		body, err := expandFields(link, rec)
+		if err != nil {
+			return err
+		}
+		for col, field := range fieldMap {
+			if v, ok := rec.Row[col]; ok && field != extField {
+				body[field] = v
+			}
+		}
+		id, _, err := c.Upsert(ctx, object, extField, extID, body)
+		if err != nil {
+			return err
+		}
+		rec.IDs[object] = id
+		return nil
+	}, nil
+}
+
+// soqlQuote returns s as a SOQL string literal.
+func soqlQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
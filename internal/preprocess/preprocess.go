@@ -0,0 +1,345 @@
+// Package preprocess runs the preProcessors declared in a Profile v2 over
+// the raw object before it reaches the parser. Each step is selected by
+// its "type" and built from the remaining keys by a registered Factory.
+package preprocess
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+
+	"github.com/your-org/file-processor-sample/internal/profile"
+)
+
+// Func wraps the object stream with one transformation.
+type Func func(r io.Reader) (io.Reader, error)
+
+// Factory builds a Func from the step parameters, rejecting bad ones.
+type Factory func(params map[string]any) (Func, error)
+
+var registry = map[string]Factory{}
+
+// Register makes a step type available to profiles. It panics on a
+// duplicate name, like the database/sql driver registry.
+func Register(name string, f Factory) {
+	if _, dup := registry[name]; dup {
+		panic("preprocess: duplicate step type " + name)
+	}
+	registry[name] = f
+}
+
+// Types lists the registered step types.
+func Types() []string {
+	out := make([]string, 0, len(registry))
+	for k := range registry {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func init() {
+	Register("gunzip", newGunzip)
+	Register("unzip", newUnzip)
+	Register("charset", newCharset)
+	Register("stripBom", newStripBOM)
+	Register("normalizeLineEndings", newNormalizeLineEndings)
+	Register("renameHeaders", newRenameHeaders)
+}
+
+// Pipeline is an ordered list of built steps.
+type Pipeline []Func
+
+// Build validates steps and builds the pipeline.
+func Build(steps []profile.Step) (Pipeline, error) {
+	p := make(Pipeline, 0, len(steps))
+	for i, s := range steps {
+		f, ok := registry[s.Type]
+		if !ok {
+			return nil, fmt.Errorf("preProcessors[%d]: unknown type %q (known: %s)", i, s.Type, strings.Join(Types(), ", "))
+		}
+		fn, err := f(s.Params)
+		if err != nil {
+			return nil, fmt.Errorf("preProcessors[%d] (%s): %w", i, s.Type, err)
+		}
+		p = append(p, fn)
+	}
+	return p, nil
+}
+
+// Apply runs r through every step in order.
+func (p Pipeline) Apply(r io.Reader) (io.Reader, error) {
+	for i, fn := range p {
+		var err error
+		if r, err = fn(r); err != nil {
+			return nil, fmt.Errorf("preProcessors[%d]: %w", i, err)
+		}
+	}
+	return r, nil
+}
+
+// stringParam returns params[key] as a string, or def when absent.
+func stringParam(params map[string]any, key, def string) (string, error) {
+	v, ok := params[key]
+	if !ok {
+		return def, nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("%s must be a string", key)
+	}
+	return s, nil
+}
+
+// DefaultMaxBytes caps the bytes gunzip and unzip produce unless the step
+// sets "maxBytes", so a small archive cannot expand beyond Lambda memory.
+const DefaultMaxBytes = 256 << 20
+
+// ErrTooLarge is returned once a decompressing step produces more than its
+// maxBytes.
+var ErrTooLarge = errors.New("decompressed size exceeds maxBytes")
+
+// maxBytesParam returns the "maxBytes" parameter of a decompressing step,
+// or DefaultMaxBytes when absent.
+func maxBytesParam(params map[string]any) (int64, error) {
+	v, ok := params["maxBytes"]
+	if !ok {
+		return DefaultMaxBytes, nil
+	}
+	f, ok := v.(float64)
+	if !ok || f < 1 || f != float64(int64(f)) {
+		return 0, fmt.Errorf("maxBytes must be a positive integer")
+	}
+	return int64(f), nil
+}
+
+// capped passes through at most max bytes of r and fails beyond that. c is
+// closed once r is exhausted or fails.
+type capped struct {
+	r    io.Reader
+	c    io.Closer
+	step string
+	max  int64
+	read int64
+}
+
+// newCapped limits r to max bytes for step.
+func newCapped(step string, r io.Reader, c io.Closer, max int64) *capped {
+	return &capped{r: io.LimitReader(r, max+1), c: c, step: step, max: max}
+}
+
+func (l *capped) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if l.read > l.max {
+		_ = l.Close()
+		return n - int(l.read-l.max), fmt.Errorf("%s: %w (%d)", l.step, ErrTooLarge, l.max)
+	}
+	if err != nil {
+		if cerr := l.Close(); cerr != nil && err == io.EOF {
+			return n, fmt.Errorf("%s: %w", l.step, cerr)
+		}
+	}
+	return n, err
+}
+
+// Close closes the underlying member once.
+func (l *capped) Close() error {
+	c := l.c
+	l.c = nil
+	if c == nil {
+		return nil
+	}
+	return c.Close()
+}
+
+// newGunzip decompresses a gzip stream of at most "maxBytes".
+func newGunzip(params map[string]any) (Func, error) {
+	max, err := maxBytesParam(params)
+	if err != nil {
+		return nil, err
+	}
+	return func(r io.Reader) (io.Reader, error) {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("gunzip: %w", err)
+		}
+		return newCapped("gunzip", zr, zr, max), nil
+	}, nil
+}
+
+// newUnzip extracts one member of a zip archive. "member" is a path.Match
+// pattern; without it the archive must hold exactly one file. The archive
+// is read into memory because zip needs random access; the member may
+// expand to at most "maxBytes".
+func newUnzip(params map[string]any) (Func, error) {
+	member, err := stringParam(params, "member", "")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := path.Match(member, ""); err != nil {
+		return nil, fmt.Errorf("member: %w", err)
+	}
+	max, err := maxBytesParam(params)
+	if err != nil {
+		return nil, err
+	}
+	return func(r io.Reader) (io.Reader, error) {
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("unzip: %w", err)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+		if err != nil {
+			return nil, fmt.Errorf("unzip: %w", err)
+		}
+		var files []*zip.File
+		for _, f := range zr.File {
+			if f.FileInfo().IsDir() {
+				continue
+			}
+			if member == "" {
+				files = append(files, f)
+			} else if ok, _ := path.Match(member, f.Name); ok {
+				files = append(files, f)
+				break
+			}
+		}
+		switch {
+		case len(files) == 0:
+			return nil, fmt.Errorf("unzip: no member matches %q", member)
+		case len(files) > 1:
+			return nil, fmt.Errorf("unzip: archive has %d files, set member", len(files))
+		}
+		f := files[0]
+		if f.UncompressedSize64 > uint64(max) {
+			return nil, fmt.Errorf("unzip: %s: %w (%d)", f.Name, ErrTooLarge, max)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("unzip: %w", err)
+		}
+		return newCapped("unzip", rc, rc, max), nil
+	}, nil
+}
+
+// charsets maps "from" values to decoders.
+var charsets = map[string]encoding.Encoding{
+	"windows-1252": charmap.Windows1252,
+	"iso-8859-1":   charmap.ISO8859_1,
+	"utf-16":       unicode.UTF16(unicode.LittleEndian, unicode.UseBOM),
+	"utf-16le":     unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM),
+	"utf-16be":     unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM),
+}
+
+// newCharset transcodes "from" to UTF-8. "utf-16" honours a BOM and
+// defaults to little endian.
+func newCharset(params map[string]any) (Func, error) {
+	from, err := stringParam(params, "from", "")
+	if err != nil {
+		return nil, err
+	}
+	enc, ok := charsets[strings.ToLower(from)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported charset %q", from)
+	}
+	return func(r io.Reader) (io.Reader, error) {
+		return transform.NewReader(r, enc.NewDecoder()), nil
+	}, nil
+}
+
+// newStripBOM drops a leading UTF-8 byte order mark.
+func newStripBOM(params map[string]any) (Func, error) {
+	return func(r io.Reader) (io.Reader, error) {
+		br := bufio.NewReader(r)
+		if b, _ := br.Peek(3); bytes.Equal(b, []byte("\xef\xbb\xbf")) {
+			_, _ = br.Discard(3)
+		}
+		return br, nil
+	}, nil
+}
+
+// newNormalizeLineEndings turns CRLF and lone CR into LF.
+func newNormalizeLineEndings(params map[string]any) (Func, error) {
+	return func(r io.Reader) (io.Reader, error) {
+		return transform.NewReader(r, lineEndings{}), nil
+	}, nil
+}
+
+// lineEndings is the transformer behind normalizeLineEndings.
+type lineEndings struct{ transform.NopResetter }
+
+// Transform implements transform.Transformer.
+func (lineEndings) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	for nSrc < len(src) {
+		c, n := src[nSrc], 1
+		if c == '\r' {
+			if nSrc+1 == len(src) && !atEOF {
+				return nDst, nSrc, transform.ErrShortSrc
+			}
+			c = '\n'
+			if nSrc+1 < len(src) && src[nSrc+1] == '\n' {
+				n = 2
+			}
+		}
+		if nDst == len(dst) {
+			return nDst, nSrc, transform.ErrShortDst
+		}
+		dst[nDst] = c
+		nDst++
+		nSrc += n
+	}
+	return nDst, nSrc, nil
+}
+
+// newRenameHeaders renames columns in the header row of delimited text.
+// "map" maps old names to new ones and "delimiter" defaults to "|".
+func newRenameHeaders(params map[string]any) (Func, error) {
+	delim, err := stringParam(params, "delimiter", "|")
+	if err != nil {
+		return nil, err
+	}
+	if delim == "" {
+		return nil, fmt.Errorf("delimiter must not be empty")
+	}
+	raw, _ := params["map"].(map[string]any)
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("map must name at least one column")
+	}
+	names := make(map[string]string, len(raw))
+	for k, v := range raw {
+		s, ok := v.(string)
+		if !ok || s == "" {
+			return nil, fmt.Errorf("map.%s must be a column name", k)
+		}
+		names[k] = s
+	}
+	return func(r io.Reader) (io.Reader, error) {
+		br := bufio.NewReader(r)
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("read header: %w", err)
+		}
+		body := strings.TrimRight(line, "\r\n")
+		cols := strings.Split(body, delim)
+		for i, c := range cols {
+			if n, ok := names[strings.TrimSpace(c)]; ok {
+				cols[i] = n
+			}
+		}
+		header := strings.Join(cols, delim) + line[len(body):]
+		return io.MultiReader(strings.NewReader(header), br), nil
+	}, nil
+}
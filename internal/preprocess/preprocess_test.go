@@ -0,0 +1,204 @@
+package preprocess
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/your-org/file-processor-sample/internal/profile"
+)
+
+func steps(t *testing.T, doc string) []profile.Step {
+	t.Helper()
+	var s []profile.Step
+	if err := json.Unmarshal([]byte(doc), &s); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func run(t *testing.T, doc string, in []byte) string {
+	t.Helper()
+	p, err := Build(steps(t, doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := p.Apply(bytes.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func zipped(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range []string{"readme.txt", "data/quotes.qns", "data/other.qns"} {
+		body, ok := files[name]
+		if !ok {
+			continue
+		}
+		w, _ := zw.Create(name)
+		_, _ = io.WriteString(w, body)
+	}
+	_ = zw.Close()
+	return buf.Bytes()
+}
+
+func TestGunzipAndNormalize(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, _ = io.WriteString(zw, "\xef\xbb\xbfa|b\r\n1|2\r3|4\n")
+	_ = zw.Close()
+	got := run(t, `[{"type":"gunzip"},{"type":"stripBom"},{"type":"normalizeLineEndings"}]`, buf.Bytes())
+	if got != "a|b\n1|2\n3|4\n" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestLineEndingsAcrossReads(t *testing.T) {
+	p, _ := Build(steps(t, `[{"type":"normalizeLineEndings"}]`))
+	r, _ := p.Apply(iotest.OneByteReader(strings.NewReader("a\r\nb\r\rc\r")))
+	out, err := io.ReadAll(r)
+	if err != nil || string(out) != "a\nb\n\nc\n" {
+		t.Fatalf("got %q %v", out, err)
+	}
+}
+
+func TestUnzip(t *testing.T) {
+	archive := zipped(t, map[string]string{"readme.txt": "ignore", "data/quotes.qns": "a|b\n", "data/other.qns": "x"})
+	if got := run(t, `[{"type":"unzip","member":"data/q*.qns"}]`, archive); got != "a|b\n" {
+		t.Fatalf("got %q", got)
+	}
+	single := zipped(t, map[string]string{"data/quotes.qns": "only"})
+	if got := run(t, `[{"type":"unzip"}]`, single); got != "only" {
+		t.Fatalf("got %q", got)
+	}
+	for _, doc := range []string{`[{"type":"unzip"}]`, `[{"type":"unzip","member":"*.csv"}]`} {
+		p, _ := Build(steps(t, doc))
+		if _, err := p.Apply(bytes.NewReader(archive)); err == nil {
+			t.Errorf("%s: expected member error", doc)
+		}
+	}
+}
+
+type closer struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closer) Close() error { c.closed = true; return nil }
+
+func TestMaxBytes(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, _ = zw.Write(make([]byte, 1<<20))
+	_ = zw.Close()
+	p, _ := Build(steps(t, `[{"type":"gunzip","maxBytes":1024}]`))
+	r, err := p.Apply(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := io.ReadAll(r); !errors.Is(err, ErrTooLarge) || len(out) != 1024 {
+		t.Fatalf("expected gunzip to stop at 1024 bytes, got %d %v", len(out), err)
+	}
+	if got := run(t, `[{"type":"gunzip","maxBytes":4}]`, gzipped("abcd")); got != "abcd" {
+		t.Fatalf("got %q", got)
+	}
+
+	archive := zipped(t, map[string]string{"data/quotes.qns": strings.Repeat("x", 2048)})
+	p, _ = Build(steps(t, `[{"type":"unzip","maxBytes":1024}]`))
+	if _, err := p.Apply(bytes.NewReader(archive)); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("expected unzip to refuse the member, got %v", err)
+	}
+
+	c := &closer{Reader: strings.NewReader("abc")}
+	if out, err := io.ReadAll(newCapped("test", c, c, 3)); err != nil || string(out) != "abc" || !c.closed {
+		t.Fatalf("got %q %v closed=%v", out, err, c.closed)
+	}
+	c = &closer{Reader: strings.NewReader("abcd")}
+	if _, err := io.ReadAll(newCapped("test", c, c, 3)); !errors.Is(err, ErrTooLarge) || !c.closed {
+		t.Fatalf("expected limit error and close, got %v closed=%v", err, c.closed)
+	}
+
+	for _, doc := range []string{`[{"type":"gunzip","maxBytes":0}]`, `[{"type":"unzip","maxBytes":"1"}]`} {
+		if _, err := Build(steps(t, doc)); err == nil {
+			t.Errorf("%s: expected maxBytes error", doc)
+		}
+	}
+}
+
+func gzipped(s string) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, _ = io.WriteString(zw, s)
+	_ = zw.Close()
+	return buf.Bytes()
+}
+
+func TestCharset(t *testing.T) {
+	// "Café – 20€" in Windows-1252
+	cp1252 := []byte{'C', 'a', 'f', 0xe9, ' ', 0x96, ' ', '2', '0', 0x80}
+	if got := run(t, `[{"type":"charset","from":"windows-1252"}]`, cp1252); got != "Café – 20€" {
+		t.Fatalf("windows-1252: got %q", got)
+	}
+	utf16le := []byte{0xff, 0xfe, 'h', 0, 0xe9, 0, '\n', 0}
+	if got := run(t, `[{"type":"charset","from":"UTF-16"}]`, utf16le); got != "hé\n" {
+		t.Fatalf("utf-16: got %q", got)
+	}
+	utf16be := []byte{0, 'h', 0, 'i'}
+	if got := run(t, `[{"type":"charset","from":"utf-16be"}]`, utf16be); got != "hi" {
+		t.Fatalf("utf-16be: got %q", got)
+	}
+}
+
+func TestRenameHeaders(t *testing.T) {
+	got := run(t, `[{"type":"renameHeaders","map":{"Member No":"MemberNumber","E-mail":"Email"}}]`, []byte("Member No| E-mail |Phone\r\n1|a@b|5\r\n"))
+	if got != "MemberNumber|Email|Phone\r\n1|a@b|5\r\n" {
+		t.Fatalf("got %q", got)
+	}
+	got = run(t, `[{"type":"renameHeaders","delimiter":",","map":{"id":"ID"}}]`, []byte("id,name"))
+	if got != "ID,name" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestBuildErrors(t *testing.T) {
+	for _, doc := range []string{
+		`[{"type":"rot13"}]`,
+		`[{"type":"charset","from":"ebcdic"}]`,
+		`[{"type":"charset"}]`,
+		`[{"type":"unzip","member":"["}]`,
+		`[{"type":"renameHeaders"}]`,
+		`[{"type":"renameHeaders","map":{"a":1}}]`,
+		`[{"type":"renameHeaders","delimiter":"","map":{"a":"b"}}]`,
+	} {
+		if _, err := Build(steps(t, doc)); err == nil {
+			t.Errorf("%s: expected error", doc)
+		}
+	}
+	p, _ := Build(steps(t, `[{"type":"gunzip"}]`))
+	if _, err := p.Apply(strings.NewReader("plain text")); err == nil {
+		t.Fatal("expected gzip header error")
+	}
+}
+
+func TestRegisterDuplicatePanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic")
+		}
+	}()
+	Register("gunzip", newGunzip)
+}
@@ -0,0 +1,134 @@
+package profile
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// maxExtends bounds the length of an extends chain.
+const maxExtends = 8
+
+// Resolve reads name from src and applies its "extends" chain: each profile
+// may name a base, absolute or relative to its own directory (e.g.
+// "../base/flood_qns"), and is applied to that base as a JSON merge patch
+// (RFC 7396). Objects merge key by key, arrays and scalars replace, and
+// null deletes a key. The returned document has no "extends" key and its
+// Revision joins the revisions of every file in the chain with "+".
+func Resolve(ctx context.Context, src Source, name string) (*Document, error) {
+	doc, err := src.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := decodeObject(doc)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := leaf["extends"]; !ok {
+		return doc, nil
+	}
+
+	layers := []map[string]any{leaf}
+	revisions := []string{doc.Revision}
+	seen := map[string]bool{doc.Name: true}
+	cur, obj := doc, leaf
+	for {
+		v, ok := obj["extends"]
+		if !ok {
+			break
+		}
+		delete(obj, "extends")
+		ref, ok := v.(string)
+		if !ok || ref == "" {
+			return nil, fmt.Errorf("profile %s: extends must be a profile name", cur.Name)
+		}
+		if len(layers) > maxExtends {
+			return nil, fmt.Errorf("profile %s: extends chain longer than %d", name, maxExtends)
+		}
+		baseName := resolveName(cur.Name, ref)
+		if seen[baseName] {
+			return nil, fmt.Errorf("profile %s: extends cycle at %s", name, baseName)
+		}
+		seen[baseName] = true
+		base, err := src.Get(ctx, baseName)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				// a missing base is a broken profile, not a missing one
+				return nil, fmt.Errorf("profile %s: extends missing profile %s", cur.Name, baseName)
+			}
+			return nil, fmt.Errorf("profile %s: extends: %w", cur.Name, err)
+		}
+		if obj, err = decodeObject(base); err != nil {
+			return nil, err
+		}
+		cur = base
+		layers = append(layers, obj)
+		revisions = append(revisions, base.Revision)
+	}
+
+	var merged any = layers[len(layers)-1]
+	for i := len(layers) - 2; i >= 0; i-- {
+		merged = mergePatch(merged, layers[i])
+	}
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return nil, fmt.Errorf("encode profile %s: %w", name, err)
+	}
+	return &Document{
+		Data:     data,
+		Name:     doc.Name,
+		Version:  doc.Version,
+		Revision: strings.Join(revisions, "+"),
+		Source:   doc.Source,
+	}, nil
+}
+
+// decodeObject decodes a document that must be a JSON object, keeping
+// numbers exact.
+func decodeObject(doc *Document) (map[string]any, error) {
+	dec := json.NewDecoder(bytes.NewReader(doc.Data))
+	dec.UseNumber()
+	var obj map[string]any
+	if err := dec.Decode(&obj); err != nil || obj == nil {
+		if err == nil {
+			err = errors.New("not an object")
+		}
+		return nil, fmt.Errorf("decode profile %s: invalid json: %w", doc.Name, err)
+	}
+	return obj, nil
+}
+
+// resolveName resolves ref against the directory of the profile that
+// names it. Absolute refs may carry a selector; the child's own selector
+// is not inherited.
+func resolveName(child, ref string) string {
+	if strings.HasPrefix(ref, "/") {
+		return ref
+	}
+	dir, _ := splitSelector(child)
+	return path.Join(path.Dir(dir), ref)
+}
+
+// mergePatch applies patch to target as described by RFC 7396.
+func mergePatch(target, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]any)
+	if !ok {
+		t = map[string]any{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+			continue
+		}
+		t[k] = mergePatch(t[k], v)
+	}
+	return t
+}
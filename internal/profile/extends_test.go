@@ -0,0 +1,80 @@
+package profile
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"go.uber.org/zap"
+)
+
+func TestMergePatch(t *testing.T) {
+	// examples from RFC 7396 section 3
+	cases := []struct{ target, patch, want string }{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+	for _, c := range cases {
+		var target, patch any
+		_ = json.Unmarshal([]byte(c.target), &target)
+		_ = json.Unmarshal([]byte(c.patch), &patch)
+		got, _ := json.Marshal(mergePatch(target, patch))
+		if string(got) != c.want {
+			t.Errorf("merge %s with %s = %s, want %s", c.target, c.patch, got, c.want)
+		}
+	}
+}
+
+func TestResolveExtends(t *testing.T) {
+	mem := fstest.MapFS{
+		"crm/file-profiles/base/qns.json": {Data: []byte(testProfile(600000))},
+		"crm/file-profiles/dev/qns.json": {Data: []byte(`{
+			"extends": "../base/qns",
+			"mapMaxConcurrency": 5,
+			"rowValidation": {"regex": {"Email": ".+@example\\.com$"}}
+		}`)},
+		"crm/file-profiles/dev/qns_small.json": {Data: []byte(`{"extends": "qns", "maxRows": 100}`)},
+		"crm/file-profiles/dev/loop_a.json":    {Data: []byte(`{"extends": "loop_b"}`)},
+		"crm/file-profiles/dev/loop_b.json":    {Data: []byte(`{"extends": "/crm/file-profiles/dev/loop_a"}`)},
+		"crm/file-profiles/dev/orphan.json":    {Data: []byte(`{"extends": "../base/missing"}`)},
+		"crm/file-profiles/dev/bad.json":       {Data: []byte(`{"extends": 3}`)},
+	}
+	src := &FSSource{FS: mem}
+	ctx := context.Background()
+
+	l := NewFromSource(src, zap.NewNop().Sugar(), Options{})
+	res, err := l.Load(ctx, "/crm/file-profiles/dev/qns_small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := res.Profile
+	if p.MaxRows != 100 || p.MapMaxConcurrency != 5 || p.MaxBytes != 1000 || p.RowValidation.Regex["Email"] != `.+@example\.com$` || len(p.Targets) != 1 {
+		t.Fatalf("unexpected effective profile %+v", p)
+	}
+	if strings.Count(res.Revision, "+") != 2 {
+		t.Fatalf("revision should cover all three files, got %q", res.Revision)
+	}
+
+	for name, want := range map[string]string{
+		"/crm/file-profiles/dev/loop_a": "cycle",
+		"/crm/file-profiles/dev/orphan": "extends missing profile /crm/file-profiles/base/missing",
+		"/crm/file-profiles/dev/bad":    "extends must be a profile name",
+	} {
+		_, err := Resolve(ctx, src, name)
+		if err == nil || !strings.Contains(err.Error(), want) || errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: expected %q, got %v", name, want, err)
+		}
+	}
+}
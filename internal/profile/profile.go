@@ -2,53 +2,215 @@ package profile
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	"go.uber.org/zap"
 )
 
-// Loader retrieves and caches JSON profiles from SSM Parameter Store.
 // SSMAPI abstracts the SSM GetParameter operation for testability.
 type SSMAPI interface {
 	GetParameter(ctx context.Context, in *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error)
 }
 
+// ErrNotFound is returned, and cached for NegativeTTL, when a profile does not exist.
+var ErrNotFound = errors.New("profile not found")
+
+// Options tunes the Loader cache. Zero values use the defaults.
+type Options struct {
+	// TTL is how long a loaded profile is served before it is reloaded (default 5m).
+	TTL time.Duration
+	// RefreshAhead starts a background reload this long before TTL expires
+	// so warm callers never wait on SSM (default TTL/5).
+	RefreshAhead time.Duration
+	// NegativeTTL is how long a missing profile is remembered (default 30s).
+	NegativeTTL time.Duration
+	// Now is the clock, for tests.
+	Now func() time.Time
+}
+
+// Result is a loaded profile and the parameter version it came from, so
+// callers can record exactly which profile processed a file.
+type Result struct {
+	Profile *Profile
+	// Name is the parameter name without selector.
+	Name string
+	// Selector is the requested version or label ("3", "prod"), empty for latest.
+	Selector string
+	// Version is the SSM parameter version that was read, zero for other sources.
+	Version int64
+	// Revision identifies the content across sources; see Document.
+	Revision string
+	// Source is the backend the profile came from.
+	Source string
+	// LoadedAt is when the profile was fetched from SSM.
+	LoadedAt time.Time
+}
+
+// Ref returns name:revision, identifying the exact profile used.
+func (r *Result) Ref() string {
+	return r.Name + ":" + r.Revision
+}
+
+// entry is a cached result or a cached miss.
+type entry struct {
+	res        *Result
+	err        error
+	expires    time.Time
+	refreshing bool
+}
+
+// Loader retrieves, validates and caches profiles from a Source, by default
+// SSM Parameter Store. Names may pin a version or label with SSM's selector
+// syntax, e.g. "/crm/file-profiles/prod/flood_qns:prod" or "...flood_qns:3".
 type Loader struct {
-	client SSMAPI
-	cache  map[string]map[string]any
-	mu     sync.Mutex
-	log    *zap.SugaredLogger
+	src   Source
+	cache map[string]*entry
+	mu    sync.Mutex
+	log   *zap.SugaredLogger
+	opts  Options
+	bg    sync.WaitGroup
 }
 
 // New creates a Loader using the provided SSM client and logger.
 func New(client SSMAPI, log *zap.SugaredLogger) *Loader {
-	return &Loader{client: client, cache: make(map[string]map[string]any), log: log}
+	return NewWithOptions(client, log, Options{})
+}
+
+// NewWithOptions creates an SSM backed Loader with custom cache settings.
+func NewWithOptions(client SSMAPI, log *zap.SugaredLogger, opts Options) *Loader {
+	return NewFromSource(&SSMSource{Client: client}, log, opts)
+}
+
+// NewFromSource creates a Loader reading profiles from src.
+func NewFromSource(src Source, log *zap.SugaredLogger, opts Options) *Loader {
+	if opts.TTL <= 0 {
+		opts.TTL = 5 * time.Minute
+	}
+	if opts.RefreshAhead <= 0 || opts.RefreshAhead >= opts.TTL {
+		opts.RefreshAhead = opts.TTL / 5
+	}
+	if opts.NegativeTTL <= 0 {
+		opts.NegativeTTL = 30 * time.Second
+	}
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	return &Loader{src: src, cache: make(map[string]*entry), log: log, opts: opts}
 }
 
-// Load fetches the profile with the given name from SSM, caching the result.
-func (l *Loader) Load(ctx context.Context, name string) (map[string]any, error) {
+// Load returns the profile with the given name. Cached profiles are served
+// until TTL; within RefreshAhead of expiry a background reload is started.
+// When a reload fails the previous profile keeps being served.
+func (l *Loader) Load(ctx context.Context, name string) (*Result, error) {
+	now := l.opts.Now()
 	l.mu.Lock()
-	if p, ok := l.cache[name]; ok {
+	e, ok := l.cache[name]
+	if ok && now.Before(e.expires) {
+		if e.err != nil {
+			l.mu.Unlock()
+			return nil, e.err
+		}
+		if !e.refreshing && !now.Before(e.expires.Add(-l.opts.RefreshAhead)) {
+			e.refreshing = true
+			l.bg.Add(1)
+			go l.refresh(name)
+		}
+		res := e.res
 		l.mu.Unlock()
-		return p, nil
+		return res, nil
+	}
+	var stale *Result
+	if ok {
+		stale = e.res
 	}
 	l.mu.Unlock()
 
-	out, err := l.client.GetParameter(ctx, &ssm.GetParameterInput{Name: &name})
-	if err != nil {
-		return nil, fmt.Errorf("get parameter %s: %w", name, err)
+	res, err := l.fetch(ctx, name)
+	if err != nil && stale != nil && !errors.Is(err, ErrNotFound) {
+		l.log.Warnw("profile reload failed, serving cached version", "name", name, "revision", stale.Revision, "error", err)
+		return stale, nil
 	}
+	l.store(name, res, err)
+	return res, err
+}
 
-	var data map[string]any
-	if err := json.Unmarshal([]byte(*out.Parameter.Value), &data); err != nil {
-		return nil, fmt.Errorf("decode profile %s: %w", name, err)
+// Invalidate drops the cached profile so the next Load reads the source.
+func (l *Loader) Invalidate(name string) {
+	l.mu.Lock()
+	delete(l.cache, name)
+	l.mu.Unlock()
+}
+
+// refresh reloads name in the background, keeping the cached profile on error.
+func (l *Loader) refresh(name string) {
+	defer l.bg.Done()
+	res, err := l.fetch(context.Background(), name)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		l.log.Warnw("profile refresh failed", "name", name, "error", err)
+		l.mu.Lock()
+		if e, ok := l.cache[name]; ok {
+			e.refreshing = false
+		}
+		l.mu.Unlock()
+		return
 	}
+	l.store(name, res, err)
+}
 
+// store caches a result or, for ErrNotFound, a negative entry. Other errors
+// are not cached.
+func (l *Loader) store(name string, res *Result, err error) {
+	now := l.opts.Now()
 	l.mu.Lock()
-	l.cache[name] = data
-	l.mu.Unlock()
-	return data, nil
+	defer l.mu.Unlock()
+	switch {
+	case err == nil:
+		old, ok := l.cache[name]
+		switch {
+		case !ok || old.res == nil:
+			l.log.Infow("profile loaded", "name", name, "source", res.Source, "revision", res.Revision)
+		case old.res.Revision != res.Revision:
+			l.log.Infow("profile changed", "name", name, "source", res.Source, "from", old.res.Revision, "to", res.Revision)
+		}
+		l.cache[name] = &entry{res: res, expires: now.Add(l.opts.TTL)}
+	case errors.Is(err, ErrNotFound):
+		l.cache[name] = &entry{err: err, expires: now.Add(l.opts.NegativeTTL)}
+	}
+}
+
+// fetch reads the profile and its extends chain from the source and
+// validates the result as a Profile v2.
+func (l *Loader) fetch(ctx context.Context, name string) (*Result, error) {
+	doc, err := Resolve(ctx, l.src, name)
+	if err != nil {
+		return nil, err
+	}
+	p, err := Parse(doc.Data)
+	if err != nil {
+		return nil, fmt.Errorf("decode profile %s: %w", name, err)
+	}
+	_, selector := splitSelector(name)
+	return &Result{
+		Profile:  p,
+		Name:     doc.Name,
+		Selector: selector,
+		Version:  doc.Version,
+		Revision: doc.Revision,
+		Source:   doc.Source,
+		LoadedAt: l.opts.Now(),
+	}, nil
+}
+
+// splitSelector separates an SSM "name:version" or "name:label" selector.
+func splitSelector(name string) (string, string) {
+	i := strings.LastIndex(name, ":")
+	if i < 0 || strings.Contains(name[i:], "/") {
+		return name, ""
+	}
+	return name[:i], name[i+1:]
 }
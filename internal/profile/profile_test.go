@@ -3,7 +3,10 @@ package profile
 import (
 	"context"
 	"errors"
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
@@ -11,24 +14,77 @@ import (
 )
 
 type mockSSM struct {
-	value string
-	err   error
-	calls int
+	mu      sync.Mutex
+	value   string
+	version int64
+	err     error
+	calls   int
+	names   []string
 }
 
 func (m *mockSSM) GetParameter(ctx context.Context, in *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.calls++
+	m.names = append(m.names, *in.Name)
 	if m.err != nil {
 		return nil, m.err
 	}
+	v := m.value
 	return &ssm.GetParameterOutput{
-		Parameter: &types.Parameter{Value: &m.value},
+		Parameter: &types.Parameter{Value: &v, Version: m.version},
 	}, nil
 }
 
+func (m *mockSSM) set(value string, version int64, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.value, m.version, m.err = value, version, err
+}
+
+func (m *mockSSM) count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.calls
+}
+
+type clock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *clock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *clock) add(d time.Duration) {
+	c.mu.Lock()
+	c.t = c.t.Add(d)
+	c.mu.Unlock()
+}
+
+// testProfile returns a valid profile, using maxRows to tell versions apart.
+func testProfile(maxRows int) string {
+	return fmt.Sprintf(`{
+		"parserId": "csv_pipe",
+		"maxBytes": 1000,
+		"maxRows": %d,
+		"rowStateMachineArn": "arn:aws:states:us-east-1:123456789012:stateMachine:BatchWrapper",
+		"mapMaxConcurrency": 10,
+		"targets": [{"object": "Account", "externalId": "Member_Number__c", "fieldMap": {"MemberNumber": "Member_Number__c"}}]
+	}`, maxRows)
+}
+
+func newTestLoader(m *mockSSM) (*Loader, *clock) {
+	c := &clock{t: time.Unix(1000, 0)}
+	l := NewWithOptions(m, zap.NewNop().Sugar(), Options{TTL: time.Minute, RefreshAhead: 10 * time.Second, NegativeTTL: 5 * time.Second, Now: c.now})
+	return l, c
+}
+
 func TestLoader_Load_SuccessAndCache(t *testing.T) {
-	val := `{"foo": 123}`
-	m := &mockSSM{value: val}
+	m := &mockSSM{value: testProfile(123)}
 	logger := zap.NewExample().Sugar()
 	l := New(m, logger)
 
@@ -37,8 +93,8 @@ func TestLoader_Load_SuccessAndCache(t *testing.T) {
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	if res["foo"] != float64(123) {
-		t.Errorf("unexpected value: %v", res["foo"])
+	if res.Profile.MaxRows != 123 || res.Profile.Targets[0].Object != "Account" {
+		t.Errorf("unexpected profile: %+v", res.Profile)
 	}
 	if m.calls != 1 {
 		t.Errorf("expected 1 call, got %d", m.calls)
@@ -74,4 +130,104 @@ func TestLoader_Load_BadJSON(t *testing.T) {
 	}
 }
 
-// ...existing code...
+func TestLoader_TTLReload(t *testing.T) {
+	m := &mockSSM{value: testProfile(1), version: 1}
+	l, c := newTestLoader(m)
+	ctx := context.Background()
+	if _, err := l.Load(ctx, "p"); err != nil {
+		t.Fatal(err)
+	}
+	m.set(testProfile(2), 2, nil)
+	c.add(61 * time.Second)
+	res, err := l.Load(ctx, "p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Version != 2 || res.Profile.MaxRows != 2 || m.count() != 2 {
+		t.Fatalf("expected reload after TTL, got version %d calls %d", res.Version, m.count())
+	}
+}
+
+func TestLoader_RefreshAhead(t *testing.T) {
+	m := &mockSSM{value: testProfile(1), version: 1}
+	l, c := newTestLoader(m)
+	ctx := context.Background()
+	if _, err := l.Load(ctx, "p"); err != nil {
+		t.Fatal(err)
+	}
+	m.set(testProfile(2), 2, nil)
+	c.add(55 * time.Second)
+	res, err := l.Load(ctx, "p")
+	if err != nil || res.Version != 1 {
+		t.Fatalf("expected cached version while refreshing, got %v %v", res, err)
+	}
+	l.bg.Wait()
+	res, _ = l.Load(ctx, "p")
+	if res.Version != 2 || m.count() != 2 {
+		t.Fatalf("expected refreshed version 2, got %d after %d calls", res.Version, m.count())
+	}
+}
+
+func TestLoader_StaleOnError(t *testing.T) {
+	m := &mockSSM{value: testProfile(1), version: 4}
+	l, c := newTestLoader(m)
+	ctx := context.Background()
+	if _, err := l.Load(ctx, "p"); err != nil {
+		t.Fatal(err)
+	}
+	m.set("", 0, errors.New("throttled"))
+	c.add(2 * time.Minute)
+	res, err := l.Load(ctx, "p")
+	if err != nil || res.Version != 4 {
+		t.Fatalf("expected stale profile, got %v %v", res, err)
+	}
+}
+
+func TestLoader_NegativeCache(t *testing.T) {
+	m := &mockSSM{err: &types.ParameterNotFound{}}
+	l, c := newTestLoader(m)
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if _, err := l.Load(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected ErrNotFound, got %v", err)
+		}
+	}
+	if m.count() != 1 {
+		t.Fatalf("expected misses to be cached, got %d calls", m.count())
+	}
+	m.set(testProfile(1), 1, nil)
+	c.add(6 * time.Second)
+	if _, err := l.Load(ctx, "missing"); err != nil {
+		t.Fatalf("expected profile after negative TTL, got %v", err)
+	}
+}
+
+func TestLoader_SelectorAndVersion(t *testing.T) {
+	m := &mockSSM{value: testProfile(1), version: 7}
+	l, _ := newTestLoader(m)
+	res, err := l.Load(context.Background(), "/crm/file-profiles/prod/flood_qns:prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.names[0] != "/crm/file-profiles/prod/flood_qns:prod" {
+		t.Fatalf("selector not passed to SSM: %v", m.names)
+	}
+	if res.Name != "/crm/file-profiles/prod/flood_qns" || res.Selector != "prod" || res.Version != 7 || res.Ref() != "/crm/file-profiles/prod/flood_qns:7" {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	if _, sel := splitSelector("/crm/a:b/c"); sel != "" {
+		t.Fatalf("colon inside the path is not a selector")
+	}
+}
+
+func TestLoader_Invalidate(t *testing.T) {
+	m := &mockSSM{value: testProfile(1), version: 1}
+	l, _ := newTestLoader(m)
+	ctx := context.Background()
+	_, _ = l.Load(ctx, "p")
+	l.Invalidate("p")
+	_, _ = l.Load(ctx, "p")
+	if m.count() != 2 {
+		t.Fatalf("expected reload after invalidate, got %d calls", m.count())
+	}
+}
@@ -0,0 +1,238 @@
+package profile
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/aws/smithy-go"
+
+	"github.com/your-org/file-processor-sample/crm"
+)
+
+// Document is a raw profile as read from a Source.
+type Document struct {
+	Data []byte
+	// Name is the profile name as the source resolved it.
+	Name string
+	// Version is the SSM parameter version, zero for other sources.
+	Version int64
+	// Revision identifies the exact content: the SSM version, the S3
+	// version id or ETag, or a content hash for files.
+	Revision string
+	// Source names the backend the document came from ("ssm", "s3", "fs").
+	Source string
+}
+
+// Source reads raw profiles by name. Names are SSM style paths such as
+// "/crm/file-profiles/prod/flood_qns", optionally with a ":selector".
+// Implementations return an error wrapping ErrNotFound for missing profiles.
+type Source interface {
+	Get(ctx context.Context, name string) (*Document, error)
+}
+
+// SSMSource reads profiles from SSM Parameter Store.
+type SSMSource struct {
+	Client SSMAPI
+}
+
+// Get implements Source.
+func (s *SSMSource) Get(ctx context.Context, name string) (*Document, error) {
+	out, err := s.Client.GetParameter(ctx, &ssm.GetParameterInput{Name: &name})
+	if err != nil {
+		var nf *types.ParameterNotFound
+		var nv *types.ParameterVersionNotFound
+		if errors.As(err, &nf) || errors.As(err, &nv) {
+			return nil, fmt.Errorf("%w: %s", ErrNotFound, name)
+		}
+		return nil, fmt.Errorf("get parameter %s: %w", name, err)
+	}
+	doc := &Document{
+		Data:     []byte(*out.Parameter.Value),
+		Version:  out.Parameter.Version,
+		Revision: strconv.FormatInt(out.Parameter.Version, 10),
+		Source:   "ssm",
+	}
+	if out.Parameter.Name != nil {
+		doc.Name = *out.Parameter.Name
+	} else {
+		doc.Name, _ = splitSelector(name)
+	}
+	return doc, nil
+}
+
+// S3API abstracts the S3 GetObject operation for testability.
+type S3API interface {
+	GetObject(ctx context.Context, in *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+// S3Source reads profiles too large for SSM from S3. The name maps to the
+// key Prefix + name + ".json" and a selector pins an object version id.
+type S3Source struct {
+	Client S3API
+	Bucket string
+	Prefix string
+}
+
+// Get implements Source.
+func (s *S3Source) Get(ctx context.Context, name string) (*Document, error) {
+	base, selector := splitSelector(name)
+	key := s.Prefix + filePath(base)
+	in := &s3.GetObjectInput{Bucket: &s.Bucket, Key: &key}
+	if selector != "" {
+		in.VersionId = &selector
+	}
+	out, err := s.Client.GetObject(ctx, in)
+	if err != nil {
+		var ae smithy.APIError
+		if errors.As(err, &ae) && (ae.ErrorCode() == "NoSuchKey" || ae.ErrorCode() == "NoSuchVersion" || ae.ErrorCode() == "NotFound") {
+			return nil, fmt.Errorf("%w: s3://%s/%s", ErrNotFound, s.Bucket, key)
+		}
+		return nil, fmt.Errorf("get s3://%s/%s: %w", s.Bucket, key, err)
+	}
+	defer out.Body.Close()
+	b, err := io.ReadAll(out.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read s3://%s/%s: %w", s.Bucket, key, err)
+	}
+	doc := &Document{Data: b, Name: base, Source: "s3"}
+	switch {
+	case out.VersionId != nil && *out.VersionId != "null":
+		doc.Revision = *out.VersionId
+	case out.ETag != nil:
+		doc.Revision = strings.Trim(*out.ETag, `"`)
+	default:
+		doc.Revision = contentHash(b)
+	}
+	return doc, nil
+}
+
+// FSSource reads profiles from a file system such as os.DirFS for local
+// runs or an embed.FS bundled into the binary. Root is the name prefix the
+// file system root stands for; the rest of the name maps to a path with
+// ".json" appended. Selectors are not supported.
+type FSSource struct {
+	FS   fs.FS
+	Root string
+}
+
+// Embedded returns the profiles under crm/file-profiles compiled into the binary.
+func Embedded() *FSSource {
+	sub, err := fs.Sub(crm.FileProfiles, "file-profiles")
+	if err != nil {
+		panic(err)
+	}
+	return &FSSource{FS: sub, Root: "/crm/file-profiles"}
+}
+
+// Get implements Source.
+func (s *FSSource) Get(ctx context.Context, name string) (*Document, error) {
+	if _, selector := splitSelector(name); selector != "" {
+		return nil, fmt.Errorf("%w: %s (file profiles have no versions)", ErrNotFound, name)
+	}
+	rel := path.Clean("/" + name)
+	if root := path.Clean("/" + s.Root); root != "/" {
+		if !strings.HasPrefix(rel, root+"/") {
+			return nil, fmt.Errorf("%w: %s (outside %s)", ErrNotFound, name, root)
+		}
+		rel = rel[len(root):]
+	}
+	p := filePath(rel)
+	b, err := fs.ReadFile(s.FS, p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrInvalid) {
+			return nil, fmt.Errorf("%w: %s", ErrNotFound, p)
+		}
+		return nil, fmt.Errorf("read %s: %w", p, err)
+	}
+	return &Document{Data: b, Name: name, Revision: contentHash(b), Source: "fs"}, nil
+}
+
+// Chain tries each source in order and returns the first profile found.
+// Only a missing profile falls through to the next source, so a bundled copy
+// never stands in for SSM while it is throttled or unreachable. Any other
+// failure is returned as is.
+type Chain []Source
+
+// Get implements Source.
+func (c Chain) Get(ctx context.Context, name string) (*Document, error) {
+	for _, s := range c {
+		doc, err := s.Get(ctx, name)
+		if err == nil {
+			return doc, nil
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrNotFound, name)
+}
+
+// filePath turns "/crm/file-profiles/prod/flood_qns" into
+// "crm/file-profiles/prod/flood_qns.json".
+func filePath(name string) string {
+	p := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if path.Ext(p) == "" {
+		p += ".json"
+	}
+	return p
+}
+
+// contentHash returns a short SHA-256 of b for use as a revision.
+func contentHash(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:6])
+}
+
+// SourceFromEnv builds the fallback order named by PROFILE_SOURCES, a comma
+// separated list of "ssm", "s3", "dir" and "embedded" (default "ssm"). "s3"
+// reads PROFILE_BUCKET and PROFILE_PREFIX; "dir" reads PROFILE_DIR, whose
+// root stands for the name "/", so a repository checkout serves
+// "/crm/file-profiles/dev/flood_qns".
+func SourceFromEnv(ssmClient SSMAPI, s3Client S3API) (Source, error) {
+	names := os.Getenv("PROFILE_SOURCES")
+	if names == "" {
+		names = "ssm"
+	}
+	var chain Chain
+	for _, n := range strings.Split(names, ",") {
+		switch strings.TrimSpace(n) {
+		case "ssm":
+			if ssmClient == nil {
+				return nil, fmt.Errorf("profile source ssm: no client")
+			}
+			chain = append(chain, &SSMSource{Client: ssmClient})
+		case "s3":
+			bucket := os.Getenv("PROFILE_BUCKET")
+			if s3Client == nil || bucket == "" {
+				return nil, fmt.Errorf("profile source s3: PROFILE_BUCKET and client required")
+			}
+			chain = append(chain, &S3Source{Client: s3Client, Bucket: bucket, Prefix: os.Getenv("PROFILE_PREFIX")})
+		case "dir":
+			dir := os.Getenv("PROFILE_DIR")
+			if dir == "" {
+				return nil, fmt.Errorf("profile source dir: PROFILE_DIR required")
+			}
+			chain = append(chain, &FSSource{FS: os.DirFS(dir)})
+		case "embedded":
+			chain = append(chain, Embedded())
+		default:
+			return nil, fmt.Errorf("unknown profile source %q", n)
+		}
+	}
+	if len(chain) == 1 {
+		return chain[0], nil
+	}
+	return chain, nil
+}
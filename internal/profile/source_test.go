@@ -0,0 +1,148 @@
+package profile
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"go.uber.org/zap"
+)
+
+type fakeS3 struct {
+	objects map[string]string
+	err     error
+	keys    []string
+	version string
+}
+
+func (f *fakeS3) GetObject(ctx context.Context, in *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	f.keys = append(f.keys, *in.Key)
+	if in.VersionId != nil {
+		f.version = *in.VersionId
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	body, ok := f.objects[*in.Key]
+	if !ok {
+		return nil, &s3types.NoSuchKey{}
+	}
+	etag := `"abc123"`
+	return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(body)), ETag: &etag}, nil
+}
+
+type staticSource struct {
+	doc *Document
+	err error
+	n   int
+}
+
+func (s *staticSource) Get(ctx context.Context, name string) (*Document, error) {
+	s.n++
+	return s.doc, s.err
+}
+
+func TestS3Source(t *testing.T) {
+	f := &fakeS3{objects: map[string]string{"profiles/crm/file-profiles/prod/big.json": testProfile(5)}}
+	src := &S3Source{Client: f, Bucket: "b", Prefix: "profiles/"}
+	doc, err := src.Get(context.Background(), "/crm/file-profiles/prod/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Revision != "abc123" || doc.Source != "s3" || doc.Name != "/crm/file-profiles/prod/big" {
+		t.Fatalf("unexpected document %+v", doc)
+	}
+	if _, err := src.Get(context.Background(), "/crm/file-profiles/prod/big:v9"); err != nil || f.version != "v9" {
+		t.Fatalf("selector should pin the version id, got %q %v", f.version, err)
+	}
+	if _, err := src.Get(context.Background(), "/crm/file-profiles/prod/missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestFSSource(t *testing.T) {
+	mem := fstest.MapFS{"prod/flood_qns.json": {Data: []byte(testProfile(1))}}
+	src := &FSSource{FS: mem, Root: "/crm/file-profiles"}
+	ctx := context.Background()
+	doc, err := src.Get(ctx, "/crm/file-profiles/prod/flood_qns")
+	if err != nil || doc.Source != "fs" || doc.Revision == "" {
+		t.Fatalf("unexpected %+v %v", doc, err)
+	}
+	for _, name := range []string{"/crm/file-profiles/prod/other", "/crm/other/prod/flood_qns", "/crm/file-profiles/prod/flood_qns:3", "/crm/file-profiles/../prod/flood_qns"} {
+		if _, err := src.Get(ctx, name); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: expected ErrNotFound, got %v", name, err)
+		}
+	}
+}
+
+func TestEmbeddedProfiles(t *testing.T) {
+	l := NewFromSource(Embedded(), zap.NewNop().Sugar(), Options{})
+	for _, env := range []string{"dev", "prod"} {
+		res, err := l.Load(context.Background(), "/crm/file-profiles/"+env+"/flood_qns")
+		if err != nil {
+			t.Fatalf("%s: %v", env, err)
+		}
+		if res.Profile.ParserID == "" || res.Source != "fs" {
+			t.Fatalf("%s: unexpected result %+v", env, res)
+		}
+	}
+}
+
+func TestChainFallback(t *testing.T) {
+	ctx := context.Background()
+	missing := &staticSource{err: ErrNotFound}
+	down := &staticSource{err: errors.New("ssm throttled")}
+	good := &staticSource{doc: &Document{Data: []byte(testProfile(1)), Name: "p", Revision: "r1", Source: "fs"}}
+
+	doc, err := Chain{missing, good}.Get(ctx, "p")
+	if err != nil || doc.Revision != "r1" || good.n != 1 {
+		t.Fatalf("expected fallback to last source, got %+v %v", doc, err)
+	}
+	_, err = Chain{down, good}.Get(ctx, "p")
+	if err == nil || !strings.Contains(err.Error(), "throttled") || good.n != 1 {
+		t.Fatalf("a failing source must not fall through, got %v", err)
+	}
+	if _, err := (Chain{missing, missing}).Get(ctx, "p"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	_, err = Chain{missing, down}.Get(ctx, "p")
+	if err == nil || errors.Is(err, ErrNotFound) || !strings.Contains(err.Error(), "throttled") {
+		t.Fatalf("a failing source must not be reported as not found: %v", err)
+	}
+}
+
+func TestSourceFromEnv(t *testing.T) {
+	t.Setenv("PROFILE_SOURCES", "ssm, dir, embedded")
+	t.Setenv("PROFILE_DIR", "../..")
+	src, err := SourceFromEnv(&mockSSM{err: &ssmtypes.ParameterNotFound{}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, ok := src.(Chain); !ok || len(c) != 3 {
+		t.Fatalf("unexpected source %#v", src)
+	}
+	doc, err := src.Get(context.Background(), "/crm/file-profiles/dev/flood_qns")
+	if err != nil || doc.Source != "fs" {
+		t.Fatalf("expected local file, got %+v %v", doc, err)
+	}
+
+	t.Setenv("PROFILE_SOURCES", "")
+	if src, err := SourceFromEnv(&mockSSM{}, nil); err != nil {
+		t.Fatal(err)
+	} else if _, ok := src.(*SSMSource); !ok {
+		t.Fatalf("expected ssm by default, got %T", src)
+	}
+	for _, v := range []string{"s3", "dir", "ftp"} {
+		t.Setenv("PROFILE_SOURCES", v)
+		t.Setenv("PROFILE_DIR", "")
+		if _, err := SourceFromEnv(&mockSSM{}, nil); err == nil {
+			t.Errorf("%s: expected configuration error", v)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package profile
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+
+	"github.com/your-org/file-processor-sample/schema"
+)
+
+// Profile is a Profile v2 feed configuration, validated against
+// schema/profile_v2.schema.json.
+type Profile struct {
+	ParserID string `json:"parserId"`
+	Limits
+	RowStateMachineArn string         `json:"rowStateMachineArn"`
+	Columns            Columns        `json:"columns,omitempty"`
+	RowValidation      RowValidation  `json:"rowValidation,omitempty"`
+	FileValidation     FileValidation `json:"fileValidation,omitempty"`
+	PreProcessors      []Step         `json:"preProcessors,omitempty"`
+	Enrichments        []Step         `json:"enrichments,omitempty"`
+	Output             Output         `json:"output,omitempty"`
+	Targets            []Target       `json:"targets"`
+}
+
+// Limits bound the size of a file and the fan-out of its rows.
+type Limits struct {
+	MaxBytes          int64 `json:"maxBytes"`
+	MaxRows           int   `json:"maxRows"`
+	MapMaxConcurrency int   `json:"mapMaxConcurrency"`
+}
+
+// Columns maps incoming header names onto the profile's column names.
+// Normalize lists what is ignored when names are compared ("case",
+// "whitespace", "punctuation") and Aliases lists other names for a column.
+type Columns struct {
+	Normalize []string            `json:"normalize,omitempty"`
+	Aliases   map[string][]string `json:"aliases,omitempty"`
+}
+
+// RowValidation lists required columns, per-column regular expressions and
+// further declarative rules.
+type RowValidation struct {
+	Required []string          `json:"required,omitempty"`
+	Regex    map[string]string `json:"regex,omitempty"`
+	Rules    []Rule            `json:"rules,omitempty"`
+}
+
+// Rule is one rowValidation rule. Type selects the check and Code is
+// reported for the rows that fail it; the other fields apply to some types
+// only (see internal/rowcheck).
+type Rule struct {
+	Type       string     `json:"type"`
+	Code       string     `json:"code"`
+	Message    string     `json:"message,omitempty"`
+	Field      string     `json:"field,omitempty"`
+	Fields     []string   `json:"fields,omitempty"`
+	Values     []string   `json:"values,omitempty"`
+	IgnoreCase bool       `json:"ignoreCase,omitempty"`
+	Min        *Bound     `json:"min,omitempty"`
+	Max        *Bound     `json:"max,omitempty"`
+	As         string     `json:"as,omitempty"`
+	Format     string     `json:"format,omitempty"`
+	Op         string     `json:"op,omitempty"`
+	Other      string     `json:"other,omitempty"`
+	If         *Condition `json:"if,omitempty"`
+}
+
+// Condition limits a rule to rows where Field equals Equals, is one of In,
+// or is present (non-empty) as Present says. Every set test must hold.
+type Condition struct {
+	Field   string   `json:"field"`
+	Equals  *string  `json:"equals,omitempty"`
+	In      []string `json:"in,omitempty"`
+	Present *bool    `json:"present,omitempty"`
+}
+
+// Bound is a rule limit written as a JSON number or string, kept as text.
+type Bound string
+
+// UnmarshalJSON accepts numbers and strings.
+func (b *Bound) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*b = Bound(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return fmt.Errorf("bound must be a number or string: %w", err)
+	}
+	*b = Bound(n)
+	return nil
+}
+
+// FileValidation sets the checks that fail a file as a whole: limits on
+// rejected rows, the header match and a control record.
+type FileValidation struct {
+	MaxBadRows       *int         `json:"maxBadRows,omitempty"`
+	MaxBadRowPercent *float64     `json:"maxBadRowPercent,omitempty"`
+	Header           *HeaderCheck `json:"header,omitempty"`
+	Trailer          *Trailer     `json:"trailer,omitempty"`
+}
+
+// HeaderCheck compares the header with Columns, which default to the
+// required columns. Match is "subset" (default) or "exact".
+type HeaderCheck struct {
+	Match   string   `json:"match,omitempty"`
+	Columns []string `json:"columns,omitempty"`
+}
+
+// Trailer describes a control record on the last line, or the first with
+// Position "first". Pattern must match it and may capture the row count
+// as "count" and the sum of TotalField as "total".
+type Trailer struct {
+	Position   string `json:"position,omitempty"`
+	Pattern    string `json:"pattern"`
+	TotalField string `json:"totalField,omitempty"`
+}
+
+// Output sets how ParseFile writes the rows of a file: the chunk Format
+// ("jsonl" by default, "jsonl.gz", "csv" or "parquet"), at most ChunkRows
+// rows and about ChunkBytes uncompressed bytes per chunk, and the Bucket
+// and key Prefix of the chunks, which default to the source file's. Rows
+// of about InlineMaxBytes or less are returned inline instead.
+type Output struct {
+	Format         string `json:"format,omitempty"`
+	ChunkRows      int    `json:"chunkRows,omitempty"`
+	ChunkBytes     int    `json:"chunkBytes,omitempty"`
+	Bucket         string `json:"bucket,omitempty"`
+	Prefix         string `json:"prefix,omitempty"`
+	InlineMaxBytes int    `json:"inlineMaxBytes,omitempty"`
+}
+
+// Target maps row columns onto one Salesforce object.
+type Target struct {
+	Object     string            `json:"object"`
+	ExternalID string            `json:"externalId"`
+	FieldMap   map[string]string `json:"fieldMap"`
+	// Link sets lookup fields from earlier targets, e.g. "@{Account.id}".
+	Link            map[string]string `json:"link,omitempty"`
+	PostCreateRules []Step            `json:"postCreateRules,omitempty"`
+}
+
+// Step is one entry of preProcessors, enrichments or postCreateRules. Type
+// selects the implementation and Params holds the remaining keys.
+type Step struct {
+	Type   string
+	Params map[string]any
+}
+
+// UnmarshalJSON splits "type" from the step settings.
+func (s *Step) UnmarshalJSON(b []byte) error {
+	var m map[string]any
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	t, _ := m["type"].(string)
+	delete(m, "type")
+	s.Type, s.Params = t, m
+	return nil
+}
+
+// MarshalJSON writes the step back in its flat form.
+func (s Step) MarshalJSON() ([]byte, error) {
+	m := make(map[string]any, len(s.Params)+1)
+	for k, v := range s.Params {
+		m[k] = v
+	}
+	m["type"] = s.Type
+	return json.Marshal(m)
+}
+
+// profileSchema is compiled once from the embedded canonical schema.
+var profileSchema = func() *jsonschema.Schema {
+	c := jsonschema.NewCompiler()
+	if err := c.AddResource("profile_v2.schema.json", bytes.NewReader(schema.ProfileV2)); err != nil {
+		panic(err)
+	}
+	return c.MustCompile("profile_v2.schema.json")
+}()
+
+// ValidationError lists every problem found in a profile.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid profile: " + strings.Join(e.Problems, "; ")
+}
+
+// Parse validates data against the Profile v2 schema and decodes it.
+func Parse(data []byte) (*Profile, error) {
+	var doc any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid json: %w", err)
+	}
+	if err := profileSchema.Validate(doc); err != nil {
+		var ve *jsonschema.ValidationError
+		if errors.As(err, &ve) {
+			return nil, &ValidationError{Problems: problems(ve)}
+		}
+		return nil, fmt.Errorf("validate profile: %w", err)
+	}
+	var p Profile
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+	if err := p.check(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// check covers rules the schema cannot express.
+func (p *Profile) check() error {
+	var errs []string
+	cols := make([]string, 0, len(p.RowValidation.Regex))
+	for c := range p.RowValidation.Regex {
+		cols = append(cols, c)
+	}
+	sort.Strings(cols)
+	for _, c := range cols {
+		if _, err := regexp.Compile(p.RowValidation.Regex[c]); err != nil {
+			errs = append(errs, fmt.Sprintf("/rowValidation/regex/%s: %v", c, err))
+		}
+	}
+	if t := p.FileValidation.Trailer; t != nil {
+		if re, err := regexp.Compile(t.Pattern); err != nil {
+			errs = append(errs, fmt.Sprintf("/fileValidation/trailer/pattern: %v", err))
+		} else {
+			groups := map[string]bool{}
+			for _, n := range re.SubexpNames() {
+				groups[n] = true
+			}
+			if !groups["count"] && !groups["total"] {
+				errs = append(errs, "/fileValidation/trailer/pattern: needs a count or total group")
+			}
+			if groups["total"] != (t.TotalField != "") {
+				errs = append(errs, "/fileValidation/trailer: a total group and totalField go together")
+			}
+		}
+	}
+	seen := map[string]bool{}
+	for i, t := range p.Targets {
+		if seen[t.Object] {
+			errs = append(errs, fmt.Sprintf("/targets/%d: duplicate object %s", i, t.Object))
+		}
+		seen[t.Object] = true
+	}
+	if len(errs) > 0 {
+		return &ValidationError{Problems: errs}
+	}
+	return nil
+}
+
+// problems flattens a jsonschema error tree into "location: message" lines.
+func problems(ve *jsonschema.ValidationError) []string {
+	if len(ve.Causes) == 0 {
+		loc := ve.InstanceLocation
+		if loc == "" {
+			loc = "/"
+		}
+		return []string{loc + ": " + ve.Message}
+	}
+	var out []string
+	for _, c := range ve.Causes {
+		out = append(out, problems(c)...)
+	}
+	return out
+}
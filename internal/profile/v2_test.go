@@ -0,0 +1,123 @@
+package profile
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseSampleProfiles(t *testing.T) {
+	files, _ := filepath.Glob("../../sample-profiles/*.json")
+	if len(files) == 0 {
+		t.Fatal("no sample profiles found")
+	}
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Parse(b); err != nil {
+			t.Errorf("%s: %v", f, err)
+		}
+	}
+
+	// crm profiles may extend a base, so resolve them first
+	crm, _ := filepath.Glob("../../crm/file-profiles/*/*.json")
+	src := &FSSource{FS: os.DirFS("../..")}
+	for _, f := range crm {
+		name := "/" + strings.TrimSuffix(strings.TrimPrefix(filepath.ToSlash(f), "../../"), ".json")
+		doc, err := Resolve(context.Background(), src, name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, err := Parse(doc.Data); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestParseFull(t *testing.T) {
+	doc := `{
+		"parserId": "csv_pipe",
+		"maxBytes": 8000000,
+		"maxRows": 600000,
+		"rowStateMachineArn": "arn:aws:states:us-east-1:123456789012:stateMachine:BatchWrapper",
+		"mapMaxConcurrency": 200,
+		"rowValidation": {"required": ["Email"], "regex": {"Email": ".+@.+"}},
+		"preProcessors": [{"type": "trim"}],
+		"enrichments": [{"type": "lookup", "object": "Account", "key": "MemberNumber"}],
+		"targets": [
+			{"object": "Account", "externalId": "Member_Number__c", "fieldMap": {"MemberNumber": "Member_Number__c"}},
+			{"object": "Quote__c", "externalId": "Quote_Number__c", "fieldMap": {"QuoteNumber": "Quote_Number__c"},
+			 "link": {"Account__c": "@{Account.id}"}, "postCreateRules": [{"type": "task", "subject": "Follow up"}]}
+		]
+	}`
+	p, err := Parse([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ParserID != "csv_pipe" || p.MaxBytes != 8000000 || p.MapMaxConcurrency != 200 || p.RowValidation.Regex["Email"] != ".+@.+" {
+		t.Fatalf("unexpected profile %+v", p)
+	}
+	if e := p.Enrichments[0]; e.Type != "lookup" || e.Params["object"] != "Account" || e.Params["type"] != nil {
+		t.Fatalf("unexpected enrichment %+v", e)
+	}
+	q := p.Targets[1]
+	if q.Link["Account__c"] != "@{Account.id}" || q.PostCreateRules[0].Params["subject"] != "Follow up" {
+		t.Fatalf("unexpected target %+v", q)
+	}
+
+	// round trip keeps steps flat and still validates
+	b, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Parse(b); err != nil {
+		t.Fatalf("round trip: %v\n%s", err, b)
+	}
+}
+
+func TestParseRowRules(t *testing.T) {
+	doc := strings.Replace(testProfile(10), `"targets"`, `"rowValidation": {"rules": [
+		{"type": "range", "code": "PREMIUM_RANGE", "field": "Premium", "min": 0, "max": "1e6"},
+		{"type": "required", "code": "PREMIUM_IF_BOUND", "field": "Premium", "if": {"field": "Stage", "equals": "Bound"}}
+	]}, "targets"`, 1)
+	p, err := Parse([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := p.RowValidation.Rules
+	if len(r) != 2 || *r[0].Min != "0" || *r[0].Max != "1e6" || *r[1].If.Equals != "Bound" {
+		t.Fatalf("unexpected rules %+v", r)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	cases := map[string]string{
+		"maxRows":                         `{"parserId":"csv_pipe","maxBytes":1,"rowStateMachineArn":"arn:aws:states:us-east-1:123456789012:stateMachine:X","mapMaxConcurrency":1,"targets":[{"object":"A","externalId":"E","fieldMap":{}}]}`,
+		"parserId":                        `{"parserId":"tsv","maxBytes":1,"maxRows":1,"rowStateMachineArn":"arn:aws:states:us-east-1:123456789012:stateMachine:X","mapMaxConcurrency":1,"targets":[{"object":"A","externalId":"E","fieldMap":{}}]}`,
+		"/preProcessors/0":                `{"parserId":"csv_pipe","maxBytes":1,"maxRows":1,"rowStateMachineArn":"arn:aws:states:us-east-1:123456789012:stateMachine:X","mapMaxConcurrency":1,"preProcessors":[{}],"targets":[{"object":"A","externalId":"E","fieldMap":{}}]}`,
+		"/rowValidation/regex/Email":      `{"parserId":"csv_pipe","maxBytes":1,"maxRows":1,"rowStateMachineArn":"arn:aws:states:us-east-1:123456789012:stateMachine:X","mapMaxConcurrency":1,"rowValidation":{"regex":{"Email":"("}},"targets":[{"object":"A","externalId":"E","fieldMap":{}}]}`,
+		"/rowValidation/rules/0/code":     `{"parserId":"csv_pipe","maxBytes":1,"maxRows":1,"rowStateMachineArn":"arn:aws:states:us-east-1:123456789012:stateMachine:X","mapMaxConcurrency":1,"rowValidation":{"rules":[{"type":"enum","code":"bad code","field":"A","values":["x"]}]},"targets":[{"object":"A","externalId":"E","fieldMap":{}}]}`,
+		"/fileValidation/trailer/pattern": `{"parserId":"csv_pipe","maxBytes":1,"maxRows":1,"rowStateMachineArn":"arn:aws:states:us-east-1:123456789012:stateMachine:X","mapMaxConcurrency":1,"fileValidation":{"trailer":{"pattern":"^TRL$"}},"targets":[{"object":"A","externalId":"E","fieldMap":{}}]}`,
+		"/fileValidation/trailer:":        `{"parserId":"csv_pipe","maxBytes":1,"maxRows":1,"rowStateMachineArn":"arn:aws:states:us-east-1:123456789012:stateMachine:X","mapMaxConcurrency":1,"fileValidation":{"trailer":{"pattern":"^TRL (?P<total>.*)$"}},"targets":[{"object":"A","externalId":"E","fieldMap":{}}]}`,
+		"/columns/normalize/0":            `{"parserId":"csv_pipe","maxBytes":1,"maxRows":1,"rowStateMachineArn":"arn:aws:states:us-east-1:123456789012:stateMachine:X","mapMaxConcurrency":1,"columns":{"normalize":["accents"]},"targets":[{"object":"A","externalId":"E","fieldMap":{}}]}`,
+		"/output/format":                  `{"parserId":"csv_pipe","maxBytes":1,"maxRows":1,"rowStateMachineArn":"arn:aws:states:us-east-1:123456789012:stateMachine:X","mapMaxConcurrency":1,"output":{"format":"xml"},"targets":[{"object":"A","externalId":"E","fieldMap":{}}]}`,
+		"/output/inlineMaxBytes":          `{"parserId":"csv_pipe","maxBytes":1,"maxRows":1,"rowStateMachineArn":"arn:aws:states:us-east-1:123456789012:stateMachine:X","mapMaxConcurrency":1,"output":{"inlineMaxBytes":262144},"targets":[{"object":"A","externalId":"E","fieldMap":{}}]}`,
+		"duplicate object":                `{"parserId":"csv_pipe","maxBytes":1,"maxRows":1,"rowStateMachineArn":"arn:aws:states:us-east-1:123456789012:stateMachine:X","mapMaxConcurrency":1,"targets":[{"object":"A","externalId":"E","fieldMap":{}},{"object":"A","externalId":"E","fieldMap":{}}]}`,
+	}
+	for want, doc := range cases {
+		_, err := Parse([]byte(doc))
+		var ve *ValidationError
+		if !errors.As(err, &ve) || !strings.Contains(err.Error(), want) {
+			t.Errorf("expected validation error mentioning %q, got %v", want, err)
+		}
+	}
+	if _, err := Parse([]byte("notjson")); err == nil {
+		t.Fatal("expected json error")
+	}
+}
@@ -0,0 +1,156 @@
+// Package route maps uploaded object keys to feed profiles so a single
+// parsefile deployment can serve every feed. Routes match the key by
+// prefix, glob or regular expression and may additionally sniff the start
+// of the file; the first matching route wins.
+package route
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// SniffBytes is how much of the object is offered to Sniff patterns.
+const SniffBytes = 4096
+
+// Route sends matching keys to a profile. Exactly one of Prefix, Glob or
+// Regex is set.
+type Route struct {
+	// Name identifies the route in logs and output; defaults to the profile.
+	Name string `json:"name,omitempty"`
+	// Prefix matches keys starting with it, e.g. "flood_qns/prod/".
+	Prefix string `json:"prefix,omitempty"`
+	// Glob matches the whole key with path.Match; "*" does not cross "/".
+	Glob string `json:"glob,omitempty"`
+	// Regex matches the key with a Go regular expression.
+	Regex string `json:"regex,omitempty"`
+	// Sniff, when set, must also match the first SniffBytes of the object,
+	// e.g. "^MemberNumber\\|" to tell two feeds sharing a prefix apart.
+	Sniff string `json:"sniff,omitempty"`
+	// Profile is the profile name handed to the profile loader.
+	Profile string `json:"profile"`
+
+	re    *regexp.Regexp
+	sniff *regexp.Regexp
+}
+
+// Table is an ordered list of routes.
+type Table struct {
+	Routes []Route `json:"routes"`
+}
+
+// NoRouteError reports a key no route accepts. Handlers return it unwrapped
+// so Step Functions can catch it by name.
+type NoRouteError struct {
+	Key string
+}
+
+func (e *NoRouteError) Error() string {
+	return fmt.Sprintf("no route for key %q", e.Key)
+}
+
+// Parse decodes and checks a routing table.
+func Parse(b []byte) (*Table, error) {
+	var t Table
+	if err := json.Unmarshal(b, &t); err != nil {
+		return nil, fmt.Errorf("decode routes: %w", err)
+	}
+	if len(t.Routes) == 0 {
+		return nil, errors.New("routes: table is empty")
+	}
+	for i := range t.Routes {
+		if err := t.Routes[i].compile(); err != nil {
+			return nil, fmt.Errorf("routes[%d]: %w", i, err)
+		}
+	}
+	return &t, nil
+}
+
+// FromEnv parses the routing table in ROUTES_JSON.
+func FromEnv() (*Table, error) {
+	v := os.Getenv("ROUTES_JSON")
+	if v == "" {
+		return nil, errors.New("ROUTES_JSON is not set")
+	}
+	return Parse([]byte(v))
+}
+
+// compile checks the route and prepares its patterns.
+func (r *Route) compile() error {
+	n := 0
+	for _, s := range []string{r.Prefix, r.Glob, r.Regex} {
+		if s != "" {
+			n++
+		}
+	}
+	if n != 1 {
+		return errors.New("exactly one of prefix, glob or regex is required")
+	}
+	if r.Profile == "" {
+		return errors.New("profile is required")
+	}
+	if r.Name == "" {
+		r.Name = r.Profile
+	}
+	if r.Glob != "" {
+		if _, err := path.Match(r.Glob, ""); err != nil {
+			return fmt.Errorf("glob %q: %w", r.Glob, err)
+		}
+	}
+	var err error
+	if r.Regex != "" {
+		if r.re, err = regexp.Compile(r.Regex); err != nil {
+			return fmt.Errorf("regex: %w", err)
+		}
+	}
+	if r.Sniff != "" {
+		if r.sniff, err = regexp.Compile(r.Sniff); err != nil {
+			return fmt.Errorf("sniff: %w", err)
+		}
+	}
+	return nil
+}
+
+// matchKey reports whether the key pattern accepts key.
+func (r *Route) matchKey(key string) bool {
+	switch {
+	case r.Prefix != "":
+		return strings.HasPrefix(key, r.Prefix)
+	case r.Glob != "":
+		ok, _ := path.Match(r.Glob, key)
+		return ok
+	default:
+		return r.re.MatchString(key)
+	}
+}
+
+// NeedsSniff reports whether any route accepting key inspects content, so
+// callers only buffer the object head when it matters.
+func (t *Table) NeedsSniff(key string) bool {
+	for i := range t.Routes {
+		if r := &t.Routes[i]; r.sniff != nil && r.matchKey(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match returns the first route accepting key and, for sniffing routes,
+// head. It returns *NoRouteError when none does.
+func (t *Table) Match(key string, head []byte) (*Route, error) {
+	for i := range t.Routes {
+		r := &t.Routes[i]
+		if !r.matchKey(key) {
+			continue
+		}
+		if r.sniff != nil && !r.sniff.Match(head) {
+			continue
+		}
+		return r, nil
+	}
+	return nil, &NoRouteError{Key: key}
+}
@@ -0,0 +1,71 @@
+package route
+
+import (
+	"errors"
+	"testing"
+)
+
+const table = `{"routes": [
+	{"name": "qns-v2", "prefix": "crm-incoming/qns/", "sniff": "^MemberNumber\\|QuoteNumber\\|Email\\|Phone", "profile": "/crm/file-profiles/prod/flood_qns_v2"},
+	{"prefix": "crm-incoming/qns/", "profile": "/crm/file-profiles/prod/flood_qns"},
+	{"glob": "crm-incoming/*/campaign_*.csv", "profile": "/crm/file-profiles/prod/campaign"},
+	{"regex": "^partners/[a-z]+/\\d{8}\\.txt$", "profile": "/crm/file-profiles/prod/partner"}
+]}`
+
+func TestMatch(t *testing.T) {
+	tbl, err := Parse([]byte(table))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		key, head, want string
+	}{
+		{"crm-incoming/qns/a.qns", "MemberNumber|QuoteNumber|Email|Phone\n1|2|x|y", "qns-v2"},
+		{"crm-incoming/qns/a.qns", "MemberNumber|QuoteNumber|Email\n1|2|x", "/crm/file-profiles/prod/flood_qns"},
+		{"crm-incoming/mkt/campaign_0101.csv", "", "/crm/file-profiles/prod/campaign"},
+		{"partners/acme/20250101.txt", "", "/crm/file-profiles/prod/partner"},
+	}
+	for _, c := range cases {
+		r, err := tbl.Match(c.key, []byte(c.head))
+		if err != nil || r.Name != c.want {
+			t.Errorf("%s: got %v %v, want %s", c.key, r, err, c.want)
+		}
+	}
+	if !tbl.NeedsSniff("crm-incoming/qns/a.qns") || tbl.NeedsSniff("partners/acme/20250101.txt") {
+		t.Fatal("unexpected NeedsSniff")
+	}
+	for _, key := range []string{"crm-incoming/mkt/sub/campaign_1.csv", "partners/acme/2025.txt", "other/file"} {
+		var nr *NoRouteError
+		if _, err := tbl.Match(key, nil); !errors.As(err, &nr) || nr.Key != key {
+			t.Errorf("%s: expected NoRouteError, got %v", key, err)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, doc := range []string{
+		`not json`,
+		`{"routes": []}`,
+		`{"routes": [{"profile": "p"}]}`,
+		`{"routes": [{"prefix": "a/", "glob": "a/*", "profile": "p"}]}`,
+		`{"routes": [{"prefix": "a/"}]}`,
+		`{"routes": [{"glob": "[", "profile": "p"}]}`,
+		`{"routes": [{"regex": "(", "profile": "p"}]}`,
+		`{"routes": [{"prefix": "a/", "sniff": "(", "profile": "p"}]}`,
+	} {
+		if _, err := Parse([]byte(doc)); err == nil {
+			t.Errorf("%s: expected error", doc)
+		}
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("ROUTES_JSON", "")
+	if _, err := FromEnv(); err == nil {
+		t.Fatal("expected error without ROUTES_JSON")
+	}
+	t.Setenv("ROUTES_JSON", table)
+	if tbl, err := FromEnv(); err != nil || len(tbl.Routes) != 4 {
+		t.Fatalf("unexpected %v %v", tbl, err)
+	}
+}
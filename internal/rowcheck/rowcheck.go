@@ -0,0 +1,423 @@
+// Package rowcheck applies a profile's rowValidation to parsed rows. Each
+// failed check names an error code so rejected rows can be reported with
+// it: REQUIRED and REGEX for the required and regex settings, and the
+// rule's own code for entries of rowValidation.rules.
+package rowcheck
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/your-org/file-processor-sample/internal/profile"
+)
+
+// Codes of the built-in checks.
+const (
+	CodeRequired = "REQUIRED"
+	CodeRegex    = "REGEX"
+)
+
+// defaultDateFormat is the layout of "date" values without a format.
+const defaultDateFormat = "2006-01-02"
+
+// Rejection explains why a row failed validation.
+type Rejection struct {
+	Code    string
+	Field   string
+	Message string
+}
+
+// Error returns the message.
+func (r *Rejection) Error() string { return r.Message }
+
+// check tests one row and returns nil when it passes.
+type check func(row map[string]string) *Rejection
+
+// Validator checks rows one at a time. It remembers the values of unique
+// rules across calls, so use one Validator per file.
+type Validator struct {
+	checks []check
+	unique []*uniqueRule
+}
+
+// Compile builds a Validator for v. Rules are checked after required and
+// regex, in declaration order, and the first failure rejects the row.
+func Compile(v profile.RowValidation) (*Validator, error) {
+	val := &Validator{}
+	for _, col := range v.Required {
+		val.checks = append(val.checks, func(row map[string]string) *Rejection {
+			if strings.TrimSpace(row[col]) == "" {
+				return &Rejection{Code: CodeRequired, Field: col, Message: col + " is required"}
+			}
+			return nil
+		})
+	}
+	for _, col := range sortedKeys(v.Regex) {
+		re, err := regexp.Compile(v.Regex[col])
+		if err != nil {
+			return nil, fmt.Errorf("rowValidation.regex.%s: %w", col, err)
+		}
+		val.checks = append(val.checks, func(row map[string]string) *Rejection {
+			if s := row[col]; s != "" && !re.MatchString(s) {
+				return &Rejection{Code: CodeRegex, Field: col, Message: fmt.Sprintf("%s %q does not match %s", col, s, re)}
+			}
+			return nil
+		})
+	}
+	for i, r := range v.Rules {
+		c, err := val.compileRule(r)
+		if err != nil {
+			return nil, fmt.Errorf("rowValidation.rules[%d] (%s): %w", i, r.Code, err)
+		}
+		cond, err := compileCondition(r.If)
+		if err != nil {
+			return nil, fmt.Errorf("rowValidation.rules[%d] (%s): %w", i, r.Code, err)
+		}
+		val.checks = append(val.checks, func(row map[string]string) *Rejection {
+			if !cond(row) {
+				return nil
+			}
+			rej := c(row)
+			if rej != nil {
+				rej.Code = r.Code
+				if rej.Field == "" {
+					rej.Field = r.Field
+				}
+				if r.Message != "" {
+					rej.Message = r.Message
+				}
+			}
+			return rej
+		})
+	}
+	return val, nil
+}
+
+// Check returns why row is rejected, or nil. Rows that pass are recorded
+// for the unique rules.
+func (v *Validator) Check(row map[string]string) *Rejection {
+	if v == nil {
+		return nil
+	}
+	for _, c := range v.checks {
+		if rej := c(row); rej != nil {
+			return rej
+		}
+	}
+	for _, u := range v.unique {
+		u.commit(row)
+	}
+	return nil
+}
+
+// compileRule returns the check for one rule, without its condition.
+func (v *Validator) compileRule(r profile.Rule) (check, error) {
+	if r.Type != "unique" && r.Field == "" {
+		return nil, fmt.Errorf("field is required")
+	}
+	switch r.Type {
+	case "required":
+		return func(row map[string]string) *Rejection {
+			if strings.TrimSpace(row[r.Field]) == "" {
+				return &Rejection{Message: r.Field + " is required"}
+			}
+			return nil
+		}, nil
+	case "enum":
+		return enumCheck(r)
+	case "range":
+		return rangeCheck(r)
+	case "length":
+		return lengthCheck(r)
+	case "compare":
+		return compareCheck(r)
+	case "unique":
+		fields := r.Fields
+		if len(fields) == 0 && r.Field != "" {
+			fields = []string{r.Field}
+		}
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("field or fields is required")
+		}
+		u := &uniqueRule{fields: fields, seen: map[string]bool{}}
+		v.unique = append(v.unique, u)
+		return u.check, nil
+	}
+	return nil, fmt.Errorf("unknown type %q", r.Type)
+}
+
+// enumCheck accepts only the listed values.
+func enumCheck(r profile.Rule) (check, error) {
+	if len(r.Values) == 0 {
+		return nil, fmt.Errorf("values is required")
+	}
+	allowed := make(map[string]bool, len(r.Values))
+	for _, s := range r.Values {
+		if r.IgnoreCase {
+			s = strings.ToLower(s)
+		}
+		allowed[s] = true
+	}
+	return func(row map[string]string) *Rejection {
+		s := row[r.Field]
+		if s == "" {
+			return nil
+		}
+		k := s
+		if r.IgnoreCase {
+			k = strings.ToLower(k)
+		}
+		if !allowed[k] {
+			return &Rejection{Message: fmt.Sprintf("%s %q is not one of %s", r.Field, s, strings.Join(r.Values, ", "))}
+		}
+		return nil
+	}, nil
+}
+
+// rangeCheck bounds numbers or dates, inclusive.
+func rangeCheck(r profile.Rule) (check, error) {
+	if r.Min == nil && r.Max == nil {
+		return nil, fmt.Errorf("min or max is required")
+	}
+	conv, err := converter(r)
+	if err != nil {
+		return nil, err
+	}
+	var lo, hi *float64
+	for _, b := range []struct {
+		bound *profile.Bound
+		dst   **float64
+		name  string
+	}{{r.Min, &lo, "min"}, {r.Max, &hi, "max"}} {
+		if b.bound == nil {
+			continue
+		}
+		x, err := conv(string(*b.bound))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", b.name, err)
+		}
+		*b.dst = &x
+	}
+	return func(row map[string]string) *Rejection {
+		s := row[r.Field]
+		if s == "" {
+			return nil
+		}
+		x, err := conv(s)
+		if err != nil {
+			return &Rejection{Message: fmt.Sprintf("%s %q: %v", r.Field, s, err)}
+		}
+		if lo != nil && x < *lo {
+			return &Rejection{Message: fmt.Sprintf("%s %s is below %s", r.Field, s, *r.Min)}
+		}
+		if hi != nil && x > *hi {
+			return &Rejection{Message: fmt.Sprintf("%s %s is above %s", r.Field, s, *r.Max)}
+		}
+		return nil
+	}, nil
+}
+
+// lengthCheck bounds the number of characters.
+func lengthCheck(r profile.Rule) (check, error) {
+	if r.Min == nil && r.Max == nil {
+		return nil, fmt.Errorf("min or max is required")
+	}
+	lo, hi := -1, -1
+	for _, b := range []struct {
+		bound *profile.Bound
+		dst   *int
+		name  string
+	}{{r.Min, &lo, "min"}, {r.Max, &hi, "max"}} {
+		if b.bound == nil {
+			continue
+		}
+		n, err := strconv.Atoi(string(*b.bound))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%s must be a non-negative integer", b.name)
+		}
+		*b.dst = n
+	}
+	return func(row map[string]string) *Rejection {
+		s := row[r.Field]
+		if s == "" {
+			return nil
+		}
+		n := len([]rune(s))
+		if lo >= 0 && n < lo || hi >= 0 && n > hi {
+			return &Rejection{Message: fmt.Sprintf("%s length %d is outside %s..%s", r.Field, n, boundText(r.Min), boundText(r.Max))}
+		}
+		return nil
+	}, nil
+}
+
+// compareCheck compares Field with Other using Op. Rows where either is
+// empty pass.
+func compareCheck(r profile.Rule) (check, error) {
+	if r.Other == "" {
+		return nil, fmt.Errorf("other is required")
+	}
+	cmp, ok := map[string]func(int) bool{
+		"==": func(c int) bool { return c == 0 },
+		"!=": func(c int) bool { return c != 0 },
+		"<":  func(c int) bool { return c < 0 },
+		"<=": func(c int) bool { return c <= 0 },
+		">":  func(c int) bool { return c > 0 },
+		">=": func(c int) bool { return c >= 0 },
+	}[r.Op]
+	if !ok {
+		return nil, fmt.Errorf("op must be one of ==, !=, <, <=, >, >=")
+	}
+	var order func(a, b string) (int, error)
+	if r.As == "string" {
+		order = func(a, b string) (int, error) { return strings.Compare(a, b), nil }
+	} else {
+		conv, err := converter(r)
+		if err != nil {
+			return nil, err
+		}
+		order = func(a, b string) (int, error) {
+			x, err := conv(a)
+			if err != nil {
+				return 0, fmt.Errorf("%s %q: %w", r.Field, a, err)
+			}
+			y, err := conv(b)
+			if err != nil {
+				return 0, fmt.Errorf("%s %q: %w", r.Other, b, err)
+			}
+			switch {
+			case x < y:
+				return -1, nil
+			case x > y:
+				return 1, nil
+			}
+			return 0, nil
+		}
+	}
+	return func(row map[string]string) *Rejection {
+		a, b := row[r.Field], row[r.Other]
+		if a == "" || b == "" {
+			return nil
+		}
+		c, err := order(a, b)
+		if err != nil {
+			return &Rejection{Message: err.Error()}
+		}
+		if !cmp(c) {
+			return &Rejection{Message: fmt.Sprintf("%s %s must be %s %s %s", r.Field, a, r.Op, r.Other, b)}
+		}
+		return nil
+	}, nil
+}
+
+// converter parses values as numbers (the default) or, with as "date",
+// as dates in Format.
+func converter(r profile.Rule) (func(string) (float64, error), error) {
+	switch r.As {
+	case "", "number":
+		return func(s string) (float64, error) {
+			x, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return 0, fmt.Errorf("not a number")
+			}
+			return x, nil
+		}, nil
+	case "date":
+		layout := r.Format
+		if layout == "" {
+			layout = defaultDateFormat
+		}
+		return func(s string) (float64, error) {
+			t, err := time.Parse(layout, s)
+			if err != nil {
+				return 0, fmt.Errorf("not a date in format %s", layout)
+			}
+			return float64(t.Unix()), nil
+		}, nil
+	}
+	return nil, fmt.Errorf("as must be number or date")
+}
+
+// uniqueRule rejects rows repeating the values of fields seen in an
+// earlier accepted row. Rows with all fields empty pass.
+type uniqueRule struct {
+	fields []string
+	seen   map[string]bool
+}
+
+func (u *uniqueRule) key(row map[string]string) (string, bool) {
+	vals := make([]string, len(u.fields))
+	empty := true
+	for i, f := range u.fields {
+		vals[i] = row[f]
+		empty = empty && vals[i] == ""
+	}
+	return strings.Join(vals, "\x00"), !empty
+}
+
+func (u *uniqueRule) check(row map[string]string) *Rejection {
+	if k, ok := u.key(row); ok && u.seen[k] {
+		return &Rejection{Field: strings.Join(u.fields, ","), Message: fmt.Sprintf("duplicate %s %s", strings.Join(u.fields, ", "), strings.ReplaceAll(k, "\x00", ", "))}
+	}
+	return nil
+}
+
+func (u *uniqueRule) commit(row map[string]string) {
+	if k, ok := u.key(row); ok {
+		u.seen[k] = true
+	}
+}
+
+// compileCondition returns the rule's "if" test; nil conditions always hold.
+func compileCondition(c *profile.Condition) (func(map[string]string) bool, error) {
+	if c == nil {
+		return func(map[string]string) bool { return true }, nil
+	}
+	if c.Field == "" {
+		return nil, fmt.Errorf("if.field is required")
+	}
+	if c.Equals == nil && c.In == nil && c.Present == nil {
+		return nil, fmt.Errorf("if needs equals, in or present")
+	}
+	return func(row map[string]string) bool {
+		v := row[c.Field]
+		if c.Equals != nil && v != *c.Equals {
+			return false
+		}
+		if c.In != nil && !contains(c.In, v) {
+			return false
+		}
+		if c.Present != nil && (strings.TrimSpace(v) != "") != *c.Present {
+			return false
+		}
+		return true
+	}, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+func boundText(b *profile.Bound) string {
+	if b == nil {
+		return ""
+	}
+	return string(*b)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
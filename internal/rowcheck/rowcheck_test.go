@@ -0,0 +1,123 @@
+package rowcheck
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/your-org/file-processor-sample/internal/profile"
+)
+
+func compile(t *testing.T, doc string) (*Validator, error) {
+	t.Helper()
+	var v profile.RowValidation
+	if err := json.Unmarshal([]byte(doc), &v); err != nil {
+		t.Fatal(err)
+	}
+	return Compile(v)
+}
+
+func TestCheck(t *testing.T) {
+	v, err := compile(t, `{
+		"required": ["Id"],
+		"regex": {"Email": ".+@.+"},
+		"rules": [
+			{"type": "enum", "code": "BAD_STAGE", "field": "Stage", "values": ["quoted", "bound"], "ignoreCase": true},
+			{"type": "required", "code": "PREMIUM_IF_BOUND", "field": "Premium", "if": {"field": "Stage", "in": ["Bound", "BOUND"]}},
+			{"type": "range", "code": "PREMIUM_RANGE", "field": "Premium", "min": 0, "max": "5000.50"},
+			{"type": "range", "code": "OLD_QUOTE", "field": "QuoteDate", "as": "date", "min": "2020-01-01"},
+			{"type": "length", "code": "NAME_LENGTH", "field": "Name", "max": 5, "message": "name too long"},
+			{"type": "compare", "code": "EXPIRES_BEFORE_QUOTE", "field": "ExpirationDate", "op": ">", "other": "QuoteDate", "as": "date"},
+			{"type": "compare", "code": "CODE_ORDER", "field": "To", "op": ">=", "other": "From", "as": "string"},
+			{"type": "unique", "code": "DUPLICATE_QUOTE", "fields": ["Id", "QuoteDate"]},
+			{"type": "range", "code": "US_DATE", "field": "Signed", "as": "date", "format": "01/02/2006", "max": "12/31/2030", "if": {"field": "Signed", "present": true}}
+		]
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok := map[string]string{"Id": "1", "Email": "a@b", "Stage": "Bound", "Premium": "100", "QuoteDate": "2024-01-01", "ExpirationDate": "2025-01-01", "Name": "Ann", "From": "A", "To": "B"}
+	with := func(k, val string) map[string]string {
+		r := map[string]string{}
+		for x, y := range ok {
+			r[x] = y
+		}
+		// distinct ids keep the unique rule out of the way
+		r["Id"] = k + val
+		r[k] = val
+		return r
+	}
+	cases := []struct {
+		row        map[string]string
+		code, fld  string
+		wantReject bool
+	}{
+		{ok, "", "", false},
+		{ok, "DUPLICATE_QUOTE", "Id,QuoteDate", true},
+		{with("Id", ""), CodeRequired, "Id", true},
+		{with("Email", "nope"), CodeRegex, "Email", true},
+		{with("Stage", "Lost"), "BAD_STAGE", "Stage", true},
+		{with("Stage", "QUOTED"), "", "", false},
+		{with("Premium", ""), "PREMIUM_IF_BOUND", "Premium", true},
+		{with("Premium", "5000.51"), "PREMIUM_RANGE", "Premium", true},
+		{with("Premium", "abc"), "PREMIUM_RANGE", "Premium", true},
+		{with("QuoteDate", "2019-12-31"), "OLD_QUOTE", "QuoteDate", true},
+		{with("QuoteDate", "31/12/2024"), "OLD_QUOTE", "QuoteDate", true},
+		{with("Name", "Annabel"), "NAME_LENGTH", "Name", true},
+		{with("ExpirationDate", "2024-01-01"), "EXPIRES_BEFORE_QUOTE", "ExpirationDate", true},
+		{with("ExpirationDate", ""), "", "", false},
+		{with("To", "0"), "CODE_ORDER", "To", true},
+		{with("Signed", "01/01/2031"), "US_DATE", "Signed", true},
+		{with("Signed", "01/01/2030"), "", "", false},
+	}
+	for i, c := range cases {
+		rej := v.Check(c.row)
+		if (rej != nil) != c.wantReject {
+			t.Errorf("case %d %v: got %v", i, c.row, rej)
+			continue
+		}
+		if rej != nil && (rej.Code != c.code || rej.Field != c.fld || rej.Message == "") {
+			t.Errorf("case %d: got %+v, want %s on %s", i, rej, c.code, c.fld)
+		}
+	}
+	if rej := v.Check(with("Name", "Annabel")); rej == nil || rej.Message != "name too long" {
+		t.Errorf("custom message: got %+v", rej)
+	}
+}
+
+func TestUniqueIgnoresRejectedRows(t *testing.T) {
+	v, _ := compile(t, `{"regex": {"N": "^[0-9]+$"}, "rules": [{"type": "unique", "code": "DUP", "field": "Id"}]}`)
+	if v.Check(map[string]string{"Id": "1", "N": "x"}) == nil {
+		t.Fatal("expected regex rejection")
+	}
+	if rej := v.Check(map[string]string{"Id": "1", "N": "2"}); rej != nil {
+		t.Fatalf("first accepted row should not be a duplicate: %v", rej)
+	}
+	if rej := v.Check(map[string]string{"Id": "1", "N": "3"}); rej == nil || rej.Code != "DUP" {
+		t.Fatalf("expected duplicate, got %v", rej)
+	}
+	if rej := v.Check(map[string]string{"N": "3"}); rej != nil {
+		t.Fatalf("empty keys are not duplicates: %v", rej)
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, doc := range []string{
+		`{"regex": {"A": "("}}`,
+		`{"rules": [{"type": "enum", "code": "X", "field": "A"}]}`,
+		`{"rules": [{"type": "enum", "code": "X", "values": ["a"]}]}`,
+		`{"rules": [{"type": "range", "code": "X", "field": "A"}]}`,
+		`{"rules": [{"type": "range", "code": "X", "field": "A", "min": "low"}]}`,
+		`{"rules": [{"type": "range", "code": "X", "field": "A", "as": "date", "min": "2020-13-01"}]}`,
+		`{"rules": [{"type": "range", "code": "X", "field": "A", "as": "string", "min": "a"}]}`,
+		`{"rules": [{"type": "length", "code": "X", "field": "A", "max": 1.5}]}`,
+		`{"rules": [{"type": "compare", "code": "X", "field": "A", "op": ">"}]}`,
+		`{"rules": [{"type": "compare", "code": "X", "field": "A", "other": "B", "op": "=~"}]}`,
+		`{"rules": [{"type": "unique", "code": "X"}]}`,
+		`{"rules": [{"type": "required", "code": "X", "field": "A", "if": {"field": "B"}}]}`,
+		`{"rules": [{"type": "checksum", "code": "X", "field": "A"}]}`,
+	} {
+		if _, err := compile(t, doc); err == nil {
+			t.Errorf("%s: expected error", doc)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package sfclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Session calls the sObject REST resources with one token, requested on
+// first use and refreshed on 401. It implements postcreate.Client.
+type Session struct {
+	Client *Client
+	token  string
+}
+
+// Token returns the session token, requesting one when needed.
+func (s *Session) Token(ctx context.Context) (string, error) {
+	if s.token == "" {
+		t, err := s.Client.Token(ctx)
+		if err != nil {
+			return "", err
+		}
+		s.token = t
+	}
+	return s.token, nil
+}
+
+// Do sends a request and decodes the response into out when given.
+func (s *Session) Do(ctx context.Context, method, path string, body, out any) (int, error) {
+	if _, err := s.Token(ctx); err != nil {
+		return 0, err
+	}
+	resp, err := s.Client.Send(ctx, method, path, &s.token, body)
+	if err != nil {
+		return 0, err
+	}
+	b, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if out != nil && len(b) > 0 {
+		if err := json.Unmarshal(b, out); err != nil {
+			return resp.StatusCode, fmt.Errorf("decode response: %w", err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// saveResult is the body returned by create and upsert.
+type saveResult struct {
+	ID      string `json:"id"`
+	Created bool   `json:"created"`
+}
+
+// Create inserts a record.
+func (s *Session) Create(ctx context.Context, object string, fields map[string]any) (string, error) {
+	var res saveResult
+	if _, err := s.Do(ctx, http.MethodPost, "/sobjects/"+object, fields, &res); err != nil {
+		return "", fmt.Errorf("create %s: %w", object, err)
+	}
+	return res.ID, nil
+}
+
+// Update changes fields on record id.
+func (s *Session) Update(ctx context.Context, object, id string, fields map[string]any) error {
+	if _, err := s.Do(ctx, http.MethodPatch, "/sobjects/"+object+"/"+url.PathEscape(id), fields, nil); err != nil {
+		return fmt.Errorf("update %s %s: %w", object, id, err)
+	}
+	return nil
+}
+
+// Upsert creates or updates object by external id. Salesforce answers 201
+// for a new record and 200 for an update.
+func (s *Session) Upsert(ctx context.Context, object, extField, extID string, fields map[string]any) (string, bool, error) {
+	var res saveResult
+	status, err := s.Do(ctx, http.MethodPatch, "/sobjects/"+object+"/"+extField+"/"+url.PathEscape(extID), fields, &res)
+	if err != nil {
+		return "", false, fmt.Errorf("upsert %s %s: %w", object, extID, err)
+	}
+	return res.ID, status == http.StatusCreated, nil
+}
+
+// Query runs a SOQL query, following nextRecordsUrl until done.
+func (s *Session) Query(ctx context.Context, soql string) ([]map[string]any, error) {
+	var records []map[string]any
+	path := "/query?q=" + url.QueryEscape(soql)
+	for {
+		var page struct {
+			Records        []map[string]any `json:"records"`
+			Done           bool             `json:"done"`
+			NextRecordsURL string           `json:"nextRecordsUrl"`
+		}
+		if _, err := s.Do(ctx, http.MethodGet, path, nil, &page); err != nil {
+			return nil, fmt.Errorf("query: %w", err)
+		}
+		records = append(records, page.Records...)
+		if page.Done || page.NextRecordsURL == "" {
+			return records, nil
+		}
+		path = "/query/" + page.NextRecordsURL[strings.LastIndex(page.NextRecordsURL, "/")+1:]
+	}
+}
@@ -0,0 +1,217 @@
+// Package sfclient is the Salesforce REST client shared by the Lambdas that
+// write to Salesforce. Tokens come from the token broker, every call goes
+// through the shared circuit breaker and the API usage reported in
+// Sforce-Limit-Info is recorded.
+package sfclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/your-org/file-processor-sample/internal/brokerauth"
+	"github.com/your-org/file-processor-sample/internal/circuit"
+	"github.com/your-org/file-processor-sample/internal/sflimits"
+)
+
+// Client sends authenticated Salesforce requests. A nil Breaker or Limits
+// disables that part.
+type Client struct {
+	// BrokerURL is the token broker endpoint; requests are HMAC signed with
+	// BrokerKey as BrokerID when BrokerKey is set.
+	BrokerURL, BrokerID, BrokerKey string
+	// API is the base REST API URL, e.g.
+	// https://example.my.salesforce.com/services/data/v59.0.
+	API     string
+	HTTP    *http.Client
+	Breaker *circuit.Breaker
+	Limits  *sflimits.Monitor
+	// Sleep waits between retries; time.Sleep when nil.
+	Sleep func(time.Duration)
+}
+
+// tokenResp mirrors the JSON structure returned by the broker. The broker
+// API answers with "token"; "access_token" is kept for OAuth-style stubs.
+type tokenResp struct {
+	Token       string `json:"token"`
+	AccessToken string `json:"access_token"`
+}
+
+// Token retrieves an auth token from the token broker, retrying once on 401.
+// A broker answering circuit_open is reported as *circuit.CircuitOpenError.
+func (c *Client) Token(ctx context.Context) (string, error) {
+	for i := 0; ; i++ {
+		if i >= 2 {
+			return "", fmt.Errorf("broker status: %s", http.StatusText(http.StatusUnauthorized))
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BrokerURL, nil)
+		if err != nil {
+			return "", fmt.Errorf("new token request: %w", err)
+		}
+		if c.BrokerKey != "" {
+			brokerauth.SignRequest(req, []byte(c.BrokerKey), c.BrokerID, nil, time.Now())
+		}
+		resp, err := c.httpClient().Do(req)
+		if err != nil {
+			return "", fmt.Errorf("do token request: %w", err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			var tr tokenResp
+			if err := json.Unmarshal(b, &tr); err != nil {
+				return "", fmt.Errorf("decode token: %w", err)
+			}
+			if tr.Token != "" {
+				return tr.Token, nil
+			}
+			return tr.AccessToken, nil
+		}
+		if resp.StatusCode == http.StatusUnauthorized {
+			continue
+		}
+		var ae struct {
+			Code string `json:"code"`
+		}
+		if json.Unmarshal(b, &ae) == nil && ae.Code == "circuit_open" {
+			secs, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+			return "", &circuit.CircuitOpenError{Name: "broker", RetryAfter: time.Duration(secs) * time.Second}
+		}
+		return "", fmt.Errorf("broker status: %s", resp.Status)
+	}
+}
+
+// Request sends one authenticated request through the circuit breaker,
+// failing fast with *circuit.CircuitOpenError while it is open, and records
+// the API usage of the response.
+func (c *Client) Request(ctx context.Context, method, path, token string, body any) (*http.Response, error) {
+	if err := c.Breaker.Allow(ctx); err != nil {
+		return nil, err
+	}
+	var r io.Reader
+	if body != nil {
+		b, _ := json.Marshal(body)
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.API+path, r)
+	if err != nil {
+		return nil, fmt.Errorf("new request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.httpClient().Do(req)
+	c.Breaker.Record(ctx, resp, err)
+	if err == nil {
+		c.Limits.Observe(ctx, resp)
+	}
+	return resp, err
+}
+
+// StatusError is returned when Salesforce keeps answering with an error
+// status. Detail joins the errorCode and message pairs of the body.
+type StatusError struct {
+	Status string
+	Code   int
+	Detail string
+}
+
+func (e *StatusError) Error() string {
+	if e.Detail == "" {
+		return "salesforce status: " + e.Status
+	}
+	return "salesforce status: " + e.Status + ": " + e.Detail
+}
+
+// Send issues a request, refreshing *token once on 401 and retrying 5xx and
+// 429 answers with backoff up to three attempts. Other error statuses are
+// returned as *StatusError. The caller must close the body of the returned
+// response.
+func (c *Client) Send(ctx context.Context, method, path string, token *string, body any) (*http.Response, error) {
+	refreshed := false
+	for attempt := 0; ; attempt++ {
+		resp, err := c.Request(ctx, method, path, *token, body)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", strings.ToLower(method), err)
+		}
+		code := resp.StatusCode
+		if code == http.StatusUnauthorized && !refreshed {
+			_ = resp.Body.Close()
+			refreshed = true
+			if *token, err = c.Token(ctx); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if code < 400 {
+			return resp, nil
+		}
+		b, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		transient := code >= 500 || code == http.StatusTooManyRequests
+		if !transient || attempt == 2 {
+			return nil, &StatusError{Status: resp.Status, Code: code, Detail: errorDetail(b)}
+		}
+		c.sleep(time.Duration(1<<attempt) * 100 * time.Millisecond)
+	}
+}
+
+// Transient reports whether err means Salesforce or the broker was
+// unreachable or overloaded, as opposed to the request being refused.
+func Transient(err error) bool {
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.Code >= 500 || se.Code == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// CircuitOpen returns the *circuit.CircuitOpenError in err's chain,
+// unwrapped so Lambda reports the error type as CircuitOpenError, or nil.
+func CircuitOpen(err error) error {
+	var oe *circuit.CircuitOpenError
+	if errors.As(err, &oe) {
+		return oe
+	}
+	return nil
+}
+
+// errorDetail joins the errorCode and message pairs of a Salesforce error
+// body.
+func errorDetail(b []byte) string {
+	var errs []struct {
+		ErrorCode string `json:"errorCode"`
+		Message   string `json:"message"`
+	}
+	if json.Unmarshal(b, &errs) != nil {
+		return strings.TrimSpace(string(b))
+	}
+	parts := make([]string, len(errs))
+	for i, e := range errs {
+		parts[i] = e.ErrorCode + ": " + e.Message
+	}
+	return strings.Join(parts, "; ")
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTP == nil {
+		return http.DefaultClient
+	}
+	return c.HTTP
+}
+
+func (c *Client) sleep(d time.Duration) {
+	if c.Sleep == nil {
+		time.Sleep(d)
+		return
+	}
+	c.Sleep(d)
+}
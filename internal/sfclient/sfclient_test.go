@@ -0,0 +1,117 @@
+package sfclient
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/your-org/file-processor-sample/internal/circuit"
+)
+
+// client returns a Client against a broker answering with broker and a
+// Salesforce stub answering with sf.
+func client(t *testing.T, broker, sf http.HandlerFunc) *Client {
+	t.Helper()
+	b := httptest.NewServer(broker)
+	t.Cleanup(b.Close)
+	api := httptest.NewServer(sf)
+	t.Cleanup(api.Close)
+	return &Client{BrokerURL: b.URL, API: api.URL, Sleep: func(time.Duration) {}}
+}
+
+func token(w http.ResponseWriter, r *http.Request) {
+	_, _ = io.WriteString(w, `{"token":"tok"}`)
+}
+
+func TestToken(t *testing.T) {
+	calls := 0
+	c := client(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = io.WriteString(w, `{"access_token":"oauth"}`)
+	}, nil)
+	if tok, err := c.Token(context.Background()); err != nil || tok != "oauth" || calls != 2 {
+		t.Fatalf("token %q err %v calls %d", tok, err, calls)
+	}
+
+	c = client(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = io.WriteString(w, `{"code":"circuit_open"}`)
+	}, nil)
+	_, err := c.Token(context.Background())
+	var oe *circuit.CircuitOpenError
+	if !errors.As(err, &oe) || oe.RetryAfter != 30*time.Second {
+		t.Fatalf("expected CircuitOpenError, got %v", err)
+	}
+}
+
+func TestSend(t *testing.T) {
+	for name, tc := range map[string]struct {
+		status    int
+		calls     int
+		transient bool
+	}{
+		"server error": {http.StatusServiceUnavailable, 3, true},
+		"throttled":    {http.StatusTooManyRequests, 3, true},
+		"client error": {http.StatusBadRequest, 1, false},
+	} {
+		calls := 0
+		c := client(t, token, func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.WriteHeader(tc.status)
+			_, _ = io.WriteString(w, `[{"errorCode":"CODE","message":"msg"}]`)
+		})
+		tok := "tok"
+		_, err := c.Send(context.Background(), http.MethodPost, "/sobjects/Task", &tok, map[string]string{})
+		var se *StatusError
+		if !errors.As(err, &se) || se.Code != tc.status || se.Detail != "CODE: msg" {
+			t.Fatalf("%s: unexpected error %v", name, err)
+		}
+		if calls != tc.calls || Transient(err) != tc.transient {
+			t.Errorf("%s: calls %d transient %v", name, calls, Transient(err))
+		}
+	}
+}
+
+func TestSendRefreshesToken(t *testing.T) {
+	c := client(t, token, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer tok" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	tok := "stale"
+	resp, err := c.Send(context.Background(), http.MethodPatch, "/sobjects/Task/00T", &tok, map[string]string{})
+	if err != nil || resp.StatusCode != http.StatusNoContent || tok != "tok" {
+		t.Fatalf("resp %v err %v token %q", resp, err, tok)
+	}
+	_ = resp.Body.Close()
+}
+
+func TestSessionUpsert(t *testing.T) {
+	s := &Session{Client: client(t, token, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.EscapedPath() == "/sobjects/Quote__c/Quote_Number__c/Q%2F1" {
+			w.WriteHeader(http.StatusCreated)
+			_, _ = io.WriteString(w, `{"id":"a01Q","success":true,"created":true}`)
+			return
+		}
+		_, _ = io.WriteString(w, `{"id":"a01R","success":true,"created":false}`)
+	})}
+	id, created, err := s.Upsert(context.Background(), "Quote__c", "Quote_Number__c", "Q/1", map[string]any{})
+	if err != nil || id != "a01Q" || !created {
+		t.Fatalf("id %q created %v err %v", id, created, err)
+	}
+	id, created, err = s.Upsert(context.Background(), "Quote__c", "Quote_Number__c", "Q2", map[string]any{})
+	if err != nil || id != "a01R" || created {
+		t.Fatalf("id %q created %v err %v", id, created, err)
+	}
+}
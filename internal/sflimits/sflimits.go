@@ -0,0 +1,304 @@
+// Package sflimits tracks the org's daily Salesforce API usage reported in the
+// Sforce-Limit-Info response header and gates new file loads on it.
+package sflimits
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	cwtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"go.uber.org/zap"
+)
+
+// Header is the Salesforce response header carrying API usage.
+const Header = "Sforce-Limit-Info"
+
+const (
+	// DefaultThrottlePercent is the usage above which new loads are deferred.
+	DefaultThrottlePercent = 80
+	// DefaultRefusePercent is the usage above which new loads are refused.
+	DefaultRefusePercent = 95
+	// DefaultInterval is the minimum time between usage writes per instance.
+	DefaultInterval = 30 * time.Second
+	// DefaultMaxAge is how long a recorded usage is trusted.
+	DefaultMaxAge = time.Hour
+)
+
+// DynamoAPI is the subset of the DynamoDB client used by Monitor.
+type DynamoAPI interface {
+	GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+	UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
+}
+
+// MetricsAPI publishes CloudWatch metrics.
+type MetricsAPI interface {
+	PutMetricData(ctx context.Context, in *cloudwatch.PutMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.PutMetricDataOutput, error)
+}
+
+// Usage is the daily API consumption of the org.
+type Usage struct {
+	Used int64
+	Max  int64
+}
+
+// Percent returns Used as a percentage of Max.
+func (u Usage) Percent() float64 {
+	if u.Max <= 0 {
+		return 0
+	}
+	return float64(u.Used) * 100 / float64(u.Max)
+}
+
+// Parse extracts the api-usage entry from a Sforce-Limit-Info value such as
+// "api-usage=25/15000, per-app-api-usage=17/250(appName=sample)".
+func Parse(h string) (Usage, bool) {
+	for _, part := range strings.Split(h, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || k != "api-usage" {
+			continue
+		}
+		used, limit, ok := strings.Cut(v, "/")
+		if !ok {
+			return Usage{}, false
+		}
+		u, err1 := strconv.ParseInt(used, 10, 64)
+		m, err2 := strconv.ParseInt(limit, 10, 64)
+		if err1 != nil || err2 != nil || m <= 0 {
+			return Usage{}, false
+		}
+		return Usage{Used: u, Max: m}, true
+	}
+	return Usage{}, false
+}
+
+// APILimitThrottledError defers a new file load while usage is above the
+// throttle percentage. Lambda reports the type name, so state machines can
+// Retry on "APILimitThrottledError".
+type APILimitThrottledError struct {
+	Usage Usage
+	Limit float64
+}
+
+func (e *APILimitThrottledError) Error() string {
+	return fmt.Sprintf("salesforce api usage %d/%d (%.1f%%) above throttle limit %.0f%%", e.Usage.Used, e.Usage.Max, e.Usage.Percent(), e.Limit)
+}
+
+// APILimitExceededError refuses a new file load while usage is above the
+// refuse percentage. State machines match "APILimitExceededError" in Catch.
+type APILimitExceededError struct {
+	Usage Usage
+	Limit float64
+}
+
+func (e *APILimitExceededError) Error() string {
+	return fmt.Sprintf("salesforce api usage %d/%d (%.1f%%) above refuse limit %.0f%%", e.Usage.Used, e.Usage.Max, e.Usage.Percent(), e.Limit)
+}
+
+// Monitor records usage seen on Salesforce responses in a shared DynamoDB
+// item and CloudWatch, and checks it before new file loads start. A nil
+// Monitor observes nothing and allows every load.
+type Monitor struct {
+	DB              DynamoAPI
+	Table           string
+	CW              MetricsAPI
+	ThrottlePercent float64
+	RefusePercent   float64
+	Interval        time.Duration
+	MaxAge          time.Duration
+	Log             *zap.SugaredLogger
+	Now             func() time.Time
+
+	mu       sync.Mutex
+	lastSave time.Time
+	lastBand int
+}
+
+// FromEnv builds a Monitor from SF_LIMITS_TABLE, SF_LIMIT_THROTTLE_PERCENT and
+// SF_LIMIT_REFUSE_PERCENT. It returns nil when SF_LIMITS_TABLE is unset.
+func FromEnv(db DynamoAPI, cw MetricsAPI, log *zap.SugaredLogger) *Monitor {
+	table := os.Getenv("SF_LIMITS_TABLE")
+	if table == "" {
+		return nil
+	}
+	m := &Monitor{DB: db, Table: table, CW: cw, Log: log}
+	if v, err := strconv.ParseFloat(os.Getenv("SF_LIMIT_THROTTLE_PERCENT"), 64); err == nil && v > 0 {
+		m.ThrottlePercent = v
+	}
+	if v, err := strconv.ParseFloat(os.Getenv("SF_LIMIT_REFUSE_PERCENT"), 64); err == nil && v > 0 {
+		m.RefusePercent = v
+	}
+	return m
+}
+
+// Observe records the usage reported on resp. Writes are limited to one per
+// Interval unless usage crosses the throttle or refuse percentage.
+func (m *Monitor) Observe(ctx context.Context, resp *http.Response) {
+	if m == nil || resp == nil {
+		return
+	}
+	u, ok := Parse(resp.Header.Get(Header))
+	if !ok {
+		return
+	}
+	now := m.now()
+	band := m.band(u.Percent())
+	m.mu.Lock()
+	due := now.Sub(m.lastSave) >= m.interval() || band != m.lastBand
+	if due {
+		m.lastSave, m.lastBand = now, band
+	}
+	m.mu.Unlock()
+	if !due {
+		return
+	}
+	m.save(ctx, u, now)
+	m.publish(ctx, u)
+}
+
+// Check returns *APILimitExceededError or *APILimitThrottledError when the
+// last recorded usage is above the configured percentages. Missing, stale or
+// unreadable usage allows the load.
+func (m *Monitor) Check(ctx context.Context) error {
+	if m == nil {
+		return nil
+	}
+	u, at, err := m.load(ctx)
+	if err != nil {
+		m.warn("api usage load", err)
+		return nil
+	}
+	if u.Max == 0 || m.now().Sub(at) > m.maxAge() {
+		return nil
+	}
+	switch m.band(u.Percent()) {
+	case 2:
+		return &APILimitExceededError{Usage: u, Limit: m.refuse()}
+	case 1:
+		return &APILimitThrottledError{Usage: u, Limit: m.throttle()}
+	}
+	return nil
+}
+
+// band returns 0 below the throttle percentage, 1 at or above it and 2 at or
+// above the refuse percentage.
+func (m *Monitor) band(pct float64) int {
+	switch {
+	case pct >= m.refuse():
+		return 2
+	case pct >= m.throttle():
+		return 1
+	}
+	return 0
+}
+
+// save writes u unless a newer observation is already stored.
+func (m *Monitor) save(ctx context.Context, u Usage, at time.Time) {
+	_, err := m.DB.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           &m.Table,
+		Key:                 key(),
+		UpdateExpression:    aws.String("SET Used = :used, MaxCalls = :max, UpdatedAt = :at"),
+		ConditionExpression: aws.String("attribute_not_exists(UpdatedAt) OR UpdatedAt <= :at"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":used": &types.AttributeValueMemberN{Value: strconv.FormatInt(u.Used, 10)},
+			":max":  &types.AttributeValueMemberN{Value: strconv.FormatInt(u.Max, 10)},
+			":at":   &types.AttributeValueMemberN{Value: strconv.FormatInt(at.UnixMilli(), 10)},
+		},
+	})
+	var ccf *types.ConditionalCheckFailedException
+	if err != nil && !errors.As(err, &ccf) {
+		m.warn("api usage save", err)
+	}
+}
+
+// publish emits ApiUsagePercent and ApiCallsUsed to the Salesforce namespace.
+func (m *Monitor) publish(ctx context.Context, u Usage) {
+	if m.CW == nil {
+		return
+	}
+	_, err := m.CW.PutMetricData(ctx, &cloudwatch.PutMetricDataInput{
+		Namespace: aws.String("Salesforce"),
+		MetricData: []cwtypes.MetricDatum{
+			{MetricName: aws.String("ApiUsagePercent"), Value: aws.Float64(u.Percent()), Unit: cwtypes.StandardUnitPercent},
+			{MetricName: aws.String("ApiCallsUsed"), Value: aws.Float64(float64(u.Used)), Unit: cwtypes.StandardUnitCount},
+		},
+	})
+	if err != nil {
+		m.warn("api usage metric", err)
+	}
+}
+
+// load reads the shared usage item and when it was recorded.
+func (m *Monitor) load(ctx context.Context) (Usage, time.Time, error) {
+	out, err := m.DB.GetItem(ctx, &dynamodb.GetItemInput{TableName: &m.Table, Key: key()})
+	if err != nil {
+		return Usage{}, time.Time{}, err
+	}
+	u := Usage{Used: num(out.Item["Used"]), Max: num(out.Item["MaxCalls"])}
+	return u, time.UnixMilli(num(out.Item["UpdatedAt"])), nil
+}
+
+// num parses a number attribute, returning 0 when absent.
+func num(av types.AttributeValue) int64 {
+	v, ok := av.(*types.AttributeValueMemberN)
+	if !ok {
+		return 0
+	}
+	n, _ := strconv.ParseInt(v.Value, 10, 64)
+	return n
+}
+
+func key() map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{"PK": &types.AttributeValueMemberS{Value: "api-usage"}}
+}
+
+func (m *Monitor) throttle() float64 {
+	if m.ThrottlePercent > 0 {
+		return m.ThrottlePercent
+	}
+	return DefaultThrottlePercent
+}
+
+func (m *Monitor) refuse() float64 {
+	if m.RefusePercent > 0 {
+		return m.RefusePercent
+	}
+	return DefaultRefusePercent
+}
+
+func (m *Monitor) interval() time.Duration {
+	if m.Interval > 0 {
+		return m.Interval
+	}
+	return DefaultInterval
+}
+
+func (m *Monitor) maxAge() time.Duration {
+	if m.MaxAge > 0 {
+		return m.MaxAge
+	}
+	return DefaultMaxAge
+}
+
+func (m *Monitor) now() time.Time {
+	if m.Now != nil {
+		return m.Now()
+	}
+	return time.Now()
+}
+
+func (m *Monitor) warn(msg string, err error) {
+	if m.Log != nil {
+		m.Log.Warnw(msg, "error", err)
+	}
+}
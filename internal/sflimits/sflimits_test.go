@@ -0,0 +1,144 @@
+package sflimits
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+type fakeDB struct {
+	item   map[string]types.AttributeValue
+	err    error
+	writes int
+}
+
+func (f *fakeDB) GetItem(ctx context.Context, in *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &dynamodb.GetItemOutput{Item: f.item}, nil
+}
+
+func (f *fakeDB) UpdateItem(ctx context.Context, in *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	f.writes++
+	v := in.ExpressionAttributeValues
+	f.item = map[string]types.AttributeValue{"Used": v[":used"], "MaxCalls": v[":max"], "UpdatedAt": v[":at"]}
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+type fakeCW struct {
+	data []*cloudwatch.PutMetricDataInput
+}
+
+func (f *fakeCW) PutMetricData(ctx context.Context, in *cloudwatch.PutMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.PutMetricDataOutput, error) {
+	f.data = append(f.data, in)
+	return &cloudwatch.PutMetricDataOutput{}, nil
+}
+
+func response(used, max int) *http.Response {
+	h := http.Header{}
+	h.Set(Header, "api-usage="+strconv.Itoa(used)+"/"+strconv.Itoa(max)+", per-app-api-usage=1/250(appName=x)")
+	return &http.Response{StatusCode: http.StatusOK, Header: h}
+}
+
+func TestParse(t *testing.T) {
+	cases := map[string]Usage{
+		"api-usage=25/15000": {Used: 25, Max: 15000},
+		"per-app-api-usage=17/250(appName=sample), api-usage=18/5000": {Used: 18, Max: 5000},
+	}
+	for h, want := range cases {
+		got, ok := Parse(h)
+		if !ok || got != want {
+			t.Fatalf("%q: got %+v %v", h, got, ok)
+		}
+	}
+	for _, h := range []string{"", "api-usage=abc/10", "api-usage=5", "api-usage=1/0"} {
+		if _, ok := Parse(h); ok {
+			t.Fatalf("%q: expected no usage", h)
+		}
+	}
+	if p := (Usage{Used: 40, Max: 50}).Percent(); p != 80 {
+		t.Fatalf("percent %v", p)
+	}
+}
+
+func TestObserveAndCheck(t *testing.T) {
+	db, cw := &fakeDB{}, &fakeCW{}
+	clock := time.Unix(1000, 0)
+	m := &Monitor{DB: db, Table: "limits", CW: cw, Now: func() time.Time { return clock }}
+	ctx := context.Background()
+
+	m.Observe(ctx, response(100, 1000))
+	m.Observe(ctx, response(101, 1000))
+	if db.writes != 1 || len(cw.data) != 1 {
+		t.Fatalf("expected one write within the interval, got %d writes %d metrics", db.writes, len(cw.data))
+	}
+	if err := m.Check(ctx); err != nil {
+		t.Fatalf("10%% usage should pass: %v", err)
+	}
+
+	// crossing the throttle percentage is written immediately
+	m.Observe(ctx, response(850, 1000))
+	var throttled *APILimitThrottledError
+	if err := m.Check(ctx); !errors.As(err, &throttled) || throttled.Limit != DefaultThrottlePercent {
+		t.Fatalf("expected throttle, got %v", err)
+	}
+
+	m.Observe(ctx, response(960, 1000))
+	var refused *APILimitExceededError
+	if err := m.Check(ctx); !errors.As(err, &refused) || refused.Usage.Used != 960 {
+		t.Fatalf("expected refusal, got %v", err)
+	}
+
+	// stale usage is ignored
+	clock = clock.Add(2 * time.Hour)
+	if err := m.Check(ctx); err != nil {
+		t.Fatalf("stale usage should pass: %v", err)
+	}
+}
+
+func TestCustomPercentages(t *testing.T) {
+	t.Setenv("SF_LIMITS_TABLE", "limits")
+	t.Setenv("SF_LIMIT_THROTTLE_PERCENT", "50")
+	t.Setenv("SF_LIMIT_REFUSE_PERCENT", "70")
+	db := &fakeDB{}
+	m := FromEnv(db, nil, nil)
+	m.Observe(context.Background(), response(60, 100))
+	var throttled *APILimitThrottledError
+	if err := m.Check(context.Background()); !errors.As(err, &throttled) {
+		t.Fatalf("expected throttle at 60%%, got %v", err)
+	}
+	m.Observe(context.Background(), response(70, 100))
+	var refused *APILimitExceededError
+	if err := m.Check(context.Background()); !errors.As(err, &refused) {
+		t.Fatalf("expected refusal at 70%%, got %v", err)
+	}
+
+	t.Setenv("SF_LIMITS_TABLE", "")
+	if FromEnv(db, nil, nil) != nil {
+		t.Fatal("expected nil monitor without table")
+	}
+}
+
+func TestFailOpen(t *testing.T) {
+	m := &Monitor{DB: &fakeDB{err: errors.New("throttled")}, Table: "limits"}
+	m.Observe(context.Background(), response(99, 100))
+	if err := m.Check(context.Background()); err != nil {
+		t.Fatalf("expected fail open, got %v", err)
+	}
+	var nilMonitor *Monitor
+	nilMonitor.Observe(context.Background(), response(99, 100))
+	if err := nilMonitor.Check(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
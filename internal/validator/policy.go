@@ -21,7 +21,14 @@ func PolicyViolations(data []byte) []error {
 	if def.Comment == "" {
 		errs = append(errs, fmt.Errorf("missing Comment"))
 	}
-	for name, state := range def.States {
+	return append(errs, stateViolations(def.States)...)
+}
+
+// stateViolations checks states and the states of their Map item
+// processors.
+func stateViolations(states map[string]map[string]any) []error {
+	var errs []error
+	for name, state := range states {
 		t, _ := state["Type"].(string)
 		// TimeoutSeconds check for key states
 		if name == "GuardDuplicate" || name == "ParseFile" || name == "ArchiveMetrics" {
@@ -34,6 +41,7 @@ func PolicyViolations(data []byte) []error {
 			if _, ok := state["MaxConcurrency"]; !ok {
 				errs = append(errs, fmt.Errorf("%s missing MaxConcurrency", name))
 			}
+			errs = append(errs, stateViolations(processorStates(state))...)
 		}
 		// Lambda Retry/Catch
 		if t == "Task" {
@@ -45,7 +53,11 @@ func PolicyViolations(data []byte) []error {
 				}
 			}
 		}
-		// transitions
+		// transitions; Fail and Succeed are terminal without End, Choice
+		// transitions through its Choices
+		if t == "Fail" || t == "Succeed" || t == "Choice" {
+			continue
+		}
 		if _, ok := state["End"]; !ok {
 			if _, ok := state["Next"]; !ok {
 				errs = append(errs, fmt.Errorf("%s missing Next or End", name))
@@ -55,19 +67,46 @@ func PolicyViolations(data []byte) []error {
 	return errs
 }
 
+// processorStates returns the states of a Map state's ItemProcessor, or of
+// its Iterator in older definitions.
+func processorStates(state map[string]any) map[string]map[string]any {
+	proc, ok := state["ItemProcessor"]
+	if !ok {
+		proc = state["Iterator"]
+	}
+	b, err := json.Marshal(proc)
+	if err != nil {
+		return nil
+	}
+	var p struct {
+		States map[string]map[string]any `json:"States"`
+	}
+	_ = json.Unmarshal(b, &p)
+	return p.States
+}
+
 // ExtractLambdas returns lambda function names referenced by the definition.
 func ExtractLambdas(data []byte) []string {
 	var def struct{ States map[string]map[string]any }
 	if err := json.Unmarshal(data, &def); err != nil {
 		return nil
 	}
+	return lambdas(def.States)
+}
+
+// lambdas returns the lambda resources of states, including Map item
+// processors.
+func lambdas(states map[string]map[string]any) []string {
 	var out []string
-	for _, s := range def.States {
+	for _, s := range states {
 		if res, ok := s["Resource"].(string); ok {
 			if strings.Contains(res, "lambda") {
 				out = append(out, path.Base(res))
 			}
 		}
+		if s["Type"] == "Map" {
+			out = append(out, lambdas(processorStates(s))...)
+		}
 	}
 	return out
 }
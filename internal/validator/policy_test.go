@@ -61,6 +61,54 @@ func TestPolicyViolations_MissingFields(t *testing.T) {
 	}
 }
 
+func TestPolicyViolations_TerminalStates(t *testing.T) {
+	def := map[string]any{
+		"Comment": "test",
+		"States": map[string]any{
+			"Failed": map[string]any{"Type": "Fail", "Error": "APILimitExceededError"},
+			"Done":   map[string]any{"Type": "Succeed"},
+		},
+	}
+	b, _ := json.Marshal(def)
+	if errs := PolicyViolations(b); len(errs) != 0 {
+		t.Errorf("expected no errors, got %v", errs)
+	}
+}
+
+func TestPolicyViolations_MapProcessor(t *testing.T) {
+	def := map[string]any{
+		"Comment": "test",
+		"States": map[string]any{
+			"Files": map[string]any{
+				"Type":           "Map",
+				"MaxConcurrency": 2,
+				"ItemProcessor": map[string]any{
+					"StartAt": "ParseFile",
+					"States": map[string]any{
+						"ParseFile": map[string]any{
+							"Type":     "Task",
+							"Resource": "arn:aws:lambda:us-east-1:123:function:bar",
+							"Retry":    []any{"bar"},
+							"End":      true,
+						},
+					},
+				},
+				"Next": "AnyFailed",
+			},
+			"AnyFailed": map[string]any{"Type": "Choice", "Choices": []any{}, "Default": "Done"},
+			"Done":      map[string]any{"Type": "Succeed"},
+		},
+	}
+	b, _ := json.Marshal(def)
+	errs := PolicyViolations(b)
+	if len(errs) != 1 || errs[0].Error() != "ParseFile missing TimeoutSeconds" {
+		t.Errorf("expected the nested ParseFile to be checked, got %v", errs)
+	}
+	if l := ExtractLambdas(b); len(l) != 1 || l[0] != "arn:aws:lambda:us-east-1:123:function:bar" {
+		t.Errorf("unexpected lambdas: %v", l)
+	}
+}
+
 func TestPolicyViolations_BadJSON(t *testing.T) {
 	errs := PolicyViolations([]byte("notjson"))
 	if len(errs) != 1 {
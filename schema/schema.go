@@ -0,0 +1,10 @@
+// Package schema embeds the canonical JSON schemas so Go code validates
+// against the same files CI checks.
+package schema
+
+import _ "embed"
+
+// ProfileV2 is the JSON schema for Profile v2 feed configurations.
+//
+//go:embed profile_v2.schema.json
+var ProfileV2 []byte
@@ -1,5 +1,7 @@
 #!/bin/bash
 # Usage: ./scripts/dev/create-profile.sh profile.json /path/in/ssm
+# A profile with "extends" needs its base published too; deploy-profiles.sh
+# publishes crm/file-profiles/base with an environment.
 set -euo pipefail
 file="$1"
 name="$2"
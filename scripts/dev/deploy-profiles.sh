@@ -0,0 +1,16 @@
+#!/bin/bash
+# Usage: ./scripts/dev/deploy-profiles.sh <env>
+# Publishes crm/file-profiles/base/*.json and crm/file-profiles/<env>/*.json
+# to SSM as /crm/file-profiles/<dir>/<name>. Bases go first so the env
+# overlays never point at a missing "extends" target.
+set -euo pipefail
+env="${1:?usage: $0 <env>}"
+root="$(cd "$(dirname "$0")/../.." && pwd)/crm/file-profiles"
+for dir in base "$env"; do
+  for file in "$root/$dir"/*.json; do
+    [ -e "$file" ] || continue
+    name="/crm/file-profiles/$dir/$(basename "$file" .json)"
+    "$(dirname "$0")/create-profile.sh" "$file" "$name"
+    echo "published $name"
+  done
+done
@@ -11,6 +11,7 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -25,12 +26,17 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/sfn"
 	sfntypes "github.com/aws/aws-sdk-go-v2/service/sfn/types"
+	"go.uber.org/zap"
+
+	"github.com/your-org/file-processor-sample/internal/importerror"
+	"github.com/your-org/file-processor-sample/internal/sfclient"
 )
 
 const (
 	awsEndpoint   = "http://localhost:4566"
 	sfnEndpoint   = "http://localhost:8083"
 	wiremockURL   = "http://localhost:8080"
+	brokerURL     = "http://localhost:8085/sf/token"
 	manifestTable = "Manifest"
 )
 
@@ -247,3 +253,37 @@ def handler(event,context):
 		t.Fatalf("metric value not 1")
 	}
 }
+
+// TestBrokerImportError delivers an import error through the Salesforce
+// client with a token from the local broker (tokenbroker -fake-sf) and
+// WireMock standing in for the REST API.
+func TestBrokerImportError(t *testing.T) {
+	if os.Getenv("E2E") == "" {
+		t.Skip("E2E env not set")
+	}
+	ctx := context.Background()
+	sf := &sfclient.Client{BrokerURL: brokerURL, BrokerID: "local", BrokerKey: "local-secret", API: wiremockURL}
+	tok, err := sf.Token(ctx)
+	if err != nil || !strings.HasPrefix(tok, "local-") {
+		t.Fatalf("broker token %q: %v", tok, err)
+	}
+
+	for _, m := range []string{
+		`{"request":{"method":"PATCH","url":"/composite/sobjects/Import_Error__c/External_Row_Id__c","headers":{"Authorization":{"matches":"Bearer local-.*"}}},
+		  "response":{"status":200,"body":"[{\"id\":\"a0E1\",\"success\":true,\"created\":true}]"}}`,
+		`{"request":{"method":"POST","url":"/composite/sobjects","headers":{"Authorization":{"matches":"Bearer local-.*"}}},
+		  "response":{"status":200,"body":"[{\"id\":\"a0F1\",\"success\":true}]"}}`,
+	} {
+		resp, err := http.Post(wiremockURL+"/__admin/mappings", "application/json", strings.NewReader(m))
+		if err != nil {
+			t.Fatalf("wiremock mapping: %v", err)
+		}
+		_ = resp.Body.Close()
+	}
+
+	l := &importerror.Logger{SF: sf, Log: zap.NewNop().Sugar()}
+	res, err := l.Batch(ctx, []importerror.Event{{ExternalRowID: "e2e-1", Message: "bad row"}})
+	if err != nil || res.Succeeded != 1 {
+		t.Fatalf("batch %+v: %v", res, err)
+	}
+}